@@ -2,12 +2,16 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
 	"log-distributor/config"
+	"log-distributor/internal/protocol"
+	"log-distributor/internal/tlsconfig"
 	"math"
 	"math/rand"
 	"net"
@@ -15,6 +19,7 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -39,14 +44,63 @@ func main() {
 	validateChecksums := config.GetEnvBoolWithDefault("ANALYZER_VALIDATE_CHECKSUMS", true)
 	pprofPort := config.GetEnvIntWithDefault("ANALYZER_PPROF_PORT", 0)
 	varyWeight := config.GetEnvBoolWithDefault("ANALYZER_VARY_WEIGHT", false)
+	legacyHandshake := config.GetEnvBoolWithDefault("ANALYZER_LEGACY_HANDSHAKE", false)
+	resume := config.GetEnvBoolWithDefault("ANALYZER_RESUME", true) && !legacyHandshake
+	reconnectTimeout := time.Duration(config.GetEnvIntWithDefault("ANALYZER_RECONNECT_TIMEOUT", 60)) * time.Second
+	drain := config.GetEnvBoolWithDefault("ANALYZER_DRAIN", true) && !legacyHandshake
+	drainTimeout := time.Duration(config.GetEnvIntWithDefault("ANALYZER_DRAIN_TIMEOUT", 30)) * time.Second
+	useTLS := config.GetEnvBoolWithDefault("ANALYZER_TLS", false)
+	authToken := config.GetEnvWithDefault("ANALYZER_AUTH_TOKEN", "")
+	prioritiesText := config.GetEnvWithDefault("ANALYZER_PRIORITIES", "")
+	processDelay := time.Duration(config.GetEnvIntWithDefault("ANALYZER_PROCESS_DELAY_US", 0)) * time.Microsecond
+	verifyOrder := config.GetEnvBoolWithDefault("ANALYZER_VERIFY_ORDER", true) && !legacyHandshake
+	batches := config.GetEnvBoolWithDefault("ANALYZER_BATCH", true) && !legacyHandshake
+	compression := config.GetEnvBoolWithDefault("ANALYZER_COMPRESSION", true) && batches
+	envelopes := config.GetEnvBoolWithDefault("ANALYZER_ENVELOPE", true) && !legacyHandshake
 
+	var priorities *protocol.PrioritySet
+	if prioritiesText != "" {
+		set, err := protocol.ParsePrioritySet(prioritiesText)
+		if err != nil {
+			log.Fatalf("Invalid ANALYZER_PRIORITIES: %v", err)
+		}
+		if legacyHandshake {
+			log.Fatalf("ANALYZER_PRIORITIES requires the hello handshake")
+		}
+		priorities = &set
+	}
+
+	var tlsConfig *tls.Config
+	if useTLS {
+		var err error
+		tlsConfig, err = tlsconfig.NewClient(tlsconfig.ClientOptions{
+			CAFile:     config.GetEnvWithDefault("ANALYZER_TLS_CA", ""),
+			CertFile:   config.GetEnvWithDefault("ANALYZER_TLS_CERT", ""),
+			KeyFile:    config.GetEnvWithDefault("ANALYZER_TLS_KEY", ""),
+			ServerName: config.GetEnvWithDefault("ANALYZER_TLS_SERVER_NAME", ""),
+		})
+		if err != nil {
+			log.Fatalf("Failed to set up TLS: %v", err)
+		}
+		// With mutual TLS the distributor knows the analyzer by its certificate
+		if analyzerID == "" {
+			analyzerID = tlsconfig.ClientIdentity(tlsConfig)
+		}
+	}
+
+	helloID := analyzerID
 	if analyzerID == "" {
 		hostname, _ := os.Hostname()
 		analyzerID = fmt.Sprintf("analyzer_%s_%d", hostname, os.Getpid())
+		// A token proves an ID of its own, which the distributor uses when the
+		// hello carries none
+		if authToken == "" {
+			helloID = analyzerID
+		}
 	}
 
 	log.Printf("Starting analyzer %s with weight %.2f", analyzerID, weight)
-	
+
 	// Start pprof server if enabled
 	if pprofPort > 0 {
 		go func() {
@@ -58,37 +112,69 @@ func main() {
 	}
 
 	// Connect to distributor
-	conn, err := net.Dial("tcp", distributorAddr)
+	sess := &session{
+		authToken:   []byte(authToken),
+		priorities:  priorities,
+		metadata:    verifyOrder,
+		batches:     batches,
+		compression: compression,
+		envelopes:   envelopes,
+	}
+	conn, err := connect(distributorAddr, tlsConfig, helloID, weight, legacyHandshake, resume, drain, sess)
 	if err != nil {
 		log.Fatalf("Failed to connect to distributor: %v", err)
 	}
-	defer conn.Close()
-
-	log.Printf("Connected to distributor at %s", distributorAddr)
-
-	// Send initial weight
-	if err := sendWeight(conn, weight); err != nil {
-		log.Fatalf("Failed to send initial weight: %v", err)
-	}
-
-	log.Printf("Sent initial weight %.2f", weight)
 
 	// Start message processing and per-second tracking
 	var messageCount uint64
 	var lastAckedSeqNum uint64
 	var invalidChecksums uint64
-	
+	var outOfOrder uint64
+	var enveloped uint64
+	ingest := &ingestStats{emitters: make(map[string]*emitterIngest)}
+
 	// Priority-based message counting (256 priorities)
 	var priorityCounts [256]uint64
 
-	// Setup signal handler for graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sigChan
+	// Writes come from both the receive loop and the signal handler, and ACKs
+	// must reach the distributor in sequence order. conn is nil while reconnecting.
+	var connMutex sync.Mutex
+	var receivedSeq atomic.Uint32 // sess.seq, readable by the signal handler
+	var draining atomic.Bool
+
+	// requestDrain asks the distributor to stop routing to this analyzer and to
+	// say goodbye once everything sent so far is acknowledged
+	requestDrain := func() bool {
+		connMutex.Lock()
+		defer connMutex.Unlock()
+
+		if conn == nil || sess.features&protocol.AnalyzerFeatureDrain == 0 {
+			return false
+		}
+		draining.Store(true)
+		if err := sendDrainRequest(conn); err != nil {
+			log.Printf("Error sending drain request: %v", err)
+			return false
+		}
+		// The receive loop acknowledges every message from now on
+		if err := sendACK(conn, receivedSeq.Load()); err != nil {
+			log.Printf("Error sending ACK: %v", err)
+			return false
+		}
+		return true
+	}
+
+	printStats := func() {
 		log.Printf("Analyzer %s processed %d messages", analyzerID, atomic.LoadUint64(&messageCount))
 		log.Printf("Analyzer %s invalid checksums: %d", analyzerID, atomic.LoadUint64(&invalidChecksums))
-		
+		if verifyOrder {
+			log.Printf("Analyzer %s out-of-order messages: %d", analyzerID, atomic.LoadUint64(&outOfOrder))
+			ingest.print(analyzerID)
+		}
+		if envelopes {
+			log.Printf("Analyzer %s messages in envelopes: %d", analyzerID, atomic.LoadUint64(&enveloped))
+		}
+
 		// Log priority distribution
 		log.Printf("Priority distribution:")
 		for i := 0; i < 256; i++ {
@@ -97,6 +183,25 @@ func main() {
 				log.Printf("  Priority %d: %d messages", i, count)
 			}
 		}
+	}
+
+	// Setup signal handler for graceful shutdown
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		// Leave without duplicates if the distributor supports draining; a second
+		// signal or the drain timeout exits straight away
+		if drain && requestDrain() {
+			log.Printf("Draining, waiting up to %v for the distributor's goodbye", drainTimeout)
+			select {
+			case <-sigChan:
+				log.Printf("Interrupted while draining")
+			case <-time.After(drainTimeout):
+				log.Printf("Timed out waiting for the distributor's goodbye")
+			}
+		}
+		printStats()
 		os.Exit(0)
 	}()
 
@@ -105,12 +210,12 @@ func main() {
 	// Per-second priority tracking
 	perSecondPriorityCounts := make(map[int64][256]uint64)
 	var perSecondMutex sync.RWMutex
-	
+
 	// Start per-second reporting goroutine
 	go func() {
 		ticker := time.NewTicker(1 * time.Second)
 		defer ticker.Stop()
-		
+
 		for range ticker.C {
 			now := time.Now().Unix()
 			perSecondMutex.RLock()
@@ -118,12 +223,12 @@ func main() {
 			prevSecondCount := perSecondCounts[now-1]
 			prevSecondPriorities := perSecondPriorityCounts[now-1]
 			perSecondMutex.RUnlock()
-			
+
 			if prevSecondCount > 0 {
 				log.Printf("Per-second stats: %d msg/s (current: %d, prev: %d, total: %d, invalid: %d, weight: %.3f, analyzer: %s)",
-					prevSecondCount, currentSecondCount, prevSecondCount, 
+					prevSecondCount, currentSecondCount, prevSecondCount,
 					atomic.LoadUint64(&messageCount), atomic.LoadUint64(&invalidChecksums), weight, analyzerID)
-				
+
 				// Log priority breakdown for the previous second
 				var priorityStats []string
 				for i := 0; i < 256; i++ {
@@ -135,7 +240,7 @@ func main() {
 					log.Printf("  Priority breakdown: %s", strings.Join(priorityStats, ", "))
 				}
 			}
-			
+
 			// Clean old entries (keep last 10 seconds)
 			perSecondMutex.Lock()
 			for timestamp := range perSecondCounts {
@@ -149,87 +254,371 @@ func main() {
 	}()
 
 	log.Printf("Starting to receive messages...")
-	bufReader := bufio.NewReader(conn)
 	lengthBuffer := make([]byte, 4)
+	goodbye := false
+	var meta *protocol.Metadata // Describes the next data frame
+	var decompressor protocol.Decompressor
 
-	for {
-		// Read message length (4 bytes)
-		if _, err := io.ReadFull(bufReader, lengthBuffer); err != nil {
-			log.Printf("Error reading message length: %v", err)
-			break
-		}
+	for conn != nil {
+		bufReader := bufio.NewReader(conn)
+		// Frames are read from the batch frame being unpacked, if any
+		var reader frameReader = bufReader
+		batchLeft := 0 // Messages of the batch not read yet
+		for {
+			if batchLeft == 0 {
+				reader = bufReader
+			}
 
-		messageLength := binary.BigEndian.Uint32(lengthBuffer)
+			// Read message length (4 bytes)
+			if _, err := io.ReadFull(reader, lengthBuffer); err != nil {
+				log.Printf("Error reading message length: %v", err)
+				break
+			}
 
-		// Read severity (1 byte)
-		severity, err := bufReader.ReadByte()
-		if err != nil {
-			log.Printf("Error reading severity: %v", err)
-			break
-		}
+			messageLength := binary.BigEndian.Uint32(lengthBuffer)
 
-		// Read payload (remaining bytes)
-		payloadLength := messageLength - 4 - 1 // subtract length and severity bytes
-		payloadBuffer := make([]byte, payloadLength)
-		if _, err := io.ReadFull(bufReader, payloadBuffer); err != nil {
-			log.Printf("Error reading payload: %v", err)
-			break
-		}
+			// An envelope frame's data frame is read from the envelope
+			msgReader := reader
+			var headers *protocol.Headers
+			if messageLength&protocol.ControlFrameFlag != 0 {
+				// Control frame: [length | flag][type][body]
+				frame := make([]byte, messageLength&^protocol.ControlFrameFlag-4)
+				if _, err := io.ReadFull(reader, frame); err != nil {
+					log.Printf("Error reading control frame: %v", err)
+					break
+				}
+				if len(frame) > 0 && frame[0] == protocol.AnalyzerFrameGoodbye {
+					log.Printf("Distributor said goodbye, all messages acknowledged")
+					goodbye = true
+					break
+				}
+				if len(frame) > 0 && frame[0] == protocol.AnalyzerFrameMetadata {
+					if meta, err = protocol.ParseMetadata(frame[1:]); err != nil {
+						log.Printf("Ignoring metadata frame: %v", err)
+					}
+				}
+				if len(frame) > 0 && (frame[0] == protocol.AnalyzerFrameBatch || frame[0] == protocol.AnalyzerFrameCompressedBatch) && batchLeft == 0 {
+					// Read the batch's frames as if they came one by one
+					batch := bytes.NewReader(frame)
+					header, err := protocol.ReadBatchHeader(batch, messageLength, 1<<31-1)
+					if err != nil {
+						log.Printf("Error reading batch frame: %v", err)
+						break
+					}
+					reader = batch
+					if header.Compressed > 0 {
+						body, err := decompressor.Decompress(frame[len(frame)-batch.Len():], header.BodyLen)
+						if err != nil {
+							log.Printf("Error decompressing batch frame: %v", err)
+							break
+						}
+						reader = bytes.NewReader(body)
+					}
+					batchLeft = header.Count
+				}
+				if len(frame) > 0 && frame[0] == protocol.AnalyzerFrameEnvelope {
+					h, dataFrame, err := protocol.ParseEnvelope(append(bytes.Clone(lengthBuffer), frame...))
+					if err != nil {
+						log.Printf("Error reading envelope frame: %v", err)
+						break
+					}
+					headers = h
+					messageLength = uint32(len(dataFrame))
+					msgReader = bytes.NewReader(dataFrame[4:])
+				}
+				if headers == nil {
+					continue
+				}
+			}
+
+			// Read severity (1 byte)
+			severity, err := msgReader.ReadByte()
+			if err != nil {
+				log.Printf("Error reading severity: %v", err)
+				break
+			}
+
+			// Read payload (remaining bytes)
+			payloadLength := messageLength - 4 - 1 // subtract length and severity bytes
+			payloadBuffer := make([]byte, payloadLength)
+			if _, err := io.ReadFull(msgReader, payloadBuffer); err != nil {
+				log.Printf("Error reading payload: %v", err)
+				break
+			}
+
+			count := atomic.AddUint64(&messageCount, 1)
+			sess.seq = (sess.seq + 1) & SeqNumValueMask
+			receivedSeq.Store(sess.seq)
+
+			// Track priority count
+			atomic.AddUint64(&priorityCounts[severity], 1)
 
-		count := atomic.AddUint64(&messageCount, 1)
-		
-		// Track priority count
-		atomic.AddUint64(&priorityCounts[severity], 1)
-		
-		// Track per-second message count and priority breakdown
-		now := time.Now().Unix()
-		perSecondMutex.Lock()
-		perSecondCounts[now]++
-		priorities := perSecondPriorityCounts[now]
-		priorities[severity]++
-		perSecondPriorityCounts[now] = priorities
-		perSecondMutex.Unlock()
-
-		// Validate checksum if enabled
-		if validateChecksums {
-			if !validateMessageChecksum(string(payloadBuffer)) {
-				atomic.AddUint64(&invalidChecksums, 1)
+			// Track per-second message count and priority breakdown
+			now := time.Now().Unix()
+			perSecondMutex.Lock()
+			perSecondCounts[now]++
+			priorities := perSecondPriorityCounts[now]
+			priorities[severity]++
+			perSecondPriorityCounts[now] = priorities
+			perSecondMutex.Unlock()
+
+			// Messages of an ordered lane must arrive with increasing sequence numbers.
+			// Gaps are expected: the lane may have been on another analyzer meanwhile.
+			if meta != nil && meta.LaneSeq != 0 {
+				if last := sess.laneSeqs[meta.Lane]; meta.LaneSeq <= last {
+					atomic.AddUint64(&outOfOrder, 1)
+					log.Printf("Out-of-order message %d in lane %d: sequence %d after %d", count, meta.Lane, meta.LaneSeq, last)
+				} else {
+					sess.laneSeqs[meta.Lane] = meta.LaneSeq
+				}
+			}
+			if meta != nil && meta.IngestSeq != 0 {
+				ingest.observe(meta, time.Now())
 				if verbose {
-					log.Printf("Invalid checksum in message %d", count)
+					log.Printf("Message %d stamped: emitter %q, ingest sequence %d, received %s",
+						count, meta.Emitter, meta.IngestSeq, meta.Received.Format(time.RFC3339Nano))
 				}
 			}
-		}
+			meta = nil
 
-		if verbose {
-			log.Printf("Received message %d (severity: %d, size: %d bytes, payload: %.50s...)",
-				count, severity, len(payloadBuffer), string(payloadBuffer))
-		}
+			// Validate checksum if enabled
+			if validateChecksums {
+				if !validateMessageChecksum(string(payloadBuffer)) {
+					atomic.AddUint64(&invalidChecksums, 1)
+					if verbose {
+						log.Printf("Invalid checksum in message %d", count)
+					}
+				}
+			}
 
-		// Send ACK every N messages
-		if count%uint64(ackEvery) == 0 {
-			if err := sendACK(conn, count); err != nil {
-				log.Printf("Error sending ACK: %v", err)
-				break
+			// Simulate a slow analyzer
+			if processDelay > 0 {
+				time.Sleep(processDelay)
 			}
 
-			if !verbose && count%1000 == 0 {
-				log.Printf("Processed %d messages (last ack: %d)", count, lastAckedSeqNum)
+			if headers != nil {
+				atomic.AddUint64(&enveloped, 1)
+			}
+			if verbose {
+				log.Printf("Received message %d (severity: %d, size: %d bytes, payload: %.50s...)",
+					count, severity, len(payloadBuffer), string(payloadBuffer))
+				if headers != nil {
+					log.Printf("Message %d envelope: source %q, timestamp %s, trace %x, content type %q, key %q, %d attributes",
+						count, headers.Source, headers.Timestamp.Format(time.RFC3339Nano), headers.TraceID, headers.ContentType, headers.Key, len(headers.Attributes))
+				}
 			}
-		}
 
-		// Simulate weight changes every 5000 messages
-		if varyWeight && count%5000 == 0 {
-			newWeight := weight * (0.8 + 0.4*rand.Float32()) // Vary weight between 80%-120%
-			if err := sendWeight(conn, newWeight); err != nil {
-				log.Printf("Error sending weight update: %v", err)
-			} else {
-				log.Printf("Sent weight update: %.2f -> %.2f", weight, newWeight)
-				weight = newWeight
+			// Send ACK every N messages, whenever everything received so far has
+			// been read, and for every message while draining. A batch is
+			// acknowledged once, after its last message.
+			ackDue := sess.seq%uint32(ackEvery) == 0 || bufReader.Buffered() == 0 || draining.Load()
+			if batchLeft > 0 {
+				batchLeft--
+				ackDue = batchLeft == 0
+			}
+			if ackDue {
+				connMutex.Lock()
+				err := sendACK(conn, sess.seq)
+				connMutex.Unlock()
+				if err != nil {
+					log.Printf("Error sending ACK: %v", err)
+					break
+				}
+				lastAckedSeqNum = uint64(sess.seq)
+
+				if !verbose && count%1000 == 0 {
+					log.Printf("Processed %d messages (last ack: %d)", count, lastAckedSeqNum)
+				}
+			}
+
+			// Simulate weight changes every 5000 messages
+			if varyWeight && count%5000 == 0 {
+				newWeight := weight * (0.8 + 0.4*rand.Float32()) // Vary weight between 80%-120%
+				if err := sendWeight(conn, newWeight); err != nil {
+					log.Printf("Error sending weight update: %v", err)
+				} else {
+					log.Printf("Sent weight update: %.2f -> %.2f", weight, newWeight)
+					weight = newWeight
+				}
 			}
 		}
+		connMutex.Lock()
+		conn.Close()
+		conn = nil
+		connMutex.Unlock()
+
+		if goodbye {
+			printStats()
+			return
+		}
+		if !resume || draining.Load() {
+			break
+		}
+		// Reconnect and pick the session up where it left off
+		newConn := reconnect(distributorAddr, tlsConfig, helloID, weight, resume, drain, sess, reconnectTimeout)
+		receivedSeq.Store(sess.seq)
+		connMutex.Lock()
+		conn = newConn
+		connMutex.Unlock()
+	}
+
+	log.Printf("Analyzer %s processed %d messages", analyzerID, atomic.LoadUint64(&messageCount))
+}
+
+// frameReader is where frames are read from: the connection, or a batch frame
+type frameReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// session tracks what the analyzer needs to resume after a reconnect
+type session struct {
+	token    []byte // Resume token issued by the distributor
+	seq      uint32 // Messages received in the current distributor session
+	features uint32 // Features the distributor agreed to
+
+	authToken   []byte                // Credentials presented in every hello
+	priorities  *protocol.PrioritySet // Priorities subscribed to, nil for all of them
+	metadata    bool                  // Ask for metadata frames to verify ordering
+	batches     bool                  // Ask for batch frames
+	compression bool                  // Ask for compressed batch frames
+	envelopes   bool                  // Ask for envelope frames with message headers
+
+	laneSeqs [256]uint64 // Last sequence number received in each ordered lane
+}
+
+// ingestStats follows the stamps the distributor puts on messages when
+// DISTRIBUTOR_STAMP_MESSAGES is set
+type ingestStats struct {
+	mutex      sync.Mutex
+	stamped    uint64
+	latency    time.Duration // Sum of the time from the distributor receiving a message until here
+	maxLatency time.Duration
+	emitters   map[string]*emitterIngest
+}
+
+// Sequence numbers received out of order that an emitterIngest keeps; beyond
+// that the lowest number not received is given up as missing
+const ingestReorderWindow = 1 << 16
+
+// emitterIngest tracks the ingest sequence numbers received from one emitter.
+// Priorities reorder messages, so numbers above a gap are kept until it fills.
+type emitterIngest struct {
+	messages uint64
+	lastSeq  uint64              // Highest number received
+	settled  uint64              // Every number up to this one was received or given up
+	above    map[uint64]struct{} // Numbers received above settled
+	missing  uint64              // Numbers given up: lost, or routed to other analyzers
+	repeated uint64              // Numbers received more than once, or after being given up
+}
+
+// observe records the stamp of a message received at now
+func (s *ingestStats) observe(meta *protocol.Metadata, now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.stamped++
+	latency := max(now.Sub(meta.Received), 0)
+	s.latency += latency
+	s.maxLatency = max(s.maxLatency, latency)
+
+	e, ok := s.emitters[meta.Emitter]
+	if !ok {
+		e = &emitterIngest{above: make(map[uint64]struct{})}
+		s.emitters[meta.Emitter] = e
+	}
+	e.messages++
+	if _, seen := e.above[meta.IngestSeq]; seen || meta.IngestSeq <= e.settled {
+		e.repeated++
+		return
+	}
+	e.above[meta.IngestSeq] = struct{}{}
+	e.lastSeq = max(e.lastSeq, meta.IngestSeq)
+	for {
+		if _, ok := e.above[e.settled+1]; ok {
+			delete(e.above, e.settled+1)
+		} else if len(e.above) > ingestReorderWindow {
+			e.missing++
+		} else {
+			break
+		}
+		e.settled++
+	}
+}
+
+// gaps returns the numbers up to the highest one received that were not
+// received
+func (e *emitterIngest) gaps() uint64 {
+	return e.missing + e.lastSeq - e.settled - uint64(len(e.above))
+}
+
+// print logs the latency and, for every emitter, the messages received from it
+// and the gaps in their numbering
+func (s *ingestStats) print(analyzerID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stamped == 0 {
+		return
+	}
+	log.Printf("Analyzer %s stamped messages: %d, latency since the distributor received them: avg %v, max %v",
+		analyzerID, s.stamped, s.latency/time.Duration(s.stamped), s.maxLatency)
+	ids := make([]string, 0, len(s.emitters))
+	for id := range s.emitters {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		e := s.emitters[id]
+		log.Printf("  Emitter %s: %d messages, up to ingest sequence %d, %d missing, %d repeated",
+			id, e.messages, e.lastSeq, e.gaps(), e.repeated)
+	}
+}
+
+// connect dials the distributor, over TLS if tlsConfig is set, and performs the
+// handshake
+func connect(addr string, tlsConfig *tls.Config, analyzerID string, weight float32, legacy, resume, drain bool, sess *session) (net.Conn, error) {
+	conn, err := tlsconfig.Dial(addr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Connected to distributor at %s", addr)
+
+	if legacy {
+		// Old distributors only understand a bare initial weight
+		if err := sendWeight(conn, weight); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to send initial weight: %w", err)
+		}
+		log.Printf("Sent initial weight %.2f", weight)
+		return conn, nil
+	}
+
+	if err := sendHello(conn, analyzerID, weight, resume, drain, sess); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("handshake failed: %w", err)
+	}
+	return conn, nil
+}
+
+// reconnect retries connect with exponential backoff until timeout passes
+func reconnect(addr string, tlsConfig *tls.Config, analyzerID string, weight float32, resume, drain bool, sess *session, timeout time.Duration) net.Conn {
+	deadline := time.Now().Add(timeout)
+	backoff := 100 * time.Millisecond
+
+	for time.Now().Before(deadline) {
+		time.Sleep(backoff)
+		conn, err := connect(addr, tlsConfig, analyzerID, weight, false, resume, drain, sess)
+		if err == nil {
+			return conn
+		}
+		log.Printf("Reconnect failed: %v", err)
+		backoff = min(backoff*2, 5*time.Second)
 	}
 
-	log.Printf("Analyzer %s processed %d messages", analyzerID, messageCount)
+	log.Printf("Giving up reconnecting after %v", timeout)
+	return nil
 }
 
 func sendWeight(conn net.Conn, weight float32) error {
@@ -239,9 +628,77 @@ func sendWeight(conn net.Conn, weight float32) error {
 	return err
 }
 
-func sendACK(conn net.Conn, seqNum uint64) error {
+func sendHello(conn net.Conn, analyzerID string, weight float32, resume, drain bool, sess *session) error {
+	hello := &protocol.Hello{
+		Version: protocol.Version,
+		Weight:  weight,
+		ID:      analyzerID,
+
+		AuthToken:  sess.authToken,
+		Priorities: sess.priorities,
+	}
+	if resume {
+		hello.Features |= protocol.AnalyzerFeatureResume
+		hello.ResumeToken = sess.token
+		hello.LastSeq = sess.seq
+	}
+	if drain {
+		hello.Features |= protocol.AnalyzerFeatureDrain
+	}
+	if sess.metadata {
+		hello.Features |= protocol.AnalyzerFeatureMetadata
+	}
+	if sess.batches {
+		hello.Features |= protocol.AnalyzerFeatureBatch
+	}
+	if sess.compression {
+		hello.Features |= protocol.AnalyzerFeatureCompression
+	}
+	if sess.envelopes {
+		hello.Features |= protocol.AnalyzerFeatureEnvelope
+	}
+	if err := protocol.WriteHello(conn, protocol.AnalyzerHelloMagic, hello); err != nil {
+		return err
+	}
+
+	reply, err := protocol.ReadReply(conn, protocol.AnalyzerHelloMagic)
+	if err != nil {
+		return err
+	}
+	if !reply.Accepted() {
+		return fmt.Errorf("rejected by distributor: %s", reply.Reason)
+	}
+
+	if analyzerID == "" {
+		analyzerID = "the ID of its token"
+	}
+	if reply.Resumed {
+		log.Printf("Resumed session as %s at sequence %d", analyzerID, sess.seq)
+	} else {
+		// A new session restarts sequence numbering
+		sess.seq = 0
+		sess.laneSeqs = [256]uint64{}
+		log.Printf("Handshake complete, registered as %s with weight %.2f", analyzerID, weight)
+	}
+	if reply.Priorities != nil {
+		log.Printf("Receiving priorities %s", reply.Priorities)
+	}
+	sess.token = reply.ResumeToken
+	sess.features = reply.Features
+	return nil
+}
+
+// sendDrainRequest asks the distributor to drain this analyzer and say goodbye
+func sendDrainRequest(conn net.Conn) error {
+	message := make([]byte, 4)
+	binary.BigEndian.PutUint32(message, protocol.AnalyzerDrainRequest)
+	_, err := conn.Write(message)
+	return err
+}
+
+func sendACK(conn net.Conn, seqNum uint32) error {
 	message := make([]byte, 4) // message type + sequence number
-	binary.BigEndian.PutUint32(message, uint32(seqNum) | SeqNumMSBMask)
+	binary.BigEndian.PutUint32(message, seqNum|SeqNumMSBMask)
 	_, err := conn.Write(message)
 	return err
 }
@@ -249,18 +706,18 @@ func sendACK(conn net.Conn, seqNum uint64) error {
 func validateMessageChecksum(payload string) bool {
 	// Payload format: [emitter_id]:[timestamp]:[counter]:[padding][checksum]
 	// Checksum is the last 64 characters (SHA256 hex)
-	
+
 	if len(payload) < 64 {
 		return false
 	}
-	
+
 	// Extract the checksum (last 64 chars)
 	messageChecksum := payload[len(payload)-64:]
 	payloadWithoutChecksum := payload[:len(payload)-64]
-	
+
 	// Calculate expected checksum
 	hash := sha256.Sum256([]byte(payloadWithoutChecksum))
 	expectedChecksum := fmt.Sprintf("%x", hash)
-	
+
 	return strings.EqualFold(messageChecksum, expectedChecksum)
 }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"log-distributor/config"
+	"log-distributor/internal/auth"
+)
+
+// auth-token prints an HMAC-signed token for an emitter or analyzer, to be
+// passed to it in EMITTER_AUTH_TOKEN or ANALYZER_AUTH_TOKEN
+func main() {
+	secretFile := config.GetEnvWithDefault("AUTH_HMAC_SECRET_FILE", "")
+	roleName := config.GetEnvWithDefault("AUTH_TOKEN_ROLE", "")
+	id := config.GetEnvWithDefault("AUTH_TOKEN_ID", "")
+	ttl := time.Duration(config.GetEnvIntWithDefault("AUTH_TOKEN_TTL_HOURS", 720)) * time.Hour
+
+	if secretFile == "" || roleName == "" || id == "" {
+		log.Fatalf("AUTH_HMAC_SECRET_FILE, AUTH_TOKEN_ROLE and AUTH_TOKEN_ID must be set")
+	}
+	role, err := auth.ParseRole(roleName)
+	if err != nil {
+		log.Fatalf("Invalid AUTH_TOKEN_ROLE: %v", err)
+	}
+	secret, err := auth.ReadSecret(secretFile)
+	if err != nil {
+		log.Fatalf("Failed to load secret: %v", err)
+	}
+
+	expiry := time.Now().Add(ttl)
+	token, err := auth.SignToken(secret, role, id, expiry)
+	if err != nil {
+		log.Fatalf("Failed to sign token: %v", err)
+	}
+	log.Printf("Token for %s %s, valid until %s", role, id, expiry.Format(time.RFC3339))
+	fmt.Println(token)
+}
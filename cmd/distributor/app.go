@@ -1,53 +1,223 @@
 package main
 
 import (
-	"fmt"
+	"errors"
+	"flag"
 	"log"
+	"log-distributor/internal/auth"
+	"log-distributor/internal/distributor"
+	"log-distributor/internal/metrics"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
-	"log-distributor/internal/distributor"
-	"log-distributor/config"
 )
 
 func main() {
-	pprofPort := config.GetEnvIntWithDefault("DISTRIBUTOR_PPROF_PORT", 0)
+	cfg, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
 
 	log.Println("Starting Log Distributor...")
-	
+
 	// Start pprof server if enabled
-	if pprofPort > 0 {
+	if cfg.PprofPort > 0 {
 		go func() {
-			log.Printf("Starting pprof server on port %d", pprofPort)
-			log.Printf("Profile endpoints: http://localhost:%d/debug/pprof/", pprofPort)
-			if err := http.ListenAndServe(fmt.Sprintf(":%d", pprofPort), nil); err != nil {
+			log.Printf("Starting pprof server on port %d", cfg.PprofPort)
+			log.Printf("Profile endpoints: http://localhost:%d/debug/pprof/", cfg.PprofPort)
+			if err := http.ListenAndServe(cfg.httpAddr(cfg.PprofPort), nil); err != nil {
 				log.Printf("pprof server failed: %v", err)
 			}
 		}()
 	}
 
-	// Create weighted tree router
-	router := distributor.NewWeightedTreeRouter()
+	// Start metrics server if enabled
+	if cfg.MetricsEnabled {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Default)
+		go func() {
+			log.Printf("Serving metrics on http://localhost:%d/metrics", cfg.MetricsPort)
+			if err := http.ListenAndServe(cfg.httpAddr(cfg.MetricsPort), mux); err != nil {
+				log.Printf("Metrics server failed: %v", err)
+			}
+		}()
+	}
+
+	// Open the spill queue for messages the analyzers have no room for if enabled
+	var spill *distributor.SpillQueue
+	if cfg.SpillDir != "" {
+		spill, err = distributor.OpenSpillQueue(cfg.SpillDir, int64(cfg.SpillSegmentMB)<<20)
+		if err != nil {
+			log.Fatalf("Failed to open spill queue: %v", err)
+		}
+		log.Printf("Spill queue enabled in %s", cfg.SpillDir)
+	}
+	overload := cfg.overload(spill)
+	log.Printf("Overload policy: %s", &overload.Policies)
+
+	// Create the router, one per analyzer group with routing rules
+	newRouter := cfg.routerFactory(overload)
+	var router distributor.Router
+	var reloaders []reloader
+	if cfg.RoutingRulesFile != "" {
+		ruleRouter, err := distributor.NewRuleRouter(cfg.RoutingRulesFile, newRouter)
+		if err != nil {
+			log.Fatalf("Failed to load routing rules: %v", err)
+		}
+		router = ruleRouter
+		reloaders = append(reloaders, reloader{"routing rules", ruleRouter})
+	} else {
+		router = newRouter()
+	}
+	switch cfg.Router {
+	case "adaptive":
+		log.Printf("Routing by weight and analyzer load")
+	case "hash":
+		log.Printf("Routing by consistent hashing of the %s key", cfg.HashKey)
+	case "ordered":
+		log.Printf("Routing in order of the %s key", cfg.HashKey)
+	}
+
+	// Keep messages that cannot be routed in a dead-letter queue if enabled
+	var deadLetters *distributor.FileDeadLetterSink
+	if cfg.DLQDir != "" {
+		var err error
+		deadLetters, err = distributor.NewFileDeadLetterSink(cfg.DLQDir, int64(cfg.DLQSegmentMB)<<20)
+		if err != nil {
+			log.Fatalf("Failed to open dead-letter queue: %v", err)
+		}
+		router.SetDeadLetterSink(deadLetters)
+		log.Printf("Dead-letter queue enabled in %s", cfg.DLQDir)
+	}
+
+	// Open the write-ahead log if enabled
+	var wal *distributor.WAL
+	if cfg.WALDir != "" {
+		syncMode, _ := distributor.ParseWALSyncMode(cfg.WALSync) // Checked by Validate
+		wal, err = distributor.OpenWAL(distributor.WALOptions{
+			Dir:          cfg.WALDir,
+			SegmentSize:  int64(cfg.WALSegmentMB) << 20,
+			SyncMode:     syncMode,
+			SyncInterval: cfg.WALSyncInterval,
+		})
+		if err != nil {
+			log.Fatalf("Failed to open WAL: %v", err)
+		}
+	}
+
+	// Load TLS certificates for the listeners that use them
+	emitterTLS, err := cfg.emitterTLS()
+	if err != nil {
+		log.Fatalf("Failed to set up emitter TLS: %v", err)
+	}
+	analyzerTLS, err := cfg.analyzerTLS()
+	if err != nil {
+		log.Fatalf("Failed to set up analyzer TLS: %v", err)
+	}
+	if emitterTLS != nil {
+		reloaders = append(reloaders, reloader{"emitter TLS certificates", emitterTLS})
+	}
+	if analyzerTLS != nil {
+		reloaders = append(reloaders, reloader{"analyzer TLS certificates", analyzerTLS})
+	}
+
+	// Load client credentials and the authorization policy
+	authenticator, authReloaders, err := cfg.authenticator()
+	if err != nil {
+		log.Fatalf("Failed to set up authentication: %v", err)
+	}
+	reloaders = append(reloaders, authReloaders...)
+	var authorizer auth.Authorizer
+	if cfg.AuthPolicyFile != "" {
+		policy, err := auth.NewPolicyFile(cfg.AuthPolicyFile)
+		if err != nil {
+			log.Fatalf("Failed to load authorization policy: %v", err)
+		}
+		authorizer = policy
+		reloaders = append(reloaders, reloader{"authorization policy", policy})
+	}
+	if authenticator == nil && (emitterTLS == nil || !emitterTLS.MutualTLS() || analyzerTLS == nil || !analyzerTLS.MutualTLS()) {
+		log.Println("WARNING: clients are not authenticated, set DISTRIBUTOR_AUTH_TOKEN_FILE, DISTRIBUTOR_AUTH_HMAC_SECRET_FILE or TLS client CAs")
+	}
 
 	// Create and start emitter server (receives log messages from emitters)
-	emitterServer := distributor.NewEmitterServer(8080, router)
+	emitterServer := distributor.NewEmitterServer(router, distributor.EmitterServerOptions{
+		Addr: cfg.EmitterAddr,
+		TLS:  emitterTLS,
+		WAL:  wal,
+
+		MaxFrameSize: cfg.MaxFrameSize,
+		Stamp:        cfg.StampMessages,
+
+		Authenticator: authenticator,
+		Authorizer:    authorizer,
+	})
 	if err := emitterServer.Start(); err != nil {
 		log.Fatalf("Failed to start emitter server: %v", err)
 	}
 
 	// Create and start analyzer server (manages connections to analyzers)
-	ackTimeout := 2 * time.Minute
-	analyzerServer := distributor.NewAnalyzerServer(8081, router, ackTimeout)
+	analyzerServer := distributor.NewAnalyzerServer(router, distributor.AnalyzerServerOptions{
+		Addr:             cfg.AnalyzerAddr,
+		TLS:              analyzerTLS,
+		AckTimeout:       cfg.AckTimeout,
+		ResumeGrace:      cfg.ResumeGrace,
+		QueueCapacity:    cfg.QueueCapacity,
+		QueueBytes:       int64(cfg.QueueMB) << 20,
+		MemoryBudget:     int64(cfg.MemoryBudgetMB) << 20,
+		FlushInterval:    cfg.FlushInterval,
+		CompressionLevel: cfg.CompressionLevel,
+		Ordered:          cfg.Router == "ordered",
+
+		Authenticator: authenticator,
+		Authorizer:    authorizer,
+	})
 	if err := analyzerServer.Start(); err != nil {
 		log.Fatalf("Failed to start analyzer server: %v", err)
 	}
 
+	// Start admin API if enabled
+	if cfg.AdminPort > 0 {
+		admin := distributor.NewAdminAPI(analyzerServer, emitterServer, cfg.AdminToken)
+		go func() {
+			log.Printf("Serving admin API on http://localhost:%d/", cfg.AdminPort)
+			if cfg.AdminToken == "" {
+				log.Printf("WARNING: admin API has no DISTRIBUTOR_ADMIN_TOKEN set, anyone who can reach it can manage analyzers")
+			}
+			if err := http.ListenAndServe(cfg.httpAddr(cfg.AdminPort), admin); err != nil {
+				log.Printf("Admin API server failed: %v", err)
+			}
+		}()
+	}
+
+	// Redeliver whatever the previous run did not get acknowledged
+	if wal != nil {
+		go wal.Replay(router)
+	}
+	if spill != nil {
+		spill.Start(router)
+	}
+
+	// Reload certificates, tokens, policy and routing rules on SIGHUP, e.g. after
+	// they were renewed
+	if len(reloaders) > 0 {
+		hupChan := make(chan os.Signal, 1)
+		signal.Notify(hupChan, syscall.SIGHUP)
+		go func() {
+			for range hupChan {
+				for _, r := range reloaders {
+					r.reload()
+				}
+			}
+		}()
+	}
+
 	log.Println("Distributor started successfully")
-	log.Println("Emitter server listening on port 8080")
-	log.Println("Analyzer server listening on port 8081")
 
 	// Wait for interrupt signal
 	sigChan := make(chan os.Signal, 1)
@@ -56,9 +226,47 @@ func main() {
 
 	log.Println("Shutting down distributor...")
 
-	// Graceful shutdown
+	// Graceful shutdown: stop taking in messages, deliver what is queued, then
+	// persist whatever is left to the WAL or dead-letter queue
 	emitterServer.Stop()
+	if analyzerServer.DrainAll(cfg.ShutdownTimeout) {
+		log.Println("All queued messages delivered")
+	} else {
+		log.Printf("Messages still undelivered after %v, handing them to the WAL and dead-letter queue", cfg.ShutdownTimeout)
+		if wal == nil && deadLetters == nil {
+			log.Println("WARNING: neither DISTRIBUTOR_WAL_DIR nor DISTRIBUTOR_DLQ_DIR is set, undelivered messages are lost")
+		}
+	}
+	router.Shutdown()
 	analyzerServer.Stop()
+	if spill != nil {
+		if err := spill.Close(); err != nil {
+			log.Printf("Failed to close spill queue: %v", err)
+		}
+	}
+	if deadLetters != nil {
+		if err := deadLetters.Close(); err != nil {
+			log.Printf("Failed to close dead-letter queue: %v", err)
+		}
+	}
+	if wal != nil {
+		wal.Close()
+	}
 
 	log.Println("Distributor shut down complete")
-}
\ No newline at end of file
+}
+
+// reloader is something read from files that SIGHUP loads again
+type reloader struct {
+	name string
+	r    interface{ Reload() error }
+}
+
+// reload loads the files again, keeping the previous contents on error
+func (r reloader) reload() {
+	if err := r.r.Reload(); err != nil {
+		log.Printf("Failed to reload %s, keeping the previous one: %v", r.name, err)
+		return
+	}
+	log.Printf("Reloaded %s", r.name)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"log-distributor/config"
+	"log-distributor/internal/auth"
+	"log-distributor/internal/distributor"
+	"log-distributor/internal/protocol"
+	"log-distributor/internal/tlsconfig"
+)
+
+// Config is the distributor's configuration. See loadConfig for where it comes from.
+type Config struct {
+	// Message servers
+	EmitterAddr      string
+	AnalyzerAddr     string
+	MaxFrameSize     int
+	StampMessages    bool
+	AckTimeout       time.Duration
+	ResumeGrace      time.Duration
+	QueueCapacity    int
+	QueueMB          int
+	MemoryBudgetMB   int
+	FlushInterval    time.Duration
+	CompressionLevel int
+	ShutdownTimeout  time.Duration
+
+	// TLS on the message servers, off without a certificate. A client CA turns
+	// on mutual TLS and makes the certificate name the client's identity.
+	EmitterTLSCert      string
+	EmitterTLSKey       string
+	EmitterTLSClientCA  string
+	AnalyzerTLSCert     string
+	AnalyzerTLSKey      string
+	AnalyzerTLSClientCA string
+
+	// Authentication and authorization of emitters and analyzers, off when empty
+	AuthTokenFile  string
+	AuthHMACSecret string
+	AuthPolicyFile string
+
+	// How messages are spread over analyzers: "weighted" at random by weight,
+	// "adaptive" by weight and live load, "hash" by consistent hashing of the
+	// emitter ID or a payload key, or "ordered" like hash but keeping each key's
+	// messages in order
+	Router           string
+	HashKey          string
+	HashKeyPrefix    string
+	HashKeyDelimiter string
+	HashKeyRegex     string
+	HashKeyHeader    string
+	LaneBacklog      int
+	LaneBacklogMB    int
+
+	// What happens to messages the analyzers have no room for, by priority
+	OverloadPolicy       string
+	OverloadBlockTimeout time.Duration
+	SpillDir             string
+	SpillSegmentMB       int
+
+	// Content-based routing rules splitting analyzers into groups, off when empty
+	RoutingRulesFile string
+
+	// HTTP servers, 0 disables pprof and admin
+	HTTPHost       string
+	PprofPort      int
+	MetricsEnabled bool
+	MetricsPort    int
+	AdminPort      int
+	AdminToken     string
+
+	// Persistence, empty directories disable them
+	DLQDir          string
+	DLQSegmentMB    int
+	WALDir          string
+	WALSync         string
+	WALSyncInterval time.Duration
+	WALSegmentMB    int
+}
+
+// loadConfig reads the configuration from defaults, the config file given with
+// -config or DISTRIBUTOR_CONFIG, the environment and the command line, each
+// overriding the one before, and validates it
+func loadConfig(args []string) (*Config, error) {
+	c := &Config{}
+	s := config.NewSettings("distributor", "DISTRIBUTOR_")
+
+	s.String(&c.EmitterAddr, "DISTRIBUTOR_EMITTER_ADDR", distributor.DefaultEmitterAddr, "Address emitters connect to")
+	s.String(&c.AnalyzerAddr, "DISTRIBUTOR_ANALYZER_ADDR", distributor.DefaultAnalyzerAddr, "Address analyzers connect to")
+	s.Int(&c.MaxFrameSize, "DISTRIBUTOR_MAX_FRAME_SIZE", distributor.DefaultMaxFrameSize, "Largest frame accepted from emitters in bytes; a longer one closes the connection")
+	s.Bool(&c.StampMessages, "DISTRIBUTOR_STAMP_MESSAGES", false, "Send analyzers that ask for metadata frames the receive time, per-emitter sequence number and emitter ID of every message")
+	s.Duration(&c.AckTimeout, "DISTRIBUTOR_ACK_TIMEOUT_SECONDS", distributor.DefaultAckTimeout, time.Second, "Disconnect an analyzer leaving a message unacknowledged this long")
+	s.Duration(&c.ResumeGrace, "DISTRIBUTOR_RESUME_GRACE_SECONDS", 30*time.Second, time.Second, "How long a disconnected analyzer's session is kept for resumption, 0 disables")
+	s.Int(&c.QueueCapacity, "DISTRIBUTOR_ANALYZER_QUEUE_CAPACITY", 0, "Messages queued for an analyzer across all priorities, 0 for no limit")
+	s.Int(&c.QueueMB, "DISTRIBUTOR_ANALYZER_QUEUE_MB", 64, "Bytes queued for each analyzer in MB, 0 for no limit")
+	s.Int(&c.MemoryBudgetMB, "DISTRIBUTOR_MEMORY_BUDGET_MB", 512, "Bytes queued for all analyzers together in MB, 0 for no limit")
+	s.Duration(&c.FlushInterval, "DISTRIBUTOR_FLUSH_INTERVAL_MS", 0, time.Millisecond, "Longest time buffered writes to an analyzer wait for more messages, 0 to flush once its queue runs empty")
+	s.Int(&c.CompressionLevel, "DISTRIBUTOR_COMPRESSION_LEVEL", 1, "DEFLATE level (1-9) of batch frames to analyzers negotiating compression, 0 disables")
+	s.Duration(&c.ShutdownTimeout, "DISTRIBUTOR_SHUTDOWN_TIMEOUT_SECONDS", 30*time.Second, time.Second, "How long shutdown waits for analyzers to acknowledge queued messages")
+
+	s.String(&c.EmitterTLSCert, "DISTRIBUTOR_EMITTER_TLS_CERT", "", "PEM certificate for the emitter listener, empty disables TLS")
+	s.String(&c.EmitterTLSKey, "DISTRIBUTOR_EMITTER_TLS_KEY", "", "PEM private key for the emitter listener")
+	s.String(&c.EmitterTLSClientCA, "DISTRIBUTOR_EMITTER_TLS_CLIENT_CA", "", "CA bundle emitter certificates must be signed by, empty accepts emitters without one")
+	s.String(&c.AnalyzerTLSCert, "DISTRIBUTOR_ANALYZER_TLS_CERT", "", "PEM certificate for the analyzer listener, empty disables TLS")
+	s.String(&c.AnalyzerTLSKey, "DISTRIBUTOR_ANALYZER_TLS_KEY", "", "PEM private key for the analyzer listener")
+	s.String(&c.AnalyzerTLSClientCA, "DISTRIBUTOR_ANALYZER_TLS_CLIENT_CA", "", "CA bundle analyzer certificates must be signed by, empty accepts analyzers without one")
+
+	s.String(&c.AuthTokenFile, "DISTRIBUTOR_AUTH_TOKEN_FILE", "", "File of static client tokens, one 'role id token' per line")
+	s.String(&c.AuthHMACSecret, "DISTRIBUTOR_AUTH_HMAC_SECRET_FILE", "", "File holding the secret HMAC-signed client tokens are checked with")
+	s.String(&c.AuthPolicyFile, "DISTRIBUTOR_AUTH_POLICY_FILE", "", "JSON policy of the emitters that may publish and the priorities each analyzer may receive")
+
+	s.String(&c.Router, "DISTRIBUTOR_ROUTER", "weighted", "Routing mode: weighted (random by weight), adaptive (by weight and load), hash (consistent hashing by key) or ordered (hashing that keeps each key in order)")
+	s.String(&c.HashKey, "DISTRIBUTOR_HASH_KEY", "emitter", "Key the hash and ordered routers place messages by: emitter (ID), payload or header")
+	s.String(&c.HashKeyPrefix, "DISTRIBUTOR_HASH_KEY_PREFIX", "", "Text preceding the payload key, empty for the payload start")
+	s.String(&c.HashKeyDelimiter, "DISTRIBUTOR_HASH_KEY_DELIMITER", "", "Text ending the payload key, empty for the payload end")
+	s.String(&c.HashKeyRegex, "DISTRIBUTOR_HASH_KEY_REGEX", "", "Regex whose first submatch is the payload key, instead of prefix and delimiter")
+	s.String(&c.HashKeyHeader, "DISTRIBUTOR_HASH_KEY_HEADER", "key", "Envelope header holding the key with the header hash key: source, trace_id, content_type, key or an attribute name")
+	s.Int(&c.LaneBacklog, "DISTRIBUTOR_LANE_BACKLOG", distributor.DefaultLaneBacklog, "Messages each ordered lane holds back while its analyzer cannot take them")
+	s.Int(&c.LaneBacklogMB, "DISTRIBUTOR_LANE_BACKLOG_MB", distributor.DefaultBacklogBytes>>20, "Bytes all ordered lanes of a group hold back together in MB")
+	s.String(&c.OverloadPolicy, "DISTRIBUTOR_OVERLOAD_POLICY", "block", "What to do with messages the analyzers have no room for: block, drop-newest, drop-oldest-lower-priority or spill, per priority like 'block;0-2=drop-oldest-lower-priority'")
+	s.Duration(&c.OverloadBlockTimeout, "DISTRIBUTOR_OVERLOAD_BLOCK_TIMEOUT_MS", distributor.DefaultBlockTimeout, time.Millisecond, "Longest time a blocked message waits for room before it is dropped")
+	s.String(&c.SpillDir, "DISTRIBUTOR_SPILL_DIR", "", "Directory the spill overload policy writes messages to")
+	s.Int(&c.SpillSegmentMB, "DISTRIBUTOR_SPILL_SEGMENT_MB", 64, "Spill segment size in MB")
+	s.String(&c.RoutingRulesFile, "DISTRIBUTOR_ROUTING_RULES_FILE", "", "JSON rules routing messages to analyzer groups by priority, emitter or payload key")
+
+	s.String(&c.HTTPHost, "DISTRIBUTOR_HTTP_HOST", "", "Host the pprof, metrics and admin servers bind to, empty for all interfaces")
+	s.Int(&c.PprofPort, "DISTRIBUTOR_PPROF_PORT", 0, "pprof port, 0 disables")
+	s.Bool(&c.MetricsEnabled, "DISTRIBUTOR_METRICS_ENABLED", false, "Serve Prometheus metrics")
+	s.Deprecate("DISTRIBUTOR_METRICS_ENABLED", "METRICS_ENABLED")
+	s.Int(&c.MetricsPort, "DISTRIBUTOR_METRICS_PORT", 9090, "Metrics port")
+	s.Int(&c.AdminPort, "DISTRIBUTOR_ADMIN_PORT", 0, "Admin API port, 0 disables")
+	s.String(&c.AdminToken, "DISTRIBUTOR_ADMIN_TOKEN", "", "Bearer token required by the admin API")
+
+	s.String(&c.DLQDir, "DISTRIBUTOR_DLQ_DIR", "", "Dead-letter queue directory, empty disables")
+	s.Int(&c.DLQSegmentMB, "DISTRIBUTOR_DLQ_SEGMENT_MB", 64, "Dead-letter segment size in MB")
+	s.String(&c.WALDir, "DISTRIBUTOR_WAL_DIR", "", "Write-ahead log directory, empty disables")
+	s.String(&c.WALSync, "DISTRIBUTOR_WAL_SYNC", "interval", "When the WAL is fsynced: always, interval or never")
+	s.Duration(&c.WALSyncInterval, "DISTRIBUTOR_WAL_SYNC_INTERVAL_MS", 100*time.Millisecond, time.Millisecond, "WAL fsync period in interval mode")
+	s.Int(&c.WALSegmentMB, "DISTRIBUTOR_WAL_SEGMENT_MB", 64, "WAL segment size in MB")
+
+	if err := s.Load(args); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Validate checks that every setting is usable, reporting all problems at once
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(validAddr(c.EmitterAddr), "emitter address %q must be host:port", c.EmitterAddr)
+	check(validAddr(c.AnalyzerAddr), "analyzer address %q must be host:port", c.AnalyzerAddr)
+	// Lengths with the top bit set mark control frames on analyzer connections
+	check(c.MaxFrameSize >= protocol.MinDataFrameLen && c.MaxFrameSize <= 1<<31-1,
+		"max frame size must be between %d and %d bytes, got %d", protocol.MinDataFrameLen, 1<<31-1, c.MaxFrameSize)
+	check(c.AckTimeout > 0, "ack timeout must be positive, got %v", c.AckTimeout)
+	check(c.ResumeGrace >= 0, "resume grace must not be negative, got %v", c.ResumeGrace)
+	check(c.FlushInterval >= 0, "flush interval must not be negative, got %v", c.FlushInterval)
+	check(c.CompressionLevel >= 0 && c.CompressionLevel <= 9, "compression level must be between 0 and 9, got %d", c.CompressionLevel)
+	check(c.ShutdownTimeout >= 0, "shutdown timeout must not be negative, got %v", c.ShutdownTimeout)
+	check((c.EmitterTLSCert == "") == (c.EmitterTLSKey == ""), "emitter TLS needs both a certificate and a key")
+	check(c.EmitterTLSClientCA == "" || c.EmitterTLSCert != "", "emitter TLS client CA set without a certificate")
+	check((c.AnalyzerTLSCert == "") == (c.AnalyzerTLSKey == ""), "analyzer TLS needs both a certificate and a key")
+	check(c.AnalyzerTLSClientCA == "" || c.AnalyzerTLSCert != "", "analyzer TLS client CA set without a certificate")
+
+	switch c.Router {
+	case "weighted", "adaptive", "hash", "ordered":
+	default:
+		errs = append(errs, fmt.Errorf("router must be weighted, adaptive, hash or ordered, got %q", c.Router))
+	}
+	check(c.HashKey == "emitter" || c.HashKey == "payload" || c.HashKey == "header", "hash key must be emitter, payload or header, got %q", c.HashKey)
+	check(c.HashKey != "header" || c.HashKeyHeader != "", "header hash key needs a header name")
+	if _, err := distributor.NewKeyExtractor(c.HashKeyPrefix, c.HashKeyDelimiter, c.HashKeyRegex); err != nil {
+		errs = append(errs, fmt.Errorf("hash key: %w", err))
+	}
+	check(c.LaneBacklog > 0, "lane backlog must be positive, got %d", c.LaneBacklog)
+	check(c.LaneBacklogMB > 0, "lane backlog size must be positive, got %d MB", c.LaneBacklogMB)
+	check(c.QueueCapacity >= 0, "analyzer queue capacity must not be negative, got %d", c.QueueCapacity)
+	check(c.QueueMB >= 0, "analyzer queue size must not be negative, got %d MB", c.QueueMB)
+	check(c.MemoryBudgetMB >= 0, "memory budget must not be negative, got %d MB", c.MemoryBudgetMB)
+
+	if policies, err := distributor.ParseOverloadPolicies(c.OverloadPolicy); err != nil {
+		errs = append(errs, err)
+	} else {
+		check(!policies.Uses(distributor.OverloadEvict) || c.QueueCapacity > 0 || c.QueueMB > 0 || c.Router == "ordered",
+			"overload policy drop-oldest-lower-priority needs an analyzer queue capacity or size")
+		check(!policies.Uses(distributor.OverloadSpill) || c.SpillDir != "", "overload policy spill needs a spill directory")
+	}
+	check(c.OverloadBlockTimeout > 0, "overload block timeout must be positive, got %v", c.OverloadBlockTimeout)
+	check(c.SpillSegmentMB > 0, "spill segment size must be positive, got %d MB", c.SpillSegmentMB)
+	check(c.SpillDir == "" || (c.SpillDir != c.DLQDir && c.SpillDir != c.WALDir), "spill directory must differ from the dead-letter and WAL directories")
+
+	check(validPort(c.PprofPort), "pprof port %d out of range", c.PprofPort)
+	check(validPort(c.MetricsPort), "metrics port %d out of range", c.MetricsPort)
+	check(c.MetricsPort > 0 || !c.MetricsEnabled, "metrics are enabled but the metrics port is 0")
+	check(validPort(c.AdminPort), "admin port %d out of range", c.AdminPort)
+
+	check(c.DLQSegmentMB > 0, "dead-letter segment size must be positive, got %d MB", c.DLQSegmentMB)
+	check(c.WALSegmentMB > 0, "WAL segment size must be positive, got %d MB", c.WALSegmentMB)
+	check(c.WALSyncInterval > 0, "WAL sync interval must be positive, got %v", c.WALSyncInterval)
+	if _, err := distributor.ParseWALSyncMode(c.WALSync); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// emitterTLS loads the emitter listener's TLS configuration, nil if TLS is off
+func (c *Config) emitterTLS() (*tlsconfig.Server, error) {
+	return loadTLS(c.EmitterTLSCert, c.EmitterTLSKey, c.EmitterTLSClientCA)
+}
+
+// analyzerTLS loads the analyzer listener's TLS configuration, nil if TLS is off
+func (c *Config) analyzerTLS() (*tlsconfig.Server, error) {
+	return loadTLS(c.AnalyzerTLSCert, c.AnalyzerTLSKey, c.AnalyzerTLSClientCA)
+}
+
+func loadTLS(cert, key, clientCA string) (*tlsconfig.Server, error) {
+	if cert == "" {
+		return nil, nil
+	}
+	return tlsconfig.NewServer(tlsconfig.ServerOptions{
+		CertFile:     cert,
+		KeyFile:      key,
+		ClientCAFile: clientCA,
+	})
+}
+
+// authenticator loads the configured token checks, nil if clients need no token
+func (c *Config) authenticator() (auth.Authenticator, []reloader, error) {
+	var chain auth.Chain
+	var reloaders []reloader
+	if c.AuthTokenFile != "" {
+		tf, err := auth.NewTokenFile(c.AuthTokenFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		chain = append(chain, tf)
+		reloaders = append(reloaders, reloader{"token file", tf})
+	}
+	if c.AuthHMACSecret != "" {
+		h, err := auth.NewHMAC(c.AuthHMACSecret)
+		if err != nil {
+			return nil, nil, err
+		}
+		chain = append(chain, h)
+		reloaders = append(reloaders, reloader{"HMAC secret", h})
+	}
+	switch len(chain) {
+	case 0:
+		return nil, nil, nil
+	case 1:
+		return chain[0], reloaders, nil
+	}
+	return chain, reloaders, nil
+}
+
+// overload returns the overload options of the routers, spilling to spill
+func (c *Config) overload(spill *distributor.SpillQueue) distributor.OverloadOptions {
+	policies, _ := distributor.ParseOverloadPolicies(c.OverloadPolicy) // Checked by Validate
+	return distributor.OverloadOptions{
+		Policies:     policies,
+		BlockTimeout: c.OverloadBlockTimeout,
+		Spill:        spill,
+	}
+}
+
+// routerFactory returns a constructor for the configured kind of router
+func (c *Config) routerFactory(overload distributor.OverloadOptions) distributor.RouterFactory {
+	var key *distributor.KeyExtractor
+	if c.HashKey == "payload" || c.HashKey == "header" {
+		key, _ = distributor.NewKeyExtractor(c.HashKeyPrefix, c.HashKeyDelimiter, c.HashKeyRegex) // Checked by Validate
+	}
+	if c.HashKey == "header" {
+		key.Header = c.HashKeyHeader
+	}
+	switch c.Router {
+	case "adaptive":
+		return func() distributor.Router {
+			r := distributor.NewAdaptiveRouter()
+			r.SetOverload(overload)
+			return r
+		}
+	case "hash":
+		opts := distributor.HashRouterOptions{Key: key}
+		return func() distributor.Router {
+			r := distributor.NewHashRouter(opts)
+			r.SetOverload(overload)
+			return r
+		}
+	case "ordered":
+		opts := distributor.OrderedRouterOptions{Key: key, MaxBacklog: c.LaneBacklog, MaxBacklogBytes: int64(c.LaneBacklogMB) << 20}
+		return func() distributor.Router {
+			r := distributor.NewOrderedRouter(opts)
+			r.SetOverload(overload)
+			return r
+		}
+	}
+	return func() distributor.Router {
+		r := distributor.NewWeightedTreeRouter()
+		r.SetOverload(overload)
+		return r
+	}
+}
+
+// httpAddr returns the listen address of an HTTP server on port
+func (c *Config) httpAddr(port int) string {
+	return net.JoinHostPort(c.HTTPHost, strconv.Itoa(port))
+}
+
+func validAddr(addr string) bool {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	n, err := strconv.Atoi(port)
+	return err == nil && validPort(n)
+}
+
+func validPort(port int) bool {
+	return port >= 0 && port <= 65535
+}
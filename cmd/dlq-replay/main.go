@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"log-distributor/config"
+	"log-distributor/internal/distributor"
+	"log-distributor/internal/protocol"
+	"log-distributor/internal/tlsconfig"
+)
+
+const (
+	// Mask for actual sequence value (bottom 31 bits)
+	SeqNumValueMask = uint32(0x7FFFFFFF)
+)
+
+func main() {
+	distributorAddr := config.GetEnvWithDefault("LOG_ADDR", "localhost:8080")
+	dlqPath := config.GetEnvWithDefault("DLQ_PATH", "")
+	emitterID := config.GetEnvWithDefault("EMITTER_ID", "")
+	authToken := config.GetEnvWithDefault("EMITTER_AUTH_TOKEN", "")
+	rate := config.GetEnvIntWithDefault("DLQ_REPLAY_RATE", 0)
+	maxAttempts := config.GetEnvIntWithDefault("DLQ_REPLAY_ATTEMPTS", 5)
+	deleteReplayed := config.GetEnvBoolWithDefault("DLQ_DELETE_REPLAYED", false)
+
+	var tlsConfig *tls.Config
+	if config.GetEnvBoolWithDefault("EMITTER_TLS", false) {
+		var err error
+		tlsConfig, err = tlsconfig.NewClient(tlsconfig.ClientOptions{
+			CAFile:     config.GetEnvWithDefault("EMITTER_TLS_CA", ""),
+			CertFile:   config.GetEnvWithDefault("EMITTER_TLS_CERT", ""),
+			KeyFile:    config.GetEnvWithDefault("EMITTER_TLS_KEY", ""),
+			ServerName: config.GetEnvWithDefault("EMITTER_TLS_SERVER_NAME", ""),
+		})
+		if err != nil {
+			log.Fatalf("Failed to set up TLS: %v", err)
+		}
+		if emitterID == "" {
+			emitterID = tlsconfig.ClientIdentity(tlsConfig)
+		}
+	}
+	// A token proves an ID of its own, which the distributor uses when the
+	// hello carries none
+	if emitterID == "" && authToken == "" {
+		emitterID = "dlq-replay"
+	}
+
+	if dlqPath == "" {
+		log.Fatalf("DLQ_PATH must name a dead-letter segment or directory")
+	}
+
+	files := []string{dlqPath}
+	if info, err := os.Stat(dlqPath); err != nil {
+		log.Fatalf("Failed to open %s: %v", dlqPath, err)
+	} else if info.IsDir() {
+		if files, err = distributor.DeadLetterFiles(dlqPath); err != nil {
+			log.Fatalf("Failed to list dead-letter segments: %v", err)
+		}
+	}
+	if len(files) == 0 {
+		log.Printf("No dead-letter segments to replay in %s", dlqPath)
+		return
+	}
+
+	r, err := dial(distributorAddr, tlsConfig, emitterID, authToken)
+	if err != nil {
+		log.Fatalf("Failed to connect to distributor: %v", err)
+	}
+	defer r.conn.Close()
+	if emitterID == "" {
+		emitterID = "the ID of its token"
+	}
+	log.Printf("Connected to distributor at %s as %s", distributorAddr, emitterID)
+
+	var interval time.Duration
+	if rate > 0 {
+		interval = time.Second / time.Duration(rate)
+	}
+
+	total := 0
+	for _, path := range files {
+		var frames [][]byte
+		reasons := make(map[distributor.DropReason]int)
+		err := distributor.ReadDeadLetters(path, func(dl *distributor.DeadLetter) bool {
+			frames = append(frames, dl.Frame)
+			reasons[dl.Reason]++
+			return true
+		})
+		if err != nil {
+			log.Fatalf("Failed to read %s: %v", path, err)
+		}
+		for reason, n := range reasons {
+			log.Printf("%s: %d messages dropped for %s", path, n, reason)
+		}
+
+		retried, err := r.replay(frames, interval, maxAttempts)
+		if err != nil {
+			log.Fatalf("Replay of %s failed: %v", path, err)
+		}
+		total += len(frames)
+		log.Printf("Replayed %d messages from %s (%d resent after being dropped again)", len(frames), path, retried)
+
+		if deleteReplayed {
+			if err := os.Remove(path); err != nil {
+				log.Printf("Failed to delete %s: %v", path, err)
+			}
+		}
+	}
+	log.Printf("Replay complete: %d messages from %d segments", total, len(files))
+}
+
+// sentFrame is a frame written to the distributor but not yet settled
+type sentFrame struct {
+	seq   uint32
+	frame []byte
+}
+
+// replayer sends frames to the distributor as an emitter with acknowledgements
+type replayer struct {
+	conn      net.Conn
+	bufWriter *bufio.Writer
+	envelopes bool // Whether the distributor accepts envelope frames
+
+	mu          sync.Mutex
+	settled     *sync.Cond
+	nextSeq     uint32
+	outstanding []sentFrame // Frames written but not yet settled, oldest first
+	nacked      [][]byte    // Frames the distributor dropped again
+	err         error
+}
+
+// dial connects to the distributor, over TLS if tlsConfig is set, and
+// negotiates acknowledgements and envelopes, presenting authToken if it is not
+// empty
+func dial(addr string, tlsConfig *tls.Config, emitterID, authToken string) (*replayer, error) {
+	conn, err := tlsconfig.Dial(addr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	hello := &protocol.Hello{
+		Version:  protocol.Version,
+		Features: protocol.EmitterFeatureAcks | protocol.EmitterFeatureEnvelope,
+		ID:       emitterID,
+
+		AuthToken: []byte(authToken),
+	}
+	if err := protocol.WriteHello(conn, protocol.EmitterHelloMagic, hello); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("handshake failed: %w", err)
+	}
+	reply, err := protocol.ReadReply(conn, protocol.EmitterHelloMagic)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("handshake failed: %w", err)
+	}
+	if !reply.Accepted() {
+		conn.Close()
+		return nil, fmt.Errorf("rejected by distributor: %s", reply.Reason)
+	}
+	if reply.Features&protocol.EmitterFeatureAcks == 0 {
+		conn.Close()
+		return nil, errors.New("distributor does not support acknowledgements")
+	}
+
+	r := &replayer{conn: conn, bufWriter: bufio.NewWriter(conn)}
+	r.envelopes = reply.Features&protocol.EmitterFeatureEnvelope != 0
+	r.settled = sync.NewCond(&r.mu)
+	go r.readAcks()
+	return r, nil
+}
+
+// replay sends frames until every one is accepted, resending those the
+// distributor drops again up to maxAttempts times. Returns how many were resent.
+func (r *replayer) replay(frames [][]byte, interval time.Duration, maxAttempts int) (int, error) {
+	retried := 0
+	backoff := time.Second
+	for attempt := 1; len(frames) > 0; attempt++ {
+		if attempt > maxAttempts {
+			return retried, fmt.Errorf("%d messages still dropped after %d attempts", len(frames), maxAttempts)
+		}
+		if attempt > 1 {
+			log.Printf("%d messages dropped again, resending in %v", len(frames), backoff)
+			time.Sleep(backoff)
+			backoff *= 2
+			retried += len(frames)
+		}
+
+		for _, frame := range frames {
+			if err := r.send(frame); err != nil {
+				return retried, err
+			}
+			if interval > 0 {
+				if err := r.bufWriter.Flush(); err != nil {
+					return retried, err
+				}
+				time.Sleep(interval)
+			}
+		}
+		if err := r.bufWriter.Flush(); err != nil {
+			return retried, err
+		}
+
+		var err error
+		if frames, err = r.wait(); err != nil {
+			return retried, err
+		}
+	}
+	return retried, nil
+}
+
+// send writes a frame, remembering it until it is settled. Envelope frames are
+// sent as the data frame they hold if the distributor does not accept them.
+func (r *replayer) send(frame []byte) error {
+	if !r.envelopes && len(frame) >= 4 && binary.BigEndian.Uint32(frame)&protocol.ControlFrameFlag != 0 {
+		_, data, err := protocol.ParseEnvelope(frame)
+		if err != nil {
+			return err
+		}
+		frame = data
+	}
+
+	r.mu.Lock()
+	if r.err != nil {
+		r.mu.Unlock()
+		return r.err
+	}
+	r.nextSeq = (r.nextSeq + 1) & SeqNumValueMask
+	r.outstanding = append(r.outstanding, sentFrame{seq: r.nextSeq, frame: frame})
+	r.mu.Unlock()
+
+	_, err := r.bufWriter.Write(frame)
+	return err
+}
+
+// wait blocks until every sent frame is settled and returns those that were dropped
+func (r *replayer) wait() ([][]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for len(r.outstanding) > 0 && r.err == nil {
+		r.settled.Wait()
+	}
+	if len(r.outstanding) > 0 {
+		return nil, fmt.Errorf("connection lost with %d messages unacknowledged: %w", len(r.outstanding), r.err)
+	}
+
+	nacked := r.nacked
+	r.nacked = nil
+	return nacked, nil
+}
+
+// readAcks applies ACK and NACK frames from the distributor until the connection fails
+func (r *replayer) readAcks() {
+	frame := make([]byte, protocol.EmitterFrameLen)
+	for {
+		_, err := io.ReadFull(r.conn, frame)
+
+		r.mu.Lock()
+		if err != nil {
+			r.err = err
+			r.settled.Broadcast()
+			r.mu.Unlock()
+			return
+		}
+		seq := binary.BigEndian.Uint32(frame[1:])
+		for len(r.outstanding) > 0 && (seq-r.outstanding[0].seq)&SeqNumValueMask < 1<<30 {
+			if frame[0] == protocol.EmitterFrameNack && r.outstanding[0].seq == seq {
+				r.nacked = append(r.nacked, r.outstanding[0].frame)
+			}
+			r.outstanding = r.outstanding[1:]
+		}
+		r.settled.Broadcast()
+		r.mu.Unlock()
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log-distributor/internal/protocol"
+	"log-distributor/internal/tlsconfig"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Mask for actual sequence value (bottom 31 bits)
+	SeqNumValueMask = uint32(0x7FFFFFFF)
+)
+
+// errPaused reports that the distributor asked the emitter to pause and reconnect
+var errPaused = errors.New("distributor is shutting down")
+
+// Largest batch frame the emitter writes, well under the distributor's default
+// maximum frame size
+const maxBatchBytes = 256 << 10
+
+// Smallest batch frame compressed when the distributor supports compression
+const minCompressedBatchBytes = 1 << 10
+
+// errRejected reports that the distributor closed the connection over a malformed frame
+var errRejected = errors.New("distributor rejected a malformed frame")
+
+// deliveryStats counts distributor acknowledgements and compressed batch frames
+// across reconnects
+type deliveryStats struct {
+	acked    atomic.Uint64
+	dropped  atomic.Uint64
+	resent   atomic.Uint64
+	rejected atomic.Uint64
+
+	compressedBytes   atomic.Uint64 // Bytes of the batch frames sent compressed
+	uncompressedBytes atomic.Uint64 // Bytes they would have taken uncompressed
+}
+
+// sentFrame is a frame written to the distributor but not yet settled
+type sentFrame struct {
+	seq     uint32
+	message []byte
+}
+
+// link is a connection to the distributor. With acknowledgements enabled it keeps
+// every frame until the distributor settles it, so dropped frames can be resent
+// and nothing unacknowledged is lost when the connection has to be re-established.
+type link struct {
+	conn      net.Conn
+	bufWriter *bufio.Writer
+	acks      bool
+	envelopes bool // Whether the distributor accepts envelope frames
+	stats     *deliveryStats
+
+	// Batch frame being collected, only used with protocol.EmitterFeatureBatch
+	batchSize  int // Messages per batch frame, 1 without batching
+	batch      [][]byte
+	batchBytes int
+	header     []byte
+
+	// Set with protocol.EmitterFeatureCompression
+	compressor *protocol.Compressor
+	body       []byte // Frames of the batch being compressed
+
+	mu      sync.Mutex
+	nextSeq uint32      // Sequence number of the last frame written
+	unacked []sentFrame // Frames written but not yet settled, oldest first
+	nacked  [][]byte    // Frames the distributor dropped, waiting to be resent
+	err     error       // Set once the connection has failed
+}
+
+// linkOptions are the features an emitter asks for when it connects
+type linkOptions struct {
+	emitterID string // Sent in the hello, empty to let the distributor pick one
+	authToken string // Presented in the hello if not empty
+	acks      bool   // Ask for acknowledgements
+	legacy    bool   // Skip the hello and send frames straight away
+	batchSize int    // Messages per batch frame, 1 without batching
+	compress  bool   // Compress batch frames
+	envelopes bool   // Send messages in envelope frames
+}
+
+// dial connects to the distributor, over TLS if tlsConfig is set, and performs
+// the emitter handshake. With a batch size above 1, messages are sent that many
+// to a batch frame if the distributor supports them, compressed if asked for
+// and the distributor supports that too.
+func dial(addr string, tlsConfig *tls.Config, opts linkOptions, stats *deliveryStats) (*link, error) {
+	conn, err := tlsconfig.Dial(addr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &link{
+		conn:      conn,
+		bufWriter: bufio.NewWriter(conn),
+		stats:     stats,
+		batchSize: 1,
+	}
+	if opts.legacy {
+		return l, nil
+	}
+
+	hello := &protocol.Hello{
+		Version:   protocol.Version,
+		ID:        opts.emitterID,
+		AuthToken: []byte(opts.authToken),
+	}
+	if opts.acks {
+		hello.Features |= protocol.EmitterFeatureAcks
+	}
+	if opts.batchSize > 1 {
+		hello.Features |= protocol.EmitterFeatureBatch
+		if opts.compress {
+			hello.Features |= protocol.EmitterFeatureCompression
+		}
+	}
+	if opts.envelopes {
+		hello.Features |= protocol.EmitterFeatureEnvelope
+	}
+	if err := protocol.WriteHello(conn, protocol.EmitterHelloMagic, hello); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("handshake failed: %w", err)
+	}
+	reply, err := protocol.ReadReply(conn, protocol.EmitterHelloMagic)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("handshake failed: %w", err)
+	}
+	if !reply.Accepted() {
+		conn.Close()
+		return nil, fmt.Errorf("rejected by distributor: %s", reply.Reason)
+	}
+
+	l.acks = reply.Features&protocol.EmitterFeatureAcks != 0
+	l.envelopes = reply.Features&protocol.EmitterFeatureEnvelope != 0
+	if reply.Features&protocol.EmitterFeatureBatch != 0 {
+		l.batchSize = opts.batchSize
+	}
+	if reply.Features&protocol.EmitterFeatureCompression != 0 {
+		if l.compressor, err = protocol.NewCompressor(flate.BestSpeed); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to set up compression: %w", err)
+		}
+	}
+	if l.acks {
+		go l.readAcks()
+	}
+	return l, nil
+}
+
+// send writes a frame, remembering it until it is acknowledged
+func (l *link) send(message []byte) error {
+	if l.acks {
+		l.mu.Lock()
+		if l.err != nil {
+			// Keep the frame so it is carried over to the next connection
+			l.nacked = append(l.nacked, message)
+			err := l.err
+			l.mu.Unlock()
+			return err
+		}
+		l.nextSeq = (l.nextSeq + 1) & SeqNumValueMask
+		l.unacked = append(l.unacked, sentFrame{seq: l.nextSeq, message: message})
+		l.mu.Unlock()
+	}
+
+	if l.batchSize > 1 {
+		if l.batchBytes+len(message) > maxBatchBytes {
+			if err := l.writeBatch(); err != nil {
+				return err
+			}
+		}
+		l.batch = append(l.batch, message)
+		l.batchBytes += len(message)
+		if len(l.batch) < l.batchSize {
+			return nil
+		}
+		return l.writeBatch()
+	}
+
+	_, err := l.bufWriter.Write(message)
+	return l.fail(err)
+}
+
+// writeBatch writes the messages collected so far as a batch frame, compressed
+// if it is large enough and compression was negotiated, or as a plain frame if
+// there is only one
+func (l *link) writeBatch() error {
+	batch := l.batch
+	defer func() {
+		clear(batch)
+		l.batch, l.batchBytes = batch[:0], 0
+	}()
+
+	switch len(batch) {
+	case 0:
+		return nil
+	case 1:
+		_, err := l.bufWriter.Write(batch[0])
+		return l.fail(err)
+	}
+	if l.compressor != nil && l.batchBytes >= minCompressedBatchBytes {
+		return l.writeCompressed(batch)
+	}
+	l.header = protocol.AppendBatchHeader(l.header[:0], len(batch), l.batchBytes)
+	if _, err := l.bufWriter.Write(l.header); err != nil {
+		return l.fail(err)
+	}
+	for _, message := range batch {
+		if _, err := l.bufWriter.Write(message); err != nil {
+			return l.fail(err)
+		}
+	}
+	return nil
+}
+
+// writeCompressed writes a batch of messages as a compressed batch frame,
+// unless compressing would not make it smaller
+func (l *link) writeCompressed(batch [][]byte) error {
+	body := l.body[:0]
+	for _, message := range batch {
+		body = append(body, message...)
+	}
+	l.body = body
+
+	frame, compressed := l.compressor.AppendBatch(l.header[:0], len(batch), body)
+	l.header = frame
+	if compressed {
+		l.stats.compressedBytes.Add(uint64(len(frame)))
+		l.stats.uncompressedBytes.Add(uint64(protocol.BatchHeaderLen + len(body)))
+	}
+	_, err := l.bufWriter.Write(frame)
+	return l.fail(err)
+}
+
+// flush pushes buffered frames, including a partial batch, to the distributor
+func (l *link) flush() error {
+	if err := l.writeBatch(); err != nil {
+		return err
+	}
+	return l.fail(l.bufWriter.Flush())
+}
+
+// fail records the first error that broke the connection and returns err
+func (l *link) fail(err error) error {
+	if err != nil {
+		l.mu.Lock()
+		if l.err == nil {
+			l.err = err
+		}
+		l.mu.Unlock()
+	}
+	return err
+}
+
+// resendDropped writes again every frame the distributor reported as dropped
+func (l *link) resendDropped() error {
+	l.mu.Lock()
+	nacked := l.nacked
+	l.nacked = nil
+	l.mu.Unlock()
+
+	for i, message := range nacked {
+		if err := l.send(message); err != nil {
+			l.mu.Lock()
+			l.nacked = append(l.nacked, nacked[i+1:]...)
+			l.mu.Unlock()
+			return err
+		}
+		l.stats.resent.Add(1)
+	}
+	return nil
+}
+
+// failed returns the error that broke the connection, if any
+func (l *link) failed() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// close shuts the connection and returns every frame that was never acknowledged
+func (l *link) close() [][]byte {
+	l.conn.Close()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err == nil {
+		l.err = net.ErrClosed
+	}
+	outstanding := l.nacked
+	for _, frame := range l.unacked {
+		outstanding = append(outstanding, frame.message)
+	}
+	l.nacked, l.unacked = nil, nil
+	return outstanding
+}
+
+// readAcks applies ACK and NACK frames from the distributor until the connection
+// fails, the distributor asks the emitter to pause or it rejects a frame
+func (l *link) readAcks() {
+	frame := make([]byte, protocol.EmitterFrameLen)
+	for {
+		if _, err := io.ReadFull(l.conn, frame); err != nil {
+			l.fail(err)
+			return
+		}
+
+		seq := binary.BigEndian.Uint32(frame[1:])
+		l.mu.Lock()
+		for len(l.unacked) > 0 && seqCovers(seq, l.unacked[0].seq) {
+			if frame[0] == protocol.EmitterFrameNack && l.unacked[0].seq == seq {
+				l.nacked = append(l.nacked, l.unacked[0].message)
+				l.stats.dropped.Add(1)
+			} else if frame[0] == protocol.EmitterFrameReject && l.unacked[0].seq == seq {
+				// Sending it again would only be rejected again
+				log.Printf("Distributor rejected a %d-byte frame as malformed, discarding it", len(l.unacked[0].message))
+				l.stats.rejected.Add(1)
+			} else {
+				l.stats.acked.Add(1)
+			}
+			l.unacked = l.unacked[1:]
+		}
+		l.mu.Unlock()
+
+		switch frame[0] {
+		case protocol.EmitterFramePause:
+			// Whatever is still unacknowledged goes to the next connection
+			l.fail(errPaused)
+			return
+		case protocol.EmitterFrameReject:
+			l.fail(errRejected)
+			return
+		}
+	}
+}
+
+// seqCovers reports whether cumulative sequence number n includes seq
+func seqCovers(n, seq uint32) bool {
+	return (n-seq)&SeqNumValueMask < 1<<30
+}
+
+// redial replaces a failed link, resending everything it never got acknowledged.
+// Returns nil if no connection could be made before timeout.
+func redial(old *link, addr string, tlsConfig *tls.Config, opts linkOptions, stats *deliveryStats, timeout time.Duration) *link {
+	outstanding := old.close()
+	deadline := time.Now().Add(timeout)
+	backoff := 100 * time.Millisecond
+
+	for time.Now().Before(deadline) {
+		time.Sleep(backoff)
+		l, err := dial(addr, tlsConfig, opts, stats)
+		if err != nil {
+			log.Printf("Reconnect failed: %v", err)
+			backoff = min(backoff*2, 5*time.Second)
+			continue
+		}
+
+		log.Printf("Reconnected to distributor at %s, resending %d unacknowledged messages", addr, len(outstanding))
+		for i, message := range outstanding {
+			if err := l.send(message); err != nil {
+				// The next tick notices the failure and redials with whatever is left
+				l.mu.Lock()
+				l.nacked = append(l.nacked, outstanding[i+1:]...)
+				l.mu.Unlock()
+				break
+			}
+			stats.resent.Add(1)
+		}
+		return l
+	}
+
+	log.Printf("Giving up reconnecting after %v", timeout)
+	return nil
+}
@@ -1,15 +1,17 @@
 package main
 
 import (
-	"bufio"
+	cryptorand "crypto/rand"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
 	"log"
 	"log-distributor/config"
+	"log-distributor/internal/protocol"
+	"log-distributor/internal/tlsconfig"
 	"math"
 	"math/rand"
-	"net"
 	"os"
 	"os/signal"
 	"sync"
@@ -20,31 +22,77 @@ import (
 
 func main() {
 	distributorAddr := config.GetEnvWithDefault("LOG_ADDR", "localhost:8080")
-	rate           := config.GetEnvIntWithDefault("EMITTER_RATE", 100)
-	emitterID      := config.GetEnvWithDefault("EMITTER_ID", "")
-	sizeMean       := config.GetEnvFloat64WithDefault("LOG_SIZE_MEAN", 512)
-	sizeStddev     := config.GetEnvFloat64WithDefault("LOG_SIZE_STDDEV", 0.5)
-	minSize        := config.GetEnvIntWithDefault("LOG_MIN_SIZE", 64)
-	maxSize        := config.GetEnvIntWithDefault("LOG_MAX_SIZE", 8192)
-	verbose		   := config.GetEnvBoolWithDefault("EMITTER_VERBOSE", false)
-	priorityMode   := config.GetEnvWithDefault("EMITTER_PRIORITY_MODE", "single") // single, random, weighted
+	rate := config.GetEnvIntWithDefault("EMITTER_RATE", 100)
+	emitterID := config.GetEnvWithDefault("EMITTER_ID", "")
+	sizeMean := config.GetEnvFloat64WithDefault("LOG_SIZE_MEAN", 512)
+	sizeStddev := config.GetEnvFloat64WithDefault("LOG_SIZE_STDDEV", 0.5)
+	minSize := config.GetEnvIntWithDefault("LOG_MIN_SIZE", 64)
+	maxSize := config.GetEnvIntWithDefault("LOG_MAX_SIZE", 8192)
+	verbose := config.GetEnvBoolWithDefault("EMITTER_VERBOSE", false)
+	priorityMode := config.GetEnvWithDefault("EMITTER_PRIORITY_MODE", "single") // single, random, weighted
+	legacy := config.GetEnvBoolWithDefault("EMITTER_LEGACY_HANDSHAKE", false)
+	acks := config.GetEnvBoolWithDefault("EMITTER_ACKS", true) && !legacy
+	reconnectTimeout := time.Duration(config.GetEnvIntWithDefault("EMITTER_RECONNECT_TIMEOUT", 60)) * time.Second
+	useTLS := config.GetEnvBoolWithDefault("EMITTER_TLS", false)
+	authToken := config.GetEnvWithDefault("EMITTER_AUTH_TOKEN", "")
+	batchSize := config.GetEnvIntWithDefault("EMITTER_BATCH_SIZE", 1)
+	compress := config.GetEnvBoolWithDefault("EMITTER_COMPRESSION", true)
+	envelopes := config.GetEnvBoolWithDefault("EMITTER_ENVELOPE", false) && !legacy
 
+	var tlsConfig *tls.Config
+	if useTLS {
+		var err error
+		tlsConfig, err = tlsconfig.NewClient(tlsconfig.ClientOptions{
+			CAFile:     config.GetEnvWithDefault("EMITTER_TLS_CA", ""),
+			CertFile:   config.GetEnvWithDefault("EMITTER_TLS_CERT", ""),
+			KeyFile:    config.GetEnvWithDefault("EMITTER_TLS_KEY", ""),
+			ServerName: config.GetEnvWithDefault("EMITTER_TLS_SERVER_NAME", ""),
+		})
+		if err != nil {
+			log.Fatalf("Failed to set up TLS: %v", err)
+		}
+		// With mutual TLS the distributor knows the emitter by its certificate
+		if emitterID == "" {
+			emitterID = tlsconfig.ClientIdentity(tlsConfig)
+		}
+	}
+
+	helloID := emitterID
 	if emitterID == "" {
 		hostname, _ := os.Hostname()
 		emitterID = fmt.Sprintf("emitter_%s_%d", hostname, os.Getpid())
+		// A token proves an ID of its own, which the distributor uses when the
+		// hello carries none
+		if authToken == "" {
+			helloID = emitterID
+		}
 	}
 
 	log.Printf("Starting emitter %s", emitterID)
-	log.Printf("Target: %s, Rate: %d msg/s", distributorAddr, rate)
-	log.Printf("Message size: log-normal(μ=%.1f, σ=%.2f), range=[%d, %d] bytes", 
+	log.Printf("Target: %s, Rate: %d msg/s, TLS: %v", distributorAddr, rate, useTLS)
+	log.Printf("Message size: log-normal(μ=%.1f, σ=%.2f), range=[%d, %d] bytes",
 		sizeMean, sizeStddev, minSize, maxSize)
 
 	// Connect to distributor
-	conn, err := net.Dial("tcp", distributorAddr)
+	stats := &deliveryStats{}
+	opts := linkOptions{
+		emitterID: helloID,
+		authToken: authToken,
+		acks:      acks,
+		legacy:    legacy,
+		batchSize: batchSize,
+		compress:  compress,
+		envelopes: envelopes,
+	}
+	conn, err := dial(distributorAddr, tlsConfig, opts, stats)
 	if err != nil {
 		log.Fatalf("Failed to connect to distributor: %v", err)
 	}
-	defer conn.Close()
+	defer func() {
+		if conn != nil {
+			conn.close()
+		}
+	}()
 
 	log.Printf("Connected to distributor at %s", distributorAddr)
 
@@ -52,9 +100,9 @@ func main() {
 	interval := time.Second / time.Duration(rate)
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
-	
+
 	startTime := time.Now()
-	messageCount := atomic.Uint64{} 
+	messageCount := atomic.Uint64{}
 	bytesSent := atomic.Uint64{}
 
 	var logFinalStats sync.Once
@@ -62,10 +110,19 @@ func main() {
 		actualDuration := time.Since(startTime)
 		actualRate := float64(messageCount.Load()) / actualDuration.Seconds()
 		totalBytes := bytesSent.Load()
-		
+
 		log.Printf("Emitter %s completed: sent %d messages", emitterID, messageCount.Load())
-		log.Printf("Emitter %s final stats: %.2fs duration, %.2f msg/s, %d bytes", 
+		log.Printf("Emitter %s final stats: %.2fs duration, %.2f msg/s, %d bytes",
 			emitterID, actualDuration.Seconds(), actualRate, totalBytes)
+		if acks {
+			log.Printf("Emitter %s delivery: %d acked, %d dropped by distributor, %d resent, %d rejected as malformed",
+				emitterID, stats.acked.Load(), stats.dropped.Load(), stats.resent.Load(), stats.rejected.Load())
+		}
+		if compressed := stats.compressedBytes.Load(); compressed > 0 {
+			uncompressed := stats.uncompressedBytes.Load()
+			log.Printf("Emitter %s compression: %d bytes of batch frames sent as %d (%.1f%%)",
+				emitterID, uncompressed, compressed, 100*float64(compressed)/float64(uncompressed))
+		}
 	}
 
 	// Defer final stats logging for normal returns
@@ -73,8 +130,6 @@ func main() {
 
 	log.Printf("Sending messages...")
 
-	bufWriter := bufio.NewWriter(conn)
-
 	// Setup signal handler for graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -85,22 +140,38 @@ func main() {
 	}()
 
 	for range ticker.C {
+		if acks {
+			if err := conn.failed(); err != nil {
+				log.Printf("Lost connection to distributor: %v", err)
+				if conn = redial(conn, distributorAddr, tlsConfig, opts, stats, reconnectTimeout); conn == nil {
+					return
+				}
+			}
+			// Messages the distributor dropped go out again before new ones
+			if err := conn.resendDropped(); err != nil {
+				continue
+			}
+		}
+
 		messageSize := generateMessageSize(sizeMean, sizeStddev, minSize, maxSize)
 		priority := generatePriority(priorityMode, int(messageCount.Load()))
 		message := createMessage(emitterID, messageSize, int(messageCount.Load()), priority)
-		if _, err := bufWriter.Write(message); err != nil {
+		if conn.envelopes {
+			message = wrapEnvelope(emitterID, priorityMode, message)
+		}
+		if err := conn.send(message); err != nil && !acks {
 			log.Printf("Failed to send message %d: %v", messageCount.Load(), err)
 			return
 		}
-		
+
 		count := messageCount.Add(1)
 		bytesSent.Add(uint64(len(message)))
-		
+
 		if verbose && count%100 == 0 {
 			log.Printf("Sent %d messages (%d bytes total)", count, bytesSent.Load())
 		} else if count%1000 == 0 {
 			log.Printf("Sent %d messages", count)
-			if err := bufWriter.Flush(); err != nil {
+			if err := conn.flush(); err != nil && !acks {
 				log.Printf("Error flushing buffer: %v", err)
 				return
 			}
@@ -112,11 +183,11 @@ func generateMessageSize(mean, stddev float64, minSize, maxSize int) int {
 	// Log-normal distribution: ln(X) ~ N(μ, σ²)
 	// For log-normal, we need to convert mean to the underlying normal distribution
 	mu := math.Log(mean) - 0.5*stddev*stddev
-	
+
 	// Generate log-normal sample
 	normal := rand.NormFloat64()
 	logNormalSample := math.Exp(mu + stddev*normal)
-	
+
 	// Clamp to bounds
 	size := int(math.Round(logNormalSample))
 	if size < minSize {
@@ -125,7 +196,7 @@ func generateMessageSize(mean, stddev float64, minSize, maxSize int) int {
 	if size > maxSize {
 		size = maxSize
 	}
-	
+
 	return size
 }
 
@@ -147,7 +218,7 @@ func generatePriority(mode string, counter int) uint8 {
 			return uint8(3 + rand.Intn(5)) // 3-7
 		}
 	case "cyclic":
-		// Cycle through priorities 0-7 
+		// Cycle through priorities 0-7
 		return uint8(counter % 8)
 	default: // "single"
 		// Default priority 1 (INFO level)
@@ -158,43 +229,64 @@ func generatePriority(mode string, counter int) uint8 {
 func createMessage(emitterID string, payloadSize, counter int, priority uint8) []byte {
 	// Message format: [4 bytes: total length][1 byte: severity][payload]
 	// Payload format: [emitter_id]:[timestamp]:[counter]:[checksum]:[padding]
-	
+
 	timestamp := time.Now().UnixNano()
 	basePayload := fmt.Sprintf("%s:%d:%08d:", emitterID, timestamp, counter)
-	
+
 	// Calculate remaining space for padding (reserve 64 chars for checksum)
 	paddingSize := payloadSize - len(basePayload) - 64
 	if paddingSize < 0 {
 		paddingSize = 0
 	}
-	
+
 	// Create padding
 	padding := make([]byte, paddingSize)
 	for i := range padding {
 		padding[i] = byte('A' + (i % 26)) // Cycle through A-Z
 	}
-	
+
 	// Create payload without checksum
 	payloadWithoutChecksum := basePayload + string(padding)
-	
+
 	// Calculate SHA256 checksum
 	hash := sha256.Sum256([]byte(payloadWithoutChecksum))
 	checksum := fmt.Sprintf("%x", hash)
-	
+
 	// Final payload
 	payload := payloadWithoutChecksum + checksum
-	
+
 	// Use provided priority as severity
 	severity := priority
-	
+
 	// Calculate total length (4 bytes length + 1 byte severity + payload)
 	totalLength := 4 + 1 + len(payload)
-	
+
 	// Create message
 	message := make([]byte, totalLength)
 	binary.BigEndian.PutUint32(message[0:4], uint32(totalLength))
 	message[4] = severity
 	copy(message[5:], payload)
-	
+
 	return message
-}
\ No newline at end of file
+}
+
+// wrapEnvelope puts a message in an envelope frame whose headers repeat what
+// the payload format only carries by convention
+func wrapEnvelope(emitterID, priorityMode string, message []byte) []byte {
+	traceID := make([]byte, 16)
+	cryptorand.Read(traceID)
+	headers := &protocol.Headers{
+		Source:      emitterID,
+		Timestamp:   time.Now(),
+		TraceID:     traceID,
+		ContentType: "text/plain",
+		Key:         []byte(emitterID),
+		Attributes:  []protocol.Attribute{{Name: "priority_mode", Value: priorityMode}},
+	}
+	frame, err := protocol.AppendEnvelope(nil, headers, message)
+	if err != nil {
+		log.Printf("Sending message without envelope: %v", err)
+		return message
+	}
+	return frame
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ReadFile reads a configuration file in a flat subset of TOML: one
+// `key = value` per line, `#` comments, and values that are quoted strings,
+// numbers or booleans. Tables and arrays are not supported.
+func ReadFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, lineNum)
+		}
+		key = strings.TrimSpace(key)
+		if key == "" || strings.ContainsAny(key, " \t[]\"") {
+			return nil, fmt.Errorf("%s:%d: invalid key %q", path, lineNum, key)
+		}
+		if _, dup := values[key]; dup {
+			return nil, fmt.Errorf("%s:%d: %s set twice", path, lineNum, key)
+		}
+
+		value, err := parseFileValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %w", path, lineNum, key, err)
+		}
+		values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	return values, nil
+}
+
+// parseFileValue returns the text of a value, unquoting strings and dropping
+// trailing comments
+func parseFileValue(raw string) (string, error) {
+	if strings.HasPrefix(raw, `"`) {
+		prefix, err := strconv.QuotedPrefix(raw)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", raw)
+		}
+		if rest := strings.TrimSpace(raw[len(prefix):]); rest != "" && rest[0] != '#' {
+			return "", fmt.Errorf("unexpected %q after string", rest)
+		}
+		return strconv.Unquote(prefix)
+	}
+
+	if i := strings.IndexByte(raw, '#'); i >= 0 {
+		raw = strings.TrimSpace(raw[:i])
+	}
+	if raw == "" {
+		return "", fmt.Errorf("missing value")
+	}
+	return raw, nil
+}
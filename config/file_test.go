@@ -0,0 +1,83 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeFile writes a config file to a temporary directory and returns its path
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadFile(t *testing.T) {
+	path := writeFile(t, `
+# Message servers
+emitter_addr = ":9000"
+max_frame_size = 4096   # bytes
+stamp_messages = true
+	ack_timeout_seconds=30
+admin_token = "has # and \"quotes\"" # comment
+empty = ""
+`)
+	values, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"emitter_addr":        ":9000",
+		"max_frame_size":      "4096",
+		"stamp_messages":      "true",
+		"ack_timeout_seconds": "30",
+		"admin_token":         `has # and "quotes"`,
+		"empty":               "",
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("read %q, want %q", values, want)
+	}
+}
+
+func TestReadFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"no equals", "emitter_addr :9000", ":1: expected key = value"},
+		{"empty key", "= 1", `:1: invalid key ""`},
+		{"key with space", "emitter addr = 1", `invalid key "emitter addr"`},
+		{"table", "[server]\naddr = 1", `:1: expected key = value`},
+		{"quoted key", `"addr" = 1`, "invalid key"},
+		{"set twice", "a = 1\n# comment\na = 2", ":3: a set twice"},
+		{"unterminated string", `a = "open`, `:1: a: invalid string "open`},
+		{"text after string", `a = "x" y`, `unexpected "y" after string`},
+		{"missing value", "a =", ":1: a: missing value"},
+		{"only comment", "a = # nothing", "a: missing value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeFile(t, tt.content)
+			values, err := ReadFile(path)
+			if err == nil {
+				t.Fatalf("read %q, want an error", values)
+			}
+			if !strings.Contains(err.Error(), tt.err) || !strings.HasPrefix(err.Error(), path) {
+				t.Errorf("error %q, want %q after the path", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestReadFileMissing(t *testing.T) {
+	if _, err := ReadFile(filepath.Join(t.TempDir(), "missing.toml")); err == nil {
+		t.Fatal("read a missing file")
+	}
+}
@@ -0,0 +1,213 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Settings loads a program's configuration from, in increasing order of
+// precedence: defaults, an optional config file (see ReadFile), environment
+// variables and command-line flags.
+//
+// Each setting is named by its environment variable. Its file key is that name
+// in lower case without the program prefix, and its flag is the file key with
+// dashes: DISTRIBUTOR_ACK_TIMEOUT_SECONDS is ack_timeout_seconds in the file and
+// -ack-timeout-seconds on the command line.
+type Settings struct {
+	prefix     string
+	flags      *flag.FlagSet
+	configPath string
+	settings   []*setting
+}
+
+type setting struct {
+	env        string
+	key        string
+	deprecated []string // Older environment variables read when env is unset
+	flag       *flagValue
+	parse      func(string) error
+}
+
+// flagValue records the raw text of a flag so it can be applied after the
+// file and environment
+type flagValue struct {
+	value  string
+	set    bool
+	isBool bool
+}
+
+func (f *flagValue) String() string   { return f.value }
+func (f *flagValue) IsBoolFlag() bool { return f.isBool }
+
+func (f *flagValue) Set(s string) error {
+	f.value = s
+	f.set = true
+	return nil
+}
+
+// NewSettings creates an empty set of settings for a program whose environment
+// variables start with prefix. The config file is given with -config or the
+// <prefix>CONFIG environment variable.
+func NewSettings(name, prefix string) *Settings {
+	s := &Settings{
+		prefix: prefix,
+		flags:  flag.NewFlagSet(name, flag.ContinueOnError),
+	}
+	s.flags.StringVar(&s.configPath, "config", "", "Path of a config file (env "+prefix+"CONFIG)")
+	s.flags.Usage = func() {
+		fmt.Fprintf(s.flags.Output(), "Usage of %s:\n", name)
+		fmt.Fprintf(s.flags.Output(), "Flags override environment variables, which override the config file.\n")
+		s.flags.PrintDefaults()
+	}
+	return s
+}
+
+// String registers a string setting
+func (s *Settings) String(p *string, env, def, usage string) {
+	*p = def
+	s.add(env, usage, fmt.Sprintf("%q", def), false, func(v string) error {
+		*p = v
+		return nil
+	})
+}
+
+// Int registers an integer setting
+func (s *Settings) Int(p *int, env string, def int, usage string) {
+	*p = def
+	s.add(env, usage, strconv.Itoa(def), false, func(v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", v)
+		}
+		*p = n
+		return nil
+	})
+}
+
+// Bool registers a boolean setting
+func (s *Settings) Bool(p *bool, env string, def bool, usage string) {
+	*p = def
+	s.add(env, usage, strconv.FormatBool(def), true, func(v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", v)
+		}
+		*p = b
+		return nil
+	})
+}
+
+// Duration registers a duration setting. A bare number is taken in unit, so
+// existing _SECONDS and _MS variables keep working; values like "1m30s" are
+// accepted too.
+func (s *Settings) Duration(p *time.Duration, env string, def, unit time.Duration, usage string) {
+	*p = def
+	s.add(env, usage, def.String(), false, func(v string) error {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			*p = time.Duration(n) * unit
+			return nil
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration", v)
+		}
+		*p = d
+		return nil
+	})
+}
+
+// Deprecate accepts old as an older name of the environment variable env,
+// read with a warning when env itself is not set
+func (s *Settings) Deprecate(env, old string) {
+	for _, st := range s.settings {
+		if st.env == env {
+			st.deprecated = append(st.deprecated, old)
+			return
+		}
+	}
+	panic("config: no setting " + env)
+}
+
+func (s *Settings) add(env, usage, def string, isBool bool, parse func(string) error) {
+	key := strings.ToLower(strings.TrimPrefix(env, s.prefix))
+	st := &setting{
+		env:   env,
+		key:   key,
+		flag:  &flagValue{isBool: isBool},
+		parse: parse,
+	}
+	s.flags.Var(st.flag, strings.ReplaceAll(key, "_", "-"), fmt.Sprintf("%s (env %s, default %s)", usage, env, def))
+	s.settings = append(s.settings, st)
+}
+
+// Load parses args (without the program name) and applies the config file, the
+// environment and the flags. Every invalid value is reported, not just the first.
+func (s *Settings) Load(args []string) error {
+	if err := s.flags.Parse(args); err != nil {
+		return err
+	}
+	if s.flags.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q", s.flags.Arg(0))
+	}
+
+	path := s.configPath
+	if path == "" {
+		path = os.Getenv(s.prefix + "CONFIG")
+	}
+	var file map[string]string
+	if path != "" {
+		var err error
+		if file, err = ReadFile(path); err != nil {
+			return err
+		}
+	}
+
+	var errs []error
+	known := make(map[string]bool, len(s.settings))
+	for _, st := range s.settings {
+		known[st.key] = true
+		if v, ok := file[st.key]; ok {
+			if err := st.parse(v); err != nil {
+				errs = append(errs, fmt.Errorf("%s in %s: %w", st.key, path, err))
+			}
+		}
+		env, v := st.env, os.Getenv(st.env)
+		for _, old := range st.deprecated {
+			if v != "" {
+				break
+			}
+			if v = os.Getenv(old); v != "" {
+				env = old
+				log.Printf("%s is deprecated, use %s", old, st.env)
+			}
+		}
+		if v != "" {
+			if err := st.parse(v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", env, err))
+			}
+		}
+		if st.flag.set {
+			if err := st.parse(st.flag.value); err != nil {
+				errs = append(errs, fmt.Errorf("-%s: %w", strings.ReplaceAll(st.key, "_", "-"), err))
+			}
+		}
+	}
+	var unknown []string
+	for key := range file {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		errs = append(errs, fmt.Errorf("unknown setting %s in %s", key, path))
+	}
+	return errors.Join(errs...)
+}
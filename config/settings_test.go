@@ -0,0 +1,171 @@
+package config
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSettings are the settings of a program using every kind of setting
+type testSettings struct {
+	addr    string
+	size    int
+	timeout time.Duration
+	stamp   bool
+	enabled bool
+}
+
+// newTestSettings registers testSettings under the TEST_ prefix
+func newTestSettings() (*Settings, *testSettings) {
+	s := NewSettings("test", "TEST_")
+	c := &testSettings{}
+	s.String(&c.addr, "TEST_ADDR", ":8080", "Address")
+	s.Int(&c.size, "TEST_SIZE", 10, "Size")
+	s.Duration(&c.timeout, "TEST_TIMEOUT_MS", time.Second, time.Millisecond, "Timeout")
+	s.Bool(&c.stamp, "TEST_STAMP", false, "Stamp")
+	s.Bool(&c.enabled, "TEST_METRICS_ENABLED", false, "Metrics")
+	s.Deprecate("TEST_METRICS_ENABLED", "METRICS_ENABLED")
+	s.flags.SetOutput(io.Discard)
+	return s, c
+}
+
+func TestSettingsDefaults(t *testing.T) {
+	s, c := newTestSettings()
+	if err := s.Load(nil); err != nil {
+		t.Fatal(err)
+	}
+	want := testSettings{addr: ":8080", size: 10, timeout: time.Second}
+	if *c != want {
+		t.Errorf("loaded %+v, want the defaults %+v", *c, want)
+	}
+}
+
+// Each source overrides the one before: defaults, file, environment, flags
+func TestSettingsPrecedence(t *testing.T) {
+	path := writeFile(t, `
+addr = ":1"
+size = 1
+timeout_ms = 1
+`)
+	t.Setenv("TEST_SIZE", "2")
+	t.Setenv("TEST_TIMEOUT_MS", "2")
+
+	s, c := newTestSettings()
+	if err := s.Load([]string{"-config", path, "-timeout-ms", "3s", "-stamp"}); err != nil {
+		t.Fatal(err)
+	}
+	want := testSettings{addr: ":1", size: 2, timeout: 3 * time.Second, stamp: true}
+	if *c != want {
+		t.Errorf("loaded %+v, want %+v", *c, want)
+	}
+}
+
+// The config file can be named by the environment instead of -config
+func TestSettingsConfigFromEnv(t *testing.T) {
+	t.Setenv("TEST_CONFIG", writeFile(t, "size = 5"))
+	s, c := newTestSettings()
+	if err := s.Load(nil); err != nil {
+		t.Fatal(err)
+	}
+	if c.size != 5 {
+		t.Errorf("size %d, want 5 from the file", c.size)
+	}
+}
+
+func TestSettingsDurationUnits(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"250":   250 * time.Millisecond,
+		"1m30s": 90 * time.Second,
+		"0":     0,
+	} {
+		t.Setenv("TEST_TIMEOUT_MS", value)
+		s, c := newTestSettings()
+		if err := s.Load(nil); err != nil {
+			t.Fatal(err)
+		}
+		if c.timeout != want {
+			t.Errorf("%q loaded as %v, want %v", value, c.timeout, want)
+		}
+	}
+}
+
+// Every invalid value is reported, each naming where it came from
+func TestSettingsReportsEveryError(t *testing.T) {
+	path := writeFile(t, `
+size = "big"
+unknown_b = 1
+unknown_a = 1
+`)
+	t.Setenv("TEST_TIMEOUT_MS", "soon")
+	t.Setenv("TEST_STAMP", "maybe")
+
+	s, _ := newTestSettings()
+	err := s.Load([]string{"-config", path, "-size", "x"})
+	if err == nil {
+		t.Fatal("invalid settings loaded")
+	}
+	for _, want := range []string{
+		`size in ` + path + `: "big" is not an integer`,
+		`TEST_TIMEOUT_MS: "soon" is not a duration`,
+		`TEST_STAMP: "maybe" is not a boolean`,
+		`-size: "x" is not an integer`,
+		"unknown setting unknown_a in " + path + "\nunknown setting unknown_b",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not report %q", err, want)
+		}
+	}
+}
+
+func TestSettingsRejectsArguments(t *testing.T) {
+	s, _ := newTestSettings()
+	if err := s.Load([]string{"-size", "1", "extra"}); err == nil || !strings.Contains(err.Error(), `"extra"`) {
+		t.Errorf("error %v, want the unexpected argument reported", err)
+	}
+	s, _ = newTestSettings()
+	if err := s.Load([]string{"-no-such-flag"}); err == nil {
+		t.Error("unknown flag accepted")
+	}
+}
+
+// A deprecated name is read with a warning while the current one is unset
+func TestSettingsDeprecatedName(t *testing.T) {
+	var out bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&out)
+
+	t.Setenv("METRICS_ENABLED", "true")
+	s, c := newTestSettings()
+	if err := s.Load(nil); err != nil {
+		t.Fatal(err)
+	}
+	if !c.enabled {
+		t.Error("deprecated METRICS_ENABLED not read")
+	}
+	if !strings.Contains(out.String(), "METRICS_ENABLED is deprecated, use TEST_METRICS_ENABLED") {
+		t.Errorf("logged %q, want a deprecation warning", out.String())
+	}
+
+	out.Reset()
+	t.Setenv("TEST_METRICS_ENABLED", "false")
+	s, c = newTestSettings()
+	if err := s.Load(nil); err != nil {
+		t.Fatal(err)
+	}
+	if c.enabled || out.Len() > 0 {
+		t.Errorf("enabled %v, logged %q, want the current name to win silently", c.enabled, out.String())
+	}
+}
+
+func TestDeprecateUnknownSettingPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("deprecating an unknown setting did not panic")
+		}
+	}()
+	s, _ := newTestSettings()
+	s.Deprecate("TEST_NONE", "NONE")
+}
@@ -0,0 +1,69 @@
+// Package auth decides which emitters and analyzers may connect to the
+// distributor and what they may do once connected.
+package auth
+
+import (
+	"errors"
+
+	"log-distributor/internal/protocol"
+)
+
+// Role is the kind of client connecting
+type Role string
+
+const (
+	RoleEmitter  Role = "emitter"
+	RoleAnalyzer Role = "analyzer"
+)
+
+// ParseRole returns the role named s
+func ParseRole(s string) (Role, error) {
+	switch Role(s) {
+	case RoleEmitter, RoleAnalyzer:
+		return Role(s), nil
+	}
+	return "", errors.New("unknown role " + s + ", must be emitter or analyzer")
+}
+
+var (
+	ErrNoToken      = errors.New("no token presented")
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token expired")
+)
+
+// Authenticator checks the credentials a client presents in its hello
+type Authenticator interface {
+	// Authenticate returns the client ID that token proves for role
+	Authenticate(role Role, token []byte) (string, error)
+}
+
+// Authorizer decides what an authenticated client may do
+type Authorizer interface {
+	// AllowEmitter reports whether the emitter may publish messages
+	AllowEmitter(id string) bool
+	// AnalyzerPriorities returns the priorities the analyzer may receive, and
+	// false if it may not connect at all
+	AnalyzerPriorities(id string) (protocol.PrioritySet, bool)
+}
+
+// Chain tries each authenticator in turn, accepting the first ID one proves
+type Chain []Authenticator
+
+// Authenticate returns the ID from the first authenticator accepting token, or
+// the most specific error if none does
+func (c Chain) Authenticate(role Role, token []byte) (string, error) {
+	err := ErrInvalidToken
+	if len(token) == 0 {
+		err = ErrNoToken
+	}
+	for _, a := range c {
+		id, aErr := a.Authenticate(role, token)
+		if aErr == nil {
+			return id, nil
+		}
+		if errors.Is(aErr, ErrExpiredToken) {
+			err = aErr
+		}
+	}
+	return "", err
+}
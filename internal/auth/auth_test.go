@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTokens writes a token file and returns its path
+func writeTokens(t *testing.T, tokens string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(path, []byte(tokens), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTokenFileAuthenticate(t *testing.T) {
+	tf, err := NewTokenFile(writeTokens(t, `
+# role     id          token
+analyzer   analyzer-1  a-token
+emitter    emitter-1   e-token
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		role   Role
+		token  string
+		wantID string
+		err    error
+	}{
+		{RoleAnalyzer, "a-token", "analyzer-1", nil},
+		{RoleEmitter, "e-token", "emitter-1", nil},
+		{RoleEmitter, "a-token", "", ErrInvalidToken},
+		{RoleAnalyzer, "unknown", "", ErrInvalidToken},
+		{RoleAnalyzer, "", "", ErrNoToken},
+	}
+	for _, tt := range tests {
+		id, err := tf.Authenticate(tt.role, []byte(tt.token))
+		if id != tt.wantID || !errors.Is(err, tt.err) || (tt.err == nil) != (err == nil) {
+			t.Errorf("%s %q: got %q, %v; want %q, %v", tt.role, tt.token, id, err, tt.wantID, tt.err)
+		}
+	}
+}
+
+func TestTokenFileRejectsInvalid(t *testing.T) {
+	for name, tokens := range map[string]string{
+		"missing field": "analyzer analyzer-1",
+		"unknown role":  "admin root token",
+		"listed twice":  "analyzer a1 same\nemitter e1 same",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewTokenFile(writeTokens(t, tokens)); err == nil {
+				t.Error("invalid token file loaded")
+			}
+		})
+	}
+}
+
+// staticAuthenticator returns the same result for every token
+type staticAuthenticator struct {
+	id  string
+	err error
+}
+
+func (a staticAuthenticator) Authenticate(role Role, token []byte) (string, error) {
+	return a.id, a.err
+}
+
+func TestChainAuthenticate(t *testing.T) {
+	invalid := staticAuthenticator{err: ErrInvalidToken}
+	expired := staticAuthenticator{err: ErrExpiredToken}
+	other := staticAuthenticator{err: errors.New("secret unreadable")}
+
+	tests := []struct {
+		name   string
+		chain  Chain
+		token  string
+		wantID string
+		err    error
+	}{
+		{"first accepting", Chain{invalid, staticAuthenticator{id: "a"}, staticAuthenticator{id: "b"}}, "t", "a", nil},
+		{"expired over invalid", Chain{invalid, expired, invalid}, "t", "", ErrExpiredToken},
+		{"invalid over other errors", Chain{other}, "t", "", ErrInvalidToken},
+		{"no token", Chain{invalid}, "", "", ErrNoToken},
+		{"expired over no token", Chain{expired}, "", "", ErrExpiredToken},
+		{"empty chain", Chain{}, "t", "", ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := tt.chain.Authenticate(RoleEmitter, []byte(tt.token))
+			if id != tt.wantID || !errors.Is(err, tt.err) || (tt.err == nil) != (err == nil) {
+				t.Errorf("got %q, %v; want %q, %v", id, err, tt.wantID, tt.err)
+			}
+		})
+	}
+}
+
+// A token file and HMAC secret chained accept the tokens of either
+func TestChainOfTokenFileAndHMAC(t *testing.T) {
+	tf, err := NewTokenFile(writeTokens(t, "emitter static-1 static-token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewHMAC(writeSecret(t, t.TempDir(), testSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := Chain{tf, h}
+
+	if id, err := chain.Authenticate(RoleEmitter, []byte("static-token")); id != "static-1" || err != nil {
+		t.Errorf("static token: %q, %v", id, err)
+	}
+	token := signed(t, testSecret, RoleEmitter, "signed-1", time.Now().Add(time.Hour))
+	if id, err := chain.Authenticate(RoleEmitter, token); id != "signed-1" || err != nil {
+		t.Errorf("signed token: %q, %v", id, err)
+	}
+	token = signed(t, testSecret, RoleEmitter, "signed-1", time.Now().Add(-time.Hour))
+	if _, err := chain.Authenticate(RoleEmitter, token); !errors.Is(err, ErrExpiredToken) {
+		t.Errorf("expired token: %v, want %v", err, ErrExpiredToken)
+	}
+}
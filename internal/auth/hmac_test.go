@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeSecret writes an HMAC secret file and returns its path
+func writeSecret(t *testing.T, dir, secret string) string {
+	t.Helper()
+	path := filepath.Join(dir, "secret")
+	if err := os.WriteFile(path, []byte(secret), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// signed returns a token signed with secret, failing the test on error
+func signed(t *testing.T, secret string, role Role, id string, expiry time.Time) []byte {
+	t.Helper()
+	token, err := SignToken([]byte(secret), role, id, expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []byte(token)
+}
+
+const testSecret = "0123456789abcdef-secret"
+
+func TestHMACAuthenticate(t *testing.T) {
+	h, err := NewHMAC(writeSecret(t, t.TempDir(), testSecret+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hour := time.Now().Add(time.Hour)
+	valid := signed(t, testSecret, RoleAnalyzer, "analyzer-1", hour)
+	payload, sig, _ := strings.Cut(string(valid), ".")
+	tampered := []byte(payload + "." + strings.Repeat("A", len(sig)))
+	forged := base64.RawURLEncoding.EncodeToString([]byte("analyzer:9999999999:admin")) + "." + sig
+
+	tests := []struct {
+		name   string
+		role   Role
+		token  []byte
+		wantID string
+		err    error
+	}{
+		{"valid", RoleAnalyzer, valid, "analyzer-1", nil},
+		{"ID with colons", RoleEmitter, signed(t, testSecret, RoleEmitter, "host:app:1", hour), "host:app:1", nil},
+		{"no token", RoleAnalyzer, nil, "", ErrNoToken},
+		{"tampered signature", RoleAnalyzer, tampered, "", ErrInvalidToken},
+		{"payload of another token", RoleAnalyzer, []byte(forged), "", ErrInvalidToken},
+		{"other secret", RoleAnalyzer, signed(t, "another secret of length", RoleAnalyzer, "analyzer-1", hour), "", ErrInvalidToken},
+		{"wrong role", RoleEmitter, valid, "", ErrInvalidToken},
+		{"expired", RoleAnalyzer, signed(t, testSecret, RoleAnalyzer, "analyzer-1", time.Now().Add(-time.Second)), "", ErrExpiredToken},
+		{"no signature", RoleAnalyzer, []byte(payload), "", ErrInvalidToken},
+		{"not base64", RoleAnalyzer, []byte("!!." + sig), "", ErrInvalidToken},
+		{"static token", RoleAnalyzer, []byte("3f9c2a"), "", ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := h.Authenticate(tt.role, tt.token)
+			if id != tt.wantID || !errors.Is(err, tt.err) || (tt.err == nil) != (err == nil) {
+				t.Errorf("got %q, %v; want %q, %v", id, err, tt.wantID, tt.err)
+			}
+		})
+	}
+}
+
+func TestSignTokenRejectsEmptyID(t *testing.T) {
+	if token, err := SignToken([]byte(testSecret), RoleEmitter, "", time.Now().Add(time.Hour)); err == nil {
+		t.Errorf("signed %q for an empty ID", token)
+	}
+}
+
+// A reload switches to the new secret, and a failed one keeps the old
+func TestHMACReload(t *testing.T) {
+	dir := t.TempDir()
+	path := writeSecret(t, dir, testSecret)
+	h, err := NewHMAC(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hour := time.Now().Add(time.Hour)
+	oldToken := signed(t, testSecret, RoleEmitter, "e1", hour)
+	newSecret := "fedcba9876543210-rotated"
+	newToken := signed(t, newSecret, RoleEmitter, "e1", hour)
+
+	writeSecret(t, dir, "too short")
+	if err := h.Reload(); err == nil {
+		t.Fatal("short secret loaded")
+	}
+	if _, err := h.Authenticate(RoleEmitter, oldToken); err != nil {
+		t.Errorf("old secret dropped by a failed reload: %v", err)
+	}
+
+	writeSecret(t, dir, newSecret)
+	if err := h.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Authenticate(RoleEmitter, oldToken); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("token of the old secret: %v, want it invalid", err)
+	}
+	if id, err := h.Authenticate(RoleEmitter, newToken); id != "e1" || err != nil {
+		t.Errorf("token of the new secret: %q, %v", id, err)
+	}
+}
+
+func TestNewHMACRejectsShortSecret(t *testing.T) {
+	if _, err := NewHMAC(writeSecret(t, t.TempDir(), "  short secret \n")); err == nil {
+		t.Error("secret below the minimum length accepted")
+	}
+}
@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync/atomic"
+
+	"log-distributor/internal/protocol"
+)
+
+// Policy lists which emitters may publish and which priorities each analyzer
+// may receive. It is read from JSON:
+//
+//	{
+//	  "emitters": ["emitter-*", "dlq-replay"],
+//	  "analyzers": [
+//	    {"id": "audit-*", "priorities": "0-9"},
+//	    {"id": "analyzer-*"}
+//	  ]
+//	}
+//
+// IDs are matched as path.Match patterns and the first matching analyzer rule
+// applies; a rule without priorities allows all of them. Leaving out a list
+// allows every client of that role, while an empty list allows none.
+type Policy struct {
+	Emitters  []string       `json:"emitters"`
+	Analyzers []AnalyzerRule `json:"analyzers"`
+}
+
+// AnalyzerRule grants the analyzers matching ID a set of priorities
+type AnalyzerRule struct {
+	ID         string `json:"id"`
+	Priorities string `json:"priorities,omitempty"`
+
+	priorities protocol.PrioritySet
+}
+
+// PolicyFile is a Policy loaded from a file that can be reloaded. Reloads apply
+// to connections made afterwards.
+type PolicyFile struct {
+	path   string
+	policy atomic.Pointer[Policy]
+}
+
+// NewPolicyFile loads the policy in path
+func NewPolicyFile(path string) (*PolicyFile, error) {
+	pf := &PolicyFile{path: path}
+	if err := pf.Reload(); err != nil {
+		return nil, err
+	}
+	return pf, nil
+}
+
+// Reload reads the policy again. On error the previous policy stays in use.
+func (pf *PolicyFile) Reload() error {
+	data, err := os.ReadFile(pf.path)
+	if err != nil {
+		return fmt.Errorf("failed to read policy file: %w", err)
+	}
+	policy := &Policy{}
+	if err := json.Unmarshal(data, policy); err != nil {
+		return fmt.Errorf("failed to parse policy file %s: %w", pf.path, err)
+	}
+	if err := policy.compile(); err != nil {
+		return fmt.Errorf("invalid policy file %s: %w", pf.path, err)
+	}
+	pf.policy.Store(policy)
+	return nil
+}
+
+// AllowEmitter reports whether the emitter may publish messages
+func (pf *PolicyFile) AllowEmitter(id string) bool {
+	return pf.policy.Load().AllowEmitter(id)
+}
+
+// AnalyzerPriorities returns the priorities the analyzer may receive
+func (pf *PolicyFile) AnalyzerPriorities(id string) (protocol.PrioritySet, bool) {
+	return pf.policy.Load().AnalyzerPriorities(id)
+}
+
+// compile checks the patterns and parses the priority ranges
+func (p *Policy) compile() error {
+	for _, pattern := range p.Emitters {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("emitter pattern %q: %w", pattern, err)
+		}
+	}
+	for i := range p.Analyzers {
+		rule := &p.Analyzers[i]
+		if _, err := path.Match(rule.ID, ""); err != nil {
+			return fmt.Errorf("analyzer pattern %q: %w", rule.ID, err)
+		}
+		rule.priorities = protocol.AllPriorities()
+		if rule.Priorities != "" {
+			set, err := protocol.ParsePrioritySet(rule.Priorities)
+			if err != nil {
+				return fmt.Errorf("analyzer rule %q: %w", rule.ID, err)
+			}
+			rule.priorities = set
+		}
+	}
+	return nil
+}
+
+// AllowEmitter reports whether the emitter may publish messages
+func (p *Policy) AllowEmitter(id string) bool {
+	if p.Emitters == nil {
+		return true
+	}
+	for _, pattern := range p.Emitters {
+		if ok, _ := path.Match(pattern, id); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// AnalyzerPriorities returns the priorities of the first rule matching the
+// analyzer, and false if none does
+func (p *Policy) AnalyzerPriorities(id string) (protocol.PrioritySet, bool) {
+	if p.Analyzers == nil {
+		return protocol.AllPriorities(), true
+	}
+	for _, rule := range p.Analyzers {
+		if ok, _ := path.Match(rule.ID, id); ok {
+			return rule.priorities, true
+		}
+	}
+	return protocol.PrioritySet{}, false
+}
@@ -0,0 +1,123 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"log-distributor/internal/protocol"
+)
+
+// writePolicy writes a policy file and returns its path
+func writePolicy(t *testing.T, dir, policy string) string {
+	t.Helper()
+	path := filepath.Join(dir, "policy.json")
+	if err := os.WriteFile(path, []byte(policy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPolicyAllowEmitter(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		allowed []string
+		denied  []string
+	}{
+		{"no list allows all", `{}`, []string{"emitter-1", ""}, nil},
+		{"null list allows all", `{"emitters": null}`, []string{"emitter-1"}, nil},
+		{"empty list allows none", `{"emitters": []}`, nil, []string{"emitter-1", ""}},
+		{"patterns", `{"emitters": ["emitter-*", "dlq-replay"]}`, []string{"emitter-1", "dlq-replay"}, []string{"analyzer-1", "dlq-replay-2", "emitter-1/x"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pf, err := NewPolicyFile(writePolicy(t, t.TempDir(), tt.policy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, id := range tt.allowed {
+				if !pf.AllowEmitter(id) {
+					t.Errorf("emitter %q denied", id)
+				}
+			}
+			for _, id := range tt.denied {
+				if pf.AllowEmitter(id) {
+					t.Errorf("emitter %q allowed", id)
+				}
+			}
+		})
+	}
+}
+
+func TestPolicyAnalyzerPriorities(t *testing.T) {
+	audit := protocol.PrioritySet{}
+	audit.AddRange(0, 9)
+
+	tests := []struct {
+		name   string
+		policy string
+		id     string
+		want   protocol.PrioritySet
+		ok     bool
+	}{
+		{"no list allows all", `{}`, "analyzer-1", protocol.AllPriorities(), true},
+		{"empty list allows none", `{"analyzers": []}`, "analyzer-1", protocol.PrioritySet{}, false},
+		{"first match wins", `{"analyzers": [{"id": "audit-*", "priorities": "0-9"}, {"id": "*"}]}`, "audit-1", audit, true},
+		{"later match", `{"analyzers": [{"id": "audit-*", "priorities": "0-9"}, {"id": "*"}]}`, "analyzer-1", protocol.AllPriorities(), true},
+		{"earlier broad rule", `{"analyzers": [{"id": "*"}, {"id": "audit-*", "priorities": "0-9"}]}`, "audit-1", protocol.AllPriorities(), true},
+		{"no match", `{"analyzers": [{"id": "audit-*", "priorities": "0-9"}]}`, "analyzer-1", protocol.PrioritySet{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pf, err := NewPolicyFile(writePolicy(t, t.TempDir(), tt.policy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := pf.AnalyzerPriorities(tt.id)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("got %s, %v; want %s, %v", &got, ok, &tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestPolicyFileRejectsInvalid(t *testing.T) {
+	for name, policy := range map[string]string{
+		"not JSON":           `{"emitters": [`,
+		"bad pattern":        `{"emitters": ["emitter-["]}`,
+		"bad analyzer":       `{"analyzers": [{"id": "["}]}`,
+		"bad priority range": `{"analyzers": [{"id": "*", "priorities": "9-0"}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewPolicyFile(writePolicy(t, t.TempDir(), policy)); err == nil {
+				t.Error("invalid policy loaded")
+			}
+		})
+	}
+}
+
+// A failed reload keeps the policy in use
+func TestPolicyFileReload(t *testing.T) {
+	dir := t.TempDir()
+	pf, err := NewPolicyFile(writePolicy(t, dir, `{"emitters": ["a"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writePolicy(t, dir, `{"emitters": [`)
+	if err := pf.Reload(); err == nil {
+		t.Fatal("invalid policy loaded")
+	}
+	if !pf.AllowEmitter("a") {
+		t.Error("policy lost by a failed reload")
+	}
+
+	writePolicy(t, dir, `{"emitters": ["b"]}`)
+	if err := pf.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if pf.AllowEmitter("a") || !pf.AllowEmitter("b") {
+		t.Error("reloaded policy not applied")
+	}
+}
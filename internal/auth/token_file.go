@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// TokenFile authenticates clients against a file of static tokens, one per line:
+//
+//	# role     id          token
+//	analyzer   analyzer-1  3f9c2a...
+//	emitter    emitter-1   b71e04...
+//
+// A token only proves the ID it is listed with, and only for its role.
+type TokenFile struct {
+	path   string
+	tokens atomic.Pointer[map[[sha256.Size]byte]principal]
+}
+
+// principal is the client a token belongs to
+type principal struct {
+	role Role
+	id   string
+}
+
+// NewTokenFile loads the tokens in path
+func NewTokenFile(path string) (*TokenFile, error) {
+	tf := &TokenFile{path: path}
+	if err := tf.Reload(); err != nil {
+		return nil, err
+	}
+	return tf, nil
+}
+
+// Reload reads the token file again. On error the previous tokens stay in use.
+func (tf *TokenFile) Reload() error {
+	f, err := os.Open(tf.path)
+	if err != nil {
+		return fmt.Errorf("failed to open token file: %w", err)
+	}
+	defer f.Close()
+
+	// Tokens are looked up by hash so the lookup time says nothing about them
+	tokens := make(map[[sha256.Size]byte]principal)
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return fmt.Errorf("%s:%d: expected role, id and token", tf.path, lineNum)
+		}
+		role, err := ParseRole(fields[0])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", tf.path, lineNum, err)
+		}
+		key := sha256.Sum256([]byte(fields[2]))
+		if _, dup := tokens[key]; dup {
+			return fmt.Errorf("%s:%d: token listed twice", tf.path, lineNum)
+		}
+		tokens[key] = principal{role: role, id: fields[1]}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read token file: %w", err)
+	}
+
+	tf.tokens.Store(&tokens)
+	return nil
+}
+
+// Authenticate returns the ID token is listed with for role
+func (tf *TokenFile) Authenticate(role Role, token []byte) (string, error) {
+	if len(token) == 0 {
+		return "", ErrNoToken
+	}
+	p, ok := (*tf.tokens.Load())[sha256.Sum256(token)]
+	if !ok || p.role != role {
+		return "", ErrInvalidToken
+	}
+	return p.id, nil
+}
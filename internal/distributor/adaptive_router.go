@@ -0,0 +1,140 @@
+package distributor
+
+import (
+	"math/rand"
+	"sort"
+	"sync/atomic"
+
+	"log-distributor/internal/metrics"
+)
+
+// AdaptiveRouter implements RouterInterface with weighted power-of-two-choices:
+// it samples two analyzers by weight and routes to the one expected to get
+// through the message soonest. An analyzer's cost is its outstanding messages
+// (pending acknowledgement plus queued at the message's priority) times
+// its average ACK latency, divided by its weight. A straggler's cost grows as
+// its queues back up and its ACKs slow down, so traffic shifts to the other
+// analyzers well before its queue fills. Routing is O(log n) in the analyzers
+// accepting the priority.
+type AdaptiveRouter struct {
+	routerBase
+	table atomic.Pointer[adaptiveTable]
+}
+
+// adaptiveTable holds the analyzers each priority is routed over. Priorities
+// routed to the same analyzers share one slice.
+type adaptiveTable struct {
+	nodes [256][]adaptiveNode // nil where no analyzer accepts the priority
+}
+
+// adaptiveNode is an analyzer as seen by the adaptive router
+type adaptiveNode struct {
+	config    *AnalyzerConfig
+	weight    float64
+	cumWeight float64 // Weight of this and every earlier node
+	routed    *metrics.Counter
+}
+
+// NewAdaptiveRouter creates a new load-aware router
+func NewAdaptiveRouter() *AdaptiveRouter {
+	ar := &AdaptiveRouter{}
+	ar.init(ar.rebuildTable)
+	ar.table.Store(&adaptiveTable{})
+	return ar
+}
+
+// RouteMessage routes a message to the less loaded of two analyzers sampled by
+// weight, trying the other one when it has no room
+func (ar *AdaptiveRouter) RouteMessage(msg LogMessage) bool {
+	return ar.route(msg, ar.tryRoute)
+}
+
+// tryRoute queues msg at the cheaper of two sampled analyzers, then at the
+// other, then at any analyzer with room
+func (ar *AdaptiveRouter) tryRoute(msg LogMessage) (bool, *AnalyzerConfig, DropReason) {
+	priority := msg.GetPriority()
+	nodes := ar.table.Load().nodes[priority]
+	if nodes == nil {
+		return false, nil, ar.noRouteReason()
+	}
+
+	// The first sample is where weights alone would send the message; taking
+	// the second instead is a diversion
+	weighted, other := sampleNode(nodes), sampleNode(nodes)
+	first, second := weighted, other
+	if other != weighted && other.cost(priority) < weighted.cost(priority) {
+		first, second = other, weighted
+	}
+	if first.send(msg, priority) {
+		if first != weighted {
+			adaptiveDiversions.Inc()
+		}
+		return true, nil, 0
+	}
+	if second.send(msg, priority) {
+		return true, nil, 0
+	}
+	for i := range nodes {
+		if nodes[i].send(msg, priority) {
+			return true, nil, 0
+		}
+	}
+	return false, first.config, first.config.queue.fullReason(msg)
+}
+
+// sampleNode picks an analyzer at random by weight
+func sampleNode(nodes []adaptiveNode) *adaptiveNode {
+	total := nodes[len(nodes)-1].cumWeight
+	sample := total * rand.Float64()
+	i := sort.Search(len(nodes), func(i int) bool { return nodes[i].cumWeight > sample })
+	return &nodes[min(i, len(nodes)-1)]
+}
+
+// cost estimates how long a message of a priority would take to be
+// acknowledged by the analyzer, relative to its weight
+func (node *adaptiveNode) cost(priority uint8) float64 {
+	outstanding := float64(node.config.load.pending.Load()) + float64(node.config.queue.slotLen(priority)) + 1
+	latency := max(node.config.load.averageAckLatency(), minAckLatency).Seconds()
+	return outstanding * latency / node.weight
+}
+
+// send queues msg for the analyzer, returning false if it has no room
+func (node *adaptiveNode) send(msg LogMessage, priority uint8) bool {
+	if !node.config.queue.push(priority, msg) {
+		return false
+	}
+	node.routed.Inc()
+	priorityRoutedCounter(priority).Inc()
+	return true
+}
+
+// rebuildTable builds the analyzer list of every priority class and publishes
+// them, with rebuildMutex held. Analyzers with zero weight are left out.
+func (ar *AdaptiveRouter) rebuildTable(classes [256]int, members [][]*AnalyzerConfig) {
+	lists := make([][]adaptiveNode, len(members))
+	for i, analyzers := range members {
+		var nodes []adaptiveNode
+		cumWeight := 0.0
+		for _, config := range analyzers {
+			if config.Weight <= 0 {
+				continue
+			}
+			cumWeight += float64(config.Weight)
+			nodes = append(nodes, adaptiveNode{
+				config:    config,
+				weight:    float64(config.Weight),
+				cumWeight: cumWeight,
+				routed:    config.routed,
+			})
+		}
+		lists[i] = nodes
+	}
+
+	table := &adaptiveTable{}
+	for p, class := range classes {
+		if class >= 0 && lists[class] != nil {
+			table.nodes[p] = lists[class]
+		}
+	}
+	ar.table.Store(table)
+}
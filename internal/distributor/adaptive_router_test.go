@@ -0,0 +1,40 @@
+package distributor
+
+import "testing"
+
+// A message only counts as diverted when it goes to another analyzer than the
+// one sampled by weight
+func TestAdaptiveRouterCountsOnlyDiversions(t *testing.T) {
+	loaded := &AnalyzerConfig{AnalyzerID: "loaded", Weight: 1}
+	loaded.queue.configure(0, 0, nil)
+	loaded.load.pending.Store(100)
+	full := &AnalyzerConfig{AnalyzerID: "full", Weight: 1} // Cheaper, but without room
+	full.queue.configure(0, 1, nil)
+
+	ar := NewAdaptiveRouter()
+	ar.RegisterAnalyzer(loaded)
+	ar.RegisterAnalyzer(full)
+
+	before := adaptiveDiversions.Value()
+	for range 100 {
+		if !ar.RouteMessage(ByteSliceMessage(dataFrame(1, "x"))) {
+			t.Fatal("message not routed")
+		}
+	}
+	if n := loaded.queue.len(); n != 100 {
+		t.Errorf("loaded analyzer queued %d, want all 100", n)
+	}
+	if n := adaptiveDiversions.Value() - before; n != 0 {
+		t.Errorf("counted %d diversions, want none as every message went where its weight sent it or fell back", n)
+	}
+
+	// With room the cheaper analyzer takes the messages weighted to the other
+	full.queue.configure(0, 0, nil)
+	before = adaptiveDiversions.Value()
+	for range 100 {
+		ar.RouteMessage(ByteSliceMessage(dataFrame(1, "x")))
+	}
+	if n := adaptiveDiversions.Value() - before; n == 0 || n > uint64(full.queue.len()) {
+		t.Errorf("counted %d diversions, want some and at most the %d messages the cheaper analyzer took", n, full.queue.len())
+	}
+}
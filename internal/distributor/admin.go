@@ -0,0 +1,136 @@
+package distributor
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// AdminAPI serves the operator HTTP API for inspecting and managing analyzers
+// and emitters:
+//
+//	GET    /analyzers               list analyzer sessions
+//	GET    /analyzers/{id}          show one analyzer session
+//	PUT    /analyzers/{id}/weight   pin the weight, body {"weight": 0.5}
+//	DELETE /analyzers/{id}/weight   return to the weight the analyzer asked for
+//	POST   /analyzers/{id}/drain    stop routing to the analyzer, deliver what is queued
+//	DELETE /analyzers/{id}/drain    route to the analyzer again
+//	POST   /analyzers/{id}/disconnect  close the connection and reroute its messages
+//	GET    /emitters                list emitter connections
+type AdminAPI struct {
+	analyzers *AnalyzerServer
+	emitters  *EmitterServer
+	token     string // Bearer token required on every request, empty for none
+	mux       *http.ServeMux
+}
+
+// NewAdminAPI creates the admin API for the given servers
+func NewAdminAPI(analyzers *AnalyzerServer, emitters *EmitterServer, token string) *AdminAPI {
+	api := &AdminAPI{
+		analyzers: analyzers,
+		emitters:  emitters,
+		token:     token,
+		mux:       http.NewServeMux(),
+	}
+
+	api.mux.HandleFunc("GET /analyzers", api.listAnalyzers)
+	api.mux.HandleFunc("GET /analyzers/{id}", api.getAnalyzer)
+	api.mux.HandleFunc("PUT /analyzers/{id}/weight", api.setWeight)
+	api.mux.HandleFunc("DELETE /analyzers/{id}/weight", api.analyzerAction(analyzers.ClearWeightOverride))
+	api.mux.HandleFunc("POST /analyzers/{id}/drain", api.analyzerAction(analyzers.Drain))
+	api.mux.HandleFunc("DELETE /analyzers/{id}/drain", api.analyzerAction(analyzers.Undrain))
+	api.mux.HandleFunc("POST /analyzers/{id}/disconnect", api.analyzerAction(analyzers.Disconnect))
+	api.mux.HandleFunc("GET /emitters", api.listEmitters)
+	return api
+}
+
+// ServeHTTP checks the bearer token and dispatches the request
+func (api *AdminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if api.token != "" {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(api.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid bearer token"))
+			return
+		}
+	}
+	api.mux.ServeHTTP(w, r)
+}
+
+func (api *AdminAPI) listAnalyzers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, api.analyzers.Analyzers())
+}
+
+func (api *AdminAPI) getAnalyzer(w http.ResponseWriter, r *http.Request) {
+	status, err := api.analyzers.Analyzer(r.PathValue("id"))
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (api *AdminAPI) setWeight(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Weight *float32 `json:"weight"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Weight == nil {
+		writeError(w, http.StatusBadRequest, errors.New(`body must be {"weight": <number>}`))
+		return
+	}
+
+	id := r.PathValue("id")
+	if err := api.analyzers.SetWeightOverride(id, *body.Weight); err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	api.getAnalyzer(w, r)
+}
+
+// analyzerAction adapts an AnalyzerServer operation to a handler that responds
+// with the analyzer's status afterwards
+func (api *AdminAPI) analyzerAction(action func(id string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if err := action(id); err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		status, err := api.analyzers.Analyzer(id)
+		if err != nil {
+			// A disconnected analyzer without a session is gone from the registry
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	}
+}
+
+func (api *AdminAPI) listEmitters(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, api.emitters.Emitters())
+}
+
+// errorStatus maps an AnalyzerServer error to an HTTP status code
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrAnalyzerNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrAnalyzerNotConnected), errors.Is(err, ErrAnalyzerLeaving):
+		return http.StatusConflict
+	case errors.Is(err, ErrInvalidWeight):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": fmt.Sprint(err)})
+}
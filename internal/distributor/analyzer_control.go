@@ -0,0 +1,311 @@
+package distributor
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"sort"
+	"time"
+
+	"log-distributor/internal/protocol"
+)
+
+var (
+	ErrAnalyzerNotFound     = errors.New("analyzer not found")
+	ErrAnalyzerNotConnected = errors.New("analyzer is not connected")
+	ErrInvalidWeight        = errors.New("weight must be a finite, non-negative number")
+	ErrAnalyzerLeaving      = errors.New("analyzer asked to drain and leave")
+)
+
+// Analyzer states reported by AnalyzerStatus
+const (
+	AnalyzerStateConnected = "connected" // Registered with the router
+	AnalyzerStateDraining  = "draining"  // Not routed to, still delivering queued messages
+	AnalyzerStateDrained   = "drained"   // Not routed to, nothing left to deliver
+	AnalyzerStateParked    = "parked"    // Disconnected, waiting for the analyzer to resume
+	AnalyzerStateClosing   = "closing"   // Disconnected, session being torn down
+)
+
+// AnalyzerStatus is a snapshot of an analyzer session
+type AnalyzerStatus struct {
+	ID             string        `json:"id"`
+	RemoteAddr     string        `json:"remote_addr"`
+	State          string        `json:"state"`
+	Features       uint32        `json:"features"`
+	Weight         float32       `json:"weight"`
+	ReportedWeight float32       `json:"reported_weight"`
+	WeightPinned   bool          `json:"weight_pinned"`
+	Priorities     string        `json:"priorities,omitempty"` // Priorities routed to the analyzer, empty for all
+	Group          string        `json:"group,omitempty"`      // Analyzer group when routing rules are in use
+	Leaving        bool          `json:"leaving"`              // Analyzer asked to drain and will be said goodbye
+	Pending        int           `json:"pending"`
+	AckLatencyMs   float64       `json:"ack_latency_ms"` // Moving average of the ACK latency
+	Queued         int           `json:"queued"`
+	Channels       map[uint8]int `json:"channels,omitempty"` // Queued messages per non-empty priority
+}
+
+// updateRegistration puts the analyzer in the router while it is connected and
+// not draining, and takes it out otherwise. Returns whether it is registered.
+func (ah *AnalyzerHandler) updateRegistration() bool {
+	ah.registrationMutex.Lock()
+	defer ah.registrationMutex.Unlock()
+
+	want := ah.isConnected.Load() && !ah.draining.Load()
+	if want != ah.registered {
+		if want {
+			ah.router.RegisterAnalyzer(ah.config)
+		} else {
+			ah.router.UnregisterAnalyzer(ah.config)
+		}
+		ah.registered = want
+	}
+	return ah.registered
+}
+
+// reportWeight applies a weight requested by the analyzer unless an operator
+// has pinned its weight
+func (ah *AnalyzerHandler) reportWeight(weight float32) {
+	ah.weightMutex.Lock()
+	defer ah.weightMutex.Unlock()
+
+	ah.reportedWeight = weight
+	if ah.weightPinned {
+		log.Printf("Analyzer %s asked for weight %.3f, keeping pinned weight %.3f", ah.config.AnalyzerID, weight, ah.config.Weight)
+		return
+	}
+	log.Printf("Analyzer %s updated weight from %.3f to %.3f", ah.config.AnalyzerID, ah.config.Weight, weight)
+	ah.router.UpdateWeight(ah.config, weight)
+}
+
+// pinWeight overrides the analyzer's weight until unpinWeight is called
+func (ah *AnalyzerHandler) pinWeight(weight float32) {
+	ah.weightMutex.Lock()
+	defer ah.weightMutex.Unlock()
+
+	ah.weightPinned = true
+	ah.router.UpdateWeight(ah.config, weight)
+}
+
+// unpinWeight returns to the weight the analyzer last asked for
+func (ah *AnalyzerHandler) unpinWeight() {
+	ah.weightMutex.Lock()
+	defer ah.weightMutex.Unlock()
+
+	ah.weightPinned = false
+	ah.router.UpdateWeight(ah.config, ah.reportedWeight)
+}
+
+// setDraining stops (or resumes) routing new messages to the analyzer.
+// Messages already queued for it are still delivered.
+func (ah *AnalyzerHandler) setDraining(draining bool) {
+	ah.draining.Store(draining)
+	ah.updateRegistration()
+}
+
+// leave handles a drain request from the analyzer: it is taken out of the router
+// and said goodbye to once everything queued for it has been acknowledged
+func (ah *AnalyzerHandler) leave() {
+	if ah.leaving.Swap(true) {
+		return
+	}
+	ah.setDraining(true)
+	log.Printf("Analyzer %s asked to leave, draining its queued messages", ah.config.AnalyzerID)
+	ah.config.queue.wake()
+}
+
+// isDrained reports whether nothing is queued for or pending on the analyzer
+func (ah *AnalyzerHandler) isDrained() bool {
+	ah.pendingMutex.RLock()
+	pending := ah.pendingQueue.Len()
+	ah.pendingMutex.RUnlock()
+	return pending == 0 && ah.config.queue.len() == 0
+}
+
+// sayGoodbye ends the connection of a drained analyzer that asked to leave.
+// Everything it received was acknowledged, so nothing is rerouted.
+func (ah *AnalyzerHandler) sayGoodbye(bufWriter *bufio.Writer) {
+	log.Printf("Analyzer %s drained, saying goodbye", ah.config.AnalyzerID)
+	bufWriter.Write(protocol.AppendControlFrame(nil, protocol.AnalyzerFrameGoodbye, nil))
+	if err := bufWriter.Flush(); err != nil {
+		log.Printf("Failed to send goodbye to analyzer %s: %v", ah.config.AnalyzerID, err)
+	}
+	ah.handleDisconnection()
+}
+
+// evict disconnects the analyzer and reroutes everything its session holds
+func (ah *AnalyzerHandler) evict() {
+	ah.evicted.Store(true)
+	ah.handleDisconnection()
+}
+
+// queueDepths returns the number of pending and queued messages, and the queued
+// count of each non-empty priority. In ordered mode the queue is split by lanes
+// holding mixed priorities, so no per-priority counts are returned.
+func (ah *AnalyzerHandler) queueDepths() (int, int, map[uint8]int) {
+	ah.pendingMutex.RLock()
+	pending := ah.pendingQueue.Len()
+	ah.pendingMutex.RUnlock()
+
+	queued := ah.config.queue.len()
+	if ah.server.ordered {
+		return pending, queued, nil
+	}
+	channels := make(map[uint8]int)
+	for priority := 0; priority < 256; priority++ {
+		if n := ah.config.queue.slotLen(uint8(priority)); n > 0 {
+			channels[uint8(priority)] = n
+		}
+	}
+	return pending, queued, channels
+}
+
+// status returns a snapshot of the session. parked must be read under the
+// server's handlersMutex by the caller.
+func (ah *AnalyzerHandler) status(parked bool) AnalyzerStatus {
+	ah.weightMutex.Lock()
+	st := AnalyzerStatus{
+		ID:             ah.config.AnalyzerID,
+		RemoteAddr:     ah.conn.RemoteAddr().String(),
+		Features:       ah.features,
+		Weight:         ah.config.Weight,
+		ReportedWeight: ah.reportedWeight,
+		WeightPinned:   ah.weightPinned,
+		Leaving:        ah.leaving.Load(),
+	}
+	if ah.config.Priorities != nil {
+		st.Priorities = ah.config.Priorities.String()
+	}
+	ah.weightMutex.Unlock()
+	if grouped, ok := ah.router.(interface{ AnalyzerGroup(*AnalyzerConfig) string }); ok {
+		st.Group = grouped.AnalyzerGroup(ah.config)
+	}
+
+	st.Pending, st.Queued, st.Channels = ah.queueDepths()
+	st.AckLatencyMs = float64(ah.config.load.averageAckLatency()) / float64(time.Millisecond)
+	switch {
+	case parked:
+		st.State = AnalyzerStateParked
+	case !ah.isConnected.Load():
+		st.State = AnalyzerStateClosing
+	case !ah.draining.Load():
+		st.State = AnalyzerStateConnected
+	case st.Pending == 0 && st.Queued == 0:
+		st.State = AnalyzerStateDrained
+	default:
+		st.State = AnalyzerStateDraining
+	}
+	return st
+}
+
+// Analyzers returns a snapshot of every analyzer session, sorted by ID
+func (as *AnalyzerServer) Analyzers() []AnalyzerStatus {
+	as.handlersMutex.Lock()
+	type entry struct {
+		ah     *AnalyzerHandler
+		parked bool
+	}
+	entries := make([]entry, 0, len(as.handlers))
+	for _, ah := range as.handlers {
+		entries = append(entries, entry{ah, ah.parked})
+	}
+	as.handlersMutex.Unlock()
+
+	statuses := make([]AnalyzerStatus, 0, len(entries))
+	for _, e := range entries {
+		statuses = append(statuses, e.ah.status(e.parked))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
+}
+
+// Analyzer returns a snapshot of one analyzer session
+func (as *AnalyzerServer) Analyzer(id string) (AnalyzerStatus, error) {
+	as.handlersMutex.Lock()
+	ah, ok := as.handlers[id]
+	parked := ok && ah.parked
+	as.handlersMutex.Unlock()
+
+	if !ok {
+		return AnalyzerStatus{}, ErrAnalyzerNotFound
+	}
+	return ah.status(parked), nil
+}
+
+// SetWeightOverride pins an analyzer's routing weight, ignoring the weight
+// updates it sends until the override is cleared
+func (as *AnalyzerServer) SetWeightOverride(id string, weight float32) error {
+	if !validWeight(weight) {
+		return ErrInvalidWeight
+	}
+	ah, err := as.lookup(id, false)
+	if err != nil {
+		return err
+	}
+	ah.pinWeight(weight)
+	log.Printf("Weight of analyzer %s pinned to %.3f", id, weight)
+	return nil
+}
+
+// ClearWeightOverride returns an analyzer to the weight it last asked for
+func (as *AnalyzerServer) ClearWeightOverride(id string) error {
+	ah, err := as.lookup(id, false)
+	if err != nil {
+		return err
+	}
+	ah.unpinWeight()
+	log.Printf("Weight override of analyzer %s cleared", id)
+	return nil
+}
+
+// Drain stops routing new messages to an analyzer while it works through the
+// messages already queued for it
+func (as *AnalyzerServer) Drain(id string) error {
+	ah, err := as.lookup(id, true)
+	if err != nil {
+		return err
+	}
+	ah.setDraining(true)
+	log.Printf("Draining analyzer %s", id)
+	return nil
+}
+
+// Undrain makes a drained analyzer eligible for routing again
+func (as *AnalyzerServer) Undrain(id string) error {
+	ah, err := as.lookup(id, false)
+	if err != nil {
+		return err
+	}
+	if ah.leaving.Load() {
+		return ErrAnalyzerLeaving
+	}
+	ah.setDraining(false)
+	log.Printf("Analyzer %s no longer draining", id)
+	return nil
+}
+
+// Disconnect closes an analyzer's connection and reroutes its queued and
+// pending messages without keeping the session for resumption
+func (as *AnalyzerServer) Disconnect(id string) error {
+	ah, err := as.lookup(id, true)
+	if err != nil {
+		return err
+	}
+	log.Printf("Disconnecting analyzer %s on operator request", id)
+	ah.evict()
+	return nil
+}
+
+// lookup finds the session for an analyzer ID, optionally requiring it to be connected
+func (as *AnalyzerServer) lookup(id string, connected bool) (*AnalyzerHandler, error) {
+	as.handlersMutex.Lock()
+	defer as.handlersMutex.Unlock()
+
+	ah, ok := as.handlers[id]
+	if !ok {
+		return nil, ErrAnalyzerNotFound
+	}
+	if connected && (ah.parked || !ah.isConnected.Load()) {
+		return nil, ErrAnalyzerNotConnected
+	}
+	return ah, nil
+}
@@ -12,6 +12,11 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"log-distributor/internal/auth"
+	"log-distributor/internal/metrics"
+	"log-distributor/internal/protocol"
+	"log-distributor/internal/tlsconfig"
 )
 
 const (
@@ -19,8 +24,50 @@ const (
 	SeqNumMSBMask = uint32(1 << 31)
 	// Mask for actual sequence value (bottom 31 bits)
 	SeqNumValueMask = uint32(0x7FFFFFFF)
+
+	// Maximum time an analyzer has to complete its handshake
+	handshakeTimeout = 10 * time.Second
+
+	// Analyzer features this distributor is able to honour
+	supportedAnalyzerFeatures = protocol.AnalyzerFeatureResume | protocol.AnalyzerFeatureDrain | protocol.AnalyzerFeatureMetadata |
+		protocol.AnalyzerFeatureBatch | protocol.AnalyzerFeatureCompression | protocol.AnalyzerFeatureEnvelope
 )
 
+// Most messages taken from an analyzer's queue at once. A message more urgent
+// than those of the batch being written waits for at most this many.
+const analyzerBatchSize = 64
+
+// Largest batch frame sent to an analyzer, unless it holds a single message
+const analyzerBatchBytes = 256 << 10
+
+// Smallest batch frame compressed for an analyzer that negotiated compression
+const minCompressedBatchBytes = 1 << 10
+
+// Defaults for AnalyzerServerOptions
+const (
+	DefaultAnalyzerAddr = ":8081"
+	DefaultAckTimeout   = 2 * time.Minute
+)
+
+// AnalyzerServerOptions configures an AnalyzerServer. Zero values select the
+// defaults, except ResumeGrace where zero disables session resumption and
+// CompressionLevel where zero disables compression.
+type AnalyzerServerOptions struct {
+	Addr             string            // Listen address
+	TLS              *tlsconfig.Server // If set, analyzers must connect with TLS
+	AckTimeout       time.Duration     // Disconnect an analyzer leaving a message unacknowledged this long
+	ResumeGrace      time.Duration     // How long a disconnected analyzer's session is kept for it to resume
+	QueueCapacity    int               // Messages queued for an analyzer across priorities, 0 for no limit
+	QueueBytes       int64             // Bytes queued for an analyzer, 0 for no limit
+	MemoryBudget     int64             // Bytes queued for all analyzers together, 0 for no limit
+	FlushInterval    time.Duration     // Longest time buffered writes to an analyzer wait for more messages, 0 to flush once its queue runs empty
+	Ordered          bool              // Queue by OrderedRouter lane instead of by priority
+	CompressionLevel int               // compress/flate level of batch frames to analyzers negotiating compression, 0 for none
+
+	Authenticator auth.Authenticator // If set, analyzers must present a token in their hello
+	Authorizer    auth.Authorizer    // If set, decides which analyzers may connect and the priorities they receive
+}
+
 // PendingMessage represents a message waiting for acknowledgement
 type PendingMessage struct {
 	message LogMessage
@@ -29,71 +76,210 @@ type PendingMessage struct {
 
 // AnalyzerHandler manages a connection to a single analyzer
 type AnalyzerHandler struct {
-	conn   net.Conn
+	conn   net.Conn // Replaced when the session resumes, under weightMutex
 	config *AnalyzerConfig
 	router RouterInterface
 
 	// Message handling
-	inputChannels   [256]chan LogMessage  // Priority channels (0 = highest priority)
+	metaBuf         []byte               // Scratch space for metadata frames
+	batchBuf        []byte               // Scratch space for batch frames
+	compressBuf     []byte               // Scratch space for compressed batch frames
+	compressor      *protocol.Compressor // Created with the first compressed batch frame
 	pendingQueue    *list.List
 	pendingMutex    sync.RWMutex
 	lastAckedSeqNum uint32
+	ackLatency      *metrics.Histogram
 
 	// Configuration
-	ackTimeout time.Duration
-
-	// State management
+	ackTimeout    time.Duration
+	flushInterval time.Duration
+
+	// Features negotiated during the handshake (0 for legacy analyzers)
+	features uint32
+
+	// Session state, guarded by the server's handlersMutex
+	resumeToken []byte      // Token a reconnecting analyzer must present to resume
+	claimed     bool        // Whether this handler owns its ID in the server registry
+	parked      bool        // Disconnected but waiting for the analyzer to resume
+	expiry      *time.Timer // Abandons a parked session once the grace window passes
+
+	// Operator controls, kept for the lifetime of the session. weightMutex also
+	// guards conn, features and config.Priorities against the admin API while a
+	// resume replaces them.
+	weightMutex    sync.Mutex
+	reportedWeight float32     // Last weight the analyzer asked for
+	weightPinned   bool        // An operator override replaces reportedWeight
+	draining       atomic.Bool // Not selected by the router, queued messages still delivered
+	evicted        atomic.Bool // Forcibly disconnected, so the session must not be parked
+	leaving        atomic.Bool // Analyzer asked to drain, goodbye follows once all is acknowledged
+
+	// Whether the analyzer is in the router, guarded by registrationMutex
+	registrationMutex sync.Mutex
+	registered        bool
+
+	// State management (per connection)
 	analyzerValBuf []byte
 	isConnected    atomic.Bool
 	wg             sync.WaitGroup
 	shutdown       chan struct{}
 
 	// Server reference for cleanup
+	server   *AnalyzerServer
 	serverWg *sync.WaitGroup
 }
 
 // AnalyzerServer manages TCP connections from analyzers
 type AnalyzerServer struct {
-	port       int
+	addr       string
+	tls        *tlsconfig.Server
 	router     RouterInterface
 	listener   net.Listener
 	ackTimeout time.Duration
 
+	// How long a disconnected analyzer's session is kept for it to resume
+	resumeGrace time.Duration
+
+	queueCapacity int
+	queueBytes    int64
+	budget        *memoryBudget // Shared by the analyzer queues
+	flushInterval time.Duration
+	ordered       bool
+
+	// compress/flate level of batch frames to analyzers, 0 if not compressed
+	compressionLevel int
+
+	access accessControl
+
+	// Handlers of analyzers that completed their handshake, keyed by analyzer ID
+	handlers      map[string]*AnalyzerHandler
+	handlersMutex sync.Mutex
+	stopping      bool // Shutting down: sessions are abandoned rather than parked
+
 	wg       sync.WaitGroup
 	shutdown chan struct{}
 }
 
 // NewAnalyzerServer creates a new analyzer server
-func NewAnalyzerServer(port int, router RouterInterface, ackTimeout time.Duration) *AnalyzerServer {
-	return &AnalyzerServer{
-		port:       port,
-		router:     router,
-		ackTimeout: ackTimeout,
-		shutdown:   make(chan struct{}),
+func NewAnalyzerServer(router RouterInterface, opts AnalyzerServerOptions) *AnalyzerServer {
+	if opts.Addr == "" {
+		opts.Addr = DefaultAnalyzerAddr
+	}
+	if opts.AckTimeout <= 0 {
+		opts.AckTimeout = DefaultAckTimeout
 	}
+
+	as := &AnalyzerServer{
+		addr:             opts.Addr,
+		tls:              opts.TLS,
+		router:           router,
+		ackTimeout:       opts.AckTimeout,
+		resumeGrace:      opts.ResumeGrace,
+		queueCapacity:    opts.QueueCapacity,
+		queueBytes:       opts.QueueBytes,
+		budget:           &memoryBudget{limit: opts.MemoryBudget},
+		flushInterval:    opts.FlushInterval,
+		ordered:          opts.Ordered,
+		compressionLevel: opts.CompressionLevel,
+		access:           accessControl{opts.Authenticator, opts.Authorizer},
+		handlers:         make(map[string]*AnalyzerHandler),
+		shutdown:         make(chan struct{}),
+	}
+	metrics.Default.OnScrape(as.sampleAnalyzerQueues)
+	return as
 }
 
 // Start begins listening for analyzer connections
 func (as *AnalyzerServer) Start() error {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", as.port))
+	listener, err := listen(as.addr, as.tls)
 	if err != nil {
-		return fmt.Errorf("failed to start analyzer server on port %d: %w", as.port, err)
+		return fmt.Errorf("failed to start analyzer server on %s: %w", as.addr, err)
 	}
 
 	as.listener = listener
-	log.Printf("Analyzer server listening on port %d", as.port)
+	log.Printf("Analyzer server listening on %s (%s)", listener.Addr(), describeTLS(as.tls))
 
 	go as.acceptConnections()
 	return nil
 }
 
-// Stop gracefully shuts down the analyzer server
+// Stop disconnects every analyzer and stops accepting new ones. Messages still
+// queued for or pending on an analyzer are handed back to the router, so call
+// DrainAll first to deliver them.
 func (as *AnalyzerServer) Stop() {
 	close(as.shutdown)
 	if as.listener != nil {
 		as.listener.Close()
 	}
+
+	as.handlersMutex.Lock()
+	as.stopping = true
+	handlers := make([]*AnalyzerHandler, 0, len(as.handlers))
+	for _, ah := range as.handlers {
+		handlers = append(handlers, ah)
+	}
+	as.handlersMutex.Unlock()
+	for _, ah := range handlers {
+		ah.handleDisconnection()
+	}
+
 	as.wg.Wait()
+	as.abandonParkedSessions()
+}
+
+// DrainAll waits until every connected analyzer has acknowledged all messages
+// queued for it, or timeout passes. Parked sessions are rerouted to connected
+// analyzers, and analyzers disconnecting from now on are not parked. Returns
+// whether everything was delivered.
+func (as *AnalyzerServer) DrainAll(timeout time.Duration) bool {
+	as.handlersMutex.Lock()
+	as.stopping = true
+	as.handlersMutex.Unlock()
+	as.abandonParkedSessions()
+
+	deadline := time.Now().Add(timeout)
+	for !as.delivered() || as.routerBacklog() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// delivered reports whether no analyzer session holds undelivered messages
+func (as *AnalyzerServer) delivered() bool {
+	as.handlersMutex.Lock()
+	handlers := make([]*AnalyzerHandler, 0, len(as.handlers))
+	for _, ah := range as.handlers {
+		handlers = append(handlers, ah)
+	}
+	as.handlersMutex.Unlock()
+
+	for _, ah := range handlers {
+		if !ah.isDrained() {
+			return false
+		}
+	}
+	return true
+}
+
+// routerBacklog returns the number of messages the router holds back for
+// analyzers, which only ordered routing does
+func (as *AnalyzerServer) routerBacklog() int {
+	if backlogged, ok := as.router.(interface{ Backlog() int }); ok {
+		return backlogged.Backlog()
+	}
+	return 0
+}
+
+// stopped reports whether Stop has been called
+func (as *AnalyzerServer) stopped() bool {
+	select {
+	case <-as.shutdown:
+		return true
+	default:
+		return false
+	}
 }
 
 // acceptConnections handles incoming analyzer connections
@@ -114,30 +300,22 @@ func (as *AnalyzerServer) acceptConnections() {
 				}
 			}
 
-			// Create an analyzer config based on the connection
+			// Until the handshake completes the analyzer is known by its address
 			analyzerID := fmt.Sprintf("analyzer_%s", conn.RemoteAddr().String())
-			config := &AnalyzerConfig{
-				AnalyzerID: analyzerID,
-			}
-			// Initialize priority channels (0 = highest priority, 255 = lowest)
-			for i := 0; i < 256; i++ {
-				config.InputChannels[i] = make(chan LogMessage, 1000)
-			}
 			log.Printf("New analyzer connected: %s", analyzerID)
 
-			// Create and start a new AnalyzerHandler for this connection
+			// Create a handler for this connection. Queues are only allocated once the
+			// handshake shows this is a new session rather than a resumed one.
 			handler := &AnalyzerHandler{
 				conn:           conn,
 				analyzerValBuf: make([]byte, 4),
 				router:         as.router,
-				config:         config,
+				config:         &AnalyzerConfig{AnalyzerID: analyzerID},
 				ackTimeout:     as.ackTimeout,
-				shutdown:       make(chan struct{}, 1),
-				pendingQueue:   list.New(),
+				flushInterval:  as.flushInterval,
+				server:         as,
 				serverWg:       &as.wg,
 			}
-			// Copy priority channels to handler
-			handler.inputChannels = config.InputChannels
 
 			as.wg.Add(1)
 			go handler.handleConnection()
@@ -145,36 +323,207 @@ func (as *AnalyzerServer) acceptConnections() {
 	}
 }
 
+// initSession sets up the queues for a new analyzer session
+func (ah *AnalyzerHandler) initSession() {
+	as := ah.server
+	ah.config.queue.configure(as.queueCapacity, as.queueBytes, as.budget)
+	ah.pendingQueue = list.New()
+	ah.lastAckedSeqNum = 0
+	ah.ackLatency = analyzerAckLatency.With(ah.config.AnalyzerID)
+}
+
 // handleConnection manages the lifecycle of a single analyzer connection
 func (ah *AnalyzerHandler) handleConnection() {
 	defer ah.serverWg.Done()
-	defer ah.conn.Close()
-	defer ah.cleanup()
 
 	log.Printf("Starting to handle connection for %s", ah.config.AnalyzerID)
 
-	// Read initial weight from first 4 bytes
-	if _, err := io.ReadFull(ah.conn, ah.analyzerValBuf); err != nil {
-		log.Printf("Failed to read initial weight from analyzer %s: %v", ah.config.AnalyzerID, err)
+	// The handshake may hand this connection to a parked session for the same analyzer
+	session := ah.performHandshake()
+	if session == nil {
+		ah.conn.Close()
 		return
 	}
+	session.serve()
+}
+
+// serve registers the analyzer and runs its handler goroutines until the current
+// connection ends
+func (ah *AnalyzerHandler) serve() {
+	defer ah.cleanup()
 
-	// Extract weight value (MSB should be 0 for weight)
-	weightBits := binary.BigEndian.Uint32(ah.analyzerValBuf)
-	if weightBits&SeqNumMSBMask != 0 {
-		log.Printf("Invalid initial weight from analyzer %s: MSB should be 0", ah.config.AnalyzerID)
+	ah.shutdown = make(chan struct{})
+	ah.isConnected.Store(true)
+	if ah.server.stopped() {
+		// Stop ran while the handshake completed and missed this connection
+		ah.handleDisconnection()
 		return
 	}
-
-	ah.config.Weight = math.Float32frombits(weightBits)
-	ah.router.RegisterAnalyzer(ah.config)
-	log.Printf("Analyzer %s registered with weight %.3f", ah.config.AnalyzerID, ah.config.Weight)
+	if ah.updateRegistration() {
+		log.Printf("Analyzer %s registered with weight %.3f", ah.config.AnalyzerID, ah.config.Weight)
+	} else {
+		log.Printf("Analyzer %s connected while draining, not registered for routing", ah.config.AnalyzerID)
+	}
 
 	// Start handler goroutines
-	ah.isConnected.Store(true)
 	ah.startHandlerRoutines()
 }
 
+// performHandshake reads the analyzer's hello (or legacy 4-byte weight) and claims
+// its ID in the server registry. It returns the handler that owns the session for
+// this connection, which is a parked handler when the analyzer resumes, or nil if
+// the connection must be closed.
+func (ah *AnalyzerHandler) performHandshake() *AnalyzerHandler {
+	// With mutual TLS the certificate decides which analyzer this is
+	certID, err := tlsIdentity(ah.conn)
+	if err != nil {
+		log.Printf("Analyzer %s: %v", ah.config.AnalyzerID, err)
+		return nil
+	}
+
+	ah.conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer ah.conn.SetDeadline(time.Time{})
+
+	if _, err := io.ReadFull(ah.conn, ah.analyzerValBuf); err != nil {
+		log.Printf("Failed to read handshake from analyzer %s: %v", ah.config.AnalyzerID, err)
+		return nil
+	}
+
+	if [4]byte(ah.analyzerValBuf) != protocol.AnalyzerHelloMagic {
+		// Legacy analyzers open with a bare float32 weight (MSB should be 0)
+		weightBits := binary.BigEndian.Uint32(ah.analyzerValBuf)
+		if weightBits&SeqNumMSBMask != 0 {
+			log.Printf("Invalid initial weight from analyzer %s: MSB should be 0", ah.config.AnalyzerID)
+			return nil
+		}
+		if !ah.server.access.allowLegacy(auth.RoleAnalyzer) {
+			log.Printf("Rejected analyzer %s: authentication requires the hello handshake", ah.config.AnalyzerID)
+			return nil
+		}
+		if certID != "" {
+			ah.config.AnalyzerID = certID
+		}
+		priorities, ok := ah.server.access.analyzerPriorities(ah.config.AnalyzerID)
+		if !ok {
+			log.Printf("Rejected analyzer %s: not authorized to connect", ah.config.AnalyzerID)
+			return nil
+		}
+		if !ah.server.acceptsPriorities(priorities) {
+			log.Printf("Rejected analyzer %s: ordered routing needs analyzers receiving every priority", ah.config.AnalyzerID)
+			return nil
+		}
+		ah.config.Priorities = priorities
+		ah.config.Weight = math.Float32frombits(weightBits)
+		ah.reportedWeight = ah.config.Weight
+		ah.initSession()
+		if !ah.server.claimID(ah) {
+			return nil
+		}
+		return ah
+	}
+
+	hello, err := protocol.ReadHelloBody(ah.conn)
+	if err != nil {
+		log.Printf("Failed to read hello from analyzer %s: %v", ah.config.AnalyzerID, err)
+		return nil
+	}
+
+	reply := &protocol.Reply{
+		Version: min(hello.Version, protocol.Version),
+		Status:  protocol.StatusRejected,
+	}
+	remoteID := ah.config.AnalyzerID
+	var session *AnalyzerHandler
+	var id string
+	switch {
+	case hello.Version == 0:
+		reply.Reason = fmt.Sprintf("unsupported protocol version %d", hello.Version)
+	case !validWeight(hello.Weight):
+		reply.Reason = fmt.Sprintf("invalid initial weight %v", hello.Weight)
+	default:
+		if id, reply.Reason = ah.server.access.identify(auth.RoleAnalyzer, certID, hello); id == "" {
+			break
+		}
+		priorities, ok := ah.server.access.analyzerPriorities(id)
+		if !ok {
+			reply.Reason = fmt.Sprintf("analyzer %q is not authorized to connect", id)
+			break
+		}
+		if priorities = subscribedPriorities(priorities, hello.Priorities); priorities != nil && priorities.IsEmpty() {
+			reply.Reason = fmt.Sprintf("analyzer %q subscribes to no priority it may receive", id)
+			break
+		}
+		if !ah.server.acceptsPriorities(priorities) {
+			reply.Reason = "ordered routing needs analyzers receiving every priority"
+			break
+		}
+		hello.ID = id
+		hello.Features &= supportedAnalyzerFeatures
+		if ah.server.compressionLevel == 0 {
+			hello.Features &^= protocol.AnalyzerFeatureCompression
+		}
+		session, reply.Resumed, reply.Reason = ah.server.openSession(ah, hello, priorities)
+		if session != nil {
+			reply.Status = protocol.StatusAccepted
+			reply.Features = session.features
+			reply.ResumeToken = session.resumeToken
+			reply.Priorities = priorities
+		}
+	}
+
+	if err := protocol.WriteReply(ah.conn, protocol.AnalyzerHelloMagic, reply); err != nil {
+		log.Printf("Failed to send handshake reply to analyzer %s: %v", ah.config.AnalyzerID, err)
+		if session != nil {
+			// Nothing was sent on this connection yet, so the session can be parked again
+			session.cleanup()
+		}
+		return nil
+	}
+
+	if !reply.Accepted() {
+		log.Printf("Rejected analyzer %s: %s", remoteID, reply.Reason)
+		return nil
+	}
+
+	if reply.Resumed {
+		log.Printf("Analyzer %s resumed session %s (protocol v%d, features 0x%x)", remoteID, hello.ID, reply.Version, reply.Features)
+	} else {
+		log.Printf("Analyzer %s identified as %s (protocol v%d, features 0x%x)", remoteID, hello.ID, reply.Version, reply.Features)
+	}
+	if reply.Priorities != nil {
+		log.Printf("Analyzer %s receives priorities %s", hello.ID, reply.Priorities)
+	}
+	return session
+}
+
+// subscribedPriorities narrows the priorities an analyzer may receive to those it
+// subscribed to. nil stands for every priority.
+func subscribedPriorities(allowed, subscribed *protocol.PrioritySet) *protocol.PrioritySet {
+	if subscribed == nil || subscribed.IsFull() {
+		return allowed
+	}
+	if allowed == nil {
+		return subscribed
+	}
+	granted := *allowed
+	for i := range granted {
+		granted[i] &= subscribed[i]
+	}
+	return &granted
+}
+
+// acceptsPriorities reports whether an analyzer routed the given priorities can
+// join. Ordered routing serves lanes mixing all priorities, so it takes only
+// analyzers receiving every one.
+func (as *AnalyzerServer) acceptsPriorities(priorities *protocol.PrioritySet) bool {
+	return !as.ordered || priorities == nil || priorities.IsFull()
+}
+
+// validWeight reports whether w is usable as a routing weight
+func validWeight(w float32) bool {
+	return w >= 0 && !math.IsInf(float64(w), 0) && !math.IsNaN(float64(w))
+}
+
 // startHandlerRoutines starts all necessary goroutines for the handler
 func (ah *AnalyzerHandler) startHandlerRoutines() {
 	// Start message processor
@@ -194,115 +543,256 @@ func (ah *AnalyzerHandler) startHandlerRoutines() {
 
 // cleanup handles cleanup when connection closes
 func (ah *AnalyzerHandler) cleanup() {
-	// Only unregister if still connected (handleDisconnection may have already done it)
-	if ah.isConnected.Load() {
-		ah.router.UnregisterAnalyzer(ah.config)
-		ah.flushPendingMessages()
+	// Unregister and close the connection if no handler goroutine has done it yet
+	ah.handleDisconnection()
+
+	if ah.server.parkSession(ah) {
+		log.Printf("Analyzer %s disconnected, holding its session for %v", ah.config.AnalyzerID, ah.server.resumeGrace)
+		return
 	}
+
+	ah.abandon()
+	ah.server.releaseID(ah)
 	log.Printf("Analyzer disconnected: %s", ah.config.AnalyzerID)
 }
 
-// processMessages handles incoming log messages from router
+// processMessages sends the messages queued for the analyzer. It takes them
+// from the queue in batches and writes them through a buffer that is flushed
+// once the queue runs empty, or up to the flush interval later if one is set,
+// and sleeps until a message is queued.
 func (ah *AnalyzerHandler) processMessages() {
 	defer ah.wg.Done()
 
 	bufWriter := bufio.NewWriter(ah.conn)
-	flushTimer := time.NewTimer(10 * time.Millisecond) // Flush every 10ms if no activity
+	flushTimer := time.NewTimer(ah.flushInterval) // Bounds how long buffered writes wait for more messages
+	flushTimer.Stop()
 	defer flushTimer.Stop()
+	var flushDue <-chan time.Time // flushTimer.C while buffered writes wait for it
+
+	// A resumed session first retransmits whatever the analyzer never received
+	if err := ah.resendPending(bufWriter); err != nil {
+		log.Printf("Failed to resend pending messages to analyzer %s: %v", ah.config.AnalyzerID, err)
+		ah.handleDisconnection()
+		return
+	}
+
+	flush := func() bool {
+		flushTimer.Stop()
+		flushDue = nil
+		if bufWriter.Buffered() == 0 {
+			return true
+		}
+		if err := bufWriter.Flush(); err != nil {
+			log.Printf("Failed to flush buffer for analyzer %s: %v", ah.config.AnalyzerID, err)
+			ah.handleDisconnection()
+			return false
+		}
+		return true
+	}
 
+	batch := make([]LogMessage, 0, analyzerBatchSize)
 	for {
 		select {
 		case <-ah.shutdown:
-			// Drain any remaining messages from all priority channels and reroute them
-			for priority := 0; priority < 256; priority++ {
-				for {
-					select {
-					case msg := <-ah.inputChannels[priority]:
-						ah.router.RouteMessage(msg)
-					default:
-						break
-					}
-				}
-			}
+			// Queued messages stay in the analyzer's queue: they are either picked up
+			// by a resumed connection or rerouted when the session is abandoned
 			return
-		case <-flushTimer.C:
-			// Timeout-based flush
-			if bufWriter.Buffered() > 0 {
-				if err := bufWriter.Flush(); err != nil {
-					log.Printf("Failed to flush buffer for analyzer %s: %v", ah.config.AnalyzerID, err)
-					ah.handleDisconnection()
-					return
-				}
-			}
-			flushTimer.Reset(10 * time.Millisecond)
 		default:
-			// Try to get a message in priority order and process it
-			processed, shouldExit := ah.tryProcessPriorityMessage(bufWriter, flushTimer)
-			if shouldExit {
+		}
+
+		batch = ah.config.queue.popBatch(batch[:0], analyzerBatchSize, ah.server.ordered)
+		if len(batch) > 0 {
+			ok := ah.sendBatch(batch, bufWriter)
+			clear(batch)
+			if !ok {
 				return
 			}
-			if processed {
-				continue // Message processed, continue loop
+			if ah.flushInterval > 0 && flushDue == nil && bufWriter.Buffered() > 0 {
+				flushTimer.Reset(ah.flushInterval)
+				flushDue = flushTimer.C
 			}
-			
-			// No messages available, wait briefly
-			select {
-			case <-ah.shutdown:
+			continue
+		}
+
+		// The queue ran empty: send what is buffered, unless it may wait for more
+		if flushDue == nil && !flush() {
+			return
+		}
+		if ah.leaving.Load() && ah.isDrained() {
+			ah.sayGoodbye(bufWriter)
+			return
+		}
+
+		select {
+		case <-ah.shutdown:
+			return
+		case <-ah.config.queue.ready:
+		case <-flushDue:
+			if !flush() {
 				return
-			case <-time.After(1 * time.Millisecond):
-				continue
 			}
 		}
 	}
 }
 
-// tryProcessPriorityMessage attempts to get and process a message from priority channels
-// Returns (processed, shouldExit) - processed=true if message was handled, shouldExit=true if should exit
-func (ah *AnalyzerHandler) tryProcessPriorityMessage(bufWriter *bufio.Writer, flushTimer *time.Timer) (bool, bool) {
-	// Check priority channels in order (0 = highest priority first)
-	for priority := 0; priority < 256; priority++ {
-		select {
-		case msg := <-ah.inputChannels[priority]:
-			success := ah.processMessage(msg, bufWriter, flushTimer)
-			return true, !success // processed=true, shouldExit=true if processMessage failed
-		default:
-			continue
-		}
+// resendPending writes every unacknowledged message again, oldest first, and
+// flushes them to the analyzer
+func (ah *AnalyzerHandler) resendPending(bufWriter *bufio.Writer) error {
+	ah.pendingMutex.Lock()
+	resend := make([]*PendingMessage, 0, ah.pendingQueue.Len())
+	for e := ah.pendingQueue.Front(); e != nil; e = e.Next() {
+		resend = append(resend, e.Value.(*PendingMessage))
+	}
+	ah.pendingMutex.Unlock()
+
+	if len(resend) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	msgs := make([]LogMessage, len(resend))
+	for i, pending := range resend {
+		pending.sentAt = now
+		msgs[i] = pending.message
+	}
+	if err := ah.writeMessages(bufWriter, msgs); err != nil {
+		return err
 	}
-	return false, false // No messages available, don't exit
+	log.Printf("Resent %d pending messages to analyzer %s", len(resend), ah.config.AnalyzerID)
+	return bufWriter.Flush()
 }
 
-// processMessage handles a single message - sending it to the analyzer
-// Returns true if processed successfully, false if should exit
-func (ah *AnalyzerHandler) processMessage(msg LogMessage, bufWriter *bufio.Writer, flushTimer *time.Timer) bool {
+// sendBatch adds a batch of messages to the pending queue and writes them to
+// the analyzer. Returns false if the connection failed.
+func (ah *AnalyzerHandler) sendBatch(batch []LogMessage, bufWriter *bufio.Writer) bool {
 	if !ah.isConnected.Load() {
 		// Not connected, reroute
-		ah.router.RouteMessage(msg)
+		for _, msg := range batch {
+			ah.config.queue.done(msg)
+			ah.router.RouteMessage(msg)
+		}
 		return true
 	}
 
-	pending := &PendingMessage{
-		message: msg,
-		sentAt:  time.Now(),
-	}
-
-	// Add to pending queue
+	now := time.Now()
 	ah.pendingMutex.Lock()
-	ah.pendingQueue.PushBack(pending)
+	for _, msg := range batch {
+		ah.pendingQueue.PushBack(&PendingMessage{
+			message: msg,
+			sentAt:  now,
+		})
+	}
+	ah.config.load.pending.Store(int32(ah.pendingQueue.Len()))
 	ah.pendingMutex.Unlock()
 
-	_, err := bufWriter.Write(msg.GetData())
-	if err != nil {
+	if err := ah.writeMessages(bufWriter, batch); err != nil {
 		log.Printf("Failed to send message to analyzer %s: %v", ah.config.AnalyzerID, err)
 		ah.handleDisconnection()
-		return false // Signal to exit
+		return false
 	}
-
-	// Reset flush timer - we just got activity
-	flushTimer.Reset(10 * time.Millisecond)
 	return true
 }
 
+// writeMessages writes messages to the analyzer in order, coalesced into batch
+// frames of up to analyzerBatchBytes if the analyzer negotiated them
+func (ah *AnalyzerHandler) writeMessages(bufWriter *bufio.Writer, msgs []LogMessage) error {
+	if ah.features&protocol.AnalyzerFeatureBatch == 0 {
+		for _, msg := range msgs {
+			if err := ah.writeMessage(bufWriter, msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for len(msgs) > 0 {
+		buf := protocol.AppendBatchHeader(ah.batchBuf[:0], 0, 0)
+		n := 0
+		for ; n < len(msgs) && n < protocol.MaxBatchMessages; n++ {
+			start := len(buf)
+			buf = append(ah.appendMetadata(buf, msgs[n]), ah.frameOf(msgs[n])...)
+			if n > 0 && len(buf) > analyzerBatchBytes {
+				buf = buf[:start]
+				break
+			}
+		}
+		ah.batchBuf = buf
+
+		switch {
+		case n == 1:
+			buf = buf[protocol.BatchHeaderLen:] // A single message goes out as it is
+		case ah.features&protocol.AnalyzerFeatureCompression != 0 && len(buf) >= minCompressedBatchBytes:
+			buf = ah.compressBatch(n, buf[protocol.BatchHeaderLen:])
+		default:
+			protocol.AppendBatchHeader(buf[:0], n, len(buf)-protocol.BatchHeaderLen)
+		}
+		if _, err := bufWriter.Write(buf); err != nil {
+			return err
+		}
+		msgs = msgs[n:]
+	}
+	return nil
+}
+
+// compressBatch returns the batch frame of count messages whose frames are
+// body, compressed unless that would not make it smaller
+func (ah *AnalyzerHandler) compressBatch(count int, body []byte) []byte {
+	if ah.compressor == nil {
+		compressor, err := protocol.NewCompressor(ah.server.compressionLevel)
+		if err != nil {
+			log.Printf("WARNING: Not compressing batches for analyzer %s: %v", ah.config.AnalyzerID, err)
+			ah.compressBuf = append(protocol.AppendBatchHeader(ah.compressBuf[:0], count, len(body)), body...)
+			return ah.compressBuf
+		}
+		ah.compressor = compressor
+	}
+	frame, compressed := ah.compressor.AppendBatch(ah.compressBuf[:0], count, body)
+	ah.compressBuf = frame
+	if compressed {
+		compressionCompressedBytes.With("analyzer").Add(uint64(len(frame)))
+		compressionUncompressedBytes.With("analyzer").Add(uint64(protocol.BatchHeaderLen + len(body)))
+	}
+	return frame
+}
+
+// writeMessage writes a message to the analyzer, preceded by a metadata frame
+// if the analyzer negotiated them and the message carries metadata
+func (ah *AnalyzerHandler) writeMessage(bufWriter *bufio.Writer, msg LogMessage) error {
+	if ah.metaBuf = ah.appendMetadata(ah.metaBuf[:0], msg); len(ah.metaBuf) > 0 {
+		if _, err := bufWriter.Write(ah.metaBuf); err != nil {
+			return err
+		}
+	}
+	_, err := bufWriter.Write(ah.frameOf(msg))
+	return err
+}
+
+// frameOf returns the frame a message is sent to the analyzer as: the frame it
+// was received in, without its envelope unless the analyzer negotiated them
+func (ah *AnalyzerHandler) frameOf(msg LogMessage) []byte {
+	if env := envelopeOf(msg); env != nil && ah.features&protocol.AnalyzerFeatureEnvelope == 0 {
+		return env.DataFrame()
+	}
+	return msg.GetData()
+}
+
+// appendMetadata appends the metadata frame describing msg to buf if the
+// analyzer negotiated them and the message carries metadata
+func (ah *AnalyzerHandler) appendMetadata(buf []byte, msg LogMessage) []byte {
+	if ah.features&protocol.AnalyzerFeatureMetadata == 0 {
+		return buf
+	}
+	described, ok := msg.(interface{ metadata() protocol.Metadata })
+	if !ok {
+		return buf
+	}
+	meta := described.metadata()
+	if meta.Empty() {
+		return buf
+	}
+	return protocol.AppendMetadataFrame(buf, &meta)
+}
+
 // handleAnalyzerMessages processes messages from the analyzer (acks and weight updates)
 func (ah *AnalyzerHandler) handleAnalyzerMessages() {
 	defer ah.wg.Done()
@@ -323,8 +813,8 @@ func (ah *AnalyzerHandler) handleAnalyzerMessages() {
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					continue
 				}
-				if err != io.EOF {
-				log.Printf("Error reading from analyzer %s: %v", ah.config.AnalyzerID, err)
+				if err != io.EOF && ah.isConnected.Load() {
+					log.Printf("Error reading from analyzer %s: %v", ah.config.AnalyzerID, err)
 				}
 				ah.handleDisconnection()
 				return
@@ -337,11 +827,16 @@ func (ah *AnalyzerHandler) handleAnalyzerMessages() {
 				// MSB = 1: This is a sequence number ACK
 				seqNum := value & SeqNumValueMask
 				ah.handleAck(seqNum)
+			} else if value == protocol.AnalyzerDrainRequest && ah.features&protocol.AnalyzerFeatureDrain != 0 {
+				ah.leave()
 			} else {
 				// MSB = 0: This is a weight update
 				newWeight := math.Float32frombits(value)
-				log.Printf("Analyzer %s updated weight from %.3f to %.3f", ah.config.AnalyzerID, ah.config.Weight, newWeight)
-				ah.router.UpdateWeight(ah.config, newWeight)
+				if !validWeight(newWeight) {
+					log.Printf("Ignoring invalid weight %v from analyzer %s", newWeight, ah.config.AnalyzerID)
+					continue
+				}
+				ah.reportWeight(newWeight)
 			}
 		}
 	}
@@ -352,17 +847,30 @@ func (ah *AnalyzerHandler) handleAck(ackedSeqNum uint32) {
 	ah.pendingMutex.Lock()
 	defer ah.pendingMutex.Unlock()
 
+	now := time.Now()
 	e := ah.pendingQueue.Front()
 	for e != nil && ah.lastAckedSeqNum != ackedSeqNum {
 		old := e
 		e = e.Next()
 		ah.pendingQueue.Remove(old)
-		messageBuf := old.Value.(*PendingMessage).message.GetData()
+		pending := old.Value.(*PendingMessage)
+		ah.ackLatency.Observe(now.Sub(pending.sentAt).Seconds())
+		ah.config.load.observeAck(now.Sub(pending.sentAt))
+		message := pending.message
+		ah.config.queue.done(message)
+		if a, ok := message.(acknowledger); ok {
+			a.Ack()
+		}
+		messageBuf := message.GetData()
 		if cap(messageBuf) < 8192 {
 			messagePool.Put(messageBuf[:0])
 		}
 		ah.lastAckedSeqNum = (ah.lastAckedSeqNum + 1) & SeqNumValueMask
 	}
+	ah.config.load.pending.Store(int32(ah.pendingQueue.Len()))
+	if ah.leaving.Load() {
+		ah.config.queue.wake() // The writer says goodbye once all is acknowledged
+	}
 }
 
 // checkTimeouts checks for and handles message timeouts
@@ -412,27 +920,42 @@ func (ah *AnalyzerHandler) handleDisconnection() {
 	log.Printf("Analyzer %s disconnected", ah.config.AnalyzerID)
 
 	// Unregister immediately to stop new messages
-	ah.router.UnregisterAnalyzer(ah.config)
+	ah.updateRegistration()
 
-	if ah.conn != nil {
-		ah.conn.Close()
-		ah.conn = nil
-	}
+	// Stop the handler goroutines; queued and pending messages are dealt with by
+	// cleanup once they have exited
+	close(ah.shutdown)
+	ah.conn.Close()
+}
 
-	// Flush pending messages
+// abandon reroutes everything the session still holds to other analyzers
+func (ah *AnalyzerHandler) abandon() {
 	ah.flushPendingMessages()
+
+	queued := ah.config.queue.drain()
+	for _, msg := range queued {
+		ah.router.RouteMessage(msg)
+	}
+	if len(queued) > 0 {
+		log.Printf("Rerouted %d queued messages from analyzer %s", len(queued), ah.config.AnalyzerID)
+	}
 }
 
-// flushPendingMessages reroutes all pending messages
+// flushPendingMessages reroutes all pending messages. They are routed after
+// releasing the pending queue, as the router may block until there is room.
 func (ah *AnalyzerHandler) flushPendingMessages() {
 	ah.pendingMutex.Lock()
-	count := 0
+	var flushed []LogMessage
 	for e := ah.pendingQueue.Front(); e != nil; e = e.Next() {
-		ah.router.RouteMessage(e.Value.(*PendingMessage).message)
-		count++
+		flushed = append(flushed, e.Value.(*PendingMessage).message)
 	}
 	ah.pendingQueue.Init()
+	ah.config.load.pending.Store(0)
 	ah.pendingMutex.Unlock()
 
-	log.Printf("Flushed %d pending messages from analyzer %s", count, ah.config.AnalyzerID)
+	for _, msg := range flushed {
+		ah.config.queue.done(msg)
+		ah.router.RouteMessage(msg)
+	}
+	log.Printf("Flushed %d pending messages from analyzer %s", len(flushed), ah.config.AnalyzerID)
 }
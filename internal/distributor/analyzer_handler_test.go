@@ -0,0 +1,316 @@
+package distributor
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"log-distributor/internal/protocol"
+)
+
+// startAnalyzerServer starts an analyzer server on a free local port, stopped
+// when the test ends after shutting the router down, as the distributor does
+func startAnalyzerServer(t testing.TB, router RouterInterface, opts AnalyzerServerOptions) *AnalyzerServer {
+	t.Helper()
+	opts.Addr = "127.0.0.1:0"
+	as := NewAnalyzerServer(router, opts)
+	if err := as.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if r, ok := router.(Router); ok {
+			r.Shutdown() // Messages handed back on stop are not blocked for
+		}
+		as.Stop()
+	})
+	return as
+}
+
+// dialAnalyzer connects to the analyzer server and performs the handshake
+func dialAnalyzer(t testing.TB, as *AnalyzerServer, hello *protocol.Hello) (net.Conn, *protocol.Reply) {
+	t.Helper()
+	conn, err := net.Dial("tcp", as.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := protocol.WriteHello(conn, protocol.AnalyzerHelloMagic, hello); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := protocol.ReadReply(conn, protocol.AnalyzerHelloMagic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reply.Accepted() {
+		t.Fatalf("analyzer %s rejected: %s", hello.ID, reply.Reason)
+	}
+	return conn, reply
+}
+
+// readDataFrame reads one data frame sent to an analyzer
+func readDataFrame(t testing.TB, conn net.Conn) []byte {
+	t.Helper()
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, binary.BigEndian.Uint32(lenBuf[:]))
+	copy(frame, lenBuf[:])
+	if _, err := io.ReadFull(conn, frame[4:]); err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+// dataFrame builds a data frame of a priority
+func dataFrame(priority uint8, payload string) []byte {
+	frame := binary.BigEndian.AppendUint32(nil, uint32(5+len(payload)))
+	frame = append(frame, priority)
+	return append(frame, payload...)
+}
+
+// dialLegacyAnalyzer connects to the analyzer server and opens with a bare
+// float32 weight, as analyzers did before the hello handshake
+func dialLegacyAnalyzer(t testing.TB, as *AnalyzerServer, weightBits uint32) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", as.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(binary.BigEndian.AppendUint32(nil, weightBits)); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// An analyzer opening with its weight instead of a hello is registered under
+// its address with that weight
+func TestLegacyAnalyzerHandshake(t *testing.T) {
+	router := NewWeightedTreeRouter()
+	as := startAnalyzerServer(t, router, AnalyzerServerOptions{})
+	conn := dialLegacyAnalyzer(t, as, math.Float32bits(2.5))
+
+	st := waitForState(t, as, "analyzer_"+conn.LocalAddr().String(), AnalyzerStateConnected)
+	if st.Weight != 2.5 || st.Features != 0 {
+		t.Errorf("weight %v, features 0x%x, want 2.5 and none", st.Weight, st.Features)
+	}
+
+	want := dataFrame(7, "legacy")
+	if !router.RouteMessage(ByteSliceMessage(want)) {
+		t.Fatal("message not routed to the legacy analyzer")
+	}
+	if got := readDataFrame(t, conn); string(got) != string(want) {
+		t.Errorf("received %q, want %q", got, want)
+	}
+}
+
+// A first word with the MSB set is neither a hello nor a weight
+func TestLegacyAnalyzerHandshakeRejectsMSB(t *testing.T) {
+	as := startAnalyzerServer(t, NewWeightedTreeRouter(), AnalyzerServerOptions{})
+	conn := dialLegacyAnalyzer(t, as, 0x80000000|math.Float32bits(1))
+
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read %d bytes (%v), want the connection closed", n, err)
+	}
+	if n := len(as.Analyzers()); n != 0 {
+		t.Errorf("%d analyzers known, want none", n)
+	}
+}
+
+// readMessages reads data and batch frames sent to an analyzer until n messages
+// arrived, and returns their payloads
+func readMessages(t testing.TB, conn net.Conn, n int) []string {
+	t.Helper()
+	var payloads []string
+	for len(payloads) < n {
+		var lenBuf [4]byte
+		if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+			t.Fatal(err)
+		}
+		length := binary.BigEndian.Uint32(lenBuf[:])
+		count := 1
+		if length&protocol.ControlFrameFlag != 0 {
+			h, err := protocol.ReadBatchHeader(conn, length, 1<<20)
+			if err != nil || h.Compressed != 0 {
+				t.Fatalf("batch header %+v: %v", h, err)
+			}
+			count = h.Count
+			if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := range count {
+			if i > 0 {
+				if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			frame := make([]byte, binary.BigEndian.Uint32(lenBuf[:]))
+			copy(frame, lenBuf[:])
+			if _, err := io.ReadFull(conn, frame[4:]); err != nil {
+				t.Fatal(err)
+			}
+			payloads = append(payloads, string(frame[5:]))
+		}
+	}
+	return payloads
+}
+
+// A batch from an emitter is split by priority over two analyzers, and each
+// releases its share from the WAL with one cumulative acknowledgement
+func TestBatchSplitAcrossAnalyzers(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestWAL(t, dir, 1) // Every frame starts a new segment
+	router := NewWeightedTreeRouter()
+	as := startAnalyzerServer(t, router, AnalyzerServerOptions{})
+
+	var low, high protocol.PrioritySet
+	low.AddRange(0, 9)
+	high.AddRange(10, 19)
+	lowConn, _ := dialAnalyzer(t, as, &protocol.Hello{Version: protocol.Version, Features: protocol.AnalyzerFeatureBatch, Weight: 1, ID: "low", Priorities: &low})
+	highConn, _ := dialAnalyzer(t, as, &protocol.Hello{Version: protocol.Version, Features: protocol.AnalyzerFeatureBatch, Weight: 1, ID: "high", Priorities: &high})
+	waitForState(t, as, "low", AnalyzerStateConnected)
+	waitForState(t, as, "high", AnalyzerStateConnected)
+
+	es := NewEmitterServer(router, EmitterServerOptions{Addr: "127.0.0.1:0", WAL: w})
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(es.Stop)
+	emitter, err := net.Dial("tcp", es.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer emitter.Close()
+	emitter.SetDeadline(time.Now().Add(5 * time.Second))
+	hello := &protocol.Hello{Version: protocol.Version, Features: protocol.EmitterFeatureAcks | protocol.EmitterFeatureBatch, ID: "e1"}
+	if err := protocol.WriteHello(emitter, protocol.EmitterHelloMagic, hello); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := protocol.ReadReply(emitter, protocol.EmitterHelloMagic); err != nil || !reply.Accepted() {
+		t.Fatalf("emitter rejected: %+v, %v", reply, err)
+	}
+
+	var body []byte
+	for _, frame := range [][]byte{dataFrame(1, "low-1"), dataFrame(11, "high-1"), dataFrame(2, "low-2"), dataFrame(12, "high-2")} {
+		body = append(body, frame...)
+	}
+	if _, err := emitter.Write(append(protocol.AppendBatchHeader(nil, 4, len(body)), body...)); err != nil {
+		t.Fatal(err)
+	}
+	var ack [protocol.EmitterFrameLen]byte
+	if _, err := io.ReadFull(emitter, ack[:]); err != nil {
+		t.Fatal(err)
+	}
+	if want := protocol.AppendEmitterFrame(nil, protocol.EmitterFrameAck, 4); !slices.Equal(ack[:], want) {
+		t.Fatalf("emitter received %x, want an ACK of the whole batch %x", ack, want)
+	}
+
+	for _, a := range []struct {
+		id   string
+		conn net.Conn
+		want []string
+	}{
+		{"low", lowConn, []string{"low-1", "low-2"}},
+		{"high", highConn, []string{"high-1", "high-2"}},
+	} {
+		a.conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if got := readMessages(t, a.conn, 2); !slices.Equal(got, a.want) {
+			t.Fatalf("analyzer %s received %q, want %q", a.id, got, a.want)
+		}
+		// One cumulative acknowledgement covers both messages
+		if _, err := a.conn.Write(binary.BigEndian.AppendUint32(nil, SeqNumMSBMask|2)); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for st, _ := as.Analyzer(a.id); st.Pending != 0; st, _ = as.Analyzer(a.id) {
+			if time.Now().After(deadline) {
+				t.Fatalf("analyzer %s still has %d messages pending", a.id, st.Pending)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// Only the active segment is left once every frame was acknowledged
+	if files := walFiles(t, dir); len(files) != 2 {
+		t.Errorf("WAL files %q, want only the active segment", files)
+	}
+}
+
+// An envelope is passed on to an analyzer that negotiated envelopes, and
+// reduced to its data frame for one that did not
+func TestEnvelopeToAnalyzers(t *testing.T) {
+	data := dataFrame(3, "enveloped")
+	frame, err := protocol.AppendEnvelope(nil, &protocol.Headers{Source: "app", Key: []byte("k")}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name     string
+		features uint32
+		want     []byte
+	}{
+		{"with envelopes", protocol.AnalyzerFeatureEnvelope, frame},
+		{"without envelopes", 0, data},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			router := NewWeightedTreeRouter()
+			as := startAnalyzerServer(t, router, AnalyzerServerOptions{})
+			conn, _ := dialAnalyzer(t, as, &protocol.Hello{Version: protocol.Version, Features: tt.features, Weight: 1, ID: "a1"})
+			waitForState(t, as, "a1", AnalyzerStateConnected)
+
+			msg, err := ParseMessage(frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !router.RouteMessage(msg) {
+				t.Fatal("message not routed")
+			}
+			got := make([]byte, len(tt.want))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("received %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+// Routes one message at a time to an idle analyzer and reads it back, so
+// every message waits for the writer to wake up. Reports the latency
+// percentiles from routing to receiving.
+func BenchmarkAnalyzerWriterWakeup(b *testing.B) {
+	router := NewWeightedTreeRouter()
+	as := startAnalyzerServer(b, router, AnalyzerServerOptions{})
+	conn, _ := dialAnalyzer(b, as, &protocol.Hello{Version: protocol.Version, Weight: 1, ID: "bench"})
+	conn.SetDeadline(time.Time{})
+	for !router.HasAnalyzers() {
+		time.Sleep(time.Millisecond)
+	}
+
+	msg := ByteSliceMessage(dataFrame(1, "wakeup"))
+	var latencies []time.Duration
+	for b.Loop() {
+		start := time.Now()
+		if !router.RouteMessage(msg) {
+			b.Fatal("message not routed")
+		}
+		readDataFrame(b, conn)
+		latencies = append(latencies, time.Since(start))
+	}
+
+	slices.Sort(latencies)
+	percentile := func(p float64) float64 {
+		return float64(latencies[int(p*float64(len(latencies)-1))].Nanoseconds())
+	}
+	b.ReportMetric(percentile(0.5), "p50-ns")
+	b.ReportMetric(percentile(0.99), "p99-ns")
+}
@@ -0,0 +1,40 @@
+package distributor
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Weight of each new ACK latency sample in an analyzer's moving average
+	ackLatencySmoothing = 0.2
+	// Latency assumed at least, so analyzers acknowledging instantly still
+	// compare by their outstanding messages
+	minAckLatency = time.Millisecond
+)
+
+// analyzerLoad holds the live load signals of an analyzer, kept up to date by
+// its handler
+type analyzerLoad struct {
+	pending    atomic.Int32  // Messages sent and not yet acknowledged
+	ackLatency atomic.Uint64 // Moving average of the ACK latency in seconds, as float64 bits
+}
+
+// observeAck folds an ACK latency sample into the moving average. Called by a
+// single goroutine at a time.
+func (l *analyzerLoad) observeAck(latency time.Duration) {
+	sample := latency.Seconds()
+	avg := math.Float64frombits(l.ackLatency.Load())
+	if avg == 0 {
+		avg = sample
+	} else {
+		avg += ackLatencySmoothing * (sample - avg)
+	}
+	l.ackLatency.Store(math.Float64bits(avg))
+}
+
+// averageAckLatency returns the moving average of the ACK latency
+func (l *analyzerLoad) averageAckLatency() time.Duration {
+	return time.Duration(math.Float64frombits(l.ackLatency.Load()) * float64(time.Second))
+}
@@ -0,0 +1,332 @@
+package distributor
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+// memoryBudget caps the bytes of messages queued for all analyzers together
+type memoryBudget struct {
+	limit int64 // 0 for no limit
+	used  atomic.Int64
+}
+
+// reserve takes n bytes from the budget, returning false if they do not fit
+func (b *memoryBudget) reserve(n int64) bool {
+	if b == nil {
+		return true
+	}
+	if used := b.used.Add(n); b.limit > 0 && used > b.limit {
+		b.used.Add(-n)
+		return false
+	}
+	return true
+}
+
+// charge takes n bytes from the budget even beyond its limit, for messages
+// that cannot be refused
+func (b *memoryBudget) charge(n int64) {
+	if b != nil {
+		b.used.Add(n)
+	}
+}
+
+// release returns n bytes to the budget
+func (b *memoryBudget) release(n int64) {
+	if b != nil {
+		b.used.Add(-n)
+	}
+}
+
+// fits reports whether n more bytes would currently fit
+func (b *memoryBudget) fits(n int64) bool {
+	return b == nil || b.limit <= 0 || b.used.Load()+n <= b.limit
+}
+
+// Capacity kept by a drained FIFO for reuse; larger ones are freed
+const fifoKeepCapacity = 64
+
+// analyzerQueue holds the messages routed to an analyzer until its handler
+// sends them, in a FIFO per slot: the priority, or the lane in ordered mode.
+// FIFOs are allocated on first use and large ones are freed once drained, so
+// idle priorities cost nothing. A bitmap of the non-empty slots finds the most
+// urgent message without scanning all 256.
+//
+// The queue is bounded, optionally, by messages and bytes across slots and by a
+// memory budget shared with the other analyzers.
+// A message that does not fit is rejected and left to the overload policy. The
+// bytes of a message taken to be sent stay counted against the byte limit and
+// the budget until done is called for it, once it was acknowledged or handed
+// back, as the handler holds it until then.
+//
+// Queuing a message signals ready, on which the handler sending the messages
+// waits while the queue is empty.
+type analyzerQueue struct {
+	mutex    sync.Mutex
+	fifos    [256]*messageFIFO
+	nonEmpty [4]uint64 // Bit i set when slot i holds messages
+	ready    chan struct{}
+
+	lens    [256]atomic.Int32 // Messages in each slot, readable without the mutex
+	count   atomic.Int32
+	bytes   atomic.Int64
+	unacked atomic.Int64 // Bytes of the messages taken by popBatch and not done
+
+	countLimit int32 // Messages across slots, 0 for no limit
+	byteLimit  int64 // Bytes across slots, 0 for no limit
+	budget     *memoryBudget
+}
+
+// messageFIFO is a growable ring of messages
+type messageFIFO struct {
+	items []LogMessage
+	head  int
+}
+
+// configure sets the queue's limits, which apply to messages queued afterwards
+func (q *analyzerQueue) configure(countLimit int, byteLimit int64, budget *memoryBudget) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.countLimit = int32(countLimit)
+	q.byteLimit = byteLimit
+	q.budget = budget
+	if q.ready == nil {
+		q.ready = make(chan struct{}, 1)
+	}
+}
+
+// wake signals ready, unless a signal is already waiting
+func (q *analyzerQueue) wake() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// push queues msg in a slot, returning false if it does not fit
+func (q *analyzerQueue) push(slot uint8, msg LogMessage) bool {
+	size := int64(len(msg.GetData()))
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if !q.roomLocked(0, 0, size) {
+		if q.byteLimit > 0 && q.held()+size > q.byteLimit {
+			analyzerBudgetRejections.Inc()
+		}
+		return false
+	}
+	if !q.budget.reserve(size) {
+		globalBudgetRejections.Inc()
+		return false
+	}
+	q.appendLocked(slot, msg, size)
+	return true
+}
+
+// pushEvicting queues msg in a slot, first evicting the oldest messages of the
+// highest slots above it until it fits. Nothing is evicted unless that makes
+// room. Returns the evicted messages and whether msg was queued.
+func (q *analyzerQueue) pushEvicting(slot uint8, msg LogMessage) ([]LogMessage, bool) {
+	size := int64(len(msg.GetData()))
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// Count what the slots above could free before evicting any of it
+	var freeCount int32
+	var freeBytes int64
+	for s := 255; s > int(slot); s-- {
+		if fifo := q.fifos[s]; fifo != nil {
+			for _, m := range fifo.items[fifo.head:] {
+				freeCount++
+				freeBytes += int64(len(m.GetData()))
+			}
+		}
+	}
+	if !q.roomLocked(freeCount, freeBytes, size) || !q.budget.fits(size-freeBytes) {
+		return nil, false
+	}
+
+	var evicted []LogMessage
+	for !q.roomLocked(0, 0, size) || !q.budget.reserve(size) {
+		s := q.lastLocked()
+		if s <= int(slot) {
+			return evicted, false // Another analyzer took the budget meanwhile
+		}
+		evicted = append(evicted, q.removeLocked(uint8(s)))
+	}
+	q.appendLocked(slot, msg, size)
+	return evicted, true
+}
+
+// roomLocked reports whether size more bytes fit once freeCount messages of
+// freeBytes were taken out, with the mutex held
+func (q *analyzerQueue) roomLocked(freeCount int32, freeBytes, size int64) bool {
+	if q.countLimit > 0 && q.count.Load()-freeCount >= q.countLimit {
+		return false
+	}
+	return q.byteLimit <= 0 || q.held()-freeBytes+size <= q.byteLimit
+}
+
+// appendLocked adds msg to a slot whose room was checked, with the mutex held
+func (q *analyzerQueue) appendLocked(slot uint8, msg LogMessage, size int64) {
+	fifo := q.fifos[slot]
+	if fifo == nil {
+		fifo = &messageFIFO{}
+		q.fifos[slot] = fifo
+	}
+	if fifo.head > 0 && len(fifo.items) == cap(fifo.items) {
+		// Reuse the space of the messages taken before growing
+		n := copy(fifo.items, fifo.items[fifo.head:])
+		clear(fifo.items[n:])
+		fifo.items, fifo.head = fifo.items[:n], 0
+	}
+	fifo.items = append(fifo.items, msg)
+
+	q.nonEmpty[slot/64] |= 1 << (slot % 64)
+	q.lens[slot].Add(1)
+	q.count.Add(1)
+	q.bytes.Add(size)
+	q.wake()
+}
+
+// popLocked takes the oldest message of a non-empty slot, with the mutex held.
+// Its bytes stay reserved in the budget.
+func (q *analyzerQueue) popLocked(slot uint8) LogMessage {
+	fifo := q.fifos[slot]
+	msg := fifo.items[fifo.head]
+	fifo.items[fifo.head] = nil
+	fifo.head++
+	if fifo.head == len(fifo.items) {
+		fifo.items, fifo.head = fifo.items[:0], 0
+		if cap(fifo.items) > fifoKeepCapacity {
+			q.fifos[slot] = nil
+		}
+		q.nonEmpty[slot/64] &^= 1 << (slot % 64)
+	}
+
+	size := int64(len(msg.GetData()))
+	q.lens[slot].Add(-1)
+	q.count.Add(-1)
+	q.bytes.Add(-size)
+	roomFreed.broadcast()
+	return msg
+}
+
+// removeLocked takes the oldest message of a non-empty slot out of the queue
+// for good, releasing its bytes, with the mutex held
+func (q *analyzerQueue) removeLocked(slot uint8) LogMessage {
+	msg := q.popLocked(slot)
+	q.budget.release(int64(len(msg.GetData())))
+	return msg
+}
+
+// done releases the bytes of a message taken by popBatch, once it was
+// acknowledged or handed back to the router
+func (q *analyzerQueue) done(msg LogMessage) {
+	size := int64(len(msg.GetData()))
+	q.unacked.Add(-size)
+	q.budget.release(size)
+	roomFreed.broadcast()
+}
+
+// held returns the bytes of the messages queued or taken and not done
+func (q *analyzerQueue) held() int64 {
+	return q.bytes.Load() + q.unacked.Load()
+}
+
+// firstLocked returns the lowest non-empty slot, -1 if the queue is empty
+func (q *analyzerQueue) firstLocked() int {
+	for i, word := range q.nonEmpty {
+		if word != 0 {
+			return i*64 + bits.TrailingZeros64(word)
+		}
+	}
+	return -1
+}
+
+// lastLocked returns the highest non-empty slot, -1 if the queue is empty
+func (q *analyzerQueue) lastLocked() int {
+	for i := len(q.nonEmpty) - 1; i >= 0; i-- {
+		if word := q.nonEmpty[i]; word != 0 {
+			return i*64 + 63 - bits.LeadingZeros64(word)
+		}
+	}
+	return -1
+}
+
+// popBatch appends up to max queued messages to batch, most urgent first: the
+// oldest messages of the lowest slots, the most urgent priorities. In ordered
+// mode, where slots are lanes holding mixed priorities, it takes the most
+// urgent of the lanes' oldest messages each time instead. Their bytes stay
+// counted until done is called for each.
+func (q *analyzerQueue) popBatch(batch []LogMessage, max int, ordered bool) []LogMessage {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for n := 0; n < max; n++ {
+		var slot int
+		if ordered {
+			slot = q.mostUrgentLocked()
+		} else {
+			slot = q.firstLocked()
+		}
+		if slot < 0 {
+			break
+		}
+		msg := q.popLocked(uint8(slot))
+		q.unacked.Add(int64(len(msg.GetData())))
+		batch = append(batch, msg)
+	}
+	return batch
+}
+
+// mostUrgentLocked returns the slot whose oldest message has the most urgent
+// priority, -1 if the queue is empty, with the mutex held
+func (q *analyzerQueue) mostUrgentLocked() int {
+	best := -1
+	var bestPriority uint8
+	for i, word := range q.nonEmpty {
+		for word != 0 {
+			slot := i*64 + bits.TrailingZeros64(word)
+			word &= word - 1
+			fifo := q.fifos[slot]
+			if priority := fifo.items[fifo.head].GetPriority(); best < 0 || priority < bestPriority {
+				best, bestPriority = slot, priority
+			}
+		}
+	}
+	return best
+}
+
+// drain takes every queued message, slot by slot
+func (q *analyzerQueue) drain() []LogMessage {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var msgs []LogMessage
+	for slot := q.firstLocked(); slot >= 0; slot = q.firstLocked() {
+		msgs = append(msgs, q.removeLocked(uint8(slot)))
+	}
+	return msgs
+}
+
+// len returns the number of queued messages
+func (q *analyzerQueue) len() int {
+	return int(q.count.Load())
+}
+
+// slotLen returns the number of messages queued in a slot
+func (q *analyzerQueue) slotLen(slot uint8) int {
+	return int(q.lens[slot].Load())
+}
+
+// fullReason explains why msg was rejected: DropMemoryBudget if it no longer
+// fits the analyzer's or the shared byte budget, DropChannelsFull otherwise
+func (q *analyzerQueue) fullReason(msg LogMessage) DropReason {
+	size := int64(len(msg.GetData()))
+	if !q.budget.fits(size) || (q.byteLimit > 0 && q.held()+size > q.byteLimit) {
+		return DropMemoryBudget
+	}
+	return DropChannelsFull
+}
@@ -0,0 +1,149 @@
+package distributor
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// benchmarkMessages returns messages of spread out priorities
+func benchmarkMessages() []LogMessage {
+	msgs := make([]LogMessage, 256)
+	for i := range msgs {
+		msgs[i] = ByteSliceMessage(dataFrame(uint8(i*37), "benchmark payload of a typical log line"))
+	}
+	return msgs
+}
+
+// Messages are taken by priority, oldest first within a priority, and in
+// ordered mode by the priority of each lane's oldest message
+func TestAnalyzerQueueOrder(t *testing.T) {
+	var q analyzerQueue
+	q.configure(0, 0, nil)
+	for i, priority := range []uint8{200, 3, 64, 3} {
+		q.push(priority, ByteSliceMessage(dataFrame(priority, string(rune('a'+i)))))
+	}
+	var got []string
+	for _, msg := range q.popBatch(nil, analyzerBatchSize, false) {
+		got = append(got, string(msg.GetData()[5:]))
+		q.done(msg)
+	}
+	if want := "bdca"; strings.Join(got, "") != want {
+		t.Errorf("taken in order %q, want %q", strings.Join(got, ""), want)
+	}
+
+	// Lane 0 holds a priority 9 message in front of a priority 1 one
+	q.push(0, ByteSliceMessage(dataFrame(9, "a")))
+	q.push(0, ByteSliceMessage(dataFrame(1, "b")))
+	q.push(7, ByteSliceMessage(dataFrame(5, "c")))
+	got = got[:0]
+	for _, msg := range q.popBatch(nil, analyzerBatchSize, true) {
+		got = append(got, string(msg.GetData()[5:]))
+		q.done(msg)
+	}
+	if want := "cab"; strings.Join(got, "") != want {
+		t.Errorf("taken in order %q, want %q", strings.Join(got, ""), want)
+	}
+}
+
+// A message taken to be sent keeps its bytes counted against the analyzer's
+// limit and the shared budget until it is done
+func TestAnalyzerQueueHoldsBytesUntilDone(t *testing.T) {
+	first, second := ByteSliceMessage(dataFrame(1, "first")), ByteSliceMessage(dataFrame(1, "second"))
+	size := int64(len(second))
+	for _, tt := range []struct {
+		name      string
+		byteLimit int64
+		budget    *memoryBudget
+	}{
+		{"analyzer limit", size, nil},
+		{"shared budget", 0, &memoryBudget{limit: size}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var q analyzerQueue
+			q.configure(0, tt.byteLimit, tt.budget)
+			if !q.push(1, first) {
+				t.Fatal("first message rejected")
+			}
+			sent := q.popBatch(nil, 1, false)
+			if q.push(1, second) {
+				t.Fatal("second message queued while the first awaits acknowledgement")
+			}
+			q.done(sent[0])
+			if !q.push(1, second) {
+				t.Error("second message rejected once the first was done")
+			}
+		})
+	}
+}
+
+// Pushes messages and takes them in batches as the writer does, by priority
+// and by ordered lane
+func BenchmarkAnalyzerQueuePushPopBatch(b *testing.B) {
+	msgs := benchmarkMessages()
+	for _, mode := range []struct {
+		name    string
+		ordered bool
+	}{{"priority", false}, {"ordered", true}} {
+		b.Run(mode.name, func(b *testing.B) {
+			var q analyzerQueue
+			q.configure(0, 0, &memoryBudget{})
+			batch := make([]LogMessage, 0, analyzerBatchSize)
+			b.ReportAllocs()
+			for i := 0; b.Loop(); i++ {
+				msg := msgs[i%len(msgs)]
+				slot := msg.GetPriority()
+				if mode.ordered {
+					slot = uint8(i) // Lanes hold mixed priorities
+				}
+				q.push(slot, msg)
+				if q.len() >= analyzerBatchSize {
+					batch = q.popBatch(batch[:0], analyzerBatchSize, mode.ordered)
+					for _, sent := range batch {
+						q.done(sent)
+					}
+				}
+			}
+		})
+	}
+}
+
+// Pushes from parallel routers while one writer drains the queue on wakeups
+func BenchmarkAnalyzerQueueParallelPush(b *testing.B) {
+	var q analyzerQueue
+	q.configure(0, 0, &memoryBudget{})
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		batch := make([]LogMessage, 0, analyzerBatchSize)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-q.ready:
+			}
+			for {
+				if batch = q.popBatch(batch[:0], analyzerBatchSize, false); len(batch) == 0 {
+					break
+				}
+				for _, sent := range batch {
+					q.done(sent)
+				}
+			}
+		}
+	}()
+
+	msgs := benchmarkMessages()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			msg := msgs[i%len(msgs)]
+			for !q.push(msg.GetPriority(), msg) {
+				runtime.Gosched()
+			}
+		}
+	})
+	close(stop)
+	<-done
+}
@@ -0,0 +1,194 @@
+package distributor
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"log"
+	"net"
+	"time"
+
+	"log-distributor/internal/protocol"
+)
+
+// Length of the resume tokens handed to analyzers
+const resumeTokenLen = 16
+
+// openSession decides which handler owns the session for a hello received on the
+// connection of ah: a parked session is re-attached when the analyzer presents its
+// resume token, otherwise ah starts a new session. Either way the session is
+// routed the given priorities. Returns the owning handler, whether it was
+// resumed, and a rejection reason if there is no owner.
+func (as *AnalyzerServer) openSession(ah *AnalyzerHandler, hello *protocol.Hello, priorities *protocol.PrioritySet) (*AnalyzerHandler, bool, string) {
+	if as.stopped() {
+		return nil, false, "distributor is shutting down"
+	}
+
+	as.handlersMutex.Lock()
+	existing := as.handlers[hello.ID]
+	wantsResume := hello.Features&protocol.AnalyzerFeatureResume != 0 && len(hello.ResumeToken) > 0
+	tokenMatches := existing != nil && wantsResume &&
+		subtle.ConstantTimeCompare(existing.resumeToken, hello.ResumeToken) == 1
+
+	switch {
+	case existing != nil && !existing.parked && tokenMatches:
+		// The analyzer reconnected before its old connection was noticed as dead.
+		// Tear that connection down so the session is parked for the next attempt.
+		as.handlersMutex.Unlock()
+		existing.handleDisconnection()
+		return nil, false, "previous connection is still being closed, retry shortly"
+
+	case existing != nil && !existing.parked:
+		as.handlersMutex.Unlock()
+		return nil, false, "analyzer ID \"" + hello.ID + "\" is already connected"
+
+	case existing != nil && tokenMatches:
+		// Take the parked session back before anyone else can
+		existing.parked = false
+		existing.expiry.Stop()
+		as.handlersMutex.Unlock()
+
+		if existing.resumeFrom(hello.LastSeq) {
+			existing.attach(ah.conn, hello.Features, priorities)
+			existing.reportWeight(hello.Weight)
+			return existing, true, ""
+		}
+
+		log.Printf("Analyzer %s reported sequence %d which does not match its session, starting over", hello.ID, hello.LastSeq)
+		as.replaceSession(existing)
+
+	case existing != nil:
+		// A parked session whose analyzer restarted without its token
+		existing.parked = false
+		existing.expiry.Stop()
+		as.handlersMutex.Unlock()
+		as.replaceSession(existing)
+
+	default:
+		as.handlersMutex.Unlock()
+	}
+
+	ah.config.AnalyzerID = hello.ID
+	ah.config.Priorities = priorities
+	ah.config.Weight = hello.Weight
+	ah.reportedWeight = hello.Weight
+	ah.features = hello.Features
+	ah.initSession()
+	if ah.features&protocol.AnalyzerFeatureResume != 0 {
+		ah.resumeToken = make([]byte, resumeTokenLen)
+		rand.Read(ah.resumeToken)
+	}
+
+	if !as.claimID(ah) {
+		return nil, false, "analyzer ID \"" + hello.ID + "\" is already connected"
+	}
+	return ah, false, ""
+}
+
+// replaceSession discards a session that can no longer be resumed
+func (as *AnalyzerServer) replaceSession(old *AnalyzerHandler) {
+	as.releaseID(old)
+	old.abandon()
+}
+
+// claimID registers the handler under its analyzer ID, failing if the ID is taken
+func (as *AnalyzerServer) claimID(ah *AnalyzerHandler) bool {
+	as.handlersMutex.Lock()
+	defer as.handlersMutex.Unlock()
+
+	if _, exists := as.handlers[ah.config.AnalyzerID]; exists || as.stopped() {
+		return false
+	}
+	as.handlers[ah.config.AnalyzerID] = ah
+	ah.claimed = true
+	return true
+}
+
+// releaseID removes the handler from the registry if it still owns its ID
+func (as *AnalyzerServer) releaseID(ah *AnalyzerHandler) {
+	as.handlersMutex.Lock()
+	defer as.handlersMutex.Unlock()
+
+	if as.handlers[ah.config.AnalyzerID] == ah {
+		delete(as.handlers, ah.config.AnalyzerID)
+	}
+	ah.claimed = false
+}
+
+// parkSession keeps a disconnected handler's queues for the resume grace window.
+// Returns false if the session cannot be resumed and must be abandoned instead.
+func (as *AnalyzerServer) parkSession(ah *AnalyzerHandler) bool {
+	if ah.features&protocol.AnalyzerFeatureResume == 0 || as.resumeGrace <= 0 || ah.evicted.Load() || ah.leaving.Load() {
+		return false
+	}
+
+	as.handlersMutex.Lock()
+	defer as.handlersMutex.Unlock()
+
+	if as.stopping || !ah.claimed {
+		return false
+	}
+
+	ah.parked = true
+	ah.expiry = time.AfterFunc(as.resumeGrace, func() {
+		as.expireSession(ah)
+	})
+	return true
+}
+
+// expireSession abandons a parked session whose analyzer did not come back in time
+func (as *AnalyzerServer) expireSession(ah *AnalyzerHandler) {
+	as.handlersMutex.Lock()
+	if !ah.parked || as.handlers[ah.config.AnalyzerID] != ah {
+		as.handlersMutex.Unlock()
+		return
+	}
+	ah.parked = false
+	delete(as.handlers, ah.config.AnalyzerID)
+	ah.claimed = false
+	as.handlersMutex.Unlock()
+
+	log.Printf("Session of analyzer %s expired, rerouting its messages", ah.config.AnalyzerID)
+	ah.abandon()
+}
+
+// abandonParkedSessions reroutes the messages of every parked session
+func (as *AnalyzerServer) abandonParkedSessions() {
+	as.handlersMutex.Lock()
+	var parked []*AnalyzerHandler
+	for _, ah := range as.handlers {
+		if ah.parked {
+			ah.expiry.Stop()
+			parked = append(parked, ah)
+		}
+	}
+	as.handlersMutex.Unlock()
+
+	for _, ah := range parked {
+		as.expireSession(ah)
+	}
+}
+
+// attach moves a resumed session onto the connection the analyzer came back on,
+// with the priorities it subscribed to this time
+func (ah *AnalyzerHandler) attach(conn net.Conn, features uint32, priorities *protocol.PrioritySet) {
+	ah.weightMutex.Lock()
+	defer ah.weightMutex.Unlock()
+
+	ah.conn = conn
+	ah.features = features
+	ah.config.Priorities = priorities
+}
+
+// resumeFrom acknowledges everything the analyzer reports having received before
+// it reconnected. Returns false if lastSeq does not fit the pending queue.
+func (ah *AnalyzerHandler) resumeFrom(lastSeq uint32) bool {
+	ah.pendingMutex.Lock()
+	received := (lastSeq - ah.lastAckedSeqNum) & SeqNumValueMask
+	consistent := int(received) <= ah.pendingQueue.Len()
+	ah.pendingMutex.Unlock()
+
+	if consistent {
+		ah.handleAck(lastSeq & SeqNumValueMask)
+	}
+	return consistent
+}
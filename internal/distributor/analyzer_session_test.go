@@ -0,0 +1,244 @@
+package distributor
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"log-distributor/internal/protocol"
+)
+
+// waitForState waits until the session of an analyzer reaches a state
+func waitForState(t testing.TB, as *AnalyzerServer, id, state string) AnalyzerStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		st, err := as.Analyzer(id)
+		if err == nil && st.State == state {
+			return st
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("analyzer %s is %q (%v), want %q", id, st.State, err, state)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// A resumed session sends again what the analyzer did not report receiving,
+// then carries on with new messages on the new connection
+func TestSessionResumeResendsUnreceived(t *testing.T) {
+	router := NewWeightedTreeRouter()
+	as := startAnalyzerServer(t, router, AnalyzerServerOptions{ResumeGrace: 10 * time.Second})
+
+	hello := &protocol.Hello{Version: protocol.Version, Features: protocol.AnalyzerFeatureResume, Weight: 1, ID: "a1"}
+	conn, reply := dialAnalyzer(t, as, hello)
+	if reply.Resumed || len(reply.ResumeToken) == 0 {
+		t.Fatalf("first hello: resumed %v, token %x", reply.Resumed, reply.ResumeToken)
+	}
+	waitForState(t, as, "a1", AnalyzerStateConnected)
+
+	first, second := dataFrame(3, "first"), dataFrame(3, "second")
+	for _, frame := range [][]byte{first, second} {
+		if !router.RouteMessage(ByteSliceMessage(frame)) {
+			t.Fatal("message not routed")
+		}
+		if got := readDataFrame(t, conn); string(got) != string(frame) {
+			t.Fatalf("received %q, want %q", got, frame)
+		}
+	}
+	conn.Close()
+	waitForState(t, as, "a1", AnalyzerStateParked)
+
+	// Only the first message made it to the analyzer's side
+	hello.ResumeToken, hello.LastSeq = reply.ResumeToken, 1
+	conn, reply = dialAnalyzer(t, as, hello)
+	if !reply.Resumed {
+		t.Fatal("session was not resumed")
+	}
+	if got := readDataFrame(t, conn); string(got) != string(second) {
+		t.Errorf("resent %q, want %q", got, second)
+	}
+
+	third := dataFrame(3, "third")
+	waitForState(t, as, "a1", AnalyzerStateConnected)
+	if !router.RouteMessage(ByteSliceMessage(third)) {
+		t.Fatal("message not routed to the resumed session")
+	}
+	if got := readDataFrame(t, conn); string(got) != string(third) {
+		t.Errorf("received %q, want %q", got, third)
+	}
+}
+
+// A wrong resume token starts a new session instead of taking over the parked one
+func TestSessionResumeRejectsWrongToken(t *testing.T) {
+	as := startAnalyzerServer(t, NewWeightedTreeRouter(), AnalyzerServerOptions{ResumeGrace: 10 * time.Second})
+
+	hello := &protocol.Hello{Version: protocol.Version, Features: protocol.AnalyzerFeatureResume, Weight: 1, ID: "a1"}
+	conn, reply := dialAnalyzer(t, as, hello)
+	waitForState(t, as, "a1", AnalyzerStateConnected)
+	conn.Close()
+	waitForState(t, as, "a1", AnalyzerStateParked)
+
+	hello.ResumeToken = append([]byte{^reply.ResumeToken[0]}, reply.ResumeToken[1:]...)
+	_, second := dialAnalyzer(t, as, hello)
+	if second.Resumed {
+		t.Error("session resumed with a wrong token")
+	}
+	if string(second.ResumeToken) == string(reply.ResumeToken) {
+		t.Error("new session was given the old token")
+	}
+}
+
+// The admin API reads the session while a resume moves it onto the new
+// connection; run with -race.
+func TestResumeWhileStatusIsRead(t *testing.T) {
+	router := NewWeightedTreeRouter()
+	as := startAnalyzerServer(t, router, AnalyzerServerOptions{ResumeGrace: 10 * time.Second})
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				as.Analyzers()
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	hello := &protocol.Hello{Version: protocol.Version, Features: protocol.AnalyzerFeatureResume, Weight: 1, ID: "a1"}
+	conn, reply := dialAnalyzer(t, as, hello)
+	waitForState(t, as, "a1", AnalyzerStateConnected)
+	conn.Close()
+	waitForState(t, as, "a1", AnalyzerStateParked)
+
+	hello.ResumeToken = reply.ResumeToken
+	conn, reply = dialAnalyzer(t, as, hello)
+	if !reply.Resumed {
+		t.Fatal("session was not resumed")
+	}
+	st := waitForState(t, as, "a1", AnalyzerStateConnected)
+	if st.RemoteAddr != conn.LocalAddr().String() {
+		t.Errorf("remote address %s, want the new connection's %s", st.RemoteAddr, conn.LocalAddr())
+	}
+
+	want := dataFrame(3, "after resume")
+	if !router.RouteMessage(ByteSliceMessage(want)) {
+		t.Fatal("message not routed to the resumed session")
+	}
+	if got := readDataFrame(t, conn); string(got) != string(want) {
+		t.Errorf("received %q, want %q", got, want)
+	}
+}
+
+// An analyzer that asks to drain keeps receiving what is queued for it, takes
+// no new messages and is said goodbye once it acknowledged everything
+func TestAnalyzerDrainRequestSaysGoodbye(t *testing.T) {
+	router := NewWeightedTreeRouter()
+	as := startAnalyzerServer(t, router, AnalyzerServerOptions{ResumeGrace: 10 * time.Second})
+
+	hello := &protocol.Hello{Version: protocol.Version, Features: protocol.AnalyzerFeatureResume | protocol.AnalyzerFeatureDrain, Weight: 1, ID: "a1"}
+	conn, _ := dialAnalyzer(t, as, hello)
+	waitForState(t, as, "a1", AnalyzerStateConnected)
+
+	want := dataFrame(3, "before drain")
+	if !router.RouteMessage(ByteSliceMessage(want)) {
+		t.Fatal("message not routed")
+	}
+	if got := readDataFrame(t, conn); string(got) != string(want) {
+		t.Fatalf("received %q, want %q", got, want)
+	}
+
+	conn.Write(binary.BigEndian.AppendUint32(nil, protocol.AnalyzerDrainRequest))
+	if st := waitForState(t, as, "a1", AnalyzerStateDraining); !st.Leaving {
+		t.Error("draining analyzer not marked as leaving")
+	}
+	if err := as.Undrain("a1"); !errors.Is(err, ErrAnalyzerLeaving) {
+		t.Errorf("undrain: %v, want %v", err, ErrAnalyzerLeaving)
+	}
+	if router.HasAnalyzers() {
+		t.Error("leaving analyzer still in the router")
+	}
+
+	conn.Write(binary.BigEndian.AppendUint32(nil, SeqNumMSBMask|1))
+	goodbye := protocol.AppendControlFrame(nil, protocol.AnalyzerFrameGoodbye, nil)
+	got := make([]byte, len(goodbye))
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != string(goodbye) {
+		t.Fatalf("received %x (%v), want the goodbye %x", got, err, goodbye)
+	}
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read %d bytes (%v) after the goodbye, want the connection closed", n, err)
+	}
+}
+
+// Shutdown waits for analyzers to acknowledge what they were sent, and stops
+// parking sessions
+func TestDrainAllWaitsForAcks(t *testing.T) {
+	router := NewWeightedTreeRouter()
+	as := startAnalyzerServer(t, router, AnalyzerServerOptions{ResumeGrace: 10 * time.Second})
+
+	hello := &protocol.Hello{Version: protocol.Version, Features: protocol.AnalyzerFeatureResume, Weight: 1, ID: "a1"}
+	conn, _ := dialAnalyzer(t, as, hello)
+	waitForState(t, as, "a1", AnalyzerStateConnected)
+	if !router.RouteMessage(ByteSliceMessage(dataFrame(3, "unacknowledged"))) {
+		t.Fatal("message not routed")
+	}
+	readDataFrame(t, conn)
+
+	if as.DrainAll(50 * time.Millisecond) {
+		t.Fatal("drained with a message still pending")
+	}
+	conn.Write(binary.BigEndian.AppendUint32(nil, SeqNumMSBMask|1))
+	if !as.DrainAll(5 * time.Second) {
+		t.Fatal("not drained once the message was acknowledged")
+	}
+
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		st, err := as.Analyzer("a1")
+		if errors.Is(err, ErrAnalyzerNotFound) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("analyzer is %q after disconnecting during shutdown, want it gone rather than parked", st.State)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// An analyzer subscribed to a priority range only receives those priorities
+func TestAnalyzerSubscribesToPriorities(t *testing.T) {
+	router := NewWeightedTreeRouter()
+	as := startAnalyzerServer(t, router, AnalyzerServerOptions{})
+
+	subscribed := protocol.PrioritySet{}
+	subscribed.AddRange(0, 9)
+	conn, reply := dialAnalyzer(t, as, &protocol.Hello{Version: protocol.Version, Weight: 1, ID: "a1", Priorities: &subscribed})
+	if reply.Priorities == nil || *reply.Priorities != subscribed {
+		t.Fatalf("granted priorities %v, want %s", reply.Priorities, subscribed)
+	}
+	if st := waitForState(t, as, "a1", AnalyzerStateConnected); st.Priorities != "0-9" {
+		t.Errorf("status priorities %q, want 0-9", st.Priorities)
+	}
+
+	if router.RouteMessage(ByteSliceMessage(dataFrame(10, "unsubscribed"))) {
+		t.Error("priority 10 routed to an analyzer subscribed to 0-9")
+	}
+	want := dataFrame(9, "subscribed")
+	if !router.RouteMessage(ByteSliceMessage(want)) {
+		t.Fatal("priority 9 not routed")
+	}
+	if got := readDataFrame(t, conn); string(got) != string(want) {
+		t.Errorf("received %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,88 @@
+package distributor
+
+import (
+	"fmt"
+
+	"log-distributor/internal/auth"
+	"log-distributor/internal/protocol"
+)
+
+// accessControl authenticates and authorizes the clients of a server
+type accessControl struct {
+	authenticator auth.Authenticator // nil accepts clients without credentials
+	authorizer    auth.Authorizer    // nil allows every client everything
+}
+
+// identify works out which client a hello comes from. The ID in the client's
+// certificate and the one its token proves must agree with each other and with
+// the ID in the hello, which may be left empty when either is present.
+// Returns the ID, or the reason to reject the client.
+func (ac *accessControl) identify(role auth.Role, certID string, hello *protocol.Hello) (string, string) {
+	id := hello.ID
+	if certID != "" {
+		if id != "" && id != certID {
+			authRejected(role, "identity_mismatch")
+			return "", fmt.Sprintf("%s ID %q does not match its certificate (%s)", role, id, certID)
+		}
+		id = certID
+	}
+
+	if ac.authenticator != nil {
+		tokenID, err := ac.authenticator.Authenticate(role, hello.AuthToken)
+		if err != nil {
+			authRejected(role, "unauthenticated")
+			return "", fmt.Sprintf("authentication failed: %v", err)
+		}
+		if id != "" && id != tokenID {
+			authRejected(role, "identity_mismatch")
+			return "", fmt.Sprintf("%s ID %q does not match its token (%s)", role, id, tokenID)
+		}
+		id = tokenID
+	}
+
+	if id == "" {
+		return "", fmt.Sprintf("%s ID must not be empty", role)
+	}
+	return id, ""
+}
+
+// allowLegacy reports whether clients skipping the hello, and so presenting no
+// credentials, may connect
+func (ac *accessControl) allowLegacy(role auth.Role) bool {
+	if ac.authenticator == nil {
+		return true
+	}
+	authRejected(role, "unauthenticated")
+	return false
+}
+
+// allowEmitter reports whether an emitter may publish messages
+func (ac *accessControl) allowEmitter(id string) bool {
+	if ac.authorizer == nil || ac.authorizer.AllowEmitter(id) {
+		return true
+	}
+	authRejected(auth.RoleEmitter, "unauthorized")
+	return false
+}
+
+// analyzerPriorities returns the priorities an analyzer may receive, nil for
+// all of them, and false if it may not connect
+func (ac *accessControl) analyzerPriorities(id string) (*protocol.PrioritySet, bool) {
+	if ac.authorizer == nil {
+		return nil, true
+	}
+	priorities, ok := ac.authorizer.AnalyzerPriorities(id)
+	if !ok || priorities.IsEmpty() {
+		authRejected(auth.RoleAnalyzer, "unauthorized")
+		return nil, false
+	}
+	if priorities.IsFull() {
+		return nil, true
+	}
+	return &priorities, true
+}
+
+// authRejected counts a connection rejected for reason
+func authRejected(role auth.Role, reason string) {
+	authRejections.With(string(role), reason).Inc()
+}
@@ -0,0 +1,305 @@
+package distributor
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"log-distributor/internal/protocol"
+)
+
+// DropReason records why the router gave up on a message
+type DropReason uint8
+
+const (
+	DropNoAnalyzers  DropReason = 1 // No analyzer was registered
+	DropChannelsFull DropReason = 2 // Every analyzer tried had a full queue
+	DropShutdown     DropReason = 3 // The router was shutting down
+
+	DropNoAnalyzerForPriority DropReason = 4 // No registered analyzer may receive the priority
+	DropNoAnalyzerInGroup     DropReason = 5 // The routing rules picked a group without analyzers
+	DropEvicted               DropReason = 6 // Evicted from an analyzer queue to make room for a more urgent message
+	DropMemoryBudget          DropReason = 7 // The analyzer's or the shared memory budget was exhausted
+)
+
+// String returns a short name for the reason
+func (r DropReason) String() string {
+	switch r {
+	case DropNoAnalyzers:
+		return "no analyzers"
+	case DropChannelsFull:
+		return "channels full"
+	case DropShutdown:
+		return "shutdown"
+	case DropNoAnalyzerForPriority:
+		return "no analyzer for priority"
+	case DropNoAnalyzerInGroup:
+		return "no analyzer in group"
+	case DropEvicted:
+		return "evicted"
+	case DropMemoryBudget:
+		return "memory budget exhausted"
+	}
+	return "unknown (" + strconv.Itoa(int(r)) + ")"
+}
+
+// DeadLetter is a message the router could not deliver
+type DeadLetter struct {
+	Reason   DropReason
+	Source   string // Emitter the message came from, empty if unknown
+	Priority uint8
+	Time     time.Time
+	Frame    []byte            // The complete frame as received from the emitter
+	Headers  *protocol.Headers // Headers of an envelope frame, nil for a data frame
+}
+
+// DeadLetterSink stores messages the router could not deliver
+type DeadLetterSink interface {
+	WriteDeadLetter(dl *DeadLetter) error
+	Close() error
+}
+
+const (
+	// Extension of sealed dead-letter segments, which are safe to replay
+	DeadLetterExt = ".dlq"
+	// Extension of the segment currently being written
+	deadLetterOpenExt = ".open"
+	// Extension of segments set aside after a record could not be read back
+	deadLetterCorruptExt = ".corrupt"
+
+	// Record header: [4 bytes: body length][4 bytes: CRC32 of body]
+	deadLetterHeaderLen = 8
+)
+
+// FileDeadLetterSink appends dead letters to segment files in a directory.
+// The segment being written ends in ".open" and is renamed to ".dlq" once it
+// is full or the sink is closed. Segments are synced when sealed, or earlier
+// by Sync.
+//
+// Record body: [1 byte: reason][1 byte: priority][8 bytes: unix nanoseconds]
+// [1 byte: source length][source][frame]
+type FileDeadLetterSink struct {
+	dir         string
+	segmentSize int64
+
+	mutex   sync.Mutex
+	file    *os.File
+	path    string
+	size    int64
+	dirty   bool // Written since the last sync
+	nextSeq uint64
+	scratch []byte
+}
+
+// NewFileDeadLetterSink opens a file sink in dir. Segments left open by a
+// previous run are sealed so they can be replayed.
+func NewFileDeadLetterSink(dir string, segmentSize int64) (*FileDeadLetterSink, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create dead-letter directory %s: %w", dir, err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dead-letter directory %s: %w", dir, err)
+	}
+
+	sink := &FileDeadLetterSink{dir: dir, segmentSize: segmentSize, nextSeq: 1}
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		if ext != DeadLetterExt && ext != deadLetterOpenExt && ext != deadLetterCorruptExt {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+		if err != nil {
+			continue
+		}
+		sink.nextSeq = max(sink.nextSeq, seq+1)
+
+		if ext == deadLetterOpenExt {
+			path := filepath.Join(dir, name)
+			if err := os.Rename(path, strings.TrimSuffix(path, ext)+DeadLetterExt); err != nil {
+				return nil, fmt.Errorf("failed to seal dead-letter segment %s: %w", path, err)
+			}
+		}
+	}
+	return sink, nil
+}
+
+// WriteDeadLetter appends a dead letter to the current segment
+func (s *FileDeadLetterSink) WriteDeadLetter(dl *DeadLetter) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil || s.size >= s.segmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	s.scratch = appendDeadLetterRecord(s.scratch[:0], dl)
+	n, err := s.file.Write(s.scratch)
+	s.size += int64(n)
+	s.dirty = true
+	if err != nil {
+		return fmt.Errorf("failed to write dead letter to %s: %w", s.path, err)
+	}
+	return nil
+}
+
+// Sync fsyncs the dead letters written so far. Callers syncing while another
+// sync runs wait for it, and return at once if it covered their writes.
+func (s *FileDeadLetterSink) Sync() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.dirty {
+		return nil
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync dead-letter segment %s: %w", s.path, err)
+	}
+	s.dirty = false
+	return nil
+}
+
+// rotate seals the current segment and opens the next one
+func (s *FileDeadLetterSink) rotate() error {
+	if err := s.seal(); err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", s.nextSeq, deadLetterOpenExt))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create dead-letter segment %s: %w", path, err)
+	}
+	s.nextSeq++
+	s.file, s.path, s.size = file, path, 0
+	return nil
+}
+
+// seal syncs and closes the current segment and gives it its final name. A
+// segment that failed to sync is still sealed, but the error is returned so
+// nothing relies on it being on disk.
+func (s *FileDeadLetterSink) seal() error {
+	if s.file == nil {
+		return nil
+	}
+
+	file, path := s.file, s.path
+	s.file, s.path, s.dirty = nil, "", false
+	syncErr := file.Sync()
+	file.Close()
+	if err := os.Rename(path, strings.TrimSuffix(path, deadLetterOpenExt)+DeadLetterExt); err != nil {
+		return fmt.Errorf("failed to seal dead-letter segment %s: %w", path, err)
+	}
+	if syncErr != nil {
+		return fmt.Errorf("failed to sync dead-letter segment %s: %w", path, syncErr)
+	}
+	return nil
+}
+
+// Close seals the current segment
+func (s *FileDeadLetterSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.seal()
+}
+
+// appendDeadLetterRecord encodes a dead letter as a file record
+func appendDeadLetterRecord(buf []byte, dl *DeadLetter) []byte {
+	source := dl.Source
+	if len(source) > 255 {
+		source = source[:255]
+	}
+
+	start := len(buf)
+	buf = append(buf, make([]byte, deadLetterHeaderLen)...)
+	buf = append(buf, uint8(dl.Reason), dl.Priority)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(dl.Time.UnixNano()))
+	buf = append(buf, uint8(len(source)))
+	buf = append(buf, source...)
+	buf = append(buf, dl.Frame...)
+
+	body := buf[start+deadLetterHeaderLen:]
+	binary.BigEndian.PutUint32(buf[start:], uint32(len(body)))
+	binary.BigEndian.PutUint32(buf[start+4:], crc32.ChecksumIEEE(body))
+	return buf
+}
+
+// DeadLetterFiles returns the sealed segments in dir, oldest first
+func DeadLetterFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dead-letter directory %s: %w", dir, err)
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && filepath.Ext(entry.Name()) == DeadLetterExt {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// ReadDeadLetters calls fn for each record in a dead-letter segment until fn
+// returns false. A torn record at the end of the file is ignored.
+func ReadDeadLetters(path string, fn func(dl *DeadLetter) bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open dead-letter segment %s: %w", path, err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var header [deadLetterHeaderLen]byte
+	for {
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return fmt.Errorf("failed to read dead-letter segment %s: %w", path, err)
+		}
+
+		body := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+		if _, err := io.ReadFull(reader, body); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return fmt.Errorf("failed to read dead-letter segment %s: %w", path, err)
+		}
+		if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:8]) {
+			return fmt.Errorf("corrupt record in dead-letter segment %s", path)
+		}
+		if len(body) < 11 || len(body) < 11+int(body[10]) {
+			return fmt.Errorf("malformed record in dead-letter segment %s", path)
+		}
+
+		sourceLen := int(body[10])
+		dl := &DeadLetter{
+			Reason:   DropReason(body[0]),
+			Priority: body[1],
+			Time:     time.Unix(0, int64(binary.BigEndian.Uint64(body[2:10]))),
+			Source:   string(body[11 : 11+sourceLen]),
+			Frame:    body[11+sourceLen:],
+		}
+		if msg, err := ParseMessage(dl.Frame); err == nil {
+			dl.Headers = messageHeaders(msg)
+		}
+		if !fn(dl) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package distributor
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink keeps the payloads of the messages dead-lettered to it
+type recordingSink struct {
+	mutex    sync.Mutex
+	payloads []string
+	reasons  []DropReason
+	syncs    int
+	syncErr  error // Returned by Sync
+}
+
+func (s *recordingSink) WriteDeadLetter(dl *DeadLetter) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.payloads = append(s.payloads, string(dl.Frame[5:]))
+	s.reasons = append(s.reasons, dl.Reason)
+	return nil
+}
+
+func (s *recordingSink) Sync() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.syncs++
+	return s.syncErr
+}
+
+func (s *recordingSink) Close() error { return nil }
+
+func (s *recordingSink) received() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.payloads...)
+}
+
+func TestFileDeadLetterSinkRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := NewFileDeadLetterSink(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	letters := []*DeadLetter{
+		{Reason: DropNoAnalyzers, Source: "e1", Priority: 0, Time: time.Unix(0, 12345), Frame: dataFrame(0, "first")},
+		{Reason: DropChannelsFull, Priority: 200, Time: time.Unix(7, 0), Frame: dataFrame(200, "second")},
+	}
+	for _, dl := range letters {
+		if err := sink.WriteDeadLetter(dl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	defer sink.file.Close()
+
+	// A crash leaves the segment open, and the next start seals it
+	if _, err := NewFileDeadLetterSink(dir, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	files, err := DeadLetterFiles(dir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("segments %q (%v), want one sealed", files, err)
+	}
+
+	var got []string
+	err = ReadDeadLetters(files[0], func(dl *DeadLetter) bool {
+		got = append(got, fmt.Sprintf("%s %q %d %d %q", dl.Reason, dl.Source, dl.Priority, dl.Time.UnixNano(), dl.Frame))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for _, dl := range letters {
+		want = append(want, fmt.Sprintf("%s %q %d %d %q", dl.Reason, dl.Source, dl.Priority, dl.Time.UnixNano(), dl.Frame))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("read %q, want %q", got, want)
+	}
+}
+
+// A dead-lettered message is released from the WAL only once the sink has
+// synced it, so a crash right after the drop cannot lose it
+func TestDeadLetterReleasesWALRecordOnceSynced(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestWAL(t, dir, 1) // Every record starts a new segment
+	sink := &recordingSink{syncErr: errors.New("disk gone")}
+	router := NewWeightedTreeRouter() // No analyzers
+	router.SetDeadLetterSink(sink)
+
+	if !router.RouteMessage(appendFrames(t, w, "unsynced")[0]) {
+		t.Fatal("message not dead-lettered")
+	}
+	sink.syncErr = nil
+	if !router.RouteMessage(appendFrames(t, w, "synced")[0]) {
+		t.Fatal("message not dead-lettered")
+	}
+	appendFrames(t, w, "rotates the second out")
+
+	first := fmt.Sprintf("%020d", 1)
+	files := walFiles(t, dir)
+	if len(files) != 4 || files[0] != first+walDataExt {
+		t.Errorf("files %q, want the unsynced record's segment and the active one", files)
+	}
+	if sink.syncs != 2 {
+		t.Errorf("sink synced %d times, want once per dead letter", sink.syncs)
+	}
+}
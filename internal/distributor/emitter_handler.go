@@ -2,15 +2,35 @@ package distributor
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"log-distributor/internal/auth"
+	"log-distributor/internal/metrics"
+	"log-distributor/internal/protocol"
+	"log-distributor/internal/tlsconfig"
 )
 
+// Emitter features this distributor is able to honour
+const supportedEmitterFeatures = protocol.EmitterFeatureAcks | protocol.EmitterFeatureBatch | protocol.EmitterFeatureCompression |
+	protocol.EmitterFeatureEnvelope
+
+// DefaultEmitterAddr is the address emitters connect to unless configured otherwise
+const DefaultEmitterAddr = ":8080"
+
+// DefaultMaxFrameSize is the largest frame accepted from emitters unless
+// configured otherwise
+const DefaultMaxFrameSize = 1 << 20
+
 // Buffer pool for message allocation
 var messagePool = sync.Pool{
 	New: func() interface{} {
@@ -34,65 +54,287 @@ func (m ByteSliceMessage) GetData() []byte {
 // GetLength returns the message length
 func (m ByteSliceMessage) GetLength() int {
 	if len(m) >= 4 {
-        return int(binary.BigEndian.Uint32(m[0:4]))
-    }
-    return 0
+		return int(binary.BigEndian.Uint32(m[0:4]))
+	}
+	return 0
 }
 
 // GetPriority returns the priority (severity) byte (0 = highest priority)
 func (m ByteSliceMessage) GetPriority() uint8 {
 	if len(m) >= 5 {
-		return m[4]  // 5th byte is the severity/priority
+		return m[4] // 5th byte is the severity/priority
+	}
+	return 255 // Default to lowest priority if malformed
+}
+
+// ingressMessage is a frame received from an emitter, tracked until an analyzer
+// acknowledges it
+type ingressMessage struct {
+	LogMessage        // ByteSliceMessage, or *EnvelopeMessage for an envelope frame
+	source     string // ID of the emitter that sent the frame, empty if unknown
+	wal        *WAL   // Set once the frame is in the write-ahead log
+	lsn        uint64
+	acked      atomic.Bool
+
+	// Set when the distributor stamps messages, see EmitterServerOptions.Stamp
+	received  time.Time
+	ingestSeq uint64
+}
+
+// Source returns the ID of the emitter the message came from
+func (m *ingressMessage) Source() string {
+	return m.source
+}
+
+// Envelope returns the envelope the message came in, nil for a data frame
+func (m *ingressMessage) Envelope() *EnvelopeMessage {
+	return envelopeOf(m.LogMessage)
+}
+
+// metadata returns the stamp sent to analyzers with the message, if it has one
+func (m *ingressMessage) metadata() protocol.Metadata {
+	if m.ingestSeq == 0 {
+		return protocol.Metadata{}
+	}
+	return protocol.Metadata{Received: m.received, IngestSeq: m.ingestSeq, Emitter: m.source}
+}
+
+// Ack marks the message as delivered so its WAL record can be released
+func (m *ingressMessage) Ack() {
+	if m.wal != nil && m.acked.CompareAndSwap(false, true) {
+		m.wal.ack(m.lsn)
 	}
-	return 255  // Default to lowest priority if malformed
 }
 
 // EmitterHandler manages a single TCP connection from an emitter
 type EmitterHandler struct {
 	conn      net.Conn
 	emitterID string
+	certID    string // Identity from the client certificate, empty without mutual TLS
 	router    RouterInterface
+	wal       *WAL // nil when the write-ahead log is disabled
+	access    *accessControl
 	wg        *sync.WaitGroup
+
+	maxFrameSize int
+
+	// Features negotiated during the handshake (0 for legacy emitters)
+	features uint32
+	idMutex  sync.Mutex // Guards emitterID and features while the handshake sets them
+
+	// Set when the server shuts down; reads then fail once buffered frames are consumed
+	stopping atomic.Bool
+
+	// Metrics for the emitter's ID, set once it is known
+	messagesReceived *metrics.Counter
+	bytesReceived    *metrics.Counter
+
+	// Connection statistics for the admin API
+	connectedAt time.Time
+	received    atomic.Uint64
+	bytes       atomic.Uint64
+
+	// Acknowledgement state, only used with protocol.EmitterFeatureAcks
+	ackWriter  *bufio.Writer
+	ackBuf     []byte
+	seqNum     uint32 // Sequence number of the last frame received
+	ackPending bool   // Whether seqNum was accepted but not yet acknowledged
+
+	// Scratch space for compressed batches, only used with protocol.EmitterFeatureCompression
+	compressed   []byte
+	decompressor protocol.Decompressor
+
+	// Numbers the emitter's messages, nil unless messages are stamped
+	stamps    *ingestCounters
+	ingestSeq *atomic.Uint64
+}
+
+// How long the numbering of an emitter ID without connections is kept for the
+// emitter to reconnect
+const ingestCounterIdle = 10 * time.Minute
+
+// Most emitter IDs without connections whose numbering is kept; the longest
+// idle ones are forgotten first
+const maxIdleIngestCounters = 10000
+
+// ingestCounters number the messages received from each emitter ID, so that
+// the numbering carries on when an emitter reconnects. The numbering of an ID
+// is forgotten once it has had no connection for ingestCounterIdle, or when
+// too many IDs are idle, and then starts over.
+type ingestCounters struct {
+	mutex     sync.Mutex
+	counters  map[string]*ingestCounter
+	idle      int // Counters without connections
+	lastSweep time.Time
+}
+
+// ingestCounter numbers the messages of one emitter ID
+type ingestCounter struct {
+	seq       atomic.Uint64
+	conns     int       // Open connections of the ID, guarded by the ingestCounters mutex
+	idleSince time.Time // When the last connection closed
+}
+
+// acquire returns the counter of an emitter ID for a new connection, creating
+// it on first use. The connection releases it when it closes.
+func (ic *ingestCounters) acquire(emitterID string) *atomic.Uint64 {
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+
+	now := time.Now()
+	if ic.idle > maxIdleIngestCounters || now.Sub(ic.lastSweep) > ingestCounterIdle/10 {
+		ic.sweepLocked(now)
+	}
+	counter, ok := ic.counters[emitterID]
+	if !ok {
+		counter = &ingestCounter{}
+		ic.counters[emitterID] = counter
+	} else if counter.conns == 0 {
+		ic.idle--
+	}
+	counter.conns++
+	return &counter.seq
+}
+
+// release records that a connection of an emitter ID closed
+func (ic *ingestCounters) release(emitterID string) {
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+
+	counter := ic.counters[emitterID]
+	if counter.conns--; counter.conns == 0 {
+		counter.idleSince = time.Now()
+		ic.idle++
+	}
+}
+
+// sweepLocked forgets the counters idle for too long and, if still too many
+// are idle, the longest idle ones, with the mutex held
+func (ic *ingestCounters) sweepLocked(now time.Time) {
+	ic.lastSweep = now
+	var idle []string
+	for id, counter := range ic.counters {
+		switch {
+		case counter.conns > 0:
+		case now.Sub(counter.idleSince) > ingestCounterIdle:
+			delete(ic.counters, id)
+			ic.idle--
+		default:
+			idle = append(idle, id)
+		}
+	}
+	if excess := len(idle) - maxIdleIngestCounters*3/4; ic.idle > maxIdleIngestCounters && excess > 0 {
+		// Leave room so the next few idle IDs do not sweep again
+		sort.Slice(idle, func(i, j int) bool {
+			return ic.counters[idle[i]].idleSince.Before(ic.counters[idle[j]].idleSince)
+		})
+		for _, id := range idle[:excess] {
+			delete(ic.counters, id)
+		}
+		ic.idle -= excess
+	}
 }
 
 // EmitterServer manages the TCP server for receiving emitter connections
 type EmitterServer struct {
-	port     int
+	addr     string
+	tls      *tlsconfig.Server
 	router   RouterInterface
+	wal      *WAL
+	access   accessControl
 	listener net.Listener
-	wg       sync.WaitGroup
-	shutdown chan struct{}
+
+	maxFrameSize int
+	stamps       *ingestCounters // nil unless messages are stamped
+	wg           sync.WaitGroup
+	shutdown     chan struct{}
+
+	// Open connections, for the admin API
+	emitters      map[*EmitterHandler]struct{}
+	emittersMutex sync.Mutex
+}
+
+// EmitterStatus is a snapshot of an emitter connection
+type EmitterStatus struct {
+	ID               string    `json:"id"`
+	RemoteAddr       string    `json:"remote_addr"`
+	ConnectedAt      time.Time `json:"connected_at"`
+	Features         uint32    `json:"features"`
+	MessagesReceived uint64    `json:"messages_received"`
+	BytesReceived    uint64    `json:"bytes_received"`
+}
+
+// EmitterServerOptions configures an EmitterServer. Zero values select the defaults.
+type EmitterServerOptions struct {
+	Addr string            // Listen address (default DefaultEmitterAddr)
+	TLS  *tlsconfig.Server // If set, emitters must connect with TLS
+	WAL  *WAL              // If set, every accepted frame is appended to it before being routed
+
+	MaxFrameSize int // Largest frame accepted in bytes, longer ones close the connection (default DefaultMaxFrameSize)
+
+	// Stamp every message with the time it was received, its number among the
+	// messages of its emitter and the emitter's ID, which analyzers that
+	// negotiated protocol.AnalyzerFeatureMetadata receive in its metadata frame.
+	// Messages replayed from the WAL or the spill queue are not stamped.
+	Stamp bool
+
+	Authenticator auth.Authenticator // If set, emitters must present a token in their hello
+	Authorizer    auth.Authorizer    // If set, decides which emitters may publish
 }
 
 // NewEmitterServer creates a new emitter server
-func NewEmitterServer(port int, router RouterInterface) *EmitterServer {
-	return &EmitterServer{
-		port:     port,
-		router:   router,
-		shutdown: make(chan struct{}),
+func NewEmitterServer(router RouterInterface, opts EmitterServerOptions) *EmitterServer {
+	if opts.Addr == "" {
+		opts.Addr = DefaultEmitterAddr
+	}
+	if opts.MaxFrameSize <= 0 {
+		opts.MaxFrameSize = DefaultMaxFrameSize
+	}
+	es := &EmitterServer{
+		addr:         opts.Addr,
+		tls:          opts.TLS,
+		router:       router,
+		wal:          opts.WAL,
+		maxFrameSize: opts.MaxFrameSize,
+		access:       accessControl{opts.Authenticator, opts.Authorizer},
+		shutdown:     make(chan struct{}),
+		emitters:     make(map[*EmitterHandler]struct{}),
+	}
+	if opts.Stamp {
+		es.stamps = &ingestCounters{counters: make(map[string]*ingestCounter)}
 	}
+	return es
 }
 
 // Start begins listening for emitter connections
 func (es *EmitterServer) Start() error {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", es.port))
+	listener, err := listen(es.addr, es.tls)
 	if err != nil {
-		return fmt.Errorf("failed to start emitter server on port %d: %w", es.port, err)
+		return fmt.Errorf("failed to start emitter server on %s: %w", es.addr, err)
 	}
-	
+
 	es.listener = listener
-	log.Printf("Emitter server listening on port %d\n", es.port)
-	
+	log.Printf("Emitter server listening on %s (%s)\n", listener.Addr(), describeTLS(es.tls))
+
 	go es.acceptConnections()
 	return nil
 }
 
-// Stop gracefully shuts down the emitter server
+// Stop stops accepting emitters and disconnects the connected ones once they
+// have routed the frames already received. Emitters that negotiated
+// acknowledgements are told to pause and resend the rest after reconnecting.
 func (es *EmitterServer) Stop() {
 	close(es.shutdown)
 	if es.listener != nil {
 		es.listener.Close()
 	}
+
+	es.emittersMutex.Lock()
+	for eh := range es.emitters {
+		eh.stop()
+	}
+	es.emittersMutex.Unlock()
+
 	es.wg.Wait()
 }
 
@@ -113,80 +355,553 @@ func (es *EmitterServer) acceptConnections() {
 					continue
 				}
 			}
-			
+
 			// Configure TCP connection for reliability and performance
-			if tcpConn, ok := conn.(*net.TCPConn); ok {
+			if tcpConn := tcpConn(conn); tcpConn != nil {
 				tcpConn.SetKeepAlive(true)
 				tcpConn.SetKeepAlivePeriod(30 * time.Second)
 				tcpConn.SetNoDelay(true) // Disable Nagle's algorithm for low latency
 			}
-			
+
 			// Create a unique emitter ID based on the connection
 			emitterID := fmt.Sprintf("emitter_%s", conn.RemoteAddr().String())
 			log.Printf("New emitter connected: %s\n", emitterID)
-			
+
 			// Create and start a new EmitterHandler for this connection
 			handler := &EmitterHandler{
-				conn:      conn,
-				emitterID: emitterID,
-				router:    es.router,
-				wg:        &es.wg,
+				conn:         conn,
+				emitterID:    emitterID,
+				router:       es.router,
+				wal:          es.wal,
+				access:       &es.access,
+				wg:           &es.wg,
+				maxFrameSize: es.maxFrameSize,
+				stamps:       es.stamps,
+				connectedAt:  time.Now(),
 			}
-			
+
 			es.wg.Add(1)
-			go handler.handleConnection()
+			go func() {
+				es.trackEmitter(handler, true)
+				defer es.trackEmitter(handler, false)
+				handler.handleConnection()
+			}()
+		}
+	}
+}
+
+// trackEmitter adds or removes a connection from the set reported by Emitters
+func (es *EmitterServer) trackEmitter(eh *EmitterHandler, open bool) {
+	es.emittersMutex.Lock()
+	defer es.emittersMutex.Unlock()
+	if open {
+		es.emitters[eh] = struct{}{}
+		select {
+		case <-es.shutdown:
+			// Accepted just before the listener closed
+			eh.stop()
+		default:
 		}
+	} else {
+		delete(es.emitters, eh)
+	}
+}
+
+// Emitters returns a snapshot of every open emitter connection, sorted by ID
+func (es *EmitterServer) Emitters() []EmitterStatus {
+	es.emittersMutex.Lock()
+	statuses := make([]EmitterStatus, 0, len(es.emitters))
+	for eh := range es.emitters {
+		eh.idMutex.Lock()
+		statuses = append(statuses, EmitterStatus{
+			ID:               eh.emitterID,
+			RemoteAddr:       eh.conn.RemoteAddr().String(),
+			ConnectedAt:      eh.connectedAt,
+			Features:         eh.features,
+			MessagesReceived: eh.received.Load(),
+			BytesReceived:    eh.bytes.Load(),
+		})
+		eh.idMutex.Unlock()
 	}
+	es.emittersMutex.Unlock()
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
 }
 
 // handleConnection manages the lifecycle of a single emitter connection
 func (eh *EmitterHandler) handleConnection() {
 	defer eh.wg.Done()
 	defer eh.conn.Close()
-	
+
+	emittersConnected.Add(1)
+	defer emittersConnected.Add(-1)
+
 	log.Printf("Starting to handle connection for %s\n", eh.emitterID)
-	
+
+	certID, err := tlsIdentity(eh.conn)
+	if err != nil {
+		log.Printf("Emitter %s: %v\n", eh.emitterID, err)
+		return
+	}
+	if certID != "" {
+		eh.certID = certID
+		eh.idMutex.Lock()
+		eh.emitterID = certID
+		eh.idMutex.Unlock()
+	}
+
 	// Buffer for reading data
 	bufReader := bufio.NewReader(eh.conn)
 	lenBuf := make([]byte, 4)
+
+	// The first four bytes are either a hello or the length of a legacy frame
+	haveLen := true
+	generatedID := false
+	if _, err := io.ReadFull(bufReader, lenBuf); err != nil {
+		eh.readFailed(err)
+		return
+	}
+	if [4]byte(lenBuf) == protocol.EmitterHelloMagic {
+		if !eh.performHandshake(bufReader) {
+			return
+		}
+		haveLen = false
+	} else {
+		if !eh.access.allowLegacy(auth.RoleEmitter) {
+			log.Printf("Rejected emitter %s: authentication requires the hello handshake\n", eh.emitterID)
+			return
+		}
+		if !eh.access.allowEmitter(eh.emitterID) {
+			log.Printf("Rejected emitter %s: not authorized to publish\n", eh.emitterID)
+			return
+		}
+		if eh.certID == "" {
+			generatedID = true
+			// Series for generated IDs would pile up as legacy emitters reconnect
+			defer emitterMessagesReceived.Delete(eh.emitterID)
+			defer emitterBytesReceived.Delete(eh.emitterID)
+			defer deleteMalformedFrameCounters(eh.emitterID)
+		}
+	}
+	eh.messagesReceived = emitterMessagesReceived.With(eh.emitterID)
+	eh.bytesReceived = emitterBytesReceived.With(eh.emitterID)
+	if eh.stamps != nil {
+		if generatedID {
+			// A generated ID is never seen again, so its numbering is not kept
+			eh.ingestSeq = &atomic.Uint64{}
+		} else {
+			eh.ingestSeq = eh.stamps.acquire(eh.emitterID)
+			defer eh.stamps.release(eh.emitterID)
+		}
+	}
+
 	for {
 		// Read data from the connection
-		_, err := io.ReadFull(bufReader, lenBuf)
-		if err != nil {
-			if err != io.EOF {
-				log.Printf("Error reading from emitter %s: %v\n", eh.emitterID, err)
-			} else {
-				log.Printf("Emitter %s disconnected\n", eh.emitterID)
+		if !haveLen {
+			_, err := io.ReadFull(bufReader, lenBuf)
+			if err != nil {
+				eh.readFailed(err)
+				return
 			}
-			return
 		}
+		haveLen = false
 
-		length := int(binary.BigEndian.Uint32(lenBuf))
-		
-		// Get buffer from pool
-		buffer := messagePool.Get().([]byte)
-		if cap(buffer) < length {
-			buffer = make([]byte, length)
+		word := binary.BigEndian.Uint32(lenBuf)
+		if word&protocol.ControlFrameFlag != 0 && eh.batchFollows(bufReader) {
+			if !eh.readBatch(bufReader, word) {
+				return
+			}
 		} else {
-			buffer = buffer[:length]
+			// A bad length would make the frame unparseable or its buffer huge, and
+			// the stream cannot be resynchronised after it
+			if err := eh.checkFrameLen(word, eh.maxFrameSize); err != nil {
+				eh.rejectFrame(err)
+				return
+			}
+			msg, ok := eh.readMessage(bufReader, lenBuf)
+			if !ok {
+				return
+			}
+			if err := eh.accept(msg); err != nil {
+				log.Printf("Error sending acknowledgement to emitter %s: %v\n", eh.emitterID, err)
+				return
+			}
 		}
-		copy(buffer, lenBuf)
 
-		_, err = io.ReadFull(bufReader, buffer[4:])
-		if err != nil {
-			// Return buffer to pool before returning
-			if cap(buffer) <= 8192 {
-				messagePool.Put(buffer[:0])
+		if eh.ackWriter != nil {
+			if err := eh.flushAcks(bufReader); err != nil {
+				log.Printf("Error sending acknowledgement to emitter %s: %v\n", eh.emitterID, err)
+				return
 			}
-			if err != io.EOF {
-				log.Printf("Error reading from emitter %s: %v\n", eh.emitterID, err)
-			} else {
-				log.Printf("Emitter %s disconnected\n", eh.emitterID)
+		}
+	}
+}
+
+// batchFollows reports whether the control frame whose length word was just
+// read is a batch frame rather than an envelope frame
+func (eh *EmitterHandler) batchFollows(bufReader *bufio.Reader) bool {
+	if eh.features&protocol.EmitterFeatureBatch == 0 {
+		return false
+	}
+	if eh.features&protocol.EmitterFeatureEnvelope == 0 {
+		return true
+	}
+	typ, err := bufReader.Peek(1)
+	return err != nil || typ[0] != protocol.FrameEnvelope
+}
+
+// checkFrameLen validates the length word of a data frame, or of an envelope
+// frame if the emitter negotiated them, which may be at most maxLen bytes long
+func (eh *EmitterHandler) checkFrameLen(word uint32, maxLen int) error {
+	if word&protocol.ControlFrameFlag != 0 && eh.features&protocol.EmitterFeatureEnvelope != 0 {
+		return protocol.CheckEnvelopeFrameLen(word, maxLen)
+	}
+	return protocol.CheckDataFrameLen(word, maxLen)
+}
+
+// readMessage reads the rest of a data or envelope frame whose length word,
+// already validated, is in lenBuf. Returns false if the connection must be
+// closed.
+func (eh *EmitterHandler) readMessage(frames io.Reader, lenBuf []byte) (*ingressMessage, bool) {
+	length := int(binary.BigEndian.Uint32(lenBuf) &^ protocol.ControlFrameFlag)
+
+	// Get buffer from pool
+	buffer := messagePool.Get().([]byte)
+	if cap(buffer) < length {
+		buffer = make([]byte, length)
+	} else {
+		buffer = buffer[:length]
+	}
+	copy(buffer, lenBuf)
+
+	_, err := io.ReadFull(frames, buffer[4:])
+	if err != nil {
+		// Return buffer to pool before returning
+		if cap(buffer) <= 8192 {
+			messagePool.Put(buffer[:0])
+		}
+		eh.readFailed(err)
+		return nil, false
+	}
+
+	eh.messagesReceived.Inc()
+	eh.bytesReceived.Add(uint64(length))
+	eh.received.Add(1)
+	eh.bytes.Add(uint64(length))
+	if length != int(binary.BigEndian.Uint32(lenBuf)) {
+		env, err := NewEnvelopeMessage(buffer)
+		if err != nil {
+			eh.rejectFrame(err)
+			return nil, false
+		}
+		observeEnvelopeAge(env, time.Now())
+		msg := &ingressMessage{LogMessage: env, source: eh.emitterID}
+		eh.stamp(msg)
+		return msg, true
+	}
+	msg := &ingressMessage{LogMessage: ByteSliceMessage(buffer), source: eh.emitterID}
+	eh.stamp(msg)
+	return msg, true
+}
+
+// stamp records when a message was received and numbers it, if messages are
+// stamped
+func (eh *EmitterHandler) stamp(msg *ingressMessage) {
+	if eh.ingestSeq == nil {
+		return
+	}
+	msg.received = time.Now()
+	msg.ingestSeq = eh.ingestSeq.Add(1)
+}
+
+// readBatch reads a batch frame whose length word was already read and
+// accepts its messages one by one, so the router splits the batch over the
+// analyzers like separate frames. Returns false if the connection must be
+// closed.
+func (eh *EmitterHandler) readBatch(bufReader *bufio.Reader, word uint32) bool {
+	header, err := protocol.ReadBatchHeader(bufReader, word, eh.maxFrameSize)
+	if err != nil {
+		eh.frameFailed(err)
+		return false
+	}
+
+	var frames io.Reader = bufReader
+	if header.Compressed > 0 {
+		body, err := eh.decompress(bufReader, header)
+		if err != nil {
+			eh.frameFailed(err)
+			return false
+		}
+		frames = bytes.NewReader(body)
+	}
+
+	lenBuf := make([]byte, 4)
+	bodyLen := header.BodyLen
+	for i := 0; i < header.Count; i++ {
+		if _, err := io.ReadFull(frames, lenBuf); err != nil {
+			eh.frameFailed(err)
+			return false
+		}
+		length := binary.BigEndian.Uint32(lenBuf)
+		if err := eh.checkFrameLen(length, bodyLen); err != nil {
+			eh.rejectFrame(fmt.Errorf("%w: message %d of %d: %v", protocol.ErrMalformedBatch, i+1, header.Count, err))
+			return false
+		}
+		bodyLen -= int(length &^ protocol.ControlFrameFlag)
+
+		msg, ok := eh.readMessage(frames, lenBuf)
+		if !ok {
+			return false
+		}
+		if err := eh.accept(msg); err != nil {
+			log.Printf("Error sending acknowledgement to emitter %s: %v\n", eh.emitterID, err)
+			return false
+		}
+	}
+	if bodyLen != 0 {
+		eh.rejectFrame(fmt.Errorf("%w: %d bytes left after its %d messages", protocol.ErrMalformedBatch, bodyLen, header.Count))
+		return false
+	}
+	return true
+}
+
+// decompress reads the compressed frames of a batch and decompresses them. The
+// result is valid until the next call.
+func (eh *EmitterHandler) decompress(bufReader *bufio.Reader, header *protocol.BatchHeader) ([]byte, error) {
+	if eh.features&protocol.EmitterFeatureCompression == 0 {
+		return nil, fmt.Errorf("%w: compressed without negotiating compression", protocol.ErrMalformedBatch)
+	}
+	if cap(eh.compressed) < header.Compressed {
+		eh.compressed = make([]byte, header.Compressed)
+	}
+	compressed := eh.compressed[:header.Compressed]
+	if _, err := io.ReadFull(bufReader, compressed); err != nil {
+		return nil, err
+	}
+	body, err := eh.decompressor.Decompress(compressed, header.BodyLen)
+	if err != nil {
+		return nil, err
+	}
+	compressionCompressedBytes.With("emitter").Add(uint64(protocol.CompressedBatchHeaderLen + len(compressed)))
+	compressionUncompressedBytes.With("emitter").Add(uint64(protocol.BatchHeaderLen + len(body)))
+	return body, nil
+}
+
+// frameFailed closes the connection over a frame that could not be read,
+// rejecting it if it was malformed
+func (eh *EmitterHandler) frameFailed(err error) {
+	if errors.Is(err, protocol.ErrMalformedBatch) || errors.Is(err, protocol.ErrMalformedEnvelope) ||
+		errors.Is(err, protocol.ErrFrameTooShort) || errors.Is(err, protocol.ErrFrameTooLarge) {
+		eh.rejectFrame(err)
+		return
+	}
+	eh.readFailed(err)
+}
+
+// accept persists and routes a message received from the emitter and records
+// its outcome for the acknowledgements
+func (eh *EmitterHandler) accept(msg *ingressMessage) error {
+	// Persist the frame before routing so it survives a restart
+	if eh.wal != nil {
+		if err := eh.wal.Append(msg); err != nil {
+			log.Printf("Error writing frame from emitter %s to WAL, routing without durability: %v\n", eh.emitterID, err)
+		}
+	}
+
+	// Route message - the router should handle pooling return
+	routed := eh.router.RouteMessage(msg)
+	if eh.ackWriter == nil {
+		return nil
+	}
+
+	// An emitter receiving acknowledgements resends what was dropped, so the
+	// WAL must not replay it as well. The router already released other drops
+	// from the WAL, except those at shutdown: frames from legacy emitters are
+	// delivered again after the next restart.
+	if !routed {
+		msg.Ack()
+	}
+	return eh.settle(routed)
+}
+
+// stop makes reads from the emitter fail once the frames already buffered
+// have been handled
+func (eh *EmitterHandler) stop() {
+	eh.stopping.Store(true)
+	if tcpConn := tcpConn(eh.conn); tcpConn != nil {
+		tcpConn.CloseRead()
+		return
+	}
+	eh.conn.SetReadDeadline(time.Now())
+}
+
+// readFailed logs why reading from the emitter ended. When the server is
+// stopping, an emitter with acknowledgements is told to pause first.
+func (eh *EmitterHandler) readFailed(err error) {
+	switch {
+	case eh.stopping.Load():
+		if eh.ackWriter != nil {
+			if err := eh.pause(); err != nil {
+				log.Printf("Error sending pause to emitter %s: %v\n", eh.emitterID, err)
 			}
-			return
 		}
-		
-		// Route message - the router should handle pooling return
-		eh.router.RouteMessage(ByteSliceMessage(buffer))
+		log.Printf("Emitter %s disconnected for shutdown\n", eh.emitterID)
+	case err != io.EOF:
+		log.Printf("Error reading from emitter %s: %v\n", eh.emitterID, err)
+	default:
+		log.Printf("Emitter %s disconnected\n", eh.emitterID)
+	}
+}
+
+// rejectFrame counts a malformed frame and closes the connection, telling an
+// emitter with acknowledgements which frame it was first
+func (eh *EmitterHandler) rejectFrame(err error) {
+	reason := "too_large"
+	switch {
+	case errors.Is(err, protocol.ErrMalformedBatch):
+		reason = "bad_batch"
+	case errors.Is(err, protocol.ErrMalformedEnvelope):
+		reason = "bad_envelope"
+	case errors.Is(err, protocol.ErrFrameTooShort):
+		reason = "too_short"
+	}
+	emitterMalformedFrames.With(eh.emitterID, reason).Inc()
+	log.Printf("Closing connection of emitter %s: malformed frame: %v\n", eh.emitterID, err)
+
+	if eh.ackWriter != nil {
+		// Settles every earlier frame, so a pending ACK is not needed
+		if err := eh.writeEmitterFrame(protocol.EmitterFrameReject, (eh.seqNum+1)&SeqNumValueMask); err == nil {
+			err = eh.ackWriter.Flush()
+		}
+		if err != nil {
+			log.Printf("Error sending reject to emitter %s: %v\n", eh.emitterID, err)
+		}
+	}
+}
+
+// deleteMalformedFrameCounters removes the malformed frame series of an emitter
+func deleteMalformedFrameCounters(emitterID string) {
+	emitterMalformedFrames.Delete(emitterID, "too_short")
+	emitterMalformedFrames.Delete(emitterID, "too_large")
+	emitterMalformedFrames.Delete(emitterID, "bad_batch")
+	emitterMalformedFrames.Delete(emitterID, "bad_envelope")
+}
+
+// pause acknowledges every frame received and tells the emitter to send the
+// rest after reconnecting
+func (eh *EmitterHandler) pause() error {
+	if err := eh.writeEmitterFrame(protocol.EmitterFramePause, eh.seqNum); err != nil {
+		return err
+	}
+	eh.ackPending = false
+	return eh.ackWriter.Flush()
+}
+
+// performHandshake reads the emitter's hello (its magic already consumed) and
+// replies. Returns false if the connection must be closed.
+func (eh *EmitterHandler) performHandshake(bufReader *bufio.Reader) bool {
+	eh.conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer eh.conn.SetDeadline(time.Time{})
+
+	hello, err := protocol.ReadHelloBody(bufReader)
+	if err != nil {
+		log.Printf("Failed to read hello from emitter %s: %v\n", eh.emitterID, err)
+		return false
 	}
-}
\ No newline at end of file
+
+	reply := &protocol.Reply{
+		Version: min(hello.Version, protocol.Version),
+		Status:  protocol.StatusRejected,
+	}
+	var id string
+	switch {
+	case hello.Version == 0:
+		reply.Reason = fmt.Sprintf("unsupported protocol version %d", hello.Version)
+	default:
+		if id, reply.Reason = eh.access.identify(auth.RoleEmitter, eh.certID, hello); id == "" {
+			break
+		}
+		if !eh.access.allowEmitter(id) {
+			reply.Reason = fmt.Sprintf("emitter %q is not authorized to publish", id)
+			break
+		}
+		hello.ID = id
+		reply.Status = protocol.StatusAccepted
+		reply.Features = hello.Features & supportedEmitterFeatures
+	}
+
+	if err := protocol.WriteReply(eh.conn, protocol.EmitterHelloMagic, reply); err != nil {
+		log.Printf("Failed to send handshake reply to emitter %s: %v\n", eh.emitterID, err)
+		return false
+	}
+
+	if !reply.Accepted() {
+		log.Printf("Rejected emitter %s: %s\n", eh.emitterID, reply.Reason)
+		return false
+	}
+
+	log.Printf("Emitter %s identified as %s (protocol v%d, features 0x%x)\n", eh.emitterID, hello.ID, reply.Version, reply.Features)
+	eh.idMutex.Lock()
+	eh.emitterID = hello.ID
+	eh.features = reply.Features
+	eh.idMutex.Unlock()
+	if eh.features&protocol.EmitterFeatureAcks != 0 {
+		eh.ackWriter = bufio.NewWriterSize(eh.conn, 512)
+		eh.ackBuf = make([]byte, 0, protocol.EmitterFrameLen)
+	}
+	return true
+}
+
+// settle records the outcome of the message just routed. Drops are reported
+// immediately; accepted messages are acknowledged cumulatively by flushAcks.
+func (eh *EmitterHandler) settle(routed bool) error {
+	eh.seqNum = (eh.seqNum + 1) & SeqNumValueMask
+
+	if routed {
+		eh.ackPending = true
+		return nil
+	}
+	// A NACK settles every earlier message as well
+	eh.ackPending = false
+	return eh.writeEmitterFrame(protocol.EmitterFrameNack, eh.seqNum)
+}
+
+// flushAcks acknowledges the messages accepted so far and sends the buffered
+// acknowledgements, unless a further complete frame is already buffered, so a
+// busy emitter gets one ACK per read.
+func (eh *EmitterHandler) flushAcks(bufReader *bufio.Reader) error {
+	if frameBuffered(bufReader) {
+		return nil
+	}
+	if eh.ackPending {
+		if err := eh.writeEmitterFrame(protocol.EmitterFrameAck, eh.seqNum); err != nil {
+			return err
+		}
+		eh.ackPending = false
+	}
+	if eh.ackWriter.Buffered() > 0 {
+		return eh.ackWriter.Flush()
+	}
+	return nil
+}
+
+// writeEmitterFrame buffers a single distributor-to-emitter frame
+func (eh *EmitterHandler) writeEmitterFrame(typ uint8, seq uint32) error {
+	eh.ackBuf = protocol.AppendEmitterFrame(eh.ackBuf[:0], typ, seq)
+	_, err := eh.ackWriter.Write(eh.ackBuf)
+	return err
+}
+
+// frameBuffered reports whether a complete frame can be read without blocking
+func frameBuffered(bufReader *bufio.Reader) bool {
+	// Peek would block for more data, so only look at what is already buffered
+	if bufReader.Buffered() < 4 {
+		return false
+	}
+	header, err := bufReader.Peek(4)
+	if err != nil {
+		return false
+	}
+	return bufReader.Buffered() >= int(binary.BigEndian.Uint32(header)&^protocol.ControlFrameFlag)
+}
@@ -0,0 +1,406 @@
+package distributor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"log-distributor/internal/protocol"
+)
+
+// recordingRouter accepts every message, keeping its frame
+type recordingRouter struct {
+	mutex  sync.Mutex
+	frames []string
+}
+
+func (r *recordingRouter) RouteMessage(msg LogMessage) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.frames = append(r.frames, string(msg.GetData()))
+	return true
+}
+
+func (r *recordingRouter) HasAnalyzers() bool                             { return true }
+func (r *recordingRouter) RegisterAnalyzer(config *AnalyzerConfig)        {}
+func (r *recordingRouter) UnregisterAnalyzer(config *AnalyzerConfig)      {}
+func (r *recordingRouter) UpdateWeight(config *AnalyzerConfig, w float32) {}
+
+func (r *recordingRouter) received() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string(nil), r.frames...)
+}
+
+// startEmitterServer starts an emitter server routing to router on a free port
+func startEmitterServer(t *testing.T, router RouterInterface) *EmitterServer {
+	t.Helper()
+	es := NewEmitterServer(router, EmitterServerOptions{Addr: "127.0.0.1:0"})
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return es
+}
+
+// connectEmitter connects to the emitter server and performs the handshake
+// with features
+func connectEmitter(t *testing.T, es *EmitterServer, features uint32) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", es.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := protocol.WriteHello(conn, protocol.EmitterHelloMagic, &protocol.Hello{Version: protocol.Version, Features: features, ID: "e1"}); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := protocol.ReadReply(conn, protocol.EmitterHelloMagic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reply.Accepted() || reply.Features != features {
+		t.Fatalf("reply %+v, want accepted with features 0x%x", reply, features)
+	}
+	return conn
+}
+
+// dialEmitter starts an emitter server routing to router, stopped when the
+// test ends, and connects to it with features
+func dialEmitter(t *testing.T, router RouterInterface, features uint32) net.Conn {
+	t.Helper()
+	es := startEmitterServer(t, router)
+	t.Cleanup(es.Stop)
+	return connectEmitter(t, es, features)
+}
+
+// readEmitterFrame reads one distributor-to-emitter frame
+func readEmitterFrame(t *testing.T, conn net.Conn) (uint8, uint32) {
+	t.Helper()
+	var frame [protocol.EmitterFrameLen]byte
+	if _, err := io.ReadFull(conn, frame[:]); err != nil {
+		t.Fatal(err)
+	}
+	return frame[0], binary.BigEndian.Uint32(frame[1:])
+}
+
+// Accepted frames are acknowledged cumulatively, up to the last one sent
+func TestEmitterAcknowledgesAcceptedFrames(t *testing.T) {
+	router := &recordingRouter{}
+	conn := dialEmitter(t, router, protocol.EmitterFeatureAcks)
+
+	frames := [][]byte{dataFrame(1, "one"), dataFrame(2, "two"), dataFrame(3, "three")}
+	if _, err := conn.Write(bytes.Join(frames, nil)); err != nil {
+		t.Fatal(err)
+	}
+	for last := uint32(0); last < 3; {
+		typ, seq := readEmitterFrame(t, conn)
+		if typ != protocol.EmitterFrameAck || seq <= last || seq > 3 {
+			t.Fatalf("frame type %d seq %d after %d, want an ACK up to 3", typ, seq, last)
+		}
+		last = seq
+	}
+
+	want := []string{string(frames[0]), string(frames[1]), string(frames[2])}
+	if got := router.received(); !slices.Equal(got, want) {
+		t.Errorf("routed %q, want %q", got, want)
+	}
+}
+
+// A frame the router drops is reported with a NACK of its sequence number
+func TestEmitterNacksDroppedFrames(t *testing.T) {
+	conn := dialEmitter(t, NewWeightedTreeRouter(), protocol.EmitterFeatureAcks)
+
+	if _, err := conn.Write(dataFrame(1, "nowhere to go")); err != nil {
+		t.Fatal(err)
+	}
+	if typ, seq := readEmitterFrame(t, conn); typ != protocol.EmitterFrameNack || seq != 1 {
+		t.Errorf("frame type %d seq %d, want a NACK of 1", typ, seq)
+	}
+}
+
+// Stopping the server pauses an emitter with acknowledgements: everything it
+// sent is acknowledged and the connection closes
+func TestEmitterPausedOnShutdown(t *testing.T) {
+	router := &recordingRouter{}
+	es := startEmitterServer(t, router)
+	conn := connectEmitter(t, es, protocol.EmitterFeatureAcks)
+
+	if _, err := conn.Write(bytes.Join([][]byte{dataFrame(1, "one"), dataFrame(1, "two")}, nil)); err != nil {
+		t.Fatal(err)
+	}
+	for last := uint32(0); last < 2; {
+		_, last = readEmitterFrame(t, conn)
+	}
+
+	es.Stop()
+	if typ, seq := readEmitterFrame(t, conn); typ != protocol.EmitterFramePause || seq != 2 {
+		t.Errorf("frame type %d seq %d, want a pause at 2", typ, seq)
+	}
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read %d bytes (%v) after the pause, want the connection closed", n, err)
+	}
+}
+
+// A length word beyond the frame size limit closes the connection, after
+// telling the emitter which frame was rejected
+func TestEmitterRejectsOversizedFrame(t *testing.T) {
+	router := &recordingRouter{}
+	conn := dialEmitter(t, router, protocol.EmitterFeatureAcks)
+
+	stream := append(dataFrame(1, "fits"), binary.BigEndian.AppendUint32(nil, DefaultMaxFrameSize+1)...)
+	if _, err := conn.Write(stream); err != nil {
+		t.Fatal(err)
+	}
+	typ, seq := readEmitterFrame(t, conn)
+	if typ == protocol.EmitterFrameAck {
+		typ, seq = readEmitterFrame(t, conn)
+	}
+	if typ != protocol.EmitterFrameReject || seq != 2 {
+		t.Errorf("frame type %d seq %d, want a reject of 2", typ, seq)
+	}
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read %d bytes (%v) after the reject, want the connection closed", n, err)
+	}
+	if got := router.received(); len(got) != 1 {
+		t.Errorf("routed %q, want only the frame that fits", got)
+	}
+}
+
+// A compressed batch is inflated and its messages routed and acknowledged
+// one by one
+func TestEmitterCompressedBatch(t *testing.T) {
+	router := &recordingRouter{}
+	conn := dialEmitter(t, router, protocol.EmitterFeatureAcks|protocol.EmitterFeatureBatch|protocol.EmitterFeatureCompression)
+
+	var frames [][]byte
+	for i := range 20 {
+		frames = append(frames, dataFrame(uint8(i), "a repetitive log line that compresses well"))
+	}
+	c, err := protocol.NewCompressor(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, compressed := c.AppendBatch(nil, len(frames), bytes.Join(frames, nil))
+	if !compressed {
+		t.Fatal("batch not compressed")
+	}
+	if _, err := conn.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	for last := uint32(0); last < 20; {
+		typ, seq := readEmitterFrame(t, conn)
+		if typ != protocol.EmitterFrameAck || seq <= last || seq > 20 {
+			t.Fatalf("frame type %d seq %d after %d, want an ACK up to 20", typ, seq, last)
+		}
+		last = seq
+	}
+
+	var want []string
+	for _, frame := range frames {
+		want = append(want, string(frame))
+	}
+	if got := router.received(); !slices.Equal(got, want) {
+		t.Errorf("routed %q, want %q", got, want)
+	}
+}
+
+// stampRouter accepts every message, keeping its stamp
+type stampRouter struct {
+	recordingRouter
+	stamps []protocol.Metadata
+}
+
+func (r *stampRouter) RouteMessage(msg LogMessage) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var meta protocol.Metadata
+	if described, ok := msg.(interface{ metadata() protocol.Metadata }); ok {
+		meta = described.metadata()
+	}
+	r.stamps = append(r.stamps, meta)
+	return true
+}
+
+// Stamped messages carry their receive time and emitter ID, numbered on from
+// where the emitter's previous connection left off
+func TestEmitterStampsMessages(t *testing.T) {
+	router := &stampRouter{}
+	es := NewEmitterServer(router, EmitterServerOptions{Addr: "127.0.0.1:0", Stamp: true})
+	if err := es.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(es.Stop)
+
+	start := time.Now()
+	for _, n := range []uint32{2, 1} {
+		conn := connectEmitter(t, es, protocol.EmitterFeatureAcks)
+		for i := range n {
+			if _, err := conn.Write(dataFrame(uint8(i), "stamped")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for last := uint32(0); last < n; {
+			typ, seq := readEmitterFrame(t, conn)
+			if typ != protocol.EmitterFrameAck || seq <= last || seq > n {
+				t.Fatalf("frame type %d seq %d after %d, want an ACK up to %d", typ, seq, last, n)
+			}
+			last = seq
+		}
+		conn.Close()
+	}
+
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+	if len(router.stamps) != 3 {
+		t.Fatalf("%d messages routed, want 3", len(router.stamps))
+	}
+	for i, meta := range router.stamps {
+		if meta.IngestSeq != uint64(i+1) || meta.Emitter != "e1" || meta.Received.Before(start) {
+			t.Errorf("message %d stamped %+v, want ingest sequence %d from e1 after %v", i, meta, i+1, start)
+		}
+	}
+}
+
+// An emitter ID keeps its ingest numbering across reconnects until it has
+// been idle for too long
+func TestIngestCountersCarryOnAcrossReconnects(t *testing.T) {
+	ic := &ingestCounters{counters: make(map[string]*ingestCounter)}
+
+	ic.acquire("e1").Add(5)
+	ic.release("e1")
+	if seq := ic.acquire("e1").Add(1); seq != 6 {
+		t.Errorf("sequence %d after reconnecting, want 6", seq)
+	}
+	ic.release("e1")
+
+	// Forgotten once idle for too long
+	ic.counters["e1"].idleSince = time.Now().Add(-2 * ingestCounterIdle)
+	ic.lastSweep = time.Time{}
+	if seq := ic.acquire("e2").Add(1); seq != 1 {
+		t.Errorf("sequence %d of a new ID, want 1", seq)
+	}
+	if _, ok := ic.counters["e1"]; ok {
+		t.Error("idle ID still kept after the idle timeout")
+	}
+	if ic.idle != 0 {
+		t.Errorf("%d counted idle, want 0", ic.idle)
+	}
+}
+
+// Only so many idle emitter IDs are remembered, the longest idle forgotten
+// first
+func TestIngestCountersBoundIdleIDs(t *testing.T) {
+	ic := &ingestCounters{counters: make(map[string]*ingestCounter)}
+
+	// An ID kept open is never forgotten
+	open := ic.acquire("open")
+	open.Add(1)
+	var last *atomic.Uint64
+	start := time.Now()
+	for i := range maxIdleIngestCounters + 1 {
+		id := fmt.Sprintf("e%d", i)
+		last = ic.acquire(id)
+		ic.release(id)
+		ic.counters[id].idleSince = start.Add(time.Duration(i)) // Idle in the order they closed
+	}
+	last.Add(1)
+
+	ic.acquire("trigger")
+	if n := len(ic.counters); n > maxIdleIngestCounters {
+		t.Errorf("%d counters kept, want at most %d", n, maxIdleIngestCounters)
+	}
+	if ic.idle != len(ic.counters)-2 {
+		t.Errorf("%d counted idle, want %d", ic.idle, len(ic.counters)-2)
+	}
+	if _, ok := ic.counters["e0"]; ok {
+		t.Error("longest idle ID kept")
+	}
+	if seq := ic.acquire(fmt.Sprintf("e%d", maxIdleIngestCounters)).Load(); seq != 1 {
+		t.Errorf("most recently idle ID forgot its sequence, got %d", seq)
+	}
+	if seq := ic.acquire("open").Load(); seq != 1 {
+		t.Errorf("open ID forgot its sequence, got %d", seq)
+	}
+}
+
+// Largest frame the fuzzed emitter handler accepts
+const fuzzMaxFrameSize = 1 << 16
+
+// helloStream returns a hello negotiating features followed by frames
+func helloStream(features uint32, frames ...[]byte) []byte {
+	var b bytes.Buffer
+	protocol.WriteHello(&b, protocol.EmitterHelloMagic, &protocol.Hello{Version: protocol.Version, Features: features, ID: "e1"})
+	for _, frame := range frames {
+		b.Write(frame)
+	}
+	return b.Bytes()
+}
+
+// Whatever an emitter sends, its handler closes the connection or keeps reading
+// without panicking, and routes no frame beyond the size limit
+func FuzzEmitterHandler(f *testing.F) {
+	all := protocol.EmitterFeatureAcks | protocol.EmitterFeatureBatch | protocol.EmitterFeatureCompression | protocol.EmitterFeatureEnvelope
+	body := append(dataFrame(1, "first"), dataFrame(2, "second")...)
+	batch := append(protocol.AppendBatchHeader(nil, 2, len(body)), body...)
+	c, _ := protocol.NewCompressor(1)
+	compressed, _ := c.AppendBatch(nil, 20, bytes.Repeat(dataFrame(3, "compressed"), 20))
+	envelope, _ := protocol.AppendEnvelope(nil, &protocol.Headers{Source: "app", Key: []byte("k")}, dataFrame(4, "enveloped"))
+
+	f.Add(append(dataFrame(1, "legacy"), dataFrame(2, "frames")...))
+	f.Add(helloStream(all, dataFrame(1, "data"), batch, compressed, envelope))
+	f.Add(helloStream(protocol.EmitterFeatureBatch, batch, dataFrame(5, "after")))
+	f.Add(helloStream(protocol.EmitterFeatureEnvelope, envelope))
+	f.Add(helloStream(all, []byte{0x80, 0, 0, 11, protocol.FrameCompressedBatch, 0, 1, 0, 1, 0, 0}))
+	f.Add(helloStream(all, protocol.AppendBatchHeader(nil, 3, len(body)), body))
+	f.Add(helloStream(0, binary.BigEndian.AppendUint32(nil, fuzzMaxFrameSize+1)))
+
+	prev := log.Writer()
+	log.SetOutput(io.Discard) // Every malformed frame is logged
+	f.Cleanup(func() { log.SetOutput(prev) })
+
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		server, client := net.Pipe()
+		router := &recordingRouter{}
+		var wg sync.WaitGroup
+		wg.Add(1)
+		eh := &EmitterHandler{
+			conn:         server,
+			emitterID:    "fuzz",
+			router:       router,
+			access:       &accessControl{},
+			wg:           &wg,
+			maxFrameSize: fuzzMaxFrameSize,
+			connectedAt:  time.Now(),
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			eh.handleConnection()
+		}()
+		go io.Copy(io.Discard, client) // Replies and acknowledgements
+
+		client.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		client.Write(stream) // Fails once the handler closes the connection
+		client.Close()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("handler still running after the emitter closed the connection")
+		}
+
+		for _, frame := range router.received() {
+			if len(frame) > fuzzMaxFrameSize {
+				t.Fatalf("routed a frame of %d bytes, max %d", len(frame), fuzzMaxFrameSize)
+			}
+		}
+	})
+}
@@ -0,0 +1,101 @@
+package distributor
+
+import (
+	"encoding/binary"
+	"time"
+
+	"log-distributor/internal/protocol"
+)
+
+// EnvelopeMessage is a message received in an envelope frame: a data frame
+// together with typed headers, which routing rules, metrics and sinks read
+// without parsing the payload
+type EnvelopeMessage struct {
+	frame   []byte // The complete envelope frame
+	data    []byte // The data frame inside it
+	headers *protocol.Headers
+}
+
+// NewEnvelopeMessage decodes an envelope frame, which the message keeps
+func NewEnvelopeMessage(frame []byte) (*EnvelopeMessage, error) {
+	headers, data, err := protocol.ParseEnvelope(frame)
+	if err != nil {
+		return nil, err
+	}
+	return &EnvelopeMessage{frame: frame, data: data, headers: headers}, nil
+}
+
+// GetData returns the complete envelope frame
+func (m *EnvelopeMessage) GetData() []byte {
+	return m.frame
+}
+
+// GetLength returns the length of the envelope frame
+func (m *EnvelopeMessage) GetLength() int {
+	return len(m.frame)
+}
+
+// GetPriority returns the priority of the data frame in the envelope
+func (m *EnvelopeMessage) GetPriority() uint8 {
+	return m.data[4]
+}
+
+// Headers returns the headers describing the message
+func (m *EnvelopeMessage) Headers() *protocol.Headers {
+	return m.headers
+}
+
+// DataFrame returns the data frame in the envelope, which is what analyzers
+// that did not negotiate envelopes receive
+func (m *EnvelopeMessage) DataFrame() []byte {
+	return m.data
+}
+
+// ParseMessage wraps a frame kept by the WAL, the spill queue or the
+// dead-letter queue in the message type matching its format
+func ParseMessage(frame []byte) (LogMessage, error) {
+	if len(frame) >= 4 && binary.BigEndian.Uint32(frame)&protocol.ControlFrameFlag != 0 {
+		return NewEnvelopeMessage(frame)
+	}
+	return ByteSliceMessage(frame), nil
+}
+
+// envelopeOf returns the envelope a message came in, nil if it came as a
+// plain data frame
+func envelopeOf(msg LogMessage) *EnvelopeMessage {
+	switch m := msg.(type) {
+	case *EnvelopeMessage:
+		return m
+	case interface{ Envelope() *EnvelopeMessage }:
+		return m.Envelope()
+	}
+	return nil
+}
+
+// messageHeaders returns the envelope headers of a message, nil if it has none
+func messageHeaders(msg LogMessage) *protocol.Headers {
+	if env := envelopeOf(msg); env != nil {
+		return env.headers
+	}
+	return nil
+}
+
+// messagePayload returns the payload of a message, without its envelope.
+// Returns false if the frame is too short to have one.
+func messagePayload(msg LogMessage) ([]byte, bool) {
+	data := msg.GetData()
+	if env := envelopeOf(msg); env != nil {
+		data = env.data
+	}
+	if len(data) < 5 {
+		return nil, false
+	}
+	return data[5:], true
+}
+
+// observeEnvelopeAge records how long ago the emitter stamped an envelope
+func observeEnvelopeAge(env *EnvelopeMessage, now time.Time) {
+	if ts := env.headers.Timestamp; !ts.IsZero() {
+		envelopeAge.Observe(max(now.Sub(ts), 0).Seconds())
+	}
+}
@@ -0,0 +1,162 @@
+package distributor
+
+import (
+	"math"
+	"math/rand"
+	"sync/atomic"
+
+	"log-distributor/internal/metrics"
+)
+
+// HashRouterOptions configure a HashRouter
+type HashRouterOptions struct {
+	Key *KeyExtractor // Payload or header key messages are placed by, nil for the emitter ID
+}
+
+// HashRouter implements RouterInterface with weighted rendezvous hashing, so
+// every message with the same key goes to the same analyzer. Each analyzer
+// scores a key as weight / -ln(hash(key, analyzer)) and the highest score wins:
+// an analyzer joining, leaving or changing weight only moves keys to or from
+// itself, and each analyzer receives a share of the keys proportional to its
+// weight. Messages without a key are placed at random, still by weight.
+// Routing is O(n) in the analyzers accepting the priority.
+type HashRouter struct {
+	routerBase
+	key   *KeyExtractor
+	table atomic.Pointer[hashTable]
+}
+
+// hashTable holds the analyzers each priority is hashed over. Priorities
+// routed to the same analyzers share one slice.
+type hashTable struct {
+	nodes [256][]hashNode // nil where no analyzer accepts the priority
+}
+
+// hashNode is an analyzer as seen by the hash router
+type hashNode struct {
+	config *AnalyzerConfig
+	idHash uint64
+	weight float64
+	routed *metrics.Counter
+}
+
+// NewHashRouter creates a new consistent-hash router
+func NewHashRouter(opts HashRouterOptions) *HashRouter {
+	hr := &HashRouter{key: opts.Key}
+	hr.init(hr.rebuildTable)
+	hr.table.Store(&hashTable{})
+	return hr
+}
+
+// RouteMessage routes a message to the analyzer its key hashes to. When that
+// analyzer has no room the message is overloaded rather than sent to another
+// analyzer, which would break the key's affinity.
+func (hr *HashRouter) RouteMessage(msg LogMessage) bool {
+	keyHash, ok := messageKeyHash(hr.key, msg)
+	if !ok {
+		hashUnkeyedMessages.Inc()
+		keyHash = rand.Uint64()
+	}
+
+	return hr.route(msg, func(msg LogMessage) (bool, *AnalyzerConfig, DropReason) {
+		priority := msg.GetPriority()
+		nodes := hr.table.Load().nodes[priority]
+		if nodes == nil {
+			return false, nil, hr.noRouteReason()
+		}
+		node := pickNode(nodes, keyHash)
+		if node == nil {
+			return false, nil, DropChannelsFull
+		}
+		if !node.config.queue.push(priority, msg) {
+			return false, node.config, node.config.queue.fullReason(msg)
+		}
+		node.routed.Inc()
+		priorityRoutedCounter(priority).Inc()
+		return true, nil, 0
+	})
+}
+
+// messageKeyHash returns the hash of the key a message is placed by, the emitter
+// ID if key is nil. Returns false if the message has no key.
+func messageKeyHash(key *KeyExtractor, msg LogMessage) (uint64, bool) {
+	if key == nil {
+		sourced, ok := msg.(interface{ Source() string })
+		if !ok || sourced.Source() == "" {
+			return 0, false
+		}
+		return fnv64a(sourced.Source()), true
+	}
+
+	k, ok := key.keyOf(msg)
+	if !ok {
+		return 0, false
+	}
+	return fnv64a(k), true
+}
+
+// pickNode returns the analyzer scoring a key highest, nil if every analyzer
+// has zero weight
+func pickNode(nodes []hashNode, keyHash uint64) *hashNode {
+	var best *hashNode
+	bestScore := 0.0
+	for i := range nodes {
+		node := &nodes[i]
+		if node.weight <= 0 {
+			continue
+		}
+		// Uniform in (0, 1) from the top 53 bits of the mixed hashes
+		u := (float64(mix64(keyHash^node.idHash)>>11) + 0.5) / (1 << 53)
+		if score := node.weight / -math.Log(u); best == nil || score > bestScore {
+			best, bestScore = node, score
+		}
+	}
+	return best
+}
+
+// rebuildTable builds the analyzer list of every priority class and publishes
+// them, with rebuildMutex held
+func (hr *HashRouter) rebuildTable(classes [256]int, members [][]*AnalyzerConfig) {
+	lists := make([][]hashNode, len(members))
+	for i, analyzers := range members {
+		nodes := make([]hashNode, len(analyzers))
+		for j, config := range analyzers {
+			nodes[j] = hashNode{
+				config: config,
+				idHash: fnv64a(config.AnalyzerID),
+				weight: float64(config.Weight),
+				routed: config.routed,
+			}
+		}
+		lists[i] = nodes
+	}
+
+	table := &hashTable{}
+	for p, class := range classes {
+		if class >= 0 {
+			table.nodes[p] = lists[class]
+		}
+	}
+	hr.table.Store(table)
+}
+
+// fnv64a hashes s with 64-bit FNV-1a
+func fnv64a[T string | []byte](s T) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+// mix64 scrambles the bits of x (the SplitMix64 finalizer), so combined hashes
+// of similar keys and IDs are independent
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
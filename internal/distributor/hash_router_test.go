@@ -0,0 +1,120 @@
+package distributor
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+// Keys hashed to measure how they spread over the analyzers
+const hashTestKeys = 20000
+
+// Largest deviation of a measured share of the keys from the expected one
+const hashShareTolerance = 0.02
+
+// hashAssignments returns the analyzer each test key hashes to
+func hashAssignments(hr *HashRouter) []string {
+	nodes := hr.table.Load().nodes[0]
+	ids := make([]string, hashTestKeys)
+	for i := range ids {
+		if node := pickNode(nodes, fnv64a(fmt.Sprintf("key-%d", i))); node != nil {
+			ids[i] = node.config.AnalyzerID
+		}
+	}
+	return ids
+}
+
+// newTestHashRouter creates a hash router with analyzers of the given weights,
+// named a0, a1 and so on
+func newTestHashRouter(weights ...float32) (*HashRouter, []*AnalyzerConfig) {
+	hr := NewHashRouter(HashRouterOptions{})
+	configs := make([]*AnalyzerConfig, len(weights))
+	for i, w := range weights {
+		configs[i] = &AnalyzerConfig{AnalyzerID: fmt.Sprintf("a%d", i), Weight: w}
+		hr.RegisterAnalyzer(configs[i])
+	}
+	return hr, configs
+}
+
+// checkShare fails the test if count of the test keys is not close to want
+func checkShare(t *testing.T, what string, count int, want float64) {
+	t.Helper()
+	if got := float64(count) / hashTestKeys; math.Abs(got-want) > hashShareTolerance {
+		t.Errorf("%s: %.3f of the keys, want %.3f", what, got, want)
+	}
+}
+
+// checkMoves fails the test unless every key that moved went from an analyzer
+// in from to one in to, and returns how many moved
+func checkMoves(t *testing.T, before, after []string, from, to map[string]bool) int {
+	t.Helper()
+	moved := 0
+	for i := range before {
+		if before[i] == after[i] {
+			continue
+		}
+		moved++
+		if !from[before[i]] || !to[after[i]] {
+			t.Fatalf("key %d moved from %s to %s", i, before[i], after[i])
+		}
+	}
+	return moved
+}
+
+func TestHashRouterSharesKeysByWeight(t *testing.T) {
+	hr, _ := newTestHashRouter(1, 2, 3, 0)
+	counts := make(map[string]int)
+	for _, id := range hashAssignments(hr) {
+		counts[id]++
+	}
+	for i, want := range []float64{1.0 / 6, 2.0 / 6, 3.0 / 6, 0} {
+		id := fmt.Sprintf("a%d", i)
+		checkShare(t, id, counts[id], want)
+	}
+}
+
+// A joining analyzer only takes keys, its weight's share of them
+func TestHashRouterJoinMovesKeysToNewAnalyzer(t *testing.T) {
+	hr, _ := newTestHashRouter(1, 1, 1)
+	before := hashAssignments(hr)
+
+	hr.RegisterAnalyzer(&AnalyzerConfig{AnalyzerID: "new", Weight: 1})
+	moved := checkMoves(t, before, hashAssignments(hr), map[string]bool{"a0": true, "a1": true, "a2": true}, map[string]bool{"new": true})
+	checkShare(t, "moved", moved, 1.0/4)
+}
+
+// A leaving analyzer's keys spread over the others and no other key moves
+func TestHashRouterLeaveMovesOnlyItsKeys(t *testing.T) {
+	hr, configs := newTestHashRouter(1, 1, 1)
+	before := hashAssignments(hr)
+	owned := 0
+	for _, id := range before {
+		if id == "a1" {
+			owned++
+		}
+	}
+
+	hr.UnregisterAnalyzer(configs[1])
+	moved := checkMoves(t, before, hashAssignments(hr), map[string]bool{"a1": true}, map[string]bool{"a0": true, "a2": true})
+	if moved != owned {
+		t.Errorf("%d keys moved, want the %d of the leaving analyzer", moved, owned)
+	}
+	checkShare(t, "moved", moved, 1.0/3)
+}
+
+// Changing an analyzer's weight only moves keys to or from it, as many as its
+// share changed by
+func TestHashRouterReweightMovesOnlyItsShare(t *testing.T) {
+	hr, configs := newTestHashRouter(1, 1, 1)
+	before := hashAssignments(hr)
+
+	hr.UpdateWeight(configs[2], 3)
+	others := map[string]bool{"a0": true, "a1": true}
+	moved := checkMoves(t, before, hashAssignments(hr), others, map[string]bool{"a2": true})
+	checkShare(t, "moved to the heavier analyzer", moved, 3.0/5-1.0/3)
+
+	before = hashAssignments(hr)
+	hr.UpdateWeight(configs[2], 1)
+	moved = checkMoves(t, before, hashAssignments(hr), map[string]bool{"a2": true}, others)
+	checkShare(t, "moved back", moved, 3.0/5-1.0/3)
+}
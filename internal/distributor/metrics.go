@@ -0,0 +1,151 @@
+package distributor
+
+import (
+	"strconv"
+	"sync/atomic"
+
+	"log-distributor/internal/metrics"
+)
+
+// Distributor metrics, exposed through metrics.Default
+var (
+	emitterMessagesReceived = metrics.Default.NewCounterVec("distributor_emitter_messages_received_total",
+		"Frames received from each emitter.", "emitter")
+	emitterBytesReceived = metrics.Default.NewCounterVec("distributor_emitter_bytes_received_total",
+		"Bytes of frames received from each emitter.", "emitter")
+	emittersConnected = metrics.Default.NewGauge("distributor_emitters_connected",
+		"Emitter connections currently open.")
+	emitterMalformedFrames = metrics.Default.NewCounterVec("distributor_emitter_malformed_frames_total",
+		"Malformed frames received from each emitter, each closing its connection.", "emitter", "reason")
+	compressionCompressedBytes = metrics.Default.NewCounterVec("distributor_compression_compressed_bytes_total",
+		"Bytes of compressed batch frames received from emitters or sent to analyzers.", "direction")
+	compressionUncompressedBytes = metrics.Default.NewCounterVec("distributor_compression_uncompressed_bytes_total",
+		"Bytes the compressed batch frames received from emitters or sent to analyzers would have taken uncompressed.", "direction")
+	envelopeAge = metrics.Default.NewHistogram("distributor_envelope_age_seconds",
+		"Time from the timestamp in a message's envelope until the distributor received it.", metrics.DefaultLatencyBuckets)
+
+	analyzerMessagesRouted = metrics.Default.NewCounterVec("distributor_analyzer_messages_routed_total",
+		"Messages the router queued for each analyzer.", "analyzer")
+	priorityMessagesRouted = metrics.Default.NewCounterVec("distributor_priority_messages_routed_total",
+		"Messages routed to an analyzer, by priority.", "priority")
+	messagesDropped = metrics.Default.NewCounterVec("distributor_messages_dropped_total",
+		"Messages the router gave up on, including those kept in the dead-letter queue.", "reason")
+	messagesDeadLettered = metrics.Default.NewCounterVec("distributor_messages_dead_lettered_total",
+		"Dropped messages written to the dead-letter queue.", "reason")
+
+	analyzersConnected = metrics.Default.NewGauge("distributor_analyzers_connected",
+		"Analyzers currently registered with the router.")
+	analyzerWeight = metrics.Default.NewGaugeVec("distributor_analyzer_weight",
+		"Routing weight of each registered analyzer.", "analyzer")
+	analyzerPendingMessages = metrics.Default.NewGaugeVec("distributor_analyzer_pending_messages",
+		"Messages sent to each analyzer and awaiting acknowledgement.", "analyzer")
+	analyzerQueuedMessages = metrics.Default.NewGaugeVec("distributor_analyzer_queued_messages",
+		"Messages waiting in each analyzer's queue, by non-empty priority.", "analyzer", "priority")
+	analyzerAckLatency = metrics.Default.NewHistogramVec("distributor_analyzer_ack_latency_seconds",
+		"Time from sending a message to an analyzer until it was acknowledged.",
+		metrics.DefaultLatencyBuckets, "analyzer")
+
+	authRejections = metrics.Default.NewCounterVec("distributor_auth_rejections_total",
+		"Connections rejected by authentication or authorization.", "role", "reason")
+
+	routerTreeRebuilds = metrics.Default.NewCounter("distributor_router_tree_rebuilds_total",
+		"Times the routing tree was rebuilt after analyzers joined, left or changed weight.")
+	routerPriorityClasses = metrics.Default.NewGaugeVec("distributor_router_priority_classes",
+		"Routing trees in use, one per set of analyzers accepting the same priorities.", "group")
+	hashUnkeyedMessages = metrics.Default.NewCounter("distributor_hash_router_unkeyed_messages_total",
+		"Messages without a key, which the consistent-hash router placed at random.")
+	adaptiveDiversions = metrics.Default.NewCounter("distributor_adaptive_router_diversions_total",
+		"Messages the adaptive router sent to another analyzer than the one it sampled by weight, because that one was more loaded.")
+	orderedBacklog = metrics.Default.NewGauge("distributor_ordered_backlog_messages",
+		"Messages the ordered router holds back until their lane's analyzer can take them.")
+	orderedLaneHandoffs = metrics.Default.NewCounter("distributor_ordered_lane_handoffs_total",
+		"Times an ordered lane moved to another analyzer once the previous one settled its messages.")
+	overloadMessages = metrics.Default.NewCounterVec("distributor_overload_messages_total",
+		"Messages the analyzers had no room for, by the overload policy applied to them.", "policy")
+	overloadBlockSeconds = metrics.Default.NewHistogram("distributor_overload_block_seconds",
+		"Time messages under the block overload policy waited for room.", metrics.DefaultLatencyBuckets)
+	overloadEvictions = metrics.Default.NewCounter("distributor_overload_evictions_total",
+		"Queued messages dropped to make room for a more urgent one.")
+	spillMessagesWritten = metrics.Default.NewCounter("distributor_spill_messages_written_total",
+		"Messages written to the spill queue because the analyzers had no room for them.")
+	spillMessagesReplayed = metrics.Default.NewCounter("distributor_spill_messages_replayed_total",
+		"Messages read back from the spill queue and routed again.")
+	memoryBudgetUsed = metrics.Default.NewGauge("distributor_memory_budget_used_bytes",
+		"Bytes of messages queued for or awaiting acknowledgement from all analyzers, counted against the shared memory budget.")
+	memoryBudgetRejections = metrics.Default.NewCounterVec("distributor_memory_budget_rejections_total",
+		"Messages an analyzer queue rejected for lack of memory, by the budget exhausted: analyzer or global.", "budget")
+	analyzerQueuedBytes = metrics.Default.NewGaugeVec("distributor_analyzer_queued_bytes",
+		"Bytes of messages waiting in each analyzer's queue.", "analyzer")
+	groupMessagesRouted = metrics.Default.NewCounterVec("distributor_group_messages_routed_total",
+		"Messages the routing rules sent to each analyzer group.", "group")
+)
+
+// Memory budget rejections by budget
+var (
+	analyzerBudgetRejections = memoryBudgetRejections.With("analyzer")
+	globalBudgetRejections   = memoryBudgetRejections.With("global")
+)
+
+// Per-priority routed counters, created on first use so idle priorities are not exported
+var priorityRoutedCounters [256]atomic.Pointer[metrics.Counter]
+
+// priorityRoutedCounter returns the routed counter for a priority
+func priorityRoutedCounter(priority uint8) *metrics.Counter {
+	if c := priorityRoutedCounters[priority].Load(); c != nil {
+		return c
+	}
+	c := priorityMessagesRouted.With(strconv.Itoa(int(priority)))
+	priorityRoutedCounters[priority].Store(c)
+	return c
+}
+
+// float32Value widens v without exposing float32 rounding noise (0.3, not 0.30000001)
+func float32Value(v float32) float64 {
+	f, _ := strconv.ParseFloat(strconv.FormatFloat(float64(v), 'g', -1, 32), 64)
+	return f
+}
+
+// metricLabel returns the reason as a Prometheus label value
+func (r DropReason) metricLabel() string {
+	switch r {
+	case DropNoAnalyzers:
+		return "no_analyzers"
+	case DropChannelsFull:
+		return "channels_full"
+	case DropShutdown:
+		return "shutdown"
+	case DropNoAnalyzerForPriority:
+		return "no_analyzer_for_priority"
+	case DropNoAnalyzerInGroup:
+		return "no_analyzer_in_group"
+	case DropEvicted:
+		return "evicted"
+	case DropMemoryBudget:
+		return "memory_budget"
+	}
+	return "unknown"
+}
+
+// sampleAnalyzerQueues refreshes the queue gauges of every analyzer session
+func (as *AnalyzerServer) sampleAnalyzerQueues() {
+	as.handlersMutex.Lock()
+	handlers := make([]*AnalyzerHandler, 0, len(as.handlers))
+	for _, ah := range as.handlers {
+		handlers = append(handlers, ah)
+	}
+	as.handlersMutex.Unlock()
+
+	analyzerPendingMessages.Reset()
+	analyzerQueuedMessages.Reset()
+	analyzerQueuedBytes.Reset()
+	memoryBudgetUsed.Set(float64(as.budget.used.Load()))
+	for _, ah := range handlers {
+		id := ah.config.AnalyzerID
+		pending, _, channels := ah.queueDepths()
+		analyzerPendingMessages.With(id).Set(float64(pending))
+		analyzerQueuedBytes.With(id).Set(float64(ah.config.queue.bytes.Load()))
+		for priority, n := range channels {
+			analyzerQueuedMessages.With(id, strconv.Itoa(int(priority))).Set(float64(n))
+		}
+	}
+}
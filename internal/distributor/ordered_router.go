@@ -0,0 +1,376 @@
+package distributor
+
+import (
+	"math/rand"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"log-distributor/internal/protocol"
+)
+
+// Lanes ordered messages are spread over. Analyzer handlers in ordered mode
+// queue by lane instead of by priority, so this matches their queue slots.
+const orderedLanes = 256
+
+// DefaultLaneBacklog is the default number of messages a lane holds while its
+// analyzer cannot take them
+const DefaultLaneBacklog = 1000
+
+// DefaultBacklogBytes is the default number of bytes all lanes of a router
+// hold together
+const DefaultBacklogBytes = 64 << 20
+
+// OrderedRouterOptions configure an OrderedRouter
+type OrderedRouterOptions struct {
+	Key             *KeyExtractor // Payload or header key messages are ordered by, nil for the emitter ID
+	MaxBacklog      int           // Messages each lane holds back, DefaultLaneBacklog if zero
+	MaxBacklogBytes int64         // Bytes all lanes hold back together, DefaultBacklogBytes if zero
+}
+
+// OrderedRouter implements RouterInterface so that the messages of every key
+// reach analyzers in the order they were routed. Keys hash to one of 256 lanes,
+// and each lane is placed on an analyzer by weighted rendezvous hashing like the
+// HashRouter places keys. A lane only moves to another analyzer once everything
+// it handed the previous one was acknowledged or handed back, and handed back
+// messages are resent ahead of the newer ones, so reroutes after failures keep
+// the order too. Messages waiting for that are held in the lane's backlog, which
+// is bounded by messages per lane and by bytes across lanes.
+//
+// Every message is numbered within its lane, and analyzers that negotiated
+// protocol.AnalyzerFeatureMetadata receive the lane and number with it. Messages
+// without a key go to a random lane.
+//
+// Only analyzers accepting every priority take part: the analyzer queues by lane
+// and serves the lane whose next message has the highest priority.
+type OrderedRouter struct {
+	routerBase
+	key        *KeyExtractor
+	maxBacklog int
+	backlog    memoryBudget // Bytes held in the lanes' backlogs
+	table      atomic.Pointer[orderedTable]
+	lanes      [orderedLanes]orderedLane
+}
+
+// orderedTable holds the analyzers the lanes are placed on
+type orderedTable struct {
+	nodes []hashNode
+}
+
+// orderedLane is the state of one lane, guarded by its mutex
+type orderedLane struct {
+	mutex    sync.Mutex
+	owner    *AnalyzerConfig   // Analyzer holding the lane's in-flight messages
+	inFlight int               // Messages queued for or sent to owner, not yet settled
+	backlog  []*orderedMessage // Messages waiting for the lane's analyzer, by sequence number
+	nextSeq  uint64
+}
+
+// orderedMessage is a message numbered within its lane
+type orderedMessage struct {
+	LogMessage
+	router   *OrderedRouter
+	lane     uint8
+	seq      uint64
+	inFlight bool // Counted in the lane's inFlight, guarded by the lane mutex
+}
+
+// NewOrderedRouter creates a new ordered router
+func NewOrderedRouter(opts OrderedRouterOptions) *OrderedRouter {
+	if opts.MaxBacklog <= 0 {
+		opts.MaxBacklog = DefaultLaneBacklog
+	}
+	if opts.MaxBacklogBytes <= 0 {
+		opts.MaxBacklogBytes = DefaultBacklogBytes
+	}
+	or := &OrderedRouter{key: opts.Key, maxBacklog: opts.MaxBacklog}
+	or.backlog.limit = opts.MaxBacklogBytes
+	or.init(or.rebuildTable)
+	or.table.Store(&orderedTable{})
+	return or
+}
+
+// RouteMessage numbers a message and queues it for the analyzer of its lane.
+// Messages handed back by an analyzer keep their number and go ahead of newer
+// ones. A new message finding its lane's backlog full, or the bytes of all
+// backlogs at their limit, is overloaded; evicting drops a lower-priority
+// message from the lane's backlog. Spilled messages are routed again later,
+// after newer messages of their key.
+func (or *OrderedRouter) RouteMessage(msg LogMessage) bool {
+	if m, ok := msg.(*orderedMessage); ok {
+		if m.router == or {
+			return or.requeue(m)
+		}
+		// Numbered by the router of another group before a reload moved it
+		m.router.settle(m)
+		msg = m.LogMessage
+	}
+
+	keyHash, ok := messageKeyHash(or.key, msg)
+	if !ok {
+		hashUnkeyedMessages.Inc()
+		keyHash = rand.Uint64()
+	}
+	i := uint8(mix64(keyHash))
+	lane := &or.lanes[i]
+
+	return or.routeEvicting(msg, func(msg LogMessage) (bool, *AnalyzerConfig, DropReason) {
+		lane.mutex.Lock()
+		defer lane.mutex.Unlock()
+		reason := DropChannelsFull
+		if len(lane.backlog) < or.maxBacklog {
+			if or.backlog.reserve(int64(len(msg.GetData()))) {
+				or.appendLocked(i, msg)
+				return true, nil, 0
+			}
+			reason = DropMemoryBudget
+		}
+		if node := pickNode(or.table.Load().nodes, laneHash(i)); node != nil {
+			return false, node.config, reason
+		}
+		return false, nil, or.noRouteReason()
+	}, func(msg LogMessage, _ *AnalyzerConfig) bool {
+		return or.evictLane(i, msg)
+	})
+}
+
+// appendLocked numbers a new message whose bytes were reserved and queues it
+// in lane i, with the lane mutex held
+func (or *OrderedRouter) appendLocked(i uint8, msg LogMessage) {
+	lane := &or.lanes[i]
+	lane.nextSeq++
+	m := &orderedMessage{LogMessage: msg, router: or, lane: i, seq: lane.nextSeq}
+	lane.backlog = append(lane.backlog, m)
+	orderedBacklog.Add(1)
+	or.advance(i)
+}
+
+// evictLane makes room for msg in the full backlog of lane i by dropping the
+// oldest message of the lowest priority below msg's. Returns false if the
+// backlog holds none, or if dropping it would not free enough bytes.
+func (or *OrderedRouter) evictLane(i uint8, msg LogMessage) bool {
+	lane := &or.lanes[i]
+	lane.mutex.Lock()
+	defer lane.mutex.Unlock()
+
+	victim := -1
+	for j, m := range lane.backlog {
+		if m.GetPriority() > msg.GetPriority() && (victim < 0 || m.GetPriority() > lane.backlog[victim].GetPriority()) {
+			victim = j
+		}
+	}
+	if victim < 0 {
+		return false
+	}
+	old := lane.backlog[victim]
+	size, freed := int64(len(msg.GetData())), int64(len(old.GetData()))
+	if !or.backlog.fits(size - freed) {
+		return false
+	}
+	lane.backlog = slices.Delete(lane.backlog, victim, victim+1)
+	orderedBacklog.Add(-1)
+	or.backlog.release(freed)
+	overloadEvictions.Inc()
+	or.deadLetter(old.LogMessage, DropEvicted)
+
+	if !or.backlog.reserve(size) {
+		return false // Another lane took the bytes meanwhile
+	}
+	or.appendLocked(i, msg)
+	return true
+}
+
+// requeue takes back a message its analyzer handed back and puts it in the
+// backlog by its number. Its bytes are charged even beyond the limit, as
+// refusing it would break the order of its key.
+func (or *OrderedRouter) requeue(m *orderedMessage) bool {
+	lane := &or.lanes[m.lane]
+	lane.mutex.Lock()
+	defer lane.mutex.Unlock()
+
+	or.settleLocked(m)
+	if or.shuttingDown.Load() {
+		return or.deadLetter(m.LogMessage, DropShutdown)
+	}
+	at, _ := slices.BinarySearchFunc(lane.backlog, m.seq, func(queued *orderedMessage, seq uint64) int {
+		switch {
+		case queued.seq < seq:
+			return -1
+		case queued.seq > seq:
+			return 1
+		}
+		return 0
+	})
+	lane.backlog = slices.Insert(lane.backlog, at, m)
+	orderedBacklog.Add(1)
+	or.backlog.charge(int64(len(m.GetData())))
+	or.advance(m.lane)
+	return true
+}
+
+// settle releases a message acknowledged by its analyzer from its lane
+func (or *OrderedRouter) settle(m *orderedMessage) {
+	lane := &or.lanes[m.lane]
+	lane.mutex.Lock()
+	defer lane.mutex.Unlock()
+
+	if or.settleLocked(m) {
+		or.advance(m.lane)
+	}
+}
+
+// settleLocked stops counting m as in flight, with the lane mutex held.
+// Returns whether it was.
+func (or *OrderedRouter) settleLocked(m *orderedMessage) bool {
+	if !m.inFlight {
+		return false
+	}
+	m.inFlight = false
+	or.lanes[m.lane].inFlight--
+	return true
+}
+
+// advance hands the backlog of lane i to the analyzer the lane is placed on, with
+// the lane mutex held. While another analyzer still holds messages of the lane
+// the backlog waits for them to settle, so the lane never has messages in flight
+// to two analyzers at once.
+func (or *OrderedRouter) advance(i uint8) {
+	lane := &or.lanes[i]
+	if len(lane.backlog) == 0 {
+		return
+	}
+	node := pickNode(or.table.Load().nodes, laneHash(i))
+	if node == nil {
+		return
+	}
+	if lane.inFlight == 0 && lane.owner != node.config {
+		if lane.owner != nil {
+			orderedLaneHandoffs.Inc()
+		}
+		lane.owner = node.config
+	}
+	if lane.owner != node.config {
+		return
+	}
+
+	sent := 0
+	for _, m := range lane.backlog {
+		if !node.config.queue.push(i, m) {
+			break
+		}
+		m.inFlight = true
+		sent++
+		or.backlog.release(int64(len(m.GetData())))
+		node.routed.Inc()
+		priorityRoutedCounter(m.GetPriority()).Inc()
+	}
+	lane.inFlight += sent
+	lane.backlog = slices.Delete(lane.backlog, 0, sent)
+	orderedBacklog.Add(-float64(sent))
+	if sent > 0 {
+		roomFreed.broadcast()
+	}
+}
+
+// laneHash returns the key a lane is placed on analyzers by
+func laneHash(i uint8) uint64 {
+	return mix64(uint64(i) * 0x9e3779b97f4a7c15)
+}
+
+// rebuildTable publishes the analyzers accepting every priority and hands each
+// lane's backlog to its analyzer, with rebuildMutex held
+func (or *OrderedRouter) rebuildTable(classes [256]int, members [][]*AnalyzerConfig) {
+	table := &orderedTable{}
+	if classes[0] >= 0 {
+		for _, config := range members[classes[0]] {
+			if config.Priorities != nil && !config.Priorities.IsFull() {
+				continue // Its lanes would miss some priorities
+			}
+			table.nodes = append(table.nodes, hashNode{
+				config: config,
+				idHash: fnv64a(config.AnalyzerID),
+				weight: float64(config.Weight),
+				routed: config.routed,
+			})
+		}
+	}
+	or.table.Store(table)
+
+	for i := range or.lanes {
+		lane := &or.lanes[i]
+		lane.mutex.Lock()
+		or.advance(uint8(i))
+		lane.mutex.Unlock()
+	}
+}
+
+// Backlog returns the number of messages waiting in the lanes for an analyzer
+func (or *OrderedRouter) Backlog() int {
+	n := 0
+	for i := range or.lanes {
+		lane := &or.lanes[i]
+		lane.mutex.Lock()
+		n += len(lane.backlog)
+		lane.mutex.Unlock()
+	}
+	return n
+}
+
+// Shutdown stops routing and dead-letters the messages waiting in the lanes
+func (or *OrderedRouter) Shutdown() {
+	for _, msg := range or.Retire() {
+		or.deadLetter(msg, DropShutdown)
+	}
+}
+
+// Retire stops routing like Shutdown but returns the messages waiting in the
+// lanes, each lane's in order, so they can be routed elsewhere
+func (or *OrderedRouter) Retire() []LogMessage {
+	or.shuttingDown.Store(true)
+	var held []LogMessage
+	for i := range or.lanes {
+		lane := &or.lanes[i]
+		lane.mutex.Lock()
+		for _, m := range lane.backlog {
+			held = append(held, m.LogMessage)
+			or.backlog.release(int64(len(m.GetData())))
+		}
+		orderedBacklog.Add(-float64(len(lane.backlog)))
+		lane.backlog = nil
+		lane.mutex.Unlock()
+	}
+	roomFreed.broadcast()
+	return held
+}
+
+// Source returns the ID of the emitter the message came from
+func (m *orderedMessage) Source() string {
+	if sourced, ok := m.LogMessage.(interface{ Source() string }); ok {
+		return sourced.Source()
+	}
+	return ""
+}
+
+// Envelope returns the envelope the message came in, nil for a data frame
+func (m *orderedMessage) Envelope() *EnvelopeMessage {
+	return envelopeOf(m.LogMessage)
+}
+
+// Ack settles the message in its lane and acknowledges the wrapped message
+func (m *orderedMessage) Ack() {
+	m.router.settle(m)
+	if a, ok := m.LogMessage.(acknowledger); ok {
+		a.Ack()
+	}
+}
+
+// metadata returns the lane and number sent to analyzers with the message,
+// along with the stamp of the wrapped message
+func (m *orderedMessage) metadata() protocol.Metadata {
+	var meta protocol.Metadata
+	if described, ok := m.LogMessage.(interface{ metadata() protocol.Metadata }); ok {
+		meta = described.metadata()
+	}
+	meta.Lane, meta.LaneSeq = m.lane, m.seq
+	return meta
+}
@@ -0,0 +1,85 @@
+package distributor
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"log-distributor/internal/protocol"
+)
+
+// newTestOrderedRouter creates an ordered router keyed by the payload text
+// after "key=", dead-lettering to sink
+func newTestOrderedRouter(opts OrderedRouterOptions, sink DeadLetterSink) *OrderedRouter {
+	opts.Key = &KeyExtractor{Prefix: "key=", Delimiter: " "}
+	or := NewOrderedRouter(opts)
+	or.SetOverload(OverloadOptions{BlockTimeout: time.Millisecond})
+	or.SetDeadLetterSink(sink)
+	return or
+}
+
+// Messages of a key handed back by an analyzer that disconnected reach the
+// next one in the order they were routed, ahead of those routed meanwhile
+func TestOrderedRouterKeepsOrderAcrossDisconnect(t *testing.T) {
+	router := newTestOrderedRouter(OrderedRouterOptions{}, &recordingSink{})
+	as := startAnalyzerServer(t, router, AnalyzerServerOptions{Ordered: true})
+
+	hello := &protocol.Hello{Version: protocol.Version, Weight: 1, ID: "a1"}
+	conn, _ := dialAnalyzer(t, as, hello)
+	waitForState(t, as, "a1", AnalyzerStateConnected)
+
+	var want []string
+	route := func(from, to int) {
+		for i := from; i < to; i++ {
+			payload := fmt.Sprintf("key=k %d", i)
+			want = append(want, payload)
+			if !router.RouteMessage(ByteSliceMessage(dataFrame(uint8(i%3), payload))) {
+				t.Fatalf("message %d not routed", i)
+			}
+		}
+	}
+
+	// The first analyzer takes some and leaves without acknowledging them
+	route(0, 5)
+	for range 2 {
+		readDataFrame(t, conn)
+	}
+	conn.Close()
+	route(5, 10)
+
+	hello.ID = "a2"
+	conn, _ = dialAnalyzer(t, as, hello)
+	var got []string
+	for range want {
+		got = append(got, string(readDataFrame(t, conn)[5:]))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("second analyzer received %q, want %q", got, want)
+	}
+}
+
+// The backlog of all lanes is bounded in bytes, and what it frees is usable
+// again
+func TestOrderedRouterBoundsBacklogBytes(t *testing.T) {
+	sink := &recordingSink{}
+	router := newTestOrderedRouter(OrderedRouterOptions{MaxBacklogBytes: 100}, sink)
+
+	// Without analyzers messages wait in the backlog until it is full
+	frame := func(key string) LogMessage {
+		return ByteSliceMessage(dataFrame(1, "key="+key+" "+string(make([]byte, 33))))
+	}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		router.RouteMessage(frame(key))
+	}
+	if n := router.Backlog(); n != 2 {
+		t.Errorf("backlog %d messages of 40 bytes, want 2 within 100 bytes", n)
+	}
+	if n := len(sink.received()); n != 2 {
+		t.Errorf("dead-lettered %d, want the 2 that did not fit", n)
+	}
+
+	router.Shutdown()
+	if used := router.backlog.used.Load(); used != 0 {
+		t.Errorf("backlog charged %d bytes after emptying it, want 0", used)
+	}
+}
@@ -0,0 +1,325 @@
+package distributor
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"log-distributor/internal/protocol"
+)
+
+// OverloadPolicy decides what happens to a message when the analyzers it may
+// be routed to have no room for it
+type OverloadPolicy uint8
+
+const (
+	// OverloadBlock waits for room, holding up the emitter connection so TCP
+	// backpressure slows the emitter down, and drops the message after the
+	// block timeout
+	OverloadBlock OverloadPolicy = iota
+	// OverloadDropNewest drops the message
+	OverloadDropNewest
+	// OverloadEvict drops the oldest queued message of the lowest priority
+	// below the message's at the analyzer picked, making room for it
+	OverloadEvict
+	// OverloadSpill writes the message to the spill queue, which routes it
+	// again once the analyzers catch up
+	OverloadSpill
+)
+
+// DefaultBlockTimeout is the default longest time a message waits for room
+// under OverloadBlock
+const DefaultBlockTimeout = time.Second
+
+// roomFreed wakes the messages waiting for room whenever an analyzer queue
+// frees some, an analyzer registers or a router shuts down
+var roomFreed roomSignal
+
+// roomSignal is a broadcast that can be waited on repeatedly. Waiters take the
+// channel before checking for room, so a broadcast in between is not missed.
+type roomSignal struct {
+	ch atomic.Pointer[chan struct{}]
+}
+
+// wait returns a channel closed by the next broadcast
+func (s *roomSignal) wait() <-chan struct{} {
+	for {
+		if ch := s.ch.Load(); ch != nil {
+			return *ch
+		}
+		ch := make(chan struct{})
+		if s.ch.CompareAndSwap(nil, &ch) {
+			return ch
+		}
+	}
+}
+
+// broadcast wakes everyone waiting
+func (s *roomSignal) broadcast() {
+	if s.ch.Load() == nil {
+		return // Nobody waits, spare the swap
+	}
+	if ch := s.ch.Swap(nil); ch != nil {
+		close(*ch)
+	}
+}
+
+// String returns the name the policy is configured by
+func (p OverloadPolicy) String() string {
+	switch p {
+	case OverloadBlock:
+		return "block"
+	case OverloadDropNewest:
+		return "drop-newest"
+	case OverloadEvict:
+		return "drop-oldest-lower-priority"
+	case OverloadSpill:
+		return "spill"
+	}
+	return fmt.Sprintf("unknown (%d)", uint8(p))
+}
+
+// metricLabel returns the policy as a Prometheus label value
+func (p OverloadPolicy) metricLabel() string {
+	switch p {
+	case OverloadBlock:
+		return "block"
+	case OverloadDropNewest:
+		return "drop_newest"
+	case OverloadEvict:
+		return "drop_oldest_lower_priority"
+	case OverloadSpill:
+		return "spill"
+	}
+	return "unknown"
+}
+
+// ParseOverloadPolicy parses a policy name
+func ParseOverloadPolicy(s string) (OverloadPolicy, error) {
+	for p := OverloadBlock; p <= OverloadSpill; p++ {
+		if s == p.String() {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown overload policy %q", s)
+}
+
+// OverloadPolicies holds the overload policy of every priority
+type OverloadPolicies [256]OverloadPolicy
+
+// ParseOverloadPolicies parses semicolon-separated policies like
+// "block;0-2=drop-oldest-lower-priority;200-255=spill". A bare policy applies
+// to every priority and "ranges=policy" to the priorities in the ranges, later
+// entries overriding earlier ones. Priorities not mentioned block.
+func ParseOverloadPolicies(s string) (OverloadPolicies, error) {
+	var policies OverloadPolicies
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		ranges, name, scoped := strings.Cut(entry, "=")
+		if !scoped {
+			ranges, name = "0-255", entry
+		}
+		policy, err := ParseOverloadPolicy(strings.TrimSpace(name))
+		if err != nil {
+			return policies, err
+		}
+		set, err := protocol.ParsePrioritySet(ranges)
+		if err != nil {
+			return policies, fmt.Errorf("overload policy %q: %w", entry, err)
+		}
+		for p := 0; p < 256; p++ {
+			if set.Contains(uint8(p)) {
+				policies[p] = policy
+			}
+		}
+	}
+	return policies, nil
+}
+
+// Uses reports whether any priority has the policy
+func (ps *OverloadPolicies) Uses(policy OverloadPolicy) bool {
+	for _, p := range ps {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// String formats the policies in the form ParseOverloadPolicies reads
+func (ps *OverloadPolicies) String() string {
+	parts := []string{OverloadBlock.String()}
+	for start := 0; start < 256; {
+		end := start
+		for end+1 < 256 && ps[end+1] == ps[start] {
+			end++
+		}
+		if ps[start] != OverloadBlock {
+			if start == end {
+				parts = append(parts, fmt.Sprintf("%d=%s", start, ps[start]))
+			} else {
+				parts = append(parts, fmt.Sprintf("%d-%d=%s", start, end, ps[start]))
+			}
+		}
+		start = end + 1
+	}
+	return strings.Join(parts, ";")
+}
+
+// OverloadOptions configure how a router handles messages it has no room for
+type OverloadOptions struct {
+	Policies     OverloadPolicies
+	BlockTimeout time.Duration // DefaultBlockTimeout if zero
+	Spill        *SpillQueue   // Required by OverloadSpill
+}
+
+// routeAttempt tries once to queue a message for an analyzer. It returns
+// whether the message was queued and, if not, the analyzer it was meant for
+// (nil when no analyzer accepts it) together with the reason it was not.
+type routeAttempt func(msg LogMessage) (bool, *AnalyzerConfig, DropReason)
+
+// SetOverload sets how the router handles messages it has no room for. Must be
+// called before messages are routed.
+func (rb *routerBase) SetOverload(opts OverloadOptions) {
+	if opts.BlockTimeout <= 0 {
+		opts.BlockTimeout = DefaultBlockTimeout
+	}
+	rb.overload = opts
+}
+
+// route places msg with try, applying the overload policy of its priority when
+// there is no room for it. A message no analyzer accepts can still be spilled,
+// or blocked until an analyzer for it registers; evicting cannot make room
+// for it.
+func (rb *routerBase) route(msg LogMessage, try routeAttempt) bool {
+	return rb.routeEvicting(msg, try, rb.evictQueued)
+}
+
+// routeEvicting is route with the eviction done by evict, which makes room for
+// msg and queues it, returning false if it could not
+func (rb *routerBase) routeEvicting(msg LogMessage, try routeAttempt, evict func(msg LogMessage, target *AnalyzerConfig) bool) bool {
+	if rb.shuttingDown.Load() {
+		return rb.deadLetter(msg, DropShutdown)
+	}
+	placed, target, reason := try(msg)
+	if placed {
+		return true
+	}
+
+	if spilled, ok := msg.(*spilledMessage); ok {
+		// Spilling again would only go round in circles
+		return rb.replay(spilled, try)
+	}
+
+	policy := rb.overload.Policies[msg.GetPriority()]
+	overloadMessages.With(policy.metricLabel()).Inc()
+	switch {
+	case policy == OverloadSpill && rb.overload.Spill != nil:
+		return rb.spill(msg, reason)
+	case policy == OverloadBlock:
+		return rb.block(msg, try)
+	case target == nil:
+		return rb.deadLetter(msg, reason)
+	case policy == OverloadEvict:
+		if evict(msg, target) {
+			return true
+		}
+	}
+	return rb.deadLetter(msg, reason)
+}
+
+// block retries msg each time room may have been freed, until it is placed,
+// the block timeout passes or the router shuts down. Without an analyzer for
+// msg it waits for one to register.
+func (rb *routerBase) block(msg LogMessage, try routeAttempt) bool {
+	start := time.Now()
+	timeout := time.NewTimer(rb.overload.BlockTimeout)
+	defer timeout.Stop()
+	defer func() { overloadBlockSeconds.Observe(time.Since(start).Seconds()) }()
+
+	for {
+		room := roomFreed.wait()
+		if rb.shuttingDown.Load() {
+			return rb.deadLetter(msg, DropShutdown)
+		}
+		placed, _, reason := try(msg)
+		if placed {
+			return true
+		}
+		select {
+		case <-room:
+		case <-timeout.C:
+			return rb.deadLetter(msg, reason)
+		}
+	}
+}
+
+// replay retries a message read back from the spill queue each time room may
+// have been freed, until it is placed or the router shuts down. It waits for
+// room however long it takes, but only for the block timeout while no analyzer
+// accepts it at all.
+func (rb *routerBase) replay(msg *spilledMessage, try routeAttempt) bool {
+	var unrouted time.Time // Since when no analyzer accepts msg
+	for {
+		room := roomFreed.wait()
+		if rb.shuttingDown.Load() {
+			return rb.deadLetter(msg, DropShutdown)
+		}
+		placed, target, reason := try(msg)
+		if placed {
+			return true
+		}
+
+		var timeout <-chan time.Time
+		if target == nil {
+			if unrouted.IsZero() {
+				unrouted = time.Now()
+			}
+			left := rb.overload.BlockTimeout - time.Since(unrouted)
+			if left <= 0 {
+				return rb.deadLetter(msg, reason)
+			}
+			timeout = time.After(left)
+		} else {
+			unrouted = time.Time{}
+		}
+		select {
+		case <-room:
+		case <-timeout:
+		}
+	}
+}
+
+// evictQueued makes room for msg at the target analyzer by dropping the oldest
+// messages of the lowest priorities queued there below msg's, and queues msg in
+// their place. Returns false if that could not make room.
+func (rb *routerBase) evictQueued(msg LogMessage, target *AnalyzerConfig) bool {
+	priority := msg.GetPriority()
+	evicted, placed := target.queue.pushEvicting(priority, msg)
+	for _, old := range evicted {
+		overloadEvictions.Inc()
+		rb.deadLetter(old, DropEvicted)
+	}
+	if !placed {
+		return false
+	}
+	target.routed.Inc()
+	priorityRoutedCounter(priority).Inc()
+	return true
+}
+
+// spill hands msg to the spill queue, which acknowledges it once it was
+// routed again
+func (rb *routerBase) spill(msg LogMessage, reason DropReason) bool {
+	if err := rb.overload.Spill.Write(msg, reason); err != nil {
+		log.Printf("WARNING: Failed to spill priority %d message: %v", msg.GetPriority(), err)
+		return rb.deadLetter(msg, reason)
+	}
+	return true
+}
@@ -0,0 +1,165 @@
+package distributor
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A blocked message waits for an analyzer to register when there is none
+func TestBlockWaitsForAnalyzer(t *testing.T) {
+	router := NewWeightedTreeRouter()
+	router.SetOverload(OverloadOptions{BlockTimeout: 5 * time.Second})
+
+	routed := make(chan bool)
+	go func() {
+		routed <- router.RouteMessage(ByteSliceMessage(dataFrame(1, "waits")))
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	config := &AnalyzerConfig{AnalyzerID: "late", Weight: 1}
+	config.queue.configure(0, 0, nil)
+	router.RegisterAnalyzer(config)
+	defer router.UnregisterAnalyzer(config)
+
+	select {
+	case ok := <-routed:
+		if !ok || config.queue.len() != 1 {
+			t.Errorf("routed %v with %d queued, want the message queued at the late analyzer", ok, config.queue.len())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message still blocked after an analyzer registered")
+	}
+}
+
+// A blocked message without an analyzer is dropped once the block timeout passes
+func TestBlockTimesOutWithoutAnalyzer(t *testing.T) {
+	router := NewWeightedTreeRouter()
+	router.SetOverload(OverloadOptions{BlockTimeout: 20 * time.Millisecond})
+
+	start := time.Now()
+	if router.RouteMessage(ByteSliceMessage(dataFrame(1, "dropped"))) {
+		t.Fatal("message routed without analyzers")
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Errorf("dropped after %v, want it to wait for the block timeout", waited)
+	}
+}
+
+func TestWarningLogAggregatesBursts(t *testing.T) {
+	var out bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&out)
+
+	var w warningLog
+	for range 100 {
+		w.printf("WARNING: dropped")
+	}
+	if lines := strings.Count(out.String(), "\n"); lines != 1 {
+		t.Errorf("logged %d lines for a burst, want 1:\n%s", lines, out.String())
+	}
+
+	out.Reset()
+	w.last.Store(0) // The interval has passed
+	w.printf("WARNING: dropped")
+	if !strings.Contains(out.String(), "(99 more since the last warning)") {
+		t.Errorf("logged %q, want the 99 left out counted", out.String())
+	}
+}
+
+// newFullAnalyzer registers an analyzer with room for one message of size
+// bytes, and fills it
+func newFullAnalyzer(t *testing.T, router *WeightedTreeRouter, size int) *AnalyzerConfig {
+	t.Helper()
+	config := &AnalyzerConfig{AnalyzerID: "full", Weight: 1}
+	config.queue.configure(0, int64(size), nil)
+	router.RegisterAnalyzer(config)
+	t.Cleanup(func() { router.UnregisterAnalyzer(config) })
+	if !router.RouteMessage(ByteSliceMessage(dataFrame(1, "fill"))) {
+		t.Fatal("analyzer not filled")
+	}
+	return config
+}
+
+// ackOne takes the oldest message queued for an analyzer as its writer would,
+// and has the analyzer acknowledge it
+func ackOne(config *AnalyzerConfig) {
+	for _, msg := range config.queue.popBatch(nil, 1, false) {
+		config.queue.done(msg)
+	}
+}
+
+// A blocked message is placed as soon as the analyzer acknowledges a message
+func TestBlockWakesWhenRoomIsFreed(t *testing.T) {
+	router := NewWeightedTreeRouter()
+	router.SetOverload(OverloadOptions{BlockTimeout: 5 * time.Second})
+	config := newFullAnalyzer(t, router, len(dataFrame(1, "fill")))
+
+	routed := make(chan bool)
+	go func() {
+		routed <- router.RouteMessage(ByteSliceMessage(dataFrame(1, "next")))
+	}()
+	time.Sleep(20 * time.Millisecond)
+	ackOne(config)
+
+	select {
+	case ok := <-routed:
+		if !ok || config.queue.len() != 1 {
+			t.Errorf("routed %v with %d queued, want the message queued", ok, config.queue.len())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message still blocked after room was freed")
+	}
+}
+
+// A replayed spilled message waits for room past the block timeout
+func TestSpillReplayWaitsForRoom(t *testing.T) {
+	router := NewWeightedTreeRouter()
+	router.SetOverload(OverloadOptions{BlockTimeout: time.Millisecond})
+	config := newFullAnalyzer(t, router, len(dataFrame(1, "fill")))
+
+	routed := make(chan bool)
+	go func() {
+		routed <- router.RouteMessage(&spilledMessage{LogMessage: ByteSliceMessage(dataFrame(1, "next"))})
+	}()
+	select {
+	case ok := <-routed:
+		t.Fatalf("replayed message gave up (routed %v) while its analyzer was full", ok)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ackOne(config)
+	select {
+	case ok := <-routed:
+		if !ok || config.queue.len() != 1 {
+			t.Errorf("routed %v with %d queued, want the message queued", ok, config.queue.len())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("replayed message still waiting after room was freed")
+	}
+}
+
+// A replayed spilled message no analyzer accepts is dead-lettered after the
+// block timeout rather than waiting forever
+func TestSpillReplayDeadLettersWithoutAnalyzer(t *testing.T) {
+	router := NewWeightedTreeRouter()
+	router.SetOverload(OverloadOptions{BlockTimeout: 20 * time.Millisecond})
+	sink := &recordingSink{}
+	router.SetDeadLetterSink(sink)
+
+	seg := &spillSegment{}
+	seg.remaining.Store(2) // Still being read, so not deleted
+	msg := &spilledMessage{LogMessage: ByteSliceMessage(dataFrame(1, "orphan")), segment: seg}
+	start := time.Now()
+	if !router.RouteMessage(msg) {
+		t.Fatal("replayed message not dead-lettered")
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Errorf("dead-lettered after %v, want it to wait for the block timeout", waited)
+	}
+	if len(sink.reasons) != 1 || sink.reasons[0] != DropNoAnalyzers || !msg.acked.Load() {
+		t.Errorf("dead-lettered as %v, acknowledged %v; want %v and released", sink.reasons, msg.acked.Load(), DropNoAnalyzers)
+	}
+}
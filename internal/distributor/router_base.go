@@ -0,0 +1,307 @@
+package distributor
+
+import (
+	"container/list"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"log-distributor/internal/metrics"
+)
+
+// Shortest time between two warnings about dropped messages
+const dropWarningInterval = time.Second
+
+// Router is a RouterInterface the distributor can divert to a dead-letter sink
+// and shut down
+type Router interface {
+	RouterInterface
+	SetDeadLetterSink(sink DeadLetterSink)
+	Shutdown()
+}
+
+// RouterFactory creates an empty router, once per analyzer group
+type RouterFactory func() Router
+
+// routerBase keeps the registered analyzers, dead-lettering and shutdown state
+// shared by the routers. The embedding router builds its routing table from the
+// analyzers in rebuild.
+type routerBase struct {
+	analyzers    *list.List // Registered analyzers by descending weight
+	count        atomic.Int32
+	rebuildMutex sync.Mutex
+	rebuild      func(classes [256]int, members [][]*AnalyzerConfig)
+
+	deadLetters  DeadLetterSink // nil discards dropped messages
+	overload     OverloadOptions
+	shuttingDown atomic.Bool
+
+	group   string         // Analyzer group routed, DefaultGroup when not split by rules
+	grouped bool           // Whether other groups have analyzers of their own
+	classes *metrics.Gauge // Priority classes in use
+}
+
+// init prepares the base of a router that builds its table in rebuild
+func (rb *routerBase) init(rebuild func(classes [256]int, members [][]*AnalyzerConfig)) {
+	rb.analyzers = list.New()
+	rb.rebuild = rebuild
+	rb.overload.BlockTimeout = DefaultBlockTimeout
+	rb.group = DefaultGroup
+	rb.classes = routerPriorityClasses.With(DefaultGroup)
+}
+
+// setGroup makes the router the one of an analyzer group of a RuleRouter
+func (rb *routerBase) setGroup(group string) {
+	rb.group = group
+	rb.grouped = true
+	rb.classes = routerPriorityClasses.With(group)
+}
+
+// SetDeadLetterSink diverts messages that cannot be routed to sink instead of
+// discarding them. Must be called before messages are routed.
+func (rb *routerBase) SetDeadLetterSink(sink DeadLetterSink) {
+	rb.deadLetters = sink
+}
+
+// Shutdown stops routing: every message routed afterwards is dead-lettered
+func (rb *routerBase) Shutdown() {
+	rb.shuttingDown.Store(true)
+	roomFreed.broadcast()
+}
+
+// HasAnalyzers reports whether any analyzer is registered
+func (rb *routerBase) HasAnalyzers() bool {
+	return rb.count.Load() > 0
+}
+
+// RegisterAnalyzer adds a new analyzer to the router
+func (rb *routerBase) RegisterAnalyzer(config *AnalyzerConfig) {
+	rb.rebuildMutex.Lock()
+	defer rb.rebuildMutex.Unlock()
+	rb.registerLocked(config)
+}
+
+// registerLocked adds an analyzer to the table, with rebuildMutex held
+func (rb *routerBase) registerLocked(config *AnalyzerConfig) {
+	if config.routed == nil {
+		config.routed = analyzerMessagesRouted.With(config.AnalyzerID)
+	}
+
+	added := false
+	for e := rb.analyzers.Front(); e != nil; e = e.Next() {
+		if e.Value.(*AnalyzerConfig).Weight < config.Weight {
+			rb.analyzers.InsertBefore(config, e)
+			added = true
+			break
+		}
+	}
+	if !added {
+		rb.analyzers.PushBack(config)
+	}
+
+	rb.rebuildLocked()
+	analyzersConnected.Add(1)
+	analyzerWeight.With(config.AnalyzerID).Set(float32Value(config.Weight))
+	roomFreed.broadcast()
+}
+
+// UnregisterAnalyzer removes an analyzer from the router
+func (rb *routerBase) UnregisterAnalyzer(config *AnalyzerConfig) {
+	rb.rebuildMutex.Lock()
+	defer rb.rebuildMutex.Unlock()
+	rb.unregisterLocked(config)
+}
+
+// unregisterLocked removes an analyzer from the table, with rebuildMutex held.
+// Returns false if the analyzer was not registered.
+func (rb *routerBase) unregisterLocked(config *AnalyzerConfig) bool {
+	removed := false
+	for e := rb.analyzers.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(*AnalyzerConfig).AnalyzerID == config.AnalyzerID {
+			rb.analyzers.Remove(e)
+			removed = true
+		}
+		e = next
+	}
+
+	if removed {
+		rb.rebuildLocked()
+		analyzersConnected.Add(-1)
+		analyzerWeight.Delete(config.AnalyzerID)
+	}
+	return removed
+}
+
+// UpdateWeight updates the weight of an existing analyzer. An analyzer that is
+// not registered only has its configured weight changed, so a later
+// RegisterAnalyzer uses the new value.
+func (rb *routerBase) UpdateWeight(config *AnalyzerConfig, weight float32) {
+	rb.rebuildMutex.Lock()
+	defer rb.rebuildMutex.Unlock()
+
+	registered := rb.unregisterLocked(config)
+	config.Weight = weight
+	if registered {
+		rb.registerLocked(config)
+	}
+}
+
+// rebuildLocked groups the priorities into classes accepted by the same
+// analyzers and has the router rebuild its table, with rebuildMutex held
+func (rb *routerBase) rebuildLocked() {
+	analyzers := make([]*AnalyzerConfig, 0, rb.analyzers.Len())
+	for e := rb.analyzers.Front(); e != nil; e = e.Next() {
+		analyzers = append(analyzers, e.Value.(*AnalyzerConfig))
+	}
+	classes, members := priorityClasses(analyzers)
+
+	rb.rebuild(classes, members)
+	rb.count.Store(int32(len(analyzers)))
+	routerTreeRebuilds.Inc()
+	rb.classes.Set(float64(len(members)))
+}
+
+// priorityClasses groups the priorities by which analyzers accept them, so
+// each class can share one routing structure. Returns the class of every
+// priority, -1 where no analyzer accepts it, and the analyzers of each class
+// in the order given.
+func priorityClasses(analyzers []*AnalyzerConfig) ([256]int, [][]*AnalyzerConfig) {
+	var classes [256]int
+	var members [][]*AnalyzerConfig
+	byKey := make(map[string]int)
+	key := make([]byte, (len(analyzers)+7)/8) // One bit per analyzer
+	for p := 0; p < 256; p++ {
+		clear(key)
+		empty := true
+		for i, config := range analyzers {
+			if config.accepts(uint8(p)) {
+				key[i/8] |= 1 << (i % 8)
+				empty = false
+			}
+		}
+		if empty {
+			classes[p] = -1
+			continue
+		}
+
+		class, ok := byKey[string(key)]
+		if !ok {
+			class = len(members)
+			byKey[string(key)] = class
+			var accepting []*AnalyzerConfig
+			for _, config := range analyzers {
+				if config.accepts(uint8(p)) {
+					accepting = append(accepting, config)
+				}
+			}
+			members = append(members, accepting)
+		}
+		classes[p] = class
+	}
+	return classes, members
+}
+
+// noRouteReason explains why no analyzer could be found for a message
+func (rb *routerBase) noRouteReason() DropReason {
+	switch {
+	case rb.count.Load() > 0:
+		return DropNoAnalyzerForPriority
+	case rb.grouped:
+		return DropNoAnalyzerInGroup
+	}
+	return DropNoAnalyzers
+}
+
+// deadLetter hands a message the router gave up on to the dead-letter sink.
+// Returns true if the sink now holds the message. A message neither the sink
+// nor the next start will deliver is acknowledged, so the WAL and the spill
+// queue do not keep it forever. One they keep on disk is only acknowledged
+// once the sink has synced it, so a crash cannot lose it.
+func (rb *routerBase) deadLetter(msg LogMessage, reason DropReason) bool {
+	messagesDropped.With(reason.metricLabel()).Inc()
+	if reason == DropShutdown && persisted(msg) {
+		// Left unacknowledged in the WAL or the spill queue, which replay it on
+		// the next start
+		return false
+	}
+	if rb.deadLetters == nil {
+		dropWarnings.printf("WARNING: Message dropped - %s", reason)
+		releaseDropped(msg)
+		return false
+	}
+
+	dl := &DeadLetter{
+		Reason:   reason,
+		Priority: msg.GetPriority(),
+		Time:     time.Now(),
+		Frame:    msg.GetData(),
+		Headers:  messageHeaders(msg),
+	}
+	if sourced, ok := msg.(interface{ Source() string }); ok {
+		dl.Source = sourced.Source()
+	}
+	if err := rb.deadLetters.WriteDeadLetter(dl); err != nil {
+		dropWarnings.printf("WARNING: Message dropped (%s), dead-letter sink failed: %v", reason, err)
+		releaseDropped(msg)
+		return false
+	}
+	messagesDeadLettered.With(reason.metricLabel()).Inc()
+	dropWarnings.printf("WARNING: Priority %d message from %q dead-lettered (%s)", dl.Priority, dl.Source, reason)
+
+	// Once the sink keeps the message on disk, the WAL no longer has to
+	if synced, ok := rb.deadLetters.(interface{ Sync() error }); ok && persisted(msg) {
+		if err := synced.Sync(); err != nil {
+			log.Printf("WARNING: Keeping dead-lettered message for replay: %v", err)
+			return true
+		}
+	}
+	releaseDropped(msg)
+	return true
+}
+
+// persisted reports whether msg is kept on disk until it is acknowledged, by
+// the WAL or the spill queue
+func persisted(msg LogMessage) bool {
+	switch m := msg.(type) {
+	case *ingressMessage:
+		return m.wal != nil
+	case *spilledMessage:
+		return true
+	}
+	return false
+}
+
+// releaseDropped acknowledges a message that left the pipeline, releasing its
+// WAL record or spill segment
+func releaseDropped(msg LogMessage) {
+	if a, ok := msg.(acknowledger); ok {
+		a.Ack()
+	}
+}
+
+// dropWarnings logs the messages the routers give up on
+var dropWarnings warningLog
+
+// warningLog logs at most one warning per dropWarningInterval, counting the
+// ones left out in the next, so a burst of drops cannot flood the log. The
+// metrics count every drop.
+type warningLog struct {
+	last       atomic.Int64 // Time of the last warning logged, in Unix nanoseconds
+	suppressed atomic.Int64
+}
+
+func (w *warningLog) printf(format string, args ...any) {
+	now := time.Now().UnixNano()
+	last := w.last.Load()
+	if now-last < int64(dropWarningInterval) || !w.last.CompareAndSwap(last, now) {
+		w.suppressed.Add(1)
+		return
+	}
+	if n := w.suppressed.Swap(0); n > 0 {
+		format += " (%d more since the last warning)"
+		args = append(args, n)
+	}
+	log.Printf(format, args...)
+}
@@ -0,0 +1,239 @@
+package distributor
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"log-distributor/internal/metrics"
+)
+
+// RuleRouter implements RouterInterface by routing each message to the analyzer
+// group its routing rules pick. Every group has a router of its own, so weights
+// and priority subscriptions are honored within the group.
+type RuleRouter struct {
+	path      string
+	newRouter RouterFactory
+	state     atomic.Pointer[ruleState]
+
+	mutex      sync.Mutex                 // Serializes registration and reloads
+	routers    map[string]Router          // By group, kept across reloads
+	registered map[*AnalyzerConfig]string // Group each analyzer is in
+
+	deadLetters  DeadLetterSink
+	shuttingDown bool
+}
+
+// ruleState is the rules in use together with the routers of their groups
+type ruleState struct {
+	rules   *RoutingRules
+	routers map[string]Router
+	routed  map[string]*metrics.Counter // Messages routed to each group
+}
+
+// NewRuleRouter loads the routing rules in path, creating the router of each
+// group with newRouter
+func NewRuleRouter(path string, newRouter RouterFactory) (*RuleRouter, error) {
+	rr := &RuleRouter{
+		path:       path,
+		newRouter:  newRouter,
+		routers:    make(map[string]Router),
+		registered: make(map[*AnalyzerConfig]string),
+	}
+	if err := rr.Reload(); err != nil {
+		return nil, err
+	}
+	return rr, nil
+}
+
+// Reload reads the rules again and moves analyzers whose group changed. The
+// routers of groups that are gone are shut down, and the messages they held
+// back are routed again under the new rules. On error the previous rules stay
+// in use.
+func (rr *RuleRouter) Reload() error {
+	rules, err := LoadRoutingRules(rr.path)
+	if err != nil {
+		return err
+	}
+
+	// Routing again may block until an analyzer has room, so it waits for the
+	// mutex to be released
+	retired := rr.reload(rules)
+	for name, router := range retired {
+		held := retire(router)
+		for _, msg := range held {
+			rr.RouteMessage(msg)
+		}
+		if len(held) > 0 {
+			log.Printf("Group %s removed: %d held back messages routed again", name, len(held))
+		}
+	}
+	return nil
+}
+
+// retire shuts down the router of a removed group, returning the messages it
+// held back
+func retire(router Router) []LogMessage {
+	if retiring, ok := router.(interface{ Retire() []LogMessage }); ok {
+		return retiring.Retire()
+	}
+	router.Shutdown()
+	return nil
+}
+
+// reload puts rules in use, returning the routers of the groups they removed
+func (rr *RuleRouter) reload(rules *RoutingRules) map[string]Router {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	state := &ruleState{
+		rules:   rules,
+		routers: make(map[string]Router),
+		routed:  make(map[string]*metrics.Counter),
+	}
+	names := []string{DefaultGroup}
+	for _, group := range rules.Groups {
+		names = append(names, group.Name)
+	}
+	for _, name := range names {
+		router := rr.routers[name]
+		if router == nil {
+			router = rr.newRouter()
+			if grouped, ok := router.(interface{ setGroup(string) }); ok {
+				grouped.setGroup(name)
+			}
+			router.SetDeadLetterSink(rr.deadLetters)
+			if rr.shuttingDown {
+				router.Shutdown()
+			}
+		}
+		state.routers[name] = router
+		state.routed[name] = groupMessagesRouted.With(name)
+	}
+
+	// Move analyzers into their new groups before retiring the old ones
+	for config, old := range rr.registered {
+		group := rules.groupOf(config.AnalyzerID)
+		if router := state.routers[group]; router != rr.routers[old] {
+			rr.routers[old].UnregisterAnalyzer(config)
+			router.RegisterAnalyzer(config)
+			rr.registered[config] = group
+			log.Printf("Analyzer %s moved to group %s", config.AnalyzerID, group)
+		}
+	}
+	retired := make(map[string]Router)
+	for name, router := range rr.routers {
+		if state.routers[name] == nil {
+			retired[name] = router
+			groupMessagesRouted.Delete(name)
+			routerPriorityClasses.Delete(name)
+		}
+	}
+	rr.routers = state.routers
+	rr.state.Store(state)
+
+	sort.Strings(names)
+	log.Printf("Routing rules loaded: %d rules over groups %v", len(rules.Rules), names)
+	return retired
+}
+
+// RouteMessage routes msg within the group the rules pick for it
+func (rr *RuleRouter) RouteMessage(msg LogMessage) bool {
+	state := rr.state.Load()
+	group := state.rules.match(msg)
+	state.routed[group].Inc()
+	return state.routers[group].RouteMessage(msg)
+}
+
+// HasAnalyzers reports whether any group has an analyzer
+func (rr *RuleRouter) HasAnalyzers() bool {
+	for _, router := range rr.state.Load().routers {
+		if router.HasAnalyzers() {
+			return true
+		}
+	}
+	return false
+}
+
+// Backlog returns the number of messages the group routers hold back for
+// analyzers
+func (rr *RuleRouter) Backlog() int {
+	n := 0
+	for _, router := range rr.state.Load().routers {
+		if backlogged, ok := router.(interface{ Backlog() int }); ok {
+			n += backlogged.Backlog()
+		}
+	}
+	return n
+}
+
+// RegisterAnalyzer adds an analyzer to the router of its group
+func (rr *RuleRouter) RegisterAnalyzer(config *AnalyzerConfig) {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	state := rr.state.Load()
+	group := state.rules.groupOf(config.AnalyzerID)
+	state.routers[group].RegisterAnalyzer(config)
+	rr.registered[config] = group
+	if group != DefaultGroup {
+		log.Printf("Analyzer %s joined group %s", config.AnalyzerID, group)
+	}
+}
+
+// UnregisterAnalyzer removes an analyzer from the router of its group
+func (rr *RuleRouter) UnregisterAnalyzer(config *AnalyzerConfig) {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	if group, ok := rr.registered[config]; ok {
+		rr.routers[group].UnregisterAnalyzer(config)
+		delete(rr.registered, config)
+	}
+}
+
+// UpdateWeight updates the weight of an analyzer in the router of its group
+func (rr *RuleRouter) UpdateWeight(config *AnalyzerConfig, weight float32) {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	group, ok := rr.registered[config]
+	if !ok {
+		// Not registered, so any router just records the weight
+		group = DefaultGroup
+	}
+	rr.routers[group].UpdateWeight(config, weight)
+}
+
+// SetDeadLetterSink diverts messages that cannot be routed in any group to
+// sink. Must be called before messages are routed.
+func (rr *RuleRouter) SetDeadLetterSink(sink DeadLetterSink) {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	rr.deadLetters = sink
+	for _, router := range rr.routers {
+		router.SetDeadLetterSink(sink)
+	}
+}
+
+// Shutdown stops routing in every group
+func (rr *RuleRouter) Shutdown() {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	rr.shuttingDown = true
+	for _, router := range rr.routers {
+		router.Shutdown()
+	}
+}
+
+// AnalyzerGroup returns the group an analyzer is routed in, empty if it is
+// not registered
+func (rr *RuleRouter) AnalyzerGroup(config *AnalyzerConfig) string {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	return rr.registered[config]
+}
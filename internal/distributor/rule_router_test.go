@@ -0,0 +1,189 @@
+package distributor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"log-distributor/internal/protocol"
+)
+
+// writeRules writes routing rules to a file in dir and returns its path
+func writeRules(t *testing.T, dir, rules string) string {
+	t.Helper()
+	path := filepath.Join(dir, "rules.json")
+	if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// groupTestRules send tenant acme to the audit group of the audit-* analyzers
+const groupTestRules = `{
+	"groups": [{"name": "audit", "analyzers": ["audit-*"]}],
+	"rules": [{"key": {"prefix": "tenant=", "delimiter": " "}, "values": ["acme"], "group": "audit"}]
+}`
+
+func newWeightedRouter() Router { return NewWeightedTreeRouter() }
+
+// queueAnalyzer returns an analyzer config whose queue has no limits
+func queueAnalyzer(id string) *AnalyzerConfig {
+	config := &AnalyzerConfig{AnalyzerID: id, Weight: 1}
+	config.queue.configure(0, 0, nil)
+	return config
+}
+
+// Messages only reach the analyzers of the group their rule picks
+func TestRuleRouterRoutesWithinGroup(t *testing.T) {
+	rr, err := NewRuleRouter(writeRules(t, t.TempDir(), groupTestRules), newWeightedRouter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit, other := queueAnalyzer("audit-1"), queueAnalyzer("analyzer-1")
+	rr.RegisterAnalyzer(audit)
+	rr.RegisterAnalyzer(other)
+	if group := rr.AnalyzerGroup(audit); group != "audit" {
+		t.Errorf("audit-1 in group %q, want audit", group)
+	}
+
+	for _, tt := range []struct {
+		payload string
+		to      *AnalyzerConfig
+	}{
+		{"tenant=acme login", audit},
+		{"tenant=globex login", other},
+		{"no tenant", other},
+	} {
+		if !rr.RouteMessage(ByteSliceMessage(dataFrame(1, tt.payload))) {
+			t.Fatalf("%q not routed", tt.payload)
+		}
+		if msgs := tt.to.queue.popBatch(nil, 1, false); len(msgs) == 0 {
+			t.Errorf("%q not routed to %s", tt.payload, tt.to.AnalyzerID)
+		} else if got := string(msgs[0].GetData()[5:]); got != tt.payload {
+			t.Errorf("%s received %q, want %q", tt.to.AnalyzerID, got, tt.payload)
+		}
+	}
+}
+
+// A rule keyed by an envelope header matches on the header, never on the
+// payload of a bare data frame
+func TestRuleRouterRoutesByHeader(t *testing.T) {
+	rules := `{
+		"groups": [{"name": "audit", "analyzers": ["audit-*"]}],
+		"rules": [{"key": {"header": "content_type"}, "values": ["application/audit+json"], "group": "audit"}]
+	}`
+	rr, err := NewRuleRouter(writeRules(t, t.TempDir(), rules), newWeightedRouter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit, other := queueAnalyzer("audit-1"), queueAnalyzer("analyzer-1")
+	rr.RegisterAnalyzer(audit)
+	rr.RegisterAnalyzer(other)
+
+	envelope := func(contentType string) LogMessage {
+		frame, err := protocol.AppendEnvelope(nil, &protocol.Headers{ContentType: contentType}, dataFrame(1, "login"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := ParseMessage(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	for _, tt := range []struct {
+		name string
+		msg  LogMessage
+		to   *AnalyzerConfig
+	}{
+		{"audit envelope", envelope("application/audit+json"), audit},
+		{"other envelope", envelope("text/plain"), other},
+		{"data frame", ByteSliceMessage(dataFrame(1, "application/audit+json")), other},
+	} {
+		if !rr.RouteMessage(tt.msg) {
+			t.Fatalf("%s not routed", tt.name)
+		}
+		if msgs := tt.to.queue.popBatch(nil, 1, false); len(msgs) == 0 {
+			t.Errorf("%s not routed to %s", tt.name, tt.to.AnalyzerID)
+		}
+	}
+}
+
+// A group the reloaded rules remove is shut down and its analyzers move to
+// the default group
+func TestReloadShutsDownRemovedGroup(t *testing.T) {
+	dir := t.TempDir()
+	rr, err := NewRuleRouter(writeRules(t, dir, groupTestRules), newWeightedRouter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit := queueAnalyzer("audit-1")
+	rr.RegisterAnalyzer(audit)
+	removed := rr.routers["audit"].(*WeightedTreeRouter)
+
+	writeRules(t, dir, `{"rules": []}`)
+	if err := rr.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !removed.shuttingDown.Load() {
+		t.Error("router of the removed group still routing")
+	}
+	if group := rr.AnalyzerGroup(audit); group != DefaultGroup {
+		t.Errorf("audit-1 in group %q, want %s", group, DefaultGroup)
+	}
+	if !rr.RouteMessage(ByteSliceMessage(dataFrame(1, "tenant=acme login"))) || audit.queue.len() != 1 {
+		t.Error("message not routed to audit-1 in the default group")
+	}
+
+	writeRules(t, dir, `{"rules": [{"group": "missing"}]}`)
+	if err := rr.Reload(); err == nil {
+		t.Error("rules routing to an unknown group loaded")
+	}
+	if len(rr.state.Load().rules.Rules) != 0 {
+		t.Error("rules that failed to load replaced the previous ones")
+	}
+}
+
+// A group removed by a reload hands the messages its ordered router held back
+// to the group the new rules pick, in order
+func TestReloadReroutesBacklogOfRemovedGroup(t *testing.T) {
+	dir := t.TempDir()
+	rr, err := NewRuleRouter(writeRules(t, dir, groupTestRules), func() Router {
+		return NewOrderedRouter(OrderedRouterOptions{Key: &KeyExtractor{Prefix: "tenant=", Delimiter: " "}})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &recordingSink{}
+	rr.SetDeadLetterSink(sink)
+
+	// Without analyzers the messages wait in the audit group's lanes
+	var want []string
+	for i := range 5 {
+		payload := fmt.Sprintf("tenant=acme %d", i)
+		want = append(want, payload)
+		if !rr.RouteMessage(ByteSliceMessage(dataFrame(1, payload))) {
+			t.Fatalf("message %d not held back", i)
+		}
+	}
+	if n := rr.Backlog(); n != 5 {
+		t.Fatalf("backlog %d, want 5", n)
+	}
+
+	writeRules(t, dir, `{"rules": []}`)
+	if err := rr.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := sink.received(); len(got) != 0 {
+		t.Fatalf("dead-lettered %q on reload, want them routed again", got)
+	}
+	if n := rr.Backlog(); n != 5 {
+		t.Fatalf("backlog %d after reload, want the 5 messages in the default group", n)
+	}
+
+	rr.Shutdown()
+	if got := sink.received(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("default group held %q, want %q", got, want)
+	}
+}
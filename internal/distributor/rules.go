@@ -0,0 +1,259 @@
+package distributor
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+
+	"log-distributor/internal/protocol"
+)
+
+// DefaultGroup is the analyzer group messages go to when no rule matches, and
+// that analyzers join when no group claims them
+const DefaultGroup = "default"
+
+// RoutingRules split the analyzers into named groups and pick the group each
+// message is routed to. They are read from JSON:
+//
+//	{
+//	  "groups": [
+//	    {"name": "compliance", "analyzers": ["compliance-*"]}
+//	  ],
+//	  "rules": [
+//	    {"emitters": ["payment-*"], "group": "compliance"},
+//	    {"key": {"prefix": "service=", "delimiter": " "}, "values": ["payment-service"], "group": "compliance"},
+//	    {"priorities": "0-2", "key": {"regex": "tenant=(\\w+)"}, "values": ["acme"], "group": "compliance"},
+//	    {"key": {"header": "content_type"}, "values": ["application/audit+json"], "group": "compliance"}
+//	  ]
+//	}
+//
+// Analyzers join the first group with a matching ID pattern. Every condition
+// of a rule must hold for it to match, and the first matching rule decides the
+// group; messages matching none go to DefaultGroup.
+type RoutingRules struct {
+	Groups []GroupRule   `json:"groups"`
+	Rules  []RoutingRule `json:"rules"`
+}
+
+// GroupRule names a group and the analyzers in it
+type GroupRule struct {
+	Name      string   `json:"name"`
+	Analyzers []string `json:"analyzers"`
+}
+
+// RoutingRule sends the messages matching all of its conditions to Group
+type RoutingRule struct {
+	Priorities string        `json:"priorities,omitempty"` // Priority ranges like "0-2,200"
+	Emitters   []string      `json:"emitters,omitempty"`   // ID patterns of the sending emitter
+	Key        *KeyExtractor `json:"key,omitempty"`        // Where in the payload to find the key
+	Values     []string      `json:"values,omitempty"`     // Patterns the key must match
+	Group      string        `json:"group"`
+
+	priorities *protocol.PrioritySet
+}
+
+// KeyExtractor finds a key in a message payload, or in one of its envelope
+// headers if Header is set, either after Prefix up to Delimiter or as the first
+// submatch of Regex (the whole match without one)
+type KeyExtractor struct {
+	Header    string `json:"header,omitempty"`    // Envelope header holding the key, see protocol.Headers.Field
+	Prefix    string `json:"prefix,omitempty"`    // Text preceding the key, empty for the payload start
+	Delimiter string `json:"delimiter,omitempty"` // Text ending the key, empty for the payload end
+	Regex     string `json:"regex,omitempty"`
+
+	regex *regexp.Regexp
+}
+
+// NewKeyExtractor creates a KeyExtractor, checking the regex
+func NewKeyExtractor(prefix, delimiter, regex string) (*KeyExtractor, error) {
+	k := &KeyExtractor{Prefix: prefix, Delimiter: delimiter, Regex: regex}
+	if err := k.compile(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// LoadRoutingRules reads and checks the rules in path
+func LoadRoutingRules(path string) (*RoutingRules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routing rules: %w", err)
+	}
+	rules := &RoutingRules{}
+	if err := json.Unmarshal(data, rules); err != nil {
+		return nil, fmt.Errorf("failed to parse routing rules %s: %w", path, err)
+	}
+	if err := rules.compile(); err != nil {
+		return nil, fmt.Errorf("invalid routing rules %s: %w", path, err)
+	}
+	return rules, nil
+}
+
+// compile checks the patterns and names and parses priorities and regexes
+func (rr *RoutingRules) compile() error {
+	groups := map[string]bool{DefaultGroup: true}
+	for _, group := range rr.Groups {
+		if group.Name == "" || group.Name == DefaultGroup {
+			return fmt.Errorf("group name %q is reserved", group.Name)
+		}
+		if groups[group.Name] {
+			return fmt.Errorf("group %q is defined twice", group.Name)
+		}
+		groups[group.Name] = true
+		for _, pattern := range group.Analyzers {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("group %q analyzer pattern %q: %w", group.Name, pattern, err)
+			}
+		}
+	}
+
+	for i := range rr.Rules {
+		rule := &rr.Rules[i]
+		if !groups[rule.Group] {
+			return fmt.Errorf("rule %d routes to unknown group %q", i+1, rule.Group)
+		}
+		if rule.Priorities != "" {
+			set, err := protocol.ParsePrioritySet(rule.Priorities)
+			if err != nil {
+				return fmt.Errorf("rule %d: %w", i+1, err)
+			}
+			rule.priorities = &set
+		}
+		for _, patterns := range [][]string{rule.Emitters, rule.Values} {
+			for _, pattern := range patterns {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("rule %d pattern %q: %w", i+1, pattern, err)
+				}
+			}
+		}
+		if (rule.Key == nil) != (len(rule.Values) == 0) {
+			return fmt.Errorf("rule %d needs both a key and values to match it against", i+1)
+		}
+		if err := rule.Key.compile(); err != nil {
+			return fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// compile parses the regex, checking it is not combined with prefix or delimiter
+func (k *KeyExtractor) compile() error {
+	if k == nil || k.Regex == "" {
+		return nil
+	}
+	if k.Prefix != "" || k.Delimiter != "" {
+		return errors.New("key regex cannot be combined with prefix or delimiter")
+	}
+	re, err := regexp.Compile(k.Regex)
+	if err != nil {
+		return fmt.Errorf("key regex: %w", err)
+	}
+	k.regex = re
+	return nil
+}
+
+// keyOf returns the key of a message, false if there is none. Messages without
+// an envelope have no key in a header.
+func (k *KeyExtractor) keyOf(msg LogMessage) ([]byte, bool) {
+	if k.Header != "" {
+		headers := messageHeaders(msg)
+		if headers == nil {
+			return nil, false
+		}
+		value, ok := headers.Field(k.Header)
+		if !ok {
+			return nil, false
+		}
+		return k.extract(value)
+	}
+
+	payload, ok := messagePayload(msg)
+	if !ok {
+		return nil, false
+	}
+	return k.extract(payload)
+}
+
+// extract returns the key in payload, false if there is none
+func (k *KeyExtractor) extract(payload []byte) ([]byte, bool) {
+	if k.regex != nil {
+		match := k.regex.FindSubmatch(payload)
+		switch {
+		case match == nil:
+			return nil, false
+		case len(match) > 1:
+			return match[1], true
+		}
+		return match[0], true
+	}
+
+	start := 0
+	if k.Prefix != "" {
+		i := bytes.Index(payload, []byte(k.Prefix))
+		if i < 0 {
+			return nil, false
+		}
+		start = i + len(k.Prefix)
+	}
+	key := payload[start:]
+	if k.Delimiter != "" {
+		if end := bytes.Index(key, []byte(k.Delimiter)); end >= 0 {
+			key = key[:end]
+		}
+	}
+	return key, true
+}
+
+// groupOf returns the group an analyzer belongs to
+func (rr *RoutingRules) groupOf(analyzerID string) string {
+	for _, group := range rr.Groups {
+		if matchAny(group.Analyzers, analyzerID) {
+			return group.Name
+		}
+	}
+	return DefaultGroup
+}
+
+// match returns the group a message is routed to
+func (rr *RoutingRules) match(msg LogMessage) string {
+	for i := range rr.Rules {
+		if rr.Rules[i].matches(msg) {
+			return rr.Rules[i].Group
+		}
+	}
+	return DefaultGroup
+}
+
+// matches reports whether a message meets every condition of the rule
+func (rule *RoutingRule) matches(msg LogMessage) bool {
+	if rule.priorities != nil && !rule.priorities.Contains(msg.GetPriority()) {
+		return false
+	}
+	if len(rule.Emitters) > 0 {
+		sourced, ok := msg.(interface{ Source() string })
+		if !ok || !matchAny(rule.Emitters, sourced.Source()) {
+			return false
+		}
+	}
+	if rule.Key != nil {
+		key, ok := rule.Key.keyOf(msg)
+		if !ok || !matchAny(rule.Values, string(key)) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchAny reports whether name matches one of the path.Match patterns
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,257 @@
+package distributor
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often the spill queue seals the segment being written and looks for
+// segments to replay
+const spillReplayInterval = time.Second
+
+// SpillQueue keeps messages the analyzers had no room for on disk and routes
+// them again once there is room. Spilled messages are written in the
+// dead-letter segment format; a segment is sealed within spillReplayInterval,
+// replayed through the router and deleted once every message in it was
+// acknowledged. Segments left by a previous run are replayed on start. A
+// segment with a record that cannot be read back is replayed up to it and then
+// renamed to ".corrupt" rather than deleted, so it is neither lost nor replayed
+// again.
+//
+// Replayed messages are not spilled again: they wait for room at the analyzers
+// however long it takes, and only give up after the block timeout if no
+// analyzer accepts them. A spilled message is only synced to disk when its
+// segment is sealed, so it is acknowledged then, not when it is written.
+type SpillQueue struct {
+	dir    string
+	sink   *FileDeadLetterSink
+	router RouterInterface
+
+	mutex     sync.Mutex
+	replaying map[string]*spillSegment // Segments read back and not yet deleted, by path
+	unsealed  []acknowledger           // Spilled messages to acknowledge once sealed
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// spillSegment counts the messages of a segment being replayed that were not
+// acknowledged yet, plus one while it is still being read
+type spillSegment struct {
+	queue     *SpillQueue
+	path      string
+	remaining atomic.Int64
+	corrupt   atomic.Bool // Set aside instead of deleted once released
+}
+
+// spilledMessage is a message read back from the spill queue
+type spilledMessage struct {
+	LogMessage
+	source  string
+	segment *spillSegment
+	acked   atomic.Bool
+}
+
+// OpenSpillQueue opens the spill queue in dir, writing segments of up to
+// segmentSize bytes
+func OpenSpillQueue(dir string, segmentSize int64) (*SpillQueue, error) {
+	sink, err := NewFileDeadLetterSink(dir, segmentSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spill queue: %w", err)
+	}
+	return &SpillQueue{
+		dir:       dir,
+		sink:      sink,
+		replaying: make(map[string]*spillSegment),
+		stop:      make(chan struct{}),
+	}, nil
+}
+
+// Start begins replaying spilled messages through router
+func (sq *SpillQueue) Start(router RouterInterface) {
+	sq.router = router
+	sq.wg.Add(1)
+	go sq.run()
+}
+
+// Write spills a message. It is acknowledged once its segment is sealed, as the
+// spill queue keeps it from then on.
+func (sq *SpillQueue) Write(msg LogMessage, reason DropReason) error {
+	dl := &DeadLetter{
+		Reason:   reason,
+		Priority: msg.GetPriority(),
+		Time:     time.Now(),
+		Frame:    msg.GetData(),
+		Headers:  messageHeaders(msg),
+	}
+	if sourced, ok := msg.(interface{ Source() string }); ok {
+		dl.Source = sourced.Source()
+	}
+	if err := sq.sink.WriteDeadLetter(dl); err != nil {
+		// A segment sealed by the write may not have reached the disk, so the
+		// messages spilled before stay unacknowledged for the WAL to replay
+		sq.mutex.Lock()
+		sq.unsealed = nil
+		sq.mutex.Unlock()
+		return err
+	}
+	spillMessagesWritten.Inc()
+
+	if a, ok := msg.(acknowledger); ok {
+		sq.mutex.Lock()
+		sq.unsealed = append(sq.unsealed, a)
+		sq.mutex.Unlock()
+	}
+	return nil
+}
+
+// seal seals the segment being written and acknowledges the messages spilled
+// into it. If the segment could not be synced they are left unacknowledged.
+func (sq *SpillQueue) seal() error {
+	// Taken before sealing, so messages written meanwhile wait for the next seal
+	sq.mutex.Lock()
+	written := sq.unsealed
+	sq.unsealed = nil
+	sq.mutex.Unlock()
+
+	if err := sq.sink.Close(); err != nil {
+		return err
+	}
+	for _, a := range written {
+		a.Ack()
+	}
+	return nil
+}
+
+// Close stops replaying and seals the segment being written. Messages that
+// were not replayed stay on disk for the next start. The router must be shut
+// down first, so replayed messages waiting for room give up, and the WAL closed
+// after, so it records the messages acknowledged by the seal.
+func (sq *SpillQueue) Close() error {
+	close(sq.stop)
+	sq.wg.Wait()
+	return sq.seal()
+}
+
+// run seals and replays segments every spillReplayInterval until Close
+func (sq *SpillQueue) run() {
+	defer sq.wg.Done()
+
+	ticker := time.NewTicker(spillReplayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sq.stop:
+			return
+		case <-ticker.C:
+		}
+
+		// Seal what was spilled since the last round so it can be replayed
+		if err := sq.seal(); err != nil {
+			log.Printf("Spill queue: %v", err)
+		}
+		files, err := DeadLetterFiles(sq.dir)
+		if err != nil {
+			log.Printf("Spill queue: %v", err)
+			continue
+		}
+		for _, path := range files {
+			sq.mutex.Lock()
+			_, seen := sq.replaying[path]
+			sq.mutex.Unlock()
+			if !seen && !sq.replay(path) {
+				return
+			}
+		}
+	}
+}
+
+// replay routes the messages of a sealed segment again. Returns false if the
+// queue was closed meanwhile.
+func (sq *SpillQueue) replay(path string) bool {
+	seg := &spillSegment{queue: sq, path: path}
+	seg.remaining.Store(1)
+	sq.mutex.Lock()
+	sq.replaying[path] = seg
+	sq.mutex.Unlock()
+
+	stopped := false
+	replayed := 0
+	err := ReadDeadLetters(path, func(dl *DeadLetter) bool {
+		select {
+		case <-sq.stop:
+			stopped = true
+			return false
+		default:
+		}
+
+		parsed, err := ParseMessage(dl.Frame)
+		if err != nil {
+			log.Printf("Spill queue: skipping message in %s: %v", path, err)
+			return true
+		}
+		seg.remaining.Add(1)
+		msg := &spilledMessage{LogMessage: parsed, source: dl.Source, segment: seg}
+		if !sq.router.RouteMessage(msg) && !msg.acked.Load() {
+			// The router dropped and released the message, unless it is
+			// shutting down and left it for the next start
+			stopped = true
+			return false
+		}
+		spillMessagesReplayed.Inc()
+		replayed++
+		return true
+	})
+	if err != nil {
+		log.Printf("Spill queue: replay of %s stopped after %d messages, setting it aside: %v", path, replayed, err)
+		seg.corrupt.Store(true)
+	} else if replayed > 0 {
+		log.Printf("Spill queue: replayed %d messages from %s", replayed, path)
+	}
+	if !stopped {
+		seg.release()
+	}
+	return !stopped
+}
+
+// release counts one message of the segment as acknowledged, deleting the
+// segment once none is left, or renaming a corrupt one
+func (seg *spillSegment) release() {
+	if seg.remaining.Add(-1) != 0 {
+		return
+	}
+	if seg.corrupt.Load() {
+		corrupt := strings.TrimSuffix(seg.path, DeadLetterExt) + deadLetterCorruptExt
+		if err := os.Rename(seg.path, corrupt); err != nil {
+			log.Printf("Spill queue: failed to set aside corrupt segment %s: %v", seg.path, err)
+		}
+	} else if err := os.Remove(seg.path); err != nil {
+		log.Printf("Spill queue: failed to delete replayed segment %s: %v", seg.path, err)
+	}
+	sq := seg.queue
+	sq.mutex.Lock()
+	delete(sq.replaying, seg.path)
+	sq.mutex.Unlock()
+}
+
+// Source returns the ID of the emitter the message came from
+func (m *spilledMessage) Source() string {
+	return m.source
+}
+
+// Envelope returns the envelope the message came in, nil for a data frame
+func (m *spilledMessage) Envelope() *EnvelopeMessage {
+	return envelopeOf(m.LogMessage)
+}
+
+// Ack releases the message from its spill segment
+func (m *spilledMessage) Ack() {
+	if m.acked.CompareAndSwap(false, true) {
+		m.segment.release()
+	}
+}
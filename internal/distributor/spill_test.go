@@ -0,0 +1,110 @@
+package distributor
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// ackingRouter accepts and acknowledges every message, keeping its frame
+type ackingRouter struct {
+	recordingRouter
+}
+
+func (r *ackingRouter) RouteMessage(msg LogMessage) bool {
+	r.recordingRouter.RouteMessage(msg)
+	releaseDropped(msg)
+	return true
+}
+
+// openTestSpillQueue opens a spill queue in dir without starting it
+func openTestSpillQueue(t *testing.T, dir string) *SpillQueue {
+	t.Helper()
+	sq, err := OpenSpillQueue(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sq
+}
+
+// A spilled message stays in the WAL until its spill segment is synced
+func TestSpillAcknowledgesOnceSealed(t *testing.T) {
+	w := openTestWAL(t, t.TempDir(), 1<<20)
+	sq := openTestSpillQueue(t, t.TempDir())
+
+	msgs := appendFrames(t, w, "sealed", "closed")
+	if err := sq.Write(msgs[0], DropChannelsFull); err != nil {
+		t.Fatal(err)
+	}
+	if msgs[0].acked.Load() {
+		t.Fatal("message acknowledged before its segment was sealed")
+	}
+	if err := sq.seal(); err != nil {
+		t.Fatal(err)
+	}
+	if !msgs[0].acked.Load() {
+		t.Error("message not acknowledged once its segment was sealed")
+	}
+
+	if err := sq.Write(msgs[1], DropChannelsFull); err != nil {
+		t.Fatal(err)
+	}
+	if err := sq.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !msgs[1].acked.Load() {
+		t.Error("message not acknowledged by closing the queue")
+	}
+}
+
+// A segment with a corrupt record is replayed up to it and set aside, so it is
+// neither deleted nor replayed again
+func TestSpillSetsAsideCorruptSegment(t *testing.T) {
+	dir := t.TempDir()
+	sq := openTestSpillQueue(t, dir)
+	for _, payload := range []string{"first", "second"} {
+		if err := sq.Write(ByteSliceMessage(dataFrame(1, payload)), DropChannelsFull); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sq.seal(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := DeadLetterFiles(dir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("segments %q (%v), want one", files, err)
+	}
+	file, err := os.OpenFile(files[0], os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{0, 0, 0, 3, 0xde, 0xad, 0xbe, 0xef, 1, 2, 3}) // Checksum does not match
+	file.Close()
+
+	router := &ackingRouter{}
+	sq.router = router
+	if !sq.replay(files[0]) {
+		t.Fatal("replay stopped by a corrupt record")
+	}
+	if got := router.received(); len(got) != 2 {
+		t.Errorf("replayed %d messages, want the 2 before the corrupt record", len(got))
+	}
+	if files, _ := DeadLetterFiles(dir); len(files) != 0 || len(sq.replaying) != 0 {
+		t.Errorf("segments %q still to replay, %d replaying", files, len(sq.replaying))
+	}
+	corrupt, _ := filepath.Glob(filepath.Join(dir, "*"+deadLetterCorruptExt))
+	if !slices.Equal(corrupt, []string{strings.TrimSuffix(files[0], DeadLetterExt) + deadLetterCorruptExt}) {
+		t.Errorf("corrupt segments %q, want the replayed one set aside", corrupt)
+	}
+
+	// New segments are numbered after the one set aside
+	sink, err := NewFileDeadLetterSink(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sink.nextSeq != 2 {
+		t.Errorf("next segment %d, want 2", sink.nextSeq)
+	}
+}
@@ -0,0 +1,59 @@
+package distributor
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"log-distributor/internal/tlsconfig"
+)
+
+// listen opens a TCP listener on addr, wrapped in TLS if tlsServer is not nil
+func listen(addr string, tlsServer *tlsconfig.Server) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsServer != nil {
+		listener = tls.NewListener(listener, tlsServer.Config())
+	}
+	return listener, nil
+}
+
+// describeTLS returns how a listener protects its connections, for logging
+func describeTLS(tlsServer *tlsconfig.Server) string {
+	switch {
+	case tlsServer == nil:
+		return "plain TCP"
+	case tlsServer.MutualTLS():
+		return "mutual TLS"
+	}
+	return "TLS"
+}
+
+// tlsIdentity completes the TLS handshake of a TLS connection and returns the
+// identity in the client's verified certificate, or "" if there is none.
+// Plain connections have no identity.
+func tlsIdentity(conn net.Conn) (string, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+
+	tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer tlsConn.SetDeadline(time.Time{})
+	if err := tlsConn.Handshake(); err != nil {
+		return "", fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	return tlsconfig.PeerIdentity(tlsConn.ConnectionState()), nil
+}
+
+// tcpConn returns the TCP connection underneath conn, or nil
+func tcpConn(conn net.Conn) *net.TCPConn {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcp, _ := conn.(*net.TCPConn)
+	return tcp
+}
@@ -0,0 +1,489 @@
+package distributor
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WALSyncMode controls when the write-ahead log is fsynced
+type WALSyncMode string
+
+const (
+	WALSyncAlways   WALSyncMode = "always"   // fsync after every appended frame
+	WALSyncInterval WALSyncMode = "interval" // fsync periodically
+	WALSyncNever    WALSyncMode = "never"    // leave flushing to the operating system
+)
+
+const (
+	walDataExt = ".wal"
+	walAckExt  = ".ack"
+
+	// Record header: [4 bytes: frame length][4 bytes: CRC32 of LSN and frame][8 bytes: LSN]
+	walHeaderLen = 16
+)
+
+// WALOptions configures a write-ahead log
+type WALOptions struct {
+	Dir          string
+	SegmentSize  int64 // Size after which a new segment is started
+	SyncMode     WALSyncMode
+	SyncInterval time.Duration // Used with WALSyncInterval
+}
+
+// ParseWALSyncMode validates a sync mode name
+func ParseWALSyncMode(mode string) (WALSyncMode, error) {
+	switch m := WALSyncMode(mode); m {
+	case WALSyncAlways, WALSyncInterval, WALSyncNever:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown WAL sync mode %q (want always, interval or never)", mode)
+}
+
+// walSegment is one data file of the log plus the file recording which of its
+// records analyzers have acknowledged
+type walSegment struct {
+	base     uint64 // LSN of the first record
+	dataPath string
+	ackPath  string
+
+	data      *os.File // Open for appending while this is the active segment
+	size      int64
+	ackFile   *os.File
+	ackWriter *bufio.Writer
+
+	count  int  // Records in the segment
+	acked  int  // Records acknowledged
+	sealed bool // No further records will be appended
+
+	// LSNs acknowledged before startup, only kept until the segment is replayed
+	ackedBefore map[uint64]struct{}
+}
+
+// WAL is a segmented write-ahead log of frames accepted from emitters. Frames
+// are appended before they are routed and acknowledged once an analyzer ACKs
+// them; segments whose records are all acknowledged are deleted, and frames
+// still unacknowledged when the distributor stops are replayed on the next start.
+type WAL struct {
+	opts WALOptions
+
+	mutex    sync.Mutex
+	segments []*walSegment // Ordered by base LSN
+	active   *walSegment
+	nextLSN  uint64
+	scratch  []byte
+
+	// Segments found on disk at startup that still need to be replayed
+	replay []*walSegment
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	syncWg    sync.WaitGroup
+}
+
+// acknowledger is implemented by messages that need to know when an analyzer
+// has acknowledged them
+type acknowledger interface {
+	Ack()
+}
+
+// OpenWAL opens (or creates) the write-ahead log in opts.Dir and loads the
+// acknowledgement state of any existing segments for replay
+func OpenWAL(opts WALOptions) (*WAL, error) {
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create WAL directory %s: %w", opts.Dir, err)
+	}
+
+	w := &WAL{
+		opts:    opts,
+		nextLSN: 1,
+		closed:  make(chan struct{}),
+	}
+
+	entries, err := os.ReadDir(opts.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WAL directory %s: %w", opts.Dir, err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, walDataExt) {
+			continue
+		}
+		base, err := strconv.ParseUint(strings.TrimSuffix(name, walDataExt), 10, 64)
+		if err != nil {
+			log.Printf("WAL: ignoring unexpected file %s", name)
+			continue
+		}
+		seg, lastLSN, err := w.loadSegment(base)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		if seg.acked == seg.count {
+			w.deleteSegment(seg)
+		} else {
+			w.segments = append(w.segments, seg)
+		}
+		w.nextLSN = max(w.nextLSN, lastLSN+1)
+	}
+	sort.Slice(w.segments, func(i, j int) bool { return w.segments[i].base < w.segments[j].base })
+	w.replay = append(w.replay, w.segments...)
+
+	if opts.SyncMode == WALSyncInterval {
+		w.syncWg.Add(1)
+		go w.syncPeriodically()
+	}
+
+	pending := 0
+	for _, seg := range w.replay {
+		pending += seg.count - seg.acked
+	}
+	log.Printf("WAL opened in %s: %d segments with %d unacknowledged frames to replay", opts.Dir, len(w.replay), pending)
+	return w, nil
+}
+
+// loadSegment scans an existing segment, counting its records and reading its
+// acknowledgements. Returns the segment and the highest LSN it contains.
+func (w *WAL) loadSegment(base uint64) (*walSegment, uint64, error) {
+	seg := w.newSegment(base)
+	seg.sealed = true
+	seg.ackedBefore = make(map[uint64]struct{})
+
+	lastLSN := base - 1
+	err := readWALSegment(seg.dataPath, func(lsn uint64, frame []byte) bool {
+		seg.count++
+		lastLSN = lsn
+		return true
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if ackData, err := os.ReadFile(seg.ackPath); err == nil {
+		for i := 0; i+8 <= len(ackData); i += 8 {
+			seg.ackedBefore[binary.BigEndian.Uint64(ackData[i:])] = struct{}{}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, 0, fmt.Errorf("failed to read WAL acknowledgements %s: %w", seg.ackPath, err)
+	}
+	seg.acked = len(seg.ackedBefore)
+
+	if err := w.openAckFile(seg); err != nil {
+		return nil, 0, err
+	}
+	return seg, lastLSN, nil
+}
+
+func (w *WAL) newSegment(base uint64) *walSegment {
+	name := fmt.Sprintf("%020d", base)
+	return &walSegment{
+		base:     base,
+		dataPath: filepath.Join(w.opts.Dir, name+walDataExt),
+		ackPath:  filepath.Join(w.opts.Dir, name+walAckExt),
+	}
+}
+
+func (w *WAL) openAckFile(seg *walSegment) error {
+	ackFile, err := os.OpenFile(seg.ackPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open WAL acknowledgements %s: %w", seg.ackPath, err)
+	}
+	seg.ackFile = ackFile
+	seg.ackWriter = bufio.NewWriterSize(ackFile, 4096)
+	return nil
+}
+
+// Append writes a message's frame to the log and attaches the message to it, so
+// acknowledging the message marks the record as delivered
+func (w *WAL) Append(msg *ingressMessage) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	select {
+	case <-w.closed:
+		return errors.New("WAL is closed")
+	default:
+	}
+
+	if w.active == nil || w.active.size >= w.opts.SegmentSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	lsn := w.nextLSN
+	w.scratch = appendWALRecord(w.scratch[:0], lsn, msg.GetData())
+	n, err := w.active.data.Write(w.scratch)
+	w.active.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to append to WAL segment %s: %w", w.active.dataPath, err)
+	}
+	if w.opts.SyncMode == WALSyncAlways {
+		if err := w.active.data.Sync(); err != nil {
+			return fmt.Errorf("failed to sync WAL segment %s: %w", w.active.dataPath, err)
+		}
+	}
+
+	w.nextLSN++
+	w.active.count++
+	msg.wal, msg.lsn = w, lsn
+	return nil
+}
+
+// rotate seals the active segment and starts a new one at the next LSN
+func (w *WAL) rotate() error {
+	if old := w.active; old != nil {
+		if err := old.data.Sync(); err != nil {
+			log.Printf("WAL: failed to sync segment %s: %v", old.dataPath, err)
+		}
+		old.data.Close()
+		old.data = nil
+		old.sealed = true
+		w.active = nil
+		if old.acked == old.count {
+			w.removeSegment(old)
+		}
+	}
+
+	seg := w.newSegment(w.nextLSN)
+	data, err := os.OpenFile(seg.dataPath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create WAL segment %s: %w", seg.dataPath, err)
+	}
+	seg.data = data
+	if err := w.openAckFile(seg); err != nil {
+		data.Close()
+		return err
+	}
+
+	w.segments = append(w.segments, seg)
+	w.active = seg
+	return nil
+}
+
+// ack records that the frame with the given LSN was acknowledged by an analyzer
+func (w *WAL) ack(lsn uint64) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	select {
+	case <-w.closed:
+		// Not recorded, so the frame is delivered again after the restart
+		return
+	default:
+	}
+
+	// Find the last segment starting at or before lsn
+	i := sort.Search(len(w.segments), func(i int) bool { return w.segments[i].base > lsn }) - 1
+	if i < 0 {
+		return
+	}
+	seg := w.segments[i]
+
+	// A lost acknowledgement only causes a duplicate on replay, so these are
+	// buffered and synced lazily even in WALSyncAlways mode
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], lsn)
+	seg.ackWriter.Write(buf[:])
+	seg.acked++
+
+	if seg.sealed && seg.acked >= seg.count {
+		w.removeSegment(seg)
+	}
+}
+
+// removeSegment drops a fully acknowledged segment from the log and deletes it
+func (w *WAL) removeSegment(seg *walSegment) {
+	for i, s := range w.segments {
+		if s == seg {
+			w.segments = append(w.segments[:i], w.segments[i+1:]...)
+			break
+		}
+	}
+	w.deleteSegment(seg)
+}
+
+func (w *WAL) deleteSegment(seg *walSegment) {
+	if seg.ackFile != nil {
+		seg.ackFile.Close()
+	}
+	if err := os.Remove(seg.dataPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("WAL: failed to delete segment %s: %v", seg.dataPath, err)
+	}
+	if err := os.Remove(seg.ackPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("WAL: failed to delete acknowledgements %s: %v", seg.ackPath, err)
+	}
+}
+
+// Replay routes every frame left unacknowledged by the previous run once the
+// router has analyzers. A frame the router gives up on is dead-lettered or
+// dropped like a new one, which releases its record, so it is not tried again.
+func (w *WAL) Replay(router RouterInterface) {
+	w.mutex.Lock()
+	segments := w.replay
+	w.replay = nil
+	w.mutex.Unlock()
+
+	replayed, dropped := 0, 0
+	for _, seg := range segments {
+		err := readWALSegment(seg.dataPath, func(lsn uint64, frame []byte) bool {
+			if _, done := seg.ackedBefore[lsn]; done {
+				return true
+			}
+			parsed, err := ParseMessage(frame)
+			if err != nil {
+				log.Printf("WAL: skipping record %d of segment %s: %v", lsn, seg.dataPath, err)
+				(&ingressMessage{LogMessage: ByteSliceMessage(frame), wal: w, lsn: lsn}).Ack()
+				return true
+			}
+			for backoff := 100 * time.Millisecond; !router.HasAnalyzers(); backoff = min(backoff*2, 5*time.Second) {
+				select {
+				case <-w.closed:
+					return false
+				case <-time.After(backoff):
+				}
+			}
+			if router.RouteMessage(&ingressMessage{LogMessage: parsed, wal: w, lsn: lsn}) {
+				replayed++
+			} else {
+				dropped++
+			}
+			return true
+		})
+		if err != nil {
+			log.Printf("WAL: replay of segment %s failed: %v", seg.dataPath, err)
+		}
+
+		w.mutex.Lock()
+		seg.ackedBefore = nil
+		w.mutex.Unlock()
+	}
+
+	if len(segments) > 0 {
+		log.Printf("WAL replay complete: %d frames rerouted, %d dropped", replayed, dropped)
+	}
+}
+
+// Sync flushes acknowledgements and fsyncs the active segment
+func (w *WAL) Sync() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.syncLocked()
+}
+
+func (w *WAL) syncLocked() {
+	for _, seg := range w.segments {
+		if seg.ackWriter.Buffered() > 0 {
+			if err := seg.ackWriter.Flush(); err != nil {
+				log.Printf("WAL: failed to write acknowledgements %s: %v", seg.ackPath, err)
+			}
+		}
+	}
+	if w.active != nil && w.opts.SyncMode != WALSyncNever {
+		if err := w.active.data.Sync(); err != nil {
+			log.Printf("WAL: failed to sync segment %s: %v", w.active.dataPath, err)
+		}
+	}
+}
+
+// syncPeriodically runs Sync every SyncInterval until the WAL is closed
+func (w *WAL) syncPeriodically() {
+	defer w.syncWg.Done()
+
+	ticker := time.NewTicker(w.opts.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.closed:
+			return
+		case <-ticker.C:
+			w.Sync()
+		}
+	}
+}
+
+// Close syncs and closes every open segment file
+func (w *WAL) Close() {
+	w.closeOnce.Do(func() {
+		close(w.closed)
+		w.syncWg.Wait()
+
+		w.mutex.Lock()
+		defer w.mutex.Unlock()
+		w.syncLocked()
+		for _, seg := range w.segments {
+			if seg.data != nil {
+				seg.data.Close()
+			}
+			if seg.ackFile != nil {
+				seg.ackFile.Close()
+			}
+		}
+	})
+}
+
+// appendWALRecord encodes a record for frame with the given LSN
+func appendWALRecord(buf []byte, lsn uint64, frame []byte) []byte {
+	var header [walHeaderLen]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(frame)))
+	binary.BigEndian.PutUint64(header[8:16], lsn)
+	crc := crc32.NewIEEE()
+	crc.Write(header[8:16])
+	crc.Write(frame)
+	binary.BigEndian.PutUint32(header[4:8], crc.Sum32())
+
+	buf = append(buf, header[:]...)
+	return append(buf, frame...)
+}
+
+// readWALSegment calls fn for each intact record in a segment file until fn
+// returns false. A torn or corrupt record ends the segment, as it can only be
+// the tail of a write interrupted by a crash.
+func readWALSegment(path string, fn func(lsn uint64, frame []byte) bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open WAL segment %s: %w", path, err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var header [walHeaderLen]byte
+	for {
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			if err != io.EOF {
+				log.Printf("WAL: truncated record header at end of %s", path)
+			}
+			return nil
+		}
+
+		frame := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			log.Printf("WAL: truncated record at end of %s", path)
+			return nil
+		}
+
+		crc := crc32.NewIEEE()
+		crc.Write(header[8:16])
+		crc.Write(frame)
+		if crc.Sum32() != binary.BigEndian.Uint32(header[4:8]) {
+			log.Printf("WAL: corrupt record in %s, ignoring the rest of the segment", path)
+			return nil
+		}
+
+		if !fn(binary.BigEndian.Uint64(header[8:16]), frame) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package distributor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openTestWAL opens a WAL in dir, closed when the test ends
+func openTestWAL(t *testing.T, dir string, segmentSize int64) *WAL {
+	t.Helper()
+	w, err := OpenWAL(WALOptions{Dir: dir, SegmentSize: segmentSize, SyncMode: WALSyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(w.Close)
+	return w
+}
+
+// appendFrames appends a data frame for each payload to the WAL
+func appendFrames(t *testing.T, w *WAL, payloads ...string) []*ingressMessage {
+	t.Helper()
+	msgs := make([]*ingressMessage, len(payloads))
+	for i, payload := range payloads {
+		msgs[i] = &ingressMessage{LogMessage: ByteSliceMessage(dataFrame(1, payload))}
+		if err := w.Append(msgs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return msgs
+}
+
+// replayed reopens the WAL in dir and returns the payloads it replays
+func replayed(t *testing.T, dir string) []string {
+	t.Helper()
+	w := openTestWAL(t, dir, 1<<20)
+	router := &recordingRouter{}
+	w.Replay(router)
+	var payloads []string
+	for _, frame := range router.received() {
+		payloads = append(payloads, frame[5:])
+	}
+	return payloads
+}
+
+// walFiles returns the segment and acknowledgement files in dir
+func walFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var names []string
+	for _, pattern := range []string{"*" + walDataExt, "*" + walAckExt} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range matches {
+			names = append(names, filepath.Base(m))
+		}
+	}
+	return names
+}
+
+func TestWALReplaysUnacknowledgedFrames(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestWAL(t, dir, 1<<20)
+	msgs := appendFrames(t, w, "one", "two", "three", "four", "five")
+	msgs[1].Ack()
+	msgs[3].Ack()
+	msgs[3].Ack() // Acknowledging twice records it once
+	w.Close()
+
+	got := replayed(t, dir)
+	want := []string{"one", "three", "five"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("replayed %q, want %q", got, want)
+	}
+}
+
+func TestWALIgnoresTornTail(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestWAL(t, dir, 1<<20)
+	appendFrames(t, w, "kept", "also kept", "torn")
+	w.Close()
+
+	// A crash in the middle of the last write leaves part of its record
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+walDataExt))
+	if len(segments) != 1 {
+		t.Fatalf("segments %q, want one", segments)
+	}
+	info, err := os.Stat(segments[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(segments[0], info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	got := replayed(t, dir)
+	want := []string{"kept", "also kept"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("replayed %q, want %q", got, want)
+	}
+}
+
+func TestWALIgnoresCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestWAL(t, dir, 1<<20)
+	appendFrames(t, w, "kept", "flipped", "after")
+	w.Close()
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+walDataExt))
+	data, err := os.ReadFile(segments[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := walHeaderLen + 5 + len("kept")
+	data[second+walHeaderLen+5] ^= 0xFF // First payload byte of the second record
+	if err := os.WriteFile(segments[0], data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := replayed(t, dir); fmt.Sprint(got) != fmt.Sprint([]string{"kept"}) {
+		t.Errorf("replayed %q, want only the record before the corrupt one", got)
+	}
+}
+
+func TestWALDeletesAcknowledgedSegments(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestWAL(t, dir, 1) // Every record starts a new segment
+	msgs := appendFrames(t, w, "one", "two", "three")
+	if files := walFiles(t, dir); len(files) != 6 {
+		t.Fatalf("files %q, want a segment and acknowledgements per record", files)
+	}
+
+	msgs[0].Ack()
+	msgs[2].Ack() // The active segment is kept until it is rotated out
+	if files := walFiles(t, dir); len(files) != 4 {
+		t.Errorf("files %q after acknowledging the first and last, want the last two segments", files)
+	}
+	msgs[1].Ack()
+	if files := walFiles(t, dir); len(files) != 2 {
+		t.Errorf("files %q after acknowledging all, want only the active segment", files)
+	}
+	w.Close()
+
+	// A fully acknowledged segment found at startup is deleted too
+	if got := replayed(t, dir); len(got) != 0 {
+		t.Errorf("replayed %q, want nothing", got)
+	}
+	if files := walFiles(t, dir); len(files) != 0 {
+		t.Errorf("files %q after reopening, want none", files)
+	}
+}
+
+// Frames the router drops are released, so their segments do not pile up
+// until the next restart
+func TestWALReleasesDroppedFrames(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestWAL(t, dir, 1)
+	router := NewWeightedTreeRouter() // No analyzers, no dead-letter queue
+
+	for _, msg := range appendFrames(t, w, "dropped", "also dropped") {
+		if router.RouteMessage(msg) {
+			t.Fatal("message routed without analyzers")
+		}
+	}
+	appendFrames(t, w, "rotates the second out")
+	if files := walFiles(t, dir); len(files) != 2 {
+		t.Errorf("files %q, want only the active segment", files)
+	}
+}
+
+// A frame the router gives up on during replay is not tried again, as the
+// router released its record when it dropped it
+func TestWALReplayDoesNotRetryDroppedFrames(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestWAL(t, dir, 1<<20)
+	appendFrames(t, w, "one", "two")
+	w.Close()
+
+	var dropNewest OverloadPolicies
+	for p := range dropNewest {
+		dropNewest[p] = OverloadDropNewest
+	}
+	router := NewWeightedTreeRouter()
+	router.SetOverload(OverloadOptions{Policies: dropNewest})
+	full := &AnalyzerConfig{AnalyzerID: "full", Weight: 1}
+	full.queue.configure(0, 1, nil) // No message fits in a byte
+	router.RegisterAnalyzer(full)
+
+	w = openTestWAL(t, dir, 1<<20)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.Replay(router)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("replay still retrying frames the router dropped")
+	}
+	if files := walFiles(t, dir); len(files) != 0 {
+		t.Errorf("files %q, want the replayed segment released", files)
+	}
+}
@@ -1,174 +1,177 @@
 package distributor
 
 import (
-	"container/list"
-	"log"
-	"math"
 	"math/rand"
-	"sync"
 	"sync/atomic"
-	"time"
+
+	"log-distributor/internal/metrics"
+	"log-distributor/internal/protocol"
 )
 
 // AnalyzerConfig represents analyzer configuration for the tree
 type AnalyzerConfig struct {
-	AnalyzerID      string
-	Weight          float32
-	InputChannels   [256]chan LogMessage  // Priority channels (0 = highest priority)
+	AnalyzerID string
+	Weight     float32
+	Priorities *protocol.PrioritySet // Priorities routed to this analyzer, nil for all
+
+	queue  analyzerQueue    // Messages routed to this analyzer, by priority (0 = highest priority)
+	routed *metrics.Counter // Messages routed to this analyzer
+	load   analyzerLoad     // Live load signals, kept up to date by the analyzer's handler
+}
+
+// accepts reports whether messages of a priority may be routed to the analyzer
+func (config *AnalyzerConfig) accepts(priority uint8) bool {
+	return config.Priorities == nil || config.Priorities.Contains(priority)
 }
 
 // WeightedTreeNode represents a node in the weight-balanced tree
 type WeightedTreeNode struct {
 	analyzerID     string
+	config         *AnalyzerConfig
 	weight         float32
 	leftCumWeight  float32
 	rightCumWeight float32
-	inputChannels  [256]chan LogMessage  // Priority channels (0 = highest priority)
+	routed         *metrics.Counter
 	left           *WeightedTreeNode
 	right          *WeightedTreeNode
 }
 
+// routeTable holds a routing tree per priority. Priorities routed to the same
+// analyzers share one tree, so without priority restrictions there is only one.
+type routeTable struct {
+	trees [256]*routeTree // nil where no analyzer accepts the priority
+}
+
+// routeTree is a weight-balanced tree over the analyzers accepting a priority
+type routeTree struct {
+	root        *WeightedTreeNode
+	totalWeight float32
+}
+
 // RouterInterface defines the contract for message routing
 type RouterInterface interface {
-	RouteMessage(msg LogMessage)
+	// RouteMessage queues msg for an analyzer, returning false if it was dropped
+	// without being kept in a dead-letter sink
+	RouteMessage(msg LogMessage) bool
+	// HasAnalyzers reports whether any analyzer is registered
+	HasAnalyzers() bool
 	RegisterAnalyzer(config *AnalyzerConfig)
 	UnregisterAnalyzer(config *AnalyzerConfig)
 	UpdateWeight(config *AnalyzerConfig, weight float32)
 }
 
-type atomicFloat32 struct {
-	value atomic.Uint32
-}
-
-func (af *atomicFloat32) Load() float32 {
-	return math.Float32frombits(af.value.Load())
-}
-
-func (af *atomicFloat32) Store(value float32) {
-	af.value.Store(math.Float32bits(value))
-}
-
 // WeightedTreeRouter implements RouterInterface using a weight-balanced tree
 type WeightedTreeRouter struct {
-	root         atomic.Pointer[WeightedTreeNode]
-	analyzers    *list.List
-	totalWeight  atomicFloat32
-	rebuildMutex sync.Mutex
+	routerBase
+	table atomic.Pointer[routeTable]
 }
 
 // NewWeightedTreeRouter creates a new weighted tree router
 func NewWeightedTreeRouter() *WeightedTreeRouter {
-	return &WeightedTreeRouter{
-		analyzers: list.New(),
-	}
+	wtr := &WeightedTreeRouter{}
+	wtr.init(wtr.rebuildTable)
+	wtr.table.Store(&routeTable{})
+	return wtr
 }
 
 // RouteMessage routes a message using the weight-balanced tree (O(log n))
-func (wtr *WeightedTreeRouter) RouteMessage(msg LogMessage) {
-	const maxAttempts = 20
-	baseBackoff := time.Microsecond * 10 // Start with 10μs
-	
-	for attempt := 1; attempt <= maxAttempts; attempt++ {
-		curNode := wtr.root.Load()
-		if curNode == nil {
-			// No analyzers available, apply backoff before retry
-			backoffTime := time.Duration(attempt) * baseBackoff
-			time.Sleep(backoffTime)
-			continue
-		}
-		sampleWeight := wtr.totalWeight.Load() * rand.Float32()
-		for curNode != nil {
-			sampleWeight -= curNode.weight
-			if sampleWeight < 0 {
-				// Route to this node using priority channel
-				priority := msg.GetPriority()
-				select {
-				case curNode.inputChannels[priority] <- msg:
-					return
-				default:
-					break
-				}
+func (wtr *WeightedTreeRouter) RouteMessage(msg LogMessage) bool {
+	return wtr.route(msg, wtr.tryRoute)
+}
+
+// tryRoute samples a path down the tree by weight and queues msg at the first
+// analyzer on it with room. When they are all full every other analyzer is
+// tried, so the message only overloads the router once no analyzer has room.
+func (wtr *WeightedTreeRouter) tryRoute(msg LogMessage) (bool, *AnalyzerConfig, DropReason) {
+	priority := msg.GetPriority()
+	tree := wtr.table.Load().trees[priority]
+	if tree == nil {
+		return false, nil, wtr.noRouteReason()
+	}
+
+	var target *AnalyzerConfig
+	curNode := tree.root
+	sampleWeight := tree.totalWeight * rand.Float32()
+	for curNode != nil {
+		sampleWeight -= curNode.weight
+		if sampleWeight < 0 {
+			// Route to this node's queue for the priority
+			if curNode.send(msg, priority) {
+				return true, nil, 0
 			}
-			if sampleWeight < curNode.leftCumWeight {
-				curNode = curNode.left
-			} else {
-				sampleWeight -= curNode.leftCumWeight
-				curNode = curNode.right
+			if target == nil {
+				target = curNode.config
 			}
 		}
-		
-		// Apply exponential backoff before retry (except on last attempt)
-		backoffTime := time.Duration(attempt) * baseBackoff
-		time.Sleep(backoffTime)
+		if sampleWeight < curNode.leftCumWeight {
+			curNode = curNode.left
+		} else {
+			sampleWeight -= curNode.leftCumWeight
+			curNode = curNode.right
+		}
 	}
-	// Log dropped message after all retries failed
-	log.Printf("WARNING: Message dropped after %d routing attempts - all channels full or no analyzers available", maxAttempts)
-}
 
-// RegisterAnalyzer adds a new analyzer to the router
-func (wtr *WeightedTreeRouter) RegisterAnalyzer(config *AnalyzerConfig) {
-	wtr.rebuildMutex.Lock()
-	defer wtr.rebuildMutex.Unlock()
-
-	added := false
-	var vtreeCopy *WeightedTreeNode = nil
-	for e := wtr.analyzers.Front(); e != nil; e = e.Next() {
-		curConfig := e.Value.(*AnalyzerConfig)
-		if !added && curConfig.Weight < config.Weight {
-			vtreeCopy = wtr.addToTree(vtreeCopy, config)
-			wtr.analyzers.InsertBefore(config, e)
-			added = true
-		}
-		vtreeCopy = wtr.addToTree(vtreeCopy, curConfig)
+	if tree.root.sendAny(msg, priority) {
+		return true, nil, 0
 	}
+	if target == nil {
+		target = tree.root.config
+	}
+	return false, target, target.queue.fullReason(msg)
+}
 
-	if !added {
-		vtreeCopy = wtr.addToTree(vtreeCopy, config)
-		wtr.analyzers.PushBack(config)
+// send queues msg for the node's analyzer, returning false if it has no room
+func (wt *WeightedTreeNode) send(msg LogMessage, priority uint8) bool {
+	if !wt.config.queue.push(priority, msg) {
+		return false
 	}
+	wt.routed.Inc()
+	priorityRoutedCounter(priority).Inc()
+	return true
+}
 
-	wtr.root.Store(vtreeCopy)
-	wtr.totalWeight.Store(wtr.totalWeight.Load() + config.Weight)
+// sendAny queues msg for the first analyzer in the subtree with room
+func (wt *WeightedTreeNode) sendAny(msg LogMessage, priority uint8) bool {
+	if wt == nil {
+		return false
+	}
+	return wt.weight > 0 && wt.send(msg, priority) || wt.left.sendAny(msg, priority) || wt.right.sendAny(msg, priority)
 }
 
-// UnregisterAnalyzer removes an analyzer from the router
-func (wtr *WeightedTreeRouter) UnregisterAnalyzer(config *AnalyzerConfig) {
-	wtr.rebuildMutex.Lock()
-	defer wtr.rebuildMutex.Unlock()
-
-	var vtreeCopy *WeightedTreeNode = nil
-	removed := false
-	for e := wtr.analyzers.Front(); e != nil; {
-		curConfig := e.Value.(*AnalyzerConfig)
-		next := e.Next()
-		if curConfig.AnalyzerID == config.AnalyzerID {
-			wtr.analyzers.Remove(e)
-			removed = true
-		} else {
-			vtreeCopy = wtr.addToTree(vtreeCopy, curConfig)
-		}
-		e = next
+// rebuildTable builds a tree per priority class and publishes them, with
+// rebuildMutex held
+func (wtr *WeightedTreeRouter) rebuildTable(classes [256]int, members [][]*AnalyzerConfig) {
+	trees := make([]*routeTree, len(members))
+	for i, analyzers := range members {
+		trees[i] = wtr.buildTree(analyzers)
 	}
 
-	if removed {
-		wtr.totalWeight.Store(wtr.totalWeight.Load() - config.Weight)
-		wtr.root.Store(vtreeCopy)
+	table := &routeTable{}
+	for p, class := range classes {
+		if class >= 0 {
+			table.trees[p] = trees[class]
+		}
 	}
+	wtr.table.Store(table)
 }
 
-// UpdateWeight updates the weight of an existing analyzer
-func (wtr *WeightedTreeRouter) UpdateWeight(config *AnalyzerConfig, weight float32) {
-	wtr.UnregisterAnalyzer(config)
-	config.Weight = weight
-	wtr.RegisterAnalyzer(config)
+// buildTree builds the tree of the analyzers of a priority class
+func (wtr *WeightedTreeRouter) buildTree(analyzers []*AnalyzerConfig) *routeTree {
+	tree := &routeTree{}
+	for _, config := range analyzers {
+		tree.root = wtr.addToTree(tree.root, config)
+		tree.totalWeight += config.Weight
+	}
+	return tree
 }
 
 func (wtr *WeightedTreeRouter) addToTree(wt *WeightedTreeNode, config *AnalyzerConfig) *WeightedTreeNode {
 	if wt == nil {
 		return &WeightedTreeNode{
-			analyzerID:    config.AnalyzerID,
-			weight:        config.Weight,
-			inputChannels: config.InputChannels,
+			analyzerID: config.AnalyzerID,
+			config:     config,
+			weight:     config.Weight,
+			routed:     config.routed,
 		}
 	}
 
@@ -181,4 +184,4 @@ func (wtr *WeightedTreeRouter) addToTree(wt *WeightedTreeNode, config *AnalyzerC
 	}
 
 	return wt
-}
\ No newline at end of file
+}
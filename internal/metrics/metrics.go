@@ -0,0 +1,328 @@
+// Package metrics is a small Prometheus-compatible metrics registry. It supports
+// counters, gauges and histograms with labels and renders them in the text
+// exposition format.
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Default is the registry the distributor's metrics are registered with
+var Default = NewRegistry()
+
+// DefaultLatencyBuckets are histogram bounds in seconds suited to ACK latencies
+var DefaultLatencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// family is a named metric with all of its labelled series
+type family interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds metric families and renders them for scraping
+type Registry struct {
+	mutex    sync.Mutex
+	families []family
+	hooks    []func()
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// OnScrape registers fn to run before every scrape, to refresh sampled gauges
+func (r *Registry) OnScrape(fn func()) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.hooks = append(r.hooks, fn)
+}
+
+// WriteText renders every metric in the Prometheus text exposition format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mutex.Lock()
+	hooks := append([]func(){}, r.hooks...)
+	families := append([]family{}, r.families...)
+	r.mutex.Unlock()
+
+	for _, hook := range hooks {
+		hook()
+	}
+
+	bufWriter := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(bufWriter)
+	}
+	return bufWriter.Flush()
+}
+
+// ServeHTTP serves the metrics to a Prometheus scraper
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteText(w)
+}
+
+func (r *Registry) register(f family) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.families = append(r.families, f)
+}
+
+// Counter is a monotonically increasing count
+type Counter struct {
+	value atomic.Uint64
+}
+
+// Inc adds one to the counter
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+// Add adds n to the counter
+func (c *Counter) Add(n uint64) {
+	c.value.Add(n)
+}
+
+// Value returns the current count
+func (c *Counter) Value() uint64 {
+	return c.value.Load()
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	bits atomic.Uint64
+}
+
+// Set replaces the gauge's value
+func (g *Gauge) Set(v float64) {
+	g.bits.Store(math.Float64bits(v))
+}
+
+// Add adds delta (which may be negative) to the gauge
+func (g *Gauge) Add(delta float64) {
+	for {
+		old := g.bits.Load()
+		if g.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+// Value returns the gauge's current value
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+// Histogram counts observations into buckets with fixed upper bounds
+type Histogram struct {
+	bounds  []float64
+	buckets []atomic.Uint64 // Non-cumulative counts, one per bound plus +Inf
+	count   atomic.Uint64
+	sum     Gauge
+}
+
+// Observe records a single value
+func (h *Histogram) Observe(v float64) {
+	h.buckets[sort.SearchFloat64s(h.bounds, v)].Add(1)
+	h.count.Add(1)
+	h.sum.Add(v)
+}
+
+// vec is a metric family whose series are distinguished by label values
+type vec[T any] struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+	create func() *T
+	render func(w *bufio.Writer, name, labels string, m *T)
+
+	mutex  sync.RWMutex
+	series map[string]*series[T]
+}
+
+type series[T any] struct {
+	labels string // Rendered label pairs, e.g. `analyzer="a1"`
+	metric *T
+}
+
+func newVec[T any](r *Registry, name, help, typ string, labels []string, create func() *T, render func(*bufio.Writer, string, string, *T)) *vec[T] {
+	v := &vec[T]{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		create: create,
+		render: render,
+		series: make(map[string]*series[T]),
+	}
+	r.register(v)
+	return v
+}
+
+// With returns the series for the given label values, creating it if needed.
+// Callers on hot paths should keep the result rather than look it up each time.
+func (v *vec[T]) With(values ...string) *T {
+	if len(values) != len(v.labels) {
+		panic("metrics: " + v.name + " expects " + strconv.Itoa(len(v.labels)) + " label values")
+	}
+	key := strings.Join(values, "\xff")
+
+	v.mutex.RLock()
+	s, ok := v.series[key]
+	v.mutex.RUnlock()
+	if ok {
+		return s.metric
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if s, ok := v.series[key]; ok {
+		return s.metric
+	}
+	s = &series[T]{labels: renderLabels(v.labels, values), metric: v.create()}
+	v.series[key] = s
+	return s.metric
+}
+
+// Delete removes the series for the given label values
+func (v *vec[T]) Delete(values ...string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	delete(v.series, strings.Join(values, "\xff"))
+}
+
+// Reset removes every series
+func (v *vec[T]) Reset() {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	clear(v.series)
+}
+
+func (v *vec[T]) write(w *bufio.Writer) {
+	v.mutex.RLock()
+	all := make([]*series[T], 0, len(v.series))
+	for _, s := range v.series {
+		all = append(all, s)
+	}
+	v.mutex.RUnlock()
+	sort.Slice(all, func(i, j int) bool { return all[i].labels < all[j].labels })
+
+	w.WriteString("# HELP " + v.name + " " + v.help + "\n")
+	w.WriteString("# TYPE " + v.name + " " + v.typ + "\n")
+	for _, s := range all {
+		v.render(w, v.name, s.labels, s.metric)
+	}
+}
+
+// CounterVec is a family of counters partitioned by labels
+type CounterVec struct {
+	*vec[Counter]
+}
+
+// NewCounterVec registers a counter family
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{newVec(r, name, help, "counter", labels,
+		func() *Counter { return &Counter{} },
+		func(w *bufio.Writer, name, labels string, c *Counter) {
+			writeSample(w, name, labels, float64(c.Value()))
+		})}
+}
+
+// NewCounter registers a counter without labels
+func (r *Registry) NewCounter(name, help string) *Counter {
+	return r.NewCounterVec(name, help).With()
+}
+
+// GaugeVec is a family of gauges partitioned by labels
+type GaugeVec struct {
+	*vec[Gauge]
+}
+
+// NewGaugeVec registers a gauge family
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{newVec(r, name, help, "gauge", labels,
+		func() *Gauge { return &Gauge{} },
+		func(w *bufio.Writer, name, labels string, g *Gauge) {
+			writeSample(w, name, labels, g.Value())
+		})}
+}
+
+// NewGauge registers a gauge without labels
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	return r.NewGaugeVec(name, help).With()
+}
+
+// HistogramVec is a family of histograms partitioned by labels
+type HistogramVec struct {
+	*vec[Histogram]
+}
+
+// NewHistogramVec registers a histogram family with the given bucket upper bounds
+func (r *Registry) NewHistogramVec(name, help string, bounds []float64, labels ...string) *HistogramVec {
+	bounds = append([]float64{}, bounds...)
+	sort.Float64s(bounds)
+
+	return &HistogramVec{newVec(r, name, help, "histogram", labels,
+		func() *Histogram {
+			return &Histogram{bounds: bounds, buckets: make([]atomic.Uint64, len(bounds)+1)}
+		},
+		func(w *bufio.Writer, name, labels string, h *Histogram) {
+			prefix := labels
+			if prefix != "" {
+				prefix += ","
+			}
+			cumulative := uint64(0)
+			for i, bound := range h.bounds {
+				cumulative += h.buckets[i].Load()
+				writeSample(w, name+"_bucket", prefix+`le="`+formatFloat(bound)+`"`, float64(cumulative))
+			}
+			cumulative += h.buckets[len(h.bounds)].Load()
+			writeSample(w, name+"_bucket", prefix+`le="+Inf"`, float64(cumulative))
+			writeSample(w, name+"_sum", labels, h.sum.Value())
+			writeSample(w, name+"_count", labels, float64(h.count.Load()))
+		})}
+}
+
+// NewHistogram registers a histogram without labels
+func (r *Registry) NewHistogram(name, help string, bounds []float64) *Histogram {
+	return r.NewHistogramVec(name, help, bounds).With()
+}
+
+func writeSample(w *bufio.Writer, name, labels string, value float64) {
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteString("{" + labels + "}")
+	}
+	w.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func renderLabels(names, values []string) string {
+	var sb strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(name + `="` + labelEscaper.Replace(values[i]) + `"`)
+	}
+	return sb.String()
+}
@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	routed := r.NewCounterVec("routed_total", "Messages routed.", "analyzer")
+	routed.With("b").Add(2)
+	routed.With(`a"1`).Inc()
+	r.NewGauge("connected", "Connected analyzers.").Set(1.5)
+	latency := r.NewHistogram("latency_seconds", "ACK latency.", []float64{1, 0.1})
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(5)
+
+	scrapes := 0
+	r.OnScrape(func() { scrapes++ })
+
+	var sb strings.Builder
+	if err := r.WriteText(&sb); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP routed_total Messages routed.
+# TYPE routed_total counter
+routed_total{analyzer="a\"1"} 1
+routed_total{analyzer="b"} 2
+# HELP connected Connected analyzers.
+# TYPE connected gauge
+connected 1.5
+# HELP latency_seconds ACK latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 5.55
+latency_seconds_count 3
+`
+	if got := sb.String(); got != want {
+		t.Errorf("rendered\n%s\nwant\n%s", got, want)
+	}
+	if scrapes != 1 {
+		t.Errorf("scrape hook ran %d times, want 1", scrapes)
+	}
+}
+
+func TestVecDelete(t *testing.T) {
+	r := NewRegistry()
+	weight := r.NewGaugeVec("weight", "Analyzer weight.", "analyzer")
+	weight.With("a1").Set(1)
+	weight.With("a2").Set(2)
+	weight.Delete("a1")
+
+	var sb strings.Builder
+	r.WriteText(&sb)
+	if got := sb.String(); strings.Contains(got, "a1") || !strings.Contains(got, `weight{analyzer="a2"} 2`) {
+		t.Errorf("rendered\n%s\nwant only a2", got)
+	}
+}
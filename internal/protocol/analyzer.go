@@ -0,0 +1,40 @@
+package protocol
+
+import "encoding/binary"
+
+// Control words an analyzer that negotiated AnalyzerFeatureDrain may send in
+// place of a weight update. Like weights they have the MSB clear, but they are
+// NaN bit patterns, which are never valid weights.
+const (
+	// Stop routing to this analyzer, deliver what is queued for it and say goodbye
+	AnalyzerDrainRequest uint32 = 0x7FFF0001
+)
+
+// Control frames sent from the distributor to an analyzer. They share the data
+// frame layout, but the length word has its MSB set, which a data frame length
+// never does:
+//
+//	[4 bytes: ControlFrameFlag | frame length][1 byte: type][body]
+//
+// Control frames are only sent to analyzers that negotiated a feature using them.
+const (
+	ControlFrameFlag uint32 = 1 << 31
+
+	// Everything sent to the analyzer was acknowledged and the connection is closing
+	AnalyzerFrameGoodbye uint8 = 1
+	// Metadata about the data frame following it, see Metadata
+	AnalyzerFrameMetadata uint8 = 2
+	// Several messages in one frame, see FrameBatch
+	AnalyzerFrameBatch = FrameBatch
+	// Several messages in one compressed frame, see FrameCompressedBatch
+	AnalyzerFrameCompressedBatch = FrameCompressedBatch
+	// A message with headers, see FrameEnvelope
+	AnalyzerFrameEnvelope = FrameEnvelope
+)
+
+// AppendControlFrame appends a distributor-to-analyzer control frame to buf
+func AppendControlFrame(buf []byte, typ uint8, body []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, ControlFrameFlag|uint32(4+1+len(body)))
+	buf = append(buf, typ)
+	return append(buf, body...)
+}
@@ -0,0 +1,91 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Batch frames carry several messages in one frame, on emitter connections
+// with EmitterFeatureBatch and analyzer connections with AnalyzerFeatureBatch.
+// They use the control frame layout:
+//
+//	[4 bytes: ControlFrameFlag | frame length][1 byte: FrameBatch][2 bytes: message count][frames]
+//
+// The frames are the message count data frames, each with its own priority.
+// Towards analyzers a data frame may be preceded by the metadata frame
+// describing it, as outside a batch. Batches do not nest. Sequence numbers and
+// acknowledgements count the messages in a batch like separate frames.
+const (
+	FrameBatch uint8 = 3
+
+	BatchHeaderLen   = 4 + 1 + 2
+	MaxBatchMessages = 1<<16 - 1
+)
+
+// ErrMalformedBatch reports a batch frame whose contents do not match its header
+var ErrMalformedBatch = errors.New("malformed batch")
+
+// AppendBatchHeader appends the header of a batch frame holding count messages
+// in bodyLen bytes of frames to buf
+func AppendBatchHeader(buf []byte, count, bodyLen int) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, ControlFrameFlag|uint32(BatchHeaderLen+bodyLen))
+	buf = append(buf, FrameBatch)
+	return binary.BigEndian.AppendUint16(buf, uint16(count))
+}
+
+// BatchHeader describes a batch frame, compressed or not
+type BatchHeader struct {
+	Count      int // Messages in the batch
+	BodyLen    int // Bytes of frames, once decompressed
+	Compressed int // Bytes of compressed frames following the header, 0 if not compressed
+}
+
+// ReadBatchHeader reads the header of a batch frame of at most maxLen bytes
+// from r, starting at its type: its length word was already read. Errors other
+// than those of r wrap ErrMalformedBatch, ErrFrameTooShort or ErrFrameTooLarge.
+// The frames that follow decompress to at most maxLen bytes as well.
+func ReadBatchHeader(r io.Reader, length uint32, maxLen int) (*BatchHeader, error) {
+	var header [CompressedBatchHeaderLen - 4]byte
+	if _, err := io.ReadFull(r, header[:BatchHeaderLen-4]); err != nil {
+		return nil, err
+	}
+	headerLen := BatchHeaderLen
+	switch header[0] {
+	case FrameBatch:
+	case FrameCompressedBatch:
+		headerLen = CompressedBatchHeaderLen
+	default:
+		return nil, fmt.Errorf("%w: frame type %d", ErrMalformedBatch, header[0])
+	}
+
+	length &^= ControlFrameFlag
+	if length < uint32(headerLen) {
+		return nil, fmt.Errorf("%w: length %d (min %d)", ErrFrameTooShort, length, headerLen)
+	}
+	if int64(length) > int64(maxLen) {
+		return nil, fmt.Errorf("%w: length %d (max %d)", ErrFrameTooLarge, length, maxLen)
+	}
+	h := &BatchHeader{
+		Count:   int(binary.BigEndian.Uint16(header[1:])),
+		BodyLen: int(length) - headerLen,
+	}
+	if headerLen == BatchHeaderLen {
+		return h, nil
+	}
+
+	if _, err := io.ReadFull(r, header[BatchHeaderLen-4:]); err != nil {
+		return nil, err
+	}
+	h.Compressed = h.BodyLen
+	bodyLen := binary.BigEndian.Uint32(header[BatchHeaderLen-4:])
+	if int64(bodyLen) > int64(maxLen) {
+		return nil, fmt.Errorf("%w: decompresses to %d bytes (max %d)", ErrFrameTooLarge, bodyLen, maxLen)
+	}
+	if h.Compressed == 0 {
+		return nil, fmt.Errorf("%w: no compressed frames", ErrMalformedBatch)
+	}
+	h.BodyLen = int(bodyLen)
+	return h, nil
+}
@@ -0,0 +1,56 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// Limit the fuzzed batch headers are read with
+const fuzzMaxFrameLen = 1 << 16
+
+// ReadBatchHeader reports frames it cannot trust with one of its errors, and
+// the sizes of those it accepts stay within the limit
+func FuzzReadBatchHeader(f *testing.F) {
+	f.Add(AppendBatchHeader(nil, 2, 20))
+	f.Add(AppendBatchHeader(nil, 0, 0))
+	compressed, _ := NewCompressor(1)
+	frame, _ := compressed.AppendBatch(nil, 1, bytes.Repeat([]byte{0, 0, 0, 64, 1}, 100))
+	f.Add(frame[:CompressedBatchHeaderLen])
+	f.Add([]byte{0x80, 0, 0, 11, FrameCompressedBatch, 0, 1, 0xFF, 0xFF, 0xFF, 0xFF})
+	f.Add([]byte{0x80, 0, 0, 5, FrameEnvelope})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) < 4 {
+			return
+		}
+		length := binary.BigEndian.Uint32(data)
+		r := bytes.NewReader(data[4:])
+		h, err := ReadBatchHeader(r, length, fuzzMaxFrameLen)
+		if err != nil {
+			if !errors.Is(err, ErrMalformedBatch) && !errors.Is(err, ErrFrameTooShort) &&
+				!errors.Is(err, ErrFrameTooLarge) && err != io.EOF && err != io.ErrUnexpectedEOF {
+				t.Fatalf("unexpected error %v", err)
+			}
+			return
+		}
+		if h.Count < 0 || h.Count > MaxBatchMessages {
+			t.Errorf("count %d", h.Count)
+		}
+		if h.BodyLen < 0 || h.BodyLen > fuzzMaxFrameLen {
+			t.Errorf("body of %d bytes, max %d", h.BodyLen, fuzzMaxFrameLen)
+		}
+		if h.Compressed < 0 || h.Compressed > fuzzMaxFrameLen {
+			t.Errorf("%d compressed bytes, max %d", h.Compressed, fuzzMaxFrameLen)
+		}
+		headerLen := BatchHeaderLen
+		if h.Compressed > 0 {
+			headerLen = CompressedBatchHeaderLen
+		}
+		if read := len(data) - r.Len(); read != headerLen {
+			t.Errorf("read %d bytes of a %d byte header", read, headerLen)
+		}
+	})
+}
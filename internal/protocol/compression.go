@@ -0,0 +1,94 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Compressed batch frames carry the frames of a batch compressed with DEFLATE
+// (RFC 1951), on emitter connections with EmitterFeatureCompression and
+// analyzer connections with AnalyzerFeatureCompression:
+//
+//	[4 bytes: ControlFrameFlag | frame length][1 byte: FrameCompressedBatch][2 bytes: message count]
+//	[4 bytes: length of the frames][compressed frames]
+//
+// Only batches are compressed: single messages are too small to gain much.
+const (
+	FrameCompressedBatch uint8 = 4
+
+	CompressedBatchHeaderLen = BatchHeaderLen + 4
+)
+
+// Compressor compresses batch frames, reusing its state between them
+type Compressor struct {
+	w   *flate.Writer
+	out bytes.Buffer
+}
+
+// NewCompressor creates a compressor at a compress/flate level
+func NewCompressor(level int) (*Compressor, error) {
+	c := &Compressor{}
+	w, err := flate.NewWriter(&c.out, level)
+	if err != nil {
+		return nil, err
+	}
+	c.w = w
+	return c, nil
+}
+
+// AppendBatch appends a batch frame holding count messages, whose frames are
+// body, to buf. The frame is compressed unless that would not make it smaller.
+func (c *Compressor) AppendBatch(buf []byte, count int, body []byte) (frame []byte, compressed bool) {
+	c.out.Reset()
+	c.w.Reset(&c.out)
+	_, err := c.w.Write(body)
+	if err == nil {
+		err = c.w.Close()
+	}
+	if err != nil || CompressedBatchHeaderLen+c.out.Len() >= BatchHeaderLen+len(body) {
+		buf = AppendBatchHeader(buf, count, len(body))
+		return append(buf, body...), false
+	}
+
+	buf = binary.BigEndian.AppendUint32(buf, ControlFrameFlag|uint32(CompressedBatchHeaderLen+c.out.Len()))
+	buf = append(buf, FrameCompressedBatch)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(count))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(body)))
+	return append(buf, c.out.Bytes()...), true
+}
+
+// Decompressor decompresses batch frames, reusing its state between them
+type Decompressor struct {
+	src bytes.Reader
+	r   io.ReadCloser
+	out []byte
+}
+
+// Decompress returns the frames of a compressed batch, which must decompress to
+// exactly bodyLen bytes. The result is valid until the next call. Errors wrap
+// ErrMalformedBatch.
+func (d *Decompressor) Decompress(compressed []byte, bodyLen int) ([]byte, error) {
+	d.src.Reset(compressed)
+	if d.r == nil {
+		d.r = flate.NewReader(&d.src)
+	} else if err := d.r.(flate.Resetter).Reset(&d.src, nil); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedBatch, err)
+	}
+
+	if cap(d.out) < bodyLen {
+		d.out = make([]byte, bodyLen)
+	}
+	out := d.out[:bodyLen]
+	if _, err := io.ReadFull(d.r, out); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedBatch, err)
+	}
+	// Anything beyond bodyLen is never inflated, so a frame cannot make it balloon
+	var extra [1]byte
+	if n, _ := d.r.Read(extra[:]); n > 0 {
+		return nil, fmt.Errorf("%w: frames longer than %d bytes", ErrMalformedBatch, bodyLen)
+	}
+	return out, nil
+}
@@ -0,0 +1,47 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// Decompress never inflates more than it was asked for, and what it accepts
+// compresses back to the same frames
+func FuzzDecompress(f *testing.F) {
+	c, _ := NewCompressor(1)
+	body := bytes.Repeat([]byte{0, 0, 0, 9, 3, 'f', 'u', 'z', 'z'}, 50)
+	frame, _ := c.AppendBatch(nil, 50, body)
+	f.Add(frame[CompressedBatchHeaderLen:], uint16(len(body)))
+	f.Add(frame[CompressedBatchHeaderLen:], uint16(len(body)-1))
+	f.Add(frame[CompressedBatchHeaderLen:len(frame)-3], uint16(len(body)))
+	f.Add([]byte{}, uint16(0))
+	f.Add([]byte{0xFF, 0xFF, 0xFF}, uint16(100))
+
+	var d Decompressor
+	f.Fuzz(func(t *testing.T, compressed []byte, bodyLen uint16) {
+		out, err := d.Decompress(compressed, int(bodyLen))
+		if cap(d.out) > 1<<16 {
+			t.Fatalf("buffer grew to %d bytes for bodies of at most %d", cap(d.out), 1<<16-1)
+		}
+		if err != nil {
+			if !errors.Is(err, ErrMalformedBatch) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			return
+		}
+		if len(out) != int(bodyLen) {
+			t.Fatalf("decompressed %d bytes, want %d", len(out), bodyLen)
+		}
+
+		body := bytes.Clone(out)
+		frame, isCompressed := c.AppendBatch(nil, 1, body)
+		if !isCompressed {
+			return
+		}
+		again, err := d.Decompress(frame[CompressedBatchHeaderLen:], len(body))
+		if err != nil || !bytes.Equal(again, body) {
+			t.Fatalf("round trip: %v", err)
+		}
+	})
+}
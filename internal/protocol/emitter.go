@@ -0,0 +1,63 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Emitter feature flags
+const (
+	// Distributor reports per-frame outcomes back to the emitter
+	EmitterFeatureAcks uint32 = 1 << 0
+	// Emitter may send batch frames, see FrameBatch
+	EmitterFeatureBatch uint32 = 1 << 1
+	// Emitter may send compressed batch frames, see FrameCompressedBatch
+	EmitterFeatureCompression uint32 = 1 << 2
+	// Emitter may send envelope frames, see FrameEnvelope
+	EmitterFeatureEnvelope uint32 = 1 << 3
+)
+
+// Frames sent from the distributor back to an emitter that negotiated
+// EmitterFeatureAcks. Each frame is [1 byte: type][4 bytes: sequence number].
+//
+// Sequence numbers count the messages received on the connection, each
+// message of a batch frame on its own, starting at 1 and wrapping at 31 bits
+// like analyzer ACKs. Every frame type is cumulative: every message before the
+// reported sequence number has been settled.
+const (
+	EmitterFrameAck    uint8 = 1 // Messages up to and including seq were accepted
+	EmitterFrameNack   uint8 = 2 // Message seq was dropped by the distributor
+	EmitterFramePause  uint8 = 3 // Like Ack, then the distributor shuts down: send the rest after reconnecting
+	EmitterFrameReject uint8 = 4 // Like Ack for the messages before seq; the frame carrying seq was malformed and the connection closes
+
+	EmitterFrameLen = 5
+)
+
+// AppendEmitterFrame appends a distributor-to-emitter frame to buf
+func AppendEmitterFrame(buf []byte, typ uint8, seq uint32) []byte {
+	buf = append(buf, typ)
+	return binary.BigEndian.AppendUint32(buf, seq)
+}
+
+// Data frames from emitters are [4 bytes: length][1 byte: priority][payload],
+// the length counting the whole frame
+const MinDataFrameLen = 5
+
+// Errors reported by CheckDataFrameLen
+var (
+	ErrFrameTooShort = errors.New("frame too short")
+	ErrFrameTooLarge = errors.New("frame too large")
+)
+
+// CheckDataFrameLen validates the length word of a data frame, which may be at
+// most maxLen bytes long
+func CheckDataFrameLen(length uint32, maxLen int) error {
+	if length < MinDataFrameLen {
+		return fmt.Errorf("%w: length %d (min %d)", ErrFrameTooShort, length, MinDataFrameLen)
+	}
+	if int64(length) > int64(maxLen) {
+		return fmt.Errorf("%w: length %d (max %d)", ErrFrameTooLarge, length, maxLen)
+	}
+	return nil
+}
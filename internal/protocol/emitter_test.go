@@ -0,0 +1,28 @@
+package protocol
+
+import (
+	"errors"
+	"testing"
+)
+
+// The length word of a data frame is accepted exactly when the frame fits
+// between the smallest frame and the limit
+func FuzzCheckDataFrameLen(f *testing.F) {
+	f.Add(uint32(0), 1024)
+	f.Add(uint32(MinDataFrameLen), 1024)
+	f.Add(uint32(1024), 1024)
+	f.Add(uint32(1025), 1024)
+	f.Add(ControlFrameFlag|10, 1<<20)
+	f.Add(uint32(10), -1)
+
+	f.Fuzz(func(t *testing.T, length uint32, maxLen int) {
+		err := CheckDataFrameLen(length, maxLen)
+		valid := length >= MinDataFrameLen && int64(length) <= int64(maxLen)
+		if valid != (err == nil) {
+			t.Fatalf("length %d, max %d: error %v", length, maxLen, err)
+		}
+		if err != nil && !errors.Is(err, ErrFrameTooShort) && !errors.Is(err, ErrFrameTooLarge) {
+			t.Fatalf("length %d, max %d: unexpected error %v", length, maxLen, err)
+		}
+	})
+}
@@ -0,0 +1,192 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Envelope frames carry a data frame together with typed headers describing
+// it, on emitter connections with EmitterFeatureEnvelope and analyzer
+// connections with AnalyzerFeatureEnvelope. They use the control frame layout:
+//
+//	[4 bytes: ControlFrameFlag | frame length][1 byte: FrameEnvelope][2 bytes: headers length][headers][data frame]
+//
+// The headers are extension records, see Hello, so header types can be added
+// without a new feature flag. The data frame at the end is an ordinary one,
+// which is sent on its own to analyzers that did not negotiate envelopes.
+// Inside a batch an envelope frame may take the place of a data frame.
+const (
+	FrameEnvelope uint8 = 5
+
+	EnvelopeHeaderLen   = 4 + 1 + 2
+	MinEnvelopeFrameLen = EnvelopeHeaderLen + MinDataFrameLen
+)
+
+// Header record types
+const (
+	HeaderSource      uint8 = 1 // Application or host that produced the message
+	HeaderTimestamp   uint8 = 2 // When the message was produced (8 bytes: unix nanoseconds)
+	HeaderTraceID     uint8 = 3 // Trace the message belongs to
+	HeaderContentType uint8 = 4 // Media type of the payload
+	HeaderKey         uint8 = 5 // Key the message is partitioned or ordered by
+	HeaderAttribute   uint8 = 6 // [1 byte: name length][name][value], once per attribute
+)
+
+// Names Headers.Field knows the typed headers by
+const (
+	FieldSource      = "source"
+	FieldTraceID     = "trace_id"
+	FieldContentType = "content_type"
+	FieldKey         = "key"
+)
+
+// ErrMalformedEnvelope reports an envelope frame that cannot be decoded
+var ErrMalformedEnvelope = errors.New("malformed envelope")
+
+// Headers describe the message in an envelope frame. Every header is optional.
+type Headers struct {
+	Source      string
+	Timestamp   time.Time // Zero if not set
+	TraceID     []byte
+	ContentType string
+	Key         []byte
+	Attributes  []Attribute
+}
+
+// Attribute is a free-form header
+type Attribute struct {
+	Name  string
+	Value string
+}
+
+// Attribute returns the value of the first attribute called name
+func (h *Headers) Attribute(name string) (string, bool) {
+	for _, attr := range h.Attributes {
+		if attr.Name == name {
+			return attr.Value, true
+		}
+	}
+	return "", false
+}
+
+// Field returns a header by name: one of the Field constants, with the trace
+// ID in hex, or else the attribute of that name. Returns false if the header is
+// not set.
+func (h *Headers) Field(name string) ([]byte, bool) {
+	switch name {
+	case FieldSource:
+		return []byte(h.Source), h.Source != ""
+	case FieldTraceID:
+		return []byte(hex.EncodeToString(h.TraceID)), len(h.TraceID) > 0
+	case FieldContentType:
+		return []byte(h.ContentType), h.ContentType != ""
+	case FieldKey:
+		return h.Key, len(h.Key) > 0
+	}
+	value, ok := h.Attribute(name)
+	return []byte(value), ok
+}
+
+// AppendEnvelope appends an envelope frame holding dataFrame, described by h,
+// to buf. Fails if the headers do not fit in 64 KiB or an attribute name in 255
+// bytes.
+func AppendEnvelope(buf []byte, h *Headers, dataFrame []byte) ([]byte, error) {
+	start := len(buf)
+	buf = append(buf, make([]byte, EnvelopeHeaderLen)...)
+	if h.Source != "" {
+		buf = appendExtension(buf, HeaderSource, []byte(h.Source))
+	}
+	if !h.Timestamp.IsZero() {
+		buf = appendExtension(buf, HeaderTimestamp, binary.BigEndian.AppendUint64(nil, uint64(h.Timestamp.UnixNano())))
+	}
+	if len(h.TraceID) > 0 {
+		buf = appendExtension(buf, HeaderTraceID, h.TraceID)
+	}
+	if h.ContentType != "" {
+		buf = appendExtension(buf, HeaderContentType, []byte(h.ContentType))
+	}
+	if len(h.Key) > 0 {
+		buf = appendExtension(buf, HeaderKey, h.Key)
+	}
+	for _, attr := range h.Attributes {
+		if len(attr.Name) > 255 {
+			return buf[:start], fmt.Errorf("attribute name of %d bytes (max 255)", len(attr.Name))
+		}
+		value := append([]byte{uint8(len(attr.Name))}, attr.Name...)
+		buf = appendExtension(buf, HeaderAttribute, append(value, attr.Value...))
+	}
+	headersLen := len(buf) - start - EnvelopeHeaderLen
+	if headersLen > 1<<16-1 {
+		return buf[:start], fmt.Errorf("headers of %d bytes (max %d)", headersLen, 1<<16-1)
+	}
+
+	buf = append(buf, dataFrame...)
+	binary.BigEndian.PutUint32(buf[start:], ControlFrameFlag|uint32(len(buf)-start))
+	buf[start+4] = FrameEnvelope
+	binary.BigEndian.PutUint16(buf[start+5:], uint16(headersLen))
+	return buf, nil
+}
+
+// CheckEnvelopeFrameLen validates the length word of an envelope frame, which
+// may be at most maxLen bytes long
+func CheckEnvelopeFrameLen(length uint32, maxLen int) error {
+	length &^= ControlFrameFlag
+	if length < MinEnvelopeFrameLen {
+		return fmt.Errorf("%w: length %d (min %d)", ErrFrameTooShort, length, MinEnvelopeFrameLen)
+	}
+	if int64(length) > int64(maxLen) {
+		return fmt.Errorf("%w: length %d (max %d)", ErrFrameTooLarge, length, maxLen)
+	}
+	return nil
+}
+
+// ParseEnvelope decodes a complete envelope frame, returning its headers and
+// the data frame it holds, which shares frame's memory. Errors wrap
+// ErrMalformedEnvelope.
+func ParseEnvelope(frame []byte) (*Headers, []byte, error) {
+	if len(frame) < MinEnvelopeFrameLen || frame[4] != FrameEnvelope {
+		return nil, nil, fmt.Errorf("%w: not an envelope frame", ErrMalformedEnvelope)
+	}
+	headersLen := int(binary.BigEndian.Uint16(frame[5:]))
+	if len(frame)-EnvelopeHeaderLen-headersLen < MinDataFrameLen {
+		return nil, nil, fmt.Errorf("%w: %d bytes of headers leave no room for the data frame", ErrMalformedEnvelope, headersLen)
+	}
+	dataFrame := frame[EnvelopeHeaderLen+headersLen:]
+	if length := binary.BigEndian.Uint32(dataFrame); int64(length) != int64(len(dataFrame)) {
+		return nil, nil, fmt.Errorf("%w: data frame length %d, %d bytes left", ErrMalformedEnvelope, length, len(dataFrame))
+	}
+
+	h := &Headers{}
+	d := &decoder{buf: frame[EnvelopeHeaderLen : EnvelopeHeaderLen+headersLen]}
+	err := d.extensions(func(typ uint8, value []byte) error {
+		switch typ {
+		case HeaderSource:
+			h.Source = string(value)
+		case HeaderTimestamp:
+			if len(value) != 8 {
+				return fmt.Errorf("timestamp header has %d bytes, want 8", len(value))
+			}
+			h.Timestamp = time.Unix(0, int64(binary.BigEndian.Uint64(value)))
+		case HeaderTraceID:
+			h.TraceID = value
+		case HeaderContentType:
+			h.ContentType = string(value)
+		case HeaderKey:
+			h.Key = value
+		case HeaderAttribute:
+			if len(value) == 0 || len(value) < 1+int(value[0]) {
+				return errors.New("truncated attribute header")
+			}
+			n := int(value[0])
+			h.Attributes = append(h.Attributes, Attribute{Name: string(value[1 : 1+n]), Value: string(value[1+n:])})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrMalformedEnvelope, err)
+	}
+	return h, dataFrame, nil
+}
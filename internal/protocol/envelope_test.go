@@ -0,0 +1,57 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+// ParseEnvelope rejects frames it cannot decode with ErrMalformedEnvelope, and
+// the headers it returns encode to a frame that parses back the same
+func FuzzParseEnvelope(f *testing.F) {
+	data := []byte{0, 0, 0, 9, 2, 'f', 'u', 'z', 'z'}
+	full, _ := AppendEnvelope(nil, &Headers{
+		Source:      "app",
+		Timestamp:   time.Unix(0, 1e18),
+		TraceID:     []byte{1, 2, 3, 4},
+		ContentType: "text/plain",
+		Key:         []byte("k"),
+		Attributes:  []Attribute{{Name: "region", Value: "eu"}, {Name: "", Value: "empty name"}},
+	}, data)
+	f.Add(full)
+	empty, _ := AppendEnvelope(nil, &Headers{}, data)
+	f.Add(empty)
+	f.Add(full[:len(full)-1])
+	f.Add([]byte{0x80, 0, 0, 12, FrameEnvelope, 0xFF, 0xFF, 0, 0, 0, 5, 1})
+
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		h, dataFrame, err := ParseEnvelope(frame)
+		if err != nil {
+			if !errors.Is(err, ErrMalformedEnvelope) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			return
+		}
+		if len(dataFrame) < MinDataFrameLen || int(binary.BigEndian.Uint32(dataFrame)) != len(dataFrame) {
+			t.Fatalf("data frame %x does not hold its own length", dataFrame)
+		}
+		if !bytes.HasSuffix(frame, dataFrame) {
+			t.Fatal("data frame is not the end of the envelope")
+		}
+
+		encoded, err := AppendEnvelope(nil, h, dataFrame)
+		if err != nil {
+			t.Fatalf("parsed headers do not encode: %v", err)
+		}
+		h2, dataFrame2, err := ParseEnvelope(encoded)
+		if err != nil {
+			t.Fatalf("encoded headers do not parse: %v", err)
+		}
+		again, _ := AppendEnvelope(nil, h2, dataFrame2)
+		if !bytes.Equal(again, encoded) {
+			t.Fatalf("headers changed in a round trip:\n%x\n%x", encoded, again)
+		}
+	})
+}
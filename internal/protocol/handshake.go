@@ -0,0 +1,339 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Version is the highest handshake protocol version this build speaks
+const Version uint8 = 1
+
+// Magic values opening a hello frame. The first byte has its MSB set so a hello
+// can never be mistaken for a legacy analyzer weight (MSB 0) or a legacy emitter
+// frame length (which is always far below 2 GB).
+var (
+	AnalyzerHelloMagic = [4]byte{0xD1, 'L', 'D', 'A'}
+	EmitterHelloMagic  = [4]byte{0xD1, 'L', 'D', 'E'}
+)
+
+// Analyzer feature flags
+const (
+	// Analyzer keeps its session (queues and sequence numbers) across reconnects
+	AnalyzerFeatureResume uint32 = 1 << 0
+	// Analyzer may ask to drain and leave, and understands the goodbye frame
+	AnalyzerFeatureDrain uint32 = 1 << 1
+	// Analyzer understands metadata frames preceding the data frames they describe
+	AnalyzerFeatureMetadata uint32 = 1 << 2
+	// Analyzer understands batch frames
+	AnalyzerFeatureBatch uint32 = 1 << 3
+	// Analyzer understands compressed batch frames
+	AnalyzerFeatureCompression uint32 = 1 << 4
+	// Analyzer understands envelope frames, see FrameEnvelope
+	AnalyzerFeatureEnvelope uint32 = 1 << 5
+)
+
+// Extension types carried after the fixed hello and reply fields
+const (
+	ExtResumeToken uint8 = 1 // Session resume token (hello: presented, reply: issued)
+	ExtLastSeq     uint8 = 2 // Hello: last sequence number the client received (4 bytes)
+	ExtResumed     uint8 = 3 // Reply: 1 if an existing session was re-attached (1 byte)
+	ExtAuthToken   uint8 = 4 // Hello: credentials for the distributor's authenticator
+	ExtPriorities  uint8 = 5 // Hello: priorities subscribed to, reply: priorities granted (PrioritySetLen bytes)
+)
+
+// Reply status codes
+const (
+	StatusAccepted uint8 = 0
+	StatusRejected uint8 = 1
+)
+
+const (
+	// Maximum size of a hello or reply body (bounded by the 2-byte length field)
+	maxBodyLen = math.MaxUint16
+	// Maximum length of a client-chosen ID (bounded by the 1-byte length field)
+	MaxIDLen = math.MaxUint8
+)
+
+var ErrBadMagic = errors.New("bad handshake magic")
+
+// Hello is the first frame a client sends after connecting.
+//
+// Wire format:
+//
+//	[4 bytes: magic][2 bytes: body length][body]
+//	body = [1 byte: version][4 bytes: features][4 bytes: weight][1 byte: id length][id][extensions]
+//	extension = [1 byte: type][2 bytes: length][value]
+//
+// Unknown extensions are skipped so newer clients can talk to older servers.
+type Hello struct {
+	Version  uint8
+	Features uint32
+	Weight   float32 // Initial routing weight, only meaningful for analyzers
+	ID       string
+
+	// Optional session resumption (analyzers with AnalyzerFeatureResume)
+	ResumeToken []byte
+	LastSeq     uint32
+
+	// Credentials, required when the distributor authenticates clients
+	AuthToken []byte
+
+	// Priorities an analyzer wants to receive, nil for all of them
+	Priorities *PrioritySet
+}
+
+// Reply is the server's answer to a Hello.
+//
+// Wire format:
+//
+//	[4 bytes: magic][2 bytes: body length][body]
+//	body = [1 byte: version][1 byte: status][4 bytes: features][2 bytes: reason length][reason][extensions]
+type Reply struct {
+	Version  uint8
+	Status   uint8
+	Features uint32 // Features the server agreed to enable for this connection
+	Reason   string // Human readable rejection reason
+
+	ResumeToken []byte       // Token to present when reconnecting to this session
+	Resumed     bool         // Whether an existing session was re-attached
+	Priorities  *PrioritySet // Priorities routed to the analyzer, nil for all of them
+}
+
+// Accepted reports whether the server accepted the connection
+func (r *Reply) Accepted() bool {
+	return r.Status == StatusAccepted
+}
+
+// WriteHello encodes a hello frame with the given magic to w
+func WriteHello(w io.Writer, magic [4]byte, h *Hello) error {
+	if len(h.ID) > MaxIDLen {
+		return fmt.Errorf("id too long: %d bytes (max %d)", len(h.ID), MaxIDLen)
+	}
+
+	body := make([]byte, 0, 10+len(h.ID))
+	body = append(body, h.Version)
+	body = binary.BigEndian.AppendUint32(body, h.Features)
+	body = binary.BigEndian.AppendUint32(body, math.Float32bits(h.Weight))
+	body = append(body, uint8(len(h.ID)))
+	body = append(body, h.ID...)
+	if len(h.ResumeToken) > 0 {
+		body = appendExtension(body, ExtResumeToken, h.ResumeToken)
+		body = appendExtension(body, ExtLastSeq, binary.BigEndian.AppendUint32(nil, h.LastSeq))
+	}
+	if len(h.AuthToken) > 0 {
+		body = appendExtension(body, ExtAuthToken, h.AuthToken)
+	}
+	if h.Priorities != nil {
+		body = appendExtension(body, ExtPriorities, h.Priorities.Bytes())
+	}
+
+	return writeFrame(w, magic, body)
+}
+
+// ReadHelloBody decodes a hello frame whose magic has already been consumed
+func ReadHelloBody(r io.Reader) (*Hello, error) {
+	body, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	d := decoder{buf: body}
+	h := &Hello{}
+	h.Version = d.uint8()
+	h.Features = d.uint32()
+	h.Weight = math.Float32frombits(d.uint32())
+	h.ID = string(d.bytes(int(d.uint8())))
+	if d.err != nil {
+		return nil, fmt.Errorf("malformed hello: %w", d.err)
+	}
+
+	err = d.extensions(func(typ uint8, value []byte) error {
+		switch typ {
+		case ExtResumeToken:
+			h.ResumeToken = value
+		case ExtLastSeq:
+			if len(value) != 4 {
+				return fmt.Errorf("last sequence extension has %d bytes", len(value))
+			}
+			h.LastSeq = binary.BigEndian.Uint32(value)
+		case ExtAuthToken:
+			h.AuthToken = value
+		case ExtPriorities:
+			set, err := PrioritySetFromBytes(value)
+			if err != nil {
+				return err
+			}
+			h.Priorities = &set
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("malformed hello: %w", err)
+	}
+	return h, nil
+}
+
+// WriteReply encodes a reply frame with the given magic to w
+func WriteReply(w io.Writer, magic [4]byte, rep *Reply) error {
+	reason := rep.Reason
+	if len(reason) > math.MaxUint16-8 {
+		reason = reason[:math.MaxUint16-8]
+	}
+
+	body := make([]byte, 0, 8+len(reason))
+	body = append(body, rep.Version, rep.Status)
+	body = binary.BigEndian.AppendUint32(body, rep.Features)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(reason)))
+	body = append(body, reason...)
+	if len(rep.ResumeToken) > 0 {
+		body = appendExtension(body, ExtResumeToken, rep.ResumeToken)
+	}
+	if rep.Resumed {
+		body = appendExtension(body, ExtResumed, []byte{1})
+	}
+	if rep.Priorities != nil {
+		body = appendExtension(body, ExtPriorities, rep.Priorities.Bytes())
+	}
+
+	return writeFrame(w, magic, body)
+}
+
+// ReadReply reads and decodes a reply frame, checking it starts with magic
+func ReadReply(r io.Reader, magic [4]byte) (*Reply, error) {
+	var got [4]byte
+	if _, err := io.ReadFull(r, got[:]); err != nil {
+		return nil, err
+	}
+	if got != magic {
+		return nil, ErrBadMagic
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	d := decoder{buf: body}
+	rep := &Reply{}
+	rep.Version = d.uint8()
+	rep.Status = d.uint8()
+	rep.Features = d.uint32()
+	rep.Reason = string(d.bytes(int(d.uint16())))
+	if d.err != nil {
+		return nil, fmt.Errorf("malformed reply: %w", d.err)
+	}
+
+	err = d.extensions(func(typ uint8, value []byte) error {
+		switch typ {
+		case ExtResumeToken:
+			rep.ResumeToken = value
+		case ExtResumed:
+			rep.Resumed = len(value) == 1 && value[0] == 1
+		case ExtPriorities:
+			set, err := PrioritySetFromBytes(value)
+			if err != nil {
+				return err
+			}
+			rep.Priorities = &set
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("malformed reply: %w", err)
+	}
+	return rep, nil
+}
+
+// writeFrame writes magic, body length and body in a single Write call
+func writeFrame(w io.Writer, magic [4]byte, body []byte) error {
+	if len(body) > maxBodyLen {
+		return fmt.Errorf("handshake body too long: %d bytes", len(body))
+	}
+
+	frame := make([]byte, 0, 6+len(body))
+	frame = append(frame, magic[:]...)
+	frame = binary.BigEndian.AppendUint16(frame, uint16(len(body)))
+	frame = append(frame, body...)
+	_, err := w.Write(frame)
+	return err
+}
+
+// appendExtension appends a type-length-value extension record to body
+func appendExtension(body []byte, typ uint8, value []byte) []byte {
+	body = append(body, typ)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(value)))
+	return append(body, value...)
+}
+
+// readBody reads a 2-byte length prefixed body
+func readBody(r io.Reader) ([]byte, error) {
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// decoder reads fixed-size fields from a body, remembering the first error
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > len(d.buf) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) uint8() uint8 {
+	if b := d.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint16() uint16 {
+	if b := d.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+// extensions walks the remaining extension records, passing each to fn.
+// Types fn does not recognise should be ignored for forward compatibility.
+func (d *decoder) extensions(fn func(typ uint8, value []byte) error) error {
+	for len(d.buf) > 0 && d.err == nil {
+		typ := d.uint8()
+		value := d.bytes(int(d.uint16()))
+		if d.err != nil {
+			break
+		}
+		if err := fn(typ, value); err != nil {
+			return err
+		}
+	}
+	return d.err
+}
@@ -0,0 +1,199 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readHello reads a hello frame, checking it starts with magic
+func readHello(t *testing.T, r io.Reader, magic [4]byte) *Hello {
+	t.Helper()
+	var got [4]byte
+	if _, err := io.ReadFull(r, got[:]); err != nil {
+		t.Fatal(err)
+	}
+	if got != magic {
+		t.Fatalf("magic %x, want %x", got, magic)
+	}
+	h, err := ReadHelloBody(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// helloFrame builds a hello frame from a raw body
+func helloFrame(body []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(body))), body...)
+}
+
+func TestHelloRoundTrip(t *testing.T) {
+	priorities := PrioritySet{}
+	priorities.AddRange(0, 9)
+
+	tests := []struct {
+		name  string
+		hello Hello
+	}{
+		{"minimal", Hello{Version: Version}},
+		{"analyzer", Hello{Version: Version, Features: AnalyzerFeatureResume | AnalyzerFeatureDrain, Weight: 0.75, ID: "analyzer-1"}},
+		{"resume", Hello{Version: Version, Features: AnalyzerFeatureResume, Weight: 1, ID: "a", ResumeToken: []byte{1, 2, 3, 4}, LastSeq: 12345}},
+		{"auth", Hello{Version: Version, ID: "e", AuthToken: []byte("emitter:e:secret")}},
+		{"priorities", Hello{Version: Version, ID: "a", Priorities: &priorities}},
+		{"longest ID", Hello{Version: Version, ID: strings.Repeat("x", MaxIDLen)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := WriteHello(&b, AnalyzerHelloMagic, &tt.hello); err != nil {
+				t.Fatal(err)
+			}
+			if got := readHello(t, &b, AnalyzerHelloMagic); !reflect.DeepEqual(got, &tt.hello) {
+				t.Errorf("read %+v, want %+v", got, &tt.hello)
+			}
+			if b.Len() != 0 {
+				t.Errorf("%d bytes left after the hello", b.Len())
+			}
+		})
+	}
+}
+
+func TestWriteHelloRejectsLongID(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteHello(&b, EmitterHelloMagic, &Hello{Version: Version, ID: strings.Repeat("x", MaxIDLen+1)}); err == nil {
+		t.Fatal("hello with a too long ID written")
+	}
+	if b.Len() != 0 {
+		t.Errorf("wrote %d bytes of a rejected hello", b.Len())
+	}
+}
+
+// Extensions a server does not know are skipped, so newer clients can talk to it
+func TestHelloSkipsUnknownExtensions(t *testing.T) {
+	body := []byte{Version, 0, 0, 0, 0}
+	body = binary.BigEndian.AppendUint32(body, math.Float32bits(2))
+	body = append(body, 1, 'a')
+	body = appendExtension(body, 200, []byte("from the future"))
+	body = appendExtension(body, ExtAuthToken, []byte("token"))
+	body = appendExtension(body, 201, nil)
+
+	h, err := ReadHelloBody(bytes.NewReader(helloFrame(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Hello{Version: Version, Weight: 2, ID: "a", AuthToken: []byte("token")}
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("read %+v, want %+v", h, want)
+	}
+}
+
+func TestReadHelloBodyRejectsMalformed(t *testing.T) {
+	fixed := []byte{Version, 0, 0, 0, 0, 0, 0, 0, 0}
+
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{"empty", nil},
+		{"short length", []byte{0}},
+		{"short body", []byte{0, 20, Version, 0, 0}},
+		{"short fields", helloFrame(fixed[:6])},
+		{"ID beyond body", helloFrame(append(fixed, 5, 'a', 'b'))},
+		{"extension beyond body", helloFrame(appendExtension(append(fixed, 0), ExtAuthToken, []byte("token"))[:len(fixed)+5])},
+		{"truncated extension header", helloFrame(append(fixed, 0, ExtAuthToken, 0))},
+		{"last sequence length", helloFrame(appendExtension(append(fixed, 0), ExtLastSeq, []byte{1, 2, 3}))},
+		{"priorities length", helloFrame(appendExtension(append(fixed, 0), ExtPriorities, []byte{0xFF}))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if h, err := ReadHelloBody(bytes.NewReader(tt.frame)); err == nil {
+				t.Errorf("read %+v from a malformed hello", h)
+			}
+		})
+	}
+}
+
+func TestReplyRoundTrip(t *testing.T) {
+	priorities := PrioritySet{}
+	priorities.Add(0)
+	priorities.Add(255)
+
+	tests := []struct {
+		name  string
+		reply Reply
+	}{
+		{"accepted", Reply{Version: Version, Status: StatusAccepted, Features: AnalyzerFeatureDrain}},
+		{"rejected", Reply{Version: Version, Status: StatusRejected, Reason: "invalid initial weight NaN"}},
+		{"resumed", Reply{Version: Version, ResumeToken: []byte{9, 8, 7}, Resumed: true}},
+		{"priorities", Reply{Version: Version, ResumeToken: []byte{1}, Priorities: &priorities}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := WriteReply(&b, AnalyzerHelloMagic, &tt.reply); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadReply(&b, AnalyzerHelloMagic)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, &tt.reply) {
+				t.Errorf("read %+v, want %+v", got, &tt.reply)
+			}
+			if got.Accepted() != (tt.reply.Status == StatusAccepted) {
+				t.Errorf("accepted %v with status %d", got.Accepted(), got.Status)
+			}
+		})
+	}
+}
+
+// A reason too long for the body is cut to fit
+func TestReplyTruncatesReason(t *testing.T) {
+	var b bytes.Buffer
+	reason := strings.Repeat("r", math.MaxUint16+100)
+	if err := WriteReply(&b, EmitterHelloMagic, &Reply{Version: Version, Status: StatusRejected, Reason: reason}); err != nil {
+		t.Fatal(err)
+	}
+	rep, err := ReadReply(&b, EmitterHelloMagic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := reason[:math.MaxUint16-8]; rep.Reason != want {
+		t.Errorf("reason of %d bytes, want the first %d", len(rep.Reason), len(want))
+	}
+}
+
+func TestReadReplyRejectsMalformed(t *testing.T) {
+	var valid bytes.Buffer
+	WriteReply(&valid, AnalyzerHelloMagic, &Reply{Version: Version, Reason: "ok"})
+	frame := valid.Bytes()
+
+	tests := []struct {
+		name  string
+		frame []byte
+		err   error
+	}{
+		{"other magic", append(EmitterHelloMagic[:], frame[4:]...), ErrBadMagic},
+		{"short magic", frame[:3], io.ErrUnexpectedEOF},
+		{"short body", frame[:len(frame)-1], io.ErrUnexpectedEOF},
+		{"reason beyond body", append(AnalyzerHelloMagic[:], helloFrame([]byte{Version, 0, 0, 0, 0, 0, 0, 9, 'x'})...), io.ErrUnexpectedEOF},
+		{"priorities length", append(AnalyzerHelloMagic[:], helloFrame(appendExtension(make([]byte, 8), ExtPriorities, []byte{1}))...), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rep, err := ReadReply(bytes.NewReader(tt.frame), AnalyzerHelloMagic)
+			if err == nil {
+				t.Fatalf("read %+v from a malformed reply", rep)
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("error %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
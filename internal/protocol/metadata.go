@@ -0,0 +1,92 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Metadata record types, carried in a metadata frame as extension records
+const (
+	MetaLane      uint8 = 1 // Ordering lane the message travelled in (1 byte)
+	MetaLaneSeq   uint8 = 2 // Sequence number of the message within its lane (8 bytes)
+	MetaReceived  uint8 = 3 // When the distributor received the message (8 bytes: unix nanoseconds)
+	MetaIngestSeq uint8 = 4 // Number of the message among those received from its emitter (8 bytes)
+	MetaEmitter   uint8 = 5 // ID of the emitter the message came from
+)
+
+// Metadata describes the data frame that follows it. Analyzers that negotiated
+// AnalyzerFeatureMetadata receive it as an AnalyzerFrameMetadata control frame
+// whose body is a list of extension records, see Hello. Records of unknown type
+// are skipped, so fields can be added without a new feature flag.
+type Metadata struct {
+	// Set by ordered routing: messages of a lane reach analyzers in increasing
+	// LaneSeq order, though not every analyzer sees every sequence number
+	Lane    uint8
+	LaneSeq uint64 // 0 when the message is not ordered
+
+	// Stamped by a distributor configured to: messages of an emitter are
+	// numbered from 1 in the order they arrive, so an analyzer receiving all of
+	// them finds the ones that never reached it by gaps in IngestSeq
+	Received  time.Time // Zero when the message is not stamped
+	IngestSeq uint64    // 0 when the message is not stamped
+	Emitter   string
+}
+
+// Empty reports whether m carries no records
+func (m *Metadata) Empty() bool {
+	return m.LaneSeq == 0 && m.IngestSeq == 0
+}
+
+// AppendMetadataFrame appends m as a metadata control frame to buf
+func AppendMetadataFrame(buf []byte, m *Metadata) []byte {
+	var body [96]byte // Room for every record but a long emitter ID
+	b := body[:0]
+	if m.LaneSeq != 0 {
+		b = appendExtension(b, MetaLane, []byte{m.Lane})
+		b = appendExtension(b, MetaLaneSeq, binary.BigEndian.AppendUint64(nil, m.LaneSeq))
+	}
+	if m.IngestSeq != 0 {
+		b = appendExtension(b, MetaReceived, binary.BigEndian.AppendUint64(nil, uint64(m.Received.UnixNano())))
+		b = appendExtension(b, MetaIngestSeq, binary.BigEndian.AppendUint64(nil, m.IngestSeq))
+		b = appendExtension(b, MetaEmitter, []byte(m.Emitter))
+	}
+	return AppendControlFrame(buf, AnalyzerFrameMetadata, b)
+}
+
+// ParseMetadata decodes the body of a metadata frame
+func ParseMetadata(body []byte) (*Metadata, error) {
+	m := &Metadata{}
+	d := &decoder{buf: body}
+	err := d.extensions(func(typ uint8, value []byte) error {
+		switch typ {
+		case MetaLane:
+			if len(value) != 1 {
+				return fmt.Errorf("lane record has %d bytes, want 1", len(value))
+			}
+			m.Lane = value[0]
+		case MetaLaneSeq:
+			if len(value) != 8 {
+				return fmt.Errorf("lane sequence record has %d bytes, want 8", len(value))
+			}
+			m.LaneSeq = binary.BigEndian.Uint64(value)
+		case MetaReceived:
+			if len(value) != 8 {
+				return fmt.Errorf("receive time record has %d bytes, want 8", len(value))
+			}
+			m.Received = time.Unix(0, int64(binary.BigEndian.Uint64(value)))
+		case MetaIngestSeq:
+			if len(value) != 8 {
+				return fmt.Errorf("ingest sequence record has %d bytes, want 8", len(value))
+			}
+			m.IngestSeq = binary.BigEndian.Uint64(value)
+		case MetaEmitter:
+			m.Emitter = string(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse metadata: %w", err)
+	}
+	return m, nil
+}
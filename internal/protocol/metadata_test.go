@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetadataRoundTrip(t *testing.T) {
+	received := time.Unix(0, 1_700_000_000_123_456_789)
+	tests := []struct {
+		name string
+		meta Metadata
+	}{
+		{"lane", Metadata{Lane: 7, LaneSeq: 42}},
+		{"stamp", Metadata{Received: received, IngestSeq: 3, Emitter: "emitter-1"}},
+		{"lane and stamp", Metadata{Lane: 1, LaneSeq: 1 << 40, Received: received, IngestSeq: 9, Emitter: "e"}},
+		{"long emitter ID", Metadata{Received: received, IngestSeq: 1, Emitter: strings.Repeat("x", MaxIDLen)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.meta.Empty() {
+				t.Fatal("metadata reported empty")
+			}
+			frame := AppendMetadataFrame(nil, &tt.meta)
+			if frame[4] != AnalyzerFrameMetadata {
+				t.Fatalf("frame type %d, want %d", frame[4], AnalyzerFrameMetadata)
+			}
+			got, err := ParseMetadata(frame[5:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, &tt.meta) {
+				t.Errorf("parsed %+v, want %+v", got, &tt.meta)
+			}
+		})
+	}
+
+	if empty := (Metadata{Lane: 3}); !empty.Empty() {
+		t.Error("metadata without a sequence number not reported empty")
+	}
+}
+
+// A record of the wrong size is rejected rather than misread
+func TestParseMetadataRejectsBadRecords(t *testing.T) {
+	for _, typ := range []uint8{MetaLane, MetaLaneSeq, MetaReceived, MetaIngestSeq} {
+		body := appendExtension(nil, typ, []byte{1, 2, 3})
+		if _, err := ParseMetadata(body); err == nil {
+			t.Errorf("record type %d of 3 bytes accepted", typ)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package protocol
+
+import (
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// PrioritySet is a set of message priorities, one bit per priority
+type PrioritySet [4]uint64
+
+// Length of an encoded PrioritySet
+const PrioritySetLen = 32
+
+// AllPriorities returns the set of every priority
+func AllPriorities() PrioritySet {
+	return PrioritySet{^uint64(0), ^uint64(0), ^uint64(0), ^uint64(0)}
+}
+
+// Add adds priority p to the set
+func (s *PrioritySet) Add(p uint8) {
+	s[p>>6] |= 1 << (p & 63)
+}
+
+// AddRange adds the priorities from lo to hi inclusive to the set
+func (s *PrioritySet) AddRange(lo, hi uint8) {
+	for p := int(lo); p <= int(hi); p++ {
+		s.Add(uint8(p))
+	}
+}
+
+// Contains reports whether priority p is in the set
+func (s *PrioritySet) Contains(p uint8) bool {
+	return s[p>>6]&(1<<(p&63)) != 0
+}
+
+// IsFull reports whether the set holds every priority
+func (s *PrioritySet) IsFull() bool {
+	return *s == AllPriorities()
+}
+
+// IsEmpty reports whether the set holds no priority
+func (s *PrioritySet) IsEmpty() bool {
+	return *s == PrioritySet{}
+}
+
+// Len returns the number of priorities in the set
+func (s *PrioritySet) Len() int {
+	n := 0
+	for _, word := range s {
+		n += bits.OnesCount64(word)
+	}
+	return n
+}
+
+// Bytes encodes the set as a bitmap: bit p%8 of byte p/8 is set for priority p
+func (s *PrioritySet) Bytes() []byte {
+	b := make([]byte, PrioritySetLen)
+	for p := 0; p < 256; p++ {
+		if s.Contains(uint8(p)) {
+			b[p/8] |= 1 << (p % 8)
+		}
+	}
+	return b
+}
+
+// PrioritySetFromBytes decodes a set encoded by Bytes
+func PrioritySetFromBytes(b []byte) (PrioritySet, error) {
+	var s PrioritySet
+	if len(b) != PrioritySetLen {
+		return s, fmt.Errorf("priority set has %d bytes, want %d", len(b), PrioritySetLen)
+	}
+	for p := 0; p < 256; p++ {
+		if b[p/8]&(1<<(p%8)) != 0 {
+			s.Add(uint8(p))
+		}
+	}
+	return s, nil
+}
+
+// String formats the set as comma-separated priorities and ranges, like "0-9,200"
+func (s PrioritySet) String() string {
+	var parts []string
+	for p := 0; p < 256; p++ {
+		if !s.Contains(uint8(p)) {
+			continue
+		}
+		lo := p
+		for p < 255 && s.Contains(uint8(p+1)) {
+			p++
+		}
+		if lo == p {
+			parts = append(parts, strconv.Itoa(p))
+		} else {
+			parts = append(parts, strconv.Itoa(lo)+"-"+strconv.Itoa(p))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParsePrioritySet parses comma-separated priorities and ranges, like "0-9,200"
+func ParsePrioritySet(text string) (PrioritySet, error) {
+	var s PrioritySet
+	for _, part := range strings.Split(text, ",") {
+		part = strings.TrimSpace(part)
+		loText, hiText, isRange := strings.Cut(part, "-")
+		lo, err := parsePriority(loText)
+		if err != nil {
+			return PrioritySet{}, err
+		}
+		hi := lo
+		if isRange {
+			if hi, err = parsePriority(hiText); err != nil {
+				return PrioritySet{}, err
+			}
+			if hi < lo {
+				return PrioritySet{}, fmt.Errorf("priority range %q is reversed", part)
+			}
+		}
+		s.AddRange(lo, hi)
+	}
+	return s, nil
+}
+
+func parsePriority(text string) (uint8, error) {
+	p, err := strconv.ParseUint(strings.TrimSpace(text), 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid priority %q, must be 0-255", text)
+	}
+	return uint8(p), nil
+}
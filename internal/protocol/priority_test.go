@@ -0,0 +1,46 @@
+package protocol
+
+import "testing"
+
+func TestPrioritySetStringRoundTrip(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+		len  int
+	}{
+		{"0-9,200", "0-9,200", 11},
+		{" 5 , 3-4, 4 ", "3-5", 3},
+		{"255", "255", 1},
+		{"0-255", "0-255", 256},
+	}
+	for _, tt := range tests {
+		s, err := ParsePrioritySet(tt.text)
+		if err != nil {
+			t.Errorf("%q: %v", tt.text, err)
+			continue
+		}
+		if got := s.String(); got != tt.want || s.Len() != tt.len {
+			t.Errorf("%q: parsed as %q with %d priorities, want %q with %d", tt.text, got, s.Len(), tt.want, tt.len)
+		}
+		decoded, err := PrioritySetFromBytes(s.Bytes())
+		if err != nil || decoded != s {
+			t.Errorf("%q: decoded %q (%v) from its bytes", tt.text, decoded, err)
+		}
+	}
+
+	all := AllPriorities()
+	if !all.IsFull() || all.String() != "0-255" {
+		t.Errorf("all priorities formatted as %q", all)
+	}
+}
+
+func TestParsePrioritySetRejectsInvalid(t *testing.T) {
+	for _, text := range []string{"", "256", "-1", "9-0", "1,,2", "a-b"} {
+		if s, err := ParsePrioritySet(text); err == nil {
+			t.Errorf("%q parsed as %q", text, s)
+		}
+	}
+	if _, err := PrioritySetFromBytes(make([]byte, PrioritySetLen-1)); err == nil {
+		t.Error("short priority set decoded")
+	}
+}
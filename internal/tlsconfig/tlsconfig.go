@@ -0,0 +1,159 @@
+// Package tlsconfig builds the TLS configurations of the distributor's
+// listeners and of the clients connecting to them.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+)
+
+// ServerOptions configures TLS on a listener
+type ServerOptions struct {
+	CertFile     string // PEM certificate chain presented to clients
+	KeyFile      string // PEM private key of the certificate
+	ClientCAFile string // If set, clients must present a certificate signed by one of these CAs
+}
+
+// Server is a listener TLS configuration whose certificates can be reloaded
+// without restarting the listener. Connections already established keep the
+// certificates they were set up with.
+type Server struct {
+	opts   ServerOptions
+	config atomic.Pointer[tls.Config]
+}
+
+// NewServer loads the certificates named in opts
+func NewServer(opts ServerOptions) (*Server, error) {
+	if opts.CertFile == "" || opts.KeyFile == "" {
+		return nil, errors.New("TLS needs both a certificate and a key file")
+	}
+	s := &Server{opts: opts}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the certificate, key and client CAs again. On error the
+// previous configuration stays in use.
+func (s *Server) Reload() error {
+	cert, err := tls.LoadX509KeyPair(s.opts.CertFile, s.opts.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if s.opts.ClientCAFile != "" {
+		pool, err := loadCertPool(s.opts.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	s.config.Store(config)
+	return nil
+}
+
+// MutualTLS reports whether clients must present a certificate
+func (s *Server) MutualTLS() bool {
+	return s.opts.ClientCAFile != ""
+}
+
+// Config returns the configuration to wrap a listener with. Every handshake
+// uses the most recently loaded certificates.
+func (s *Server) Config() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return s.config.Load(), nil
+		},
+	}
+}
+
+// ClientOptions configures TLS on a client connection
+type ClientOptions struct {
+	CAFile     string // CAs trusted to sign the server certificate, system roots if empty
+	CertFile   string // Client certificate for mutual TLS, optional
+	KeyFile    string // Private key of the client certificate
+	ServerName string // Name expected in the server certificate, the dialled host if empty
+}
+
+// NewClient returns the configuration for dialling a TLS listener
+func NewClient(opts ClientOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: opts.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if opts.CAFile != "" {
+		pool, err := loadCertPool(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// Dial connects to addr over TCP, or over TLS if config is not nil
+func Dial(addr string, config *tls.Config) (net.Conn, error) {
+	if config == nil {
+		return net.Dial("tcp", addr)
+	}
+	return tls.Dial("tcp", addr, config)
+}
+
+// ClientIdentity returns the identity a server with mutual TLS takes from the
+// client certificate in config, or "" if there is none
+func ClientIdentity(config *tls.Config) string {
+	if config == nil || len(config.Certificates) == 0 || config.Certificates[0].Leaf == nil {
+		return ""
+	}
+	return certIdentity(config.Certificates[0].Leaf)
+}
+
+// PeerIdentity returns the identity in the verified client certificate of a
+// connection: its subject common name, or its first DNS name if the common
+// name is empty. Returns "" if the client presented no verified certificate.
+func PeerIdentity(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return certIdentity(state.VerifiedChains[0][0])
+}
+
+func certIdentity(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return ""
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,193 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA signs certificates for a test
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	path string // PEM file of the CA certificate
+}
+
+func newTestCA(t *testing.T, dir string) *testCA {
+	t.Helper()
+	ca := &testCA{path: filepath.Join(dir, "ca.pem")}
+	ca.cert, ca.key = ca.issue(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	writePEM(t, ca.path, "CERTIFICATE", ca.cert.Raw)
+	return ca
+}
+
+// issue signs template, self-signed if the CA has no certificate yet
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	parent, signer := template, key
+	if ca.cert != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// issueFiles writes a certificate and key for template and returns their paths
+func (ca *testCA) issueFiles(t *testing.T, dir, name string, template *x509.Certificate) (string, string) {
+	t.Helper()
+	cert, key := ca.issue(t, template)
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", cert.Raw)
+	writePEM(t, keyFile, "EC PRIVATE KEY", der)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serve accepts one connection on a TLS listener and reports the identity of
+// its client, or the handshake error
+func serve(t *testing.T, s *Server) (string, <-chan string, <-chan error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	listener = tls.NewListener(listener, s.Config())
+
+	identities, errs := make(chan string, 1), make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+		tlsConn := conn.(*tls.Conn)
+		if err := tlsConn.Handshake(); err != nil {
+			errs <- err
+			return
+		}
+		identities <- PeerIdentity(tlsConn.ConnectionState())
+	}()
+	return listener.Addr().String(), identities, errs
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	serverCert, serverKey := ca.issueFiles(t, dir, "server", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "distributor"},
+		DNSNames:    []string{"distributor"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	clientCert, clientKey := ca.issueFiles(t, dir, "client", &x509.Certificate{
+		DNSNames:    []string{"analyzer-1"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	s, err := NewServer(ServerOptions{CertFile: serverCert, KeyFile: serverKey, ClientCAFile: ca.path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.MutualTLS() {
+		t.Error("client CA set but mutual TLS not reported")
+	}
+
+	t.Run("with client certificate", func(t *testing.T) {
+		addr, identities, errs := serve(t, s)
+		config, err := NewClient(ClientOptions{CAFile: ca.path, CertFile: clientCert, KeyFile: clientKey, ServerName: "distributor"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := Dial(addr, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		select {
+		case id := <-identities:
+			if id != "analyzer-1" {
+				t.Errorf("identity %q, want the DNS name analyzer-1", id)
+			}
+		case err := <-errs:
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("without client certificate", func(t *testing.T) {
+		addr, _, errs := serve(t, s)
+		config, err := NewClient(ClientOptions{CAFile: ca.path, ServerName: "distributor"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn, err := Dial(addr, config); err == nil {
+			// TLS 1.3 clients learn of the rejection on their first read
+			conn.Read(make([]byte, 1))
+			conn.Close()
+		}
+		if err := <-errs; err == nil {
+			t.Error("client without a certificate accepted")
+		}
+	})
+}
+
+// A failed reload keeps the certificates loaded before
+func TestServerReloadKeepsConfigOnError(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir)
+	certFile, keyFile := ca.issueFiles(t, dir, "server", &x509.Certificate{Subject: pkix.Name{CommonName: "distributor"}})
+	s, err := NewServer(ServerOptions{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := s.config.Load()
+
+	if err := os.WriteFile(keyFile, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err == nil {
+		t.Fatal("reload of an invalid key succeeded")
+	}
+	if s.config.Load() != before {
+		t.Error("configuration replaced by a failed reload")
+	}
+}